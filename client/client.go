@@ -0,0 +1,372 @@
+// Package client talks to the HTTP API of a Qingping collector, for Go
+// services that want its devices and readings without hand-rolled HTTP
+// calls.
+//
+//	c := client.New("http://collector:9273", client.WithToken(os.Getenv("API_TOKEN")))
+//	devices, err := c.Devices(ctx)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client is a client of one collector. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken sends the collector's API_TOKEN with every request.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithHTTPClient makes requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// New returns a client of the collector at baseURL, e.g.
+// http://collector:9273.
+func New(baseURL string, options ...Option) *Client {
+	c := &Client{baseURL: strings.TrimRight(baseURL, "/"), httpClient: http.DefaultClient}
+	for _, option := range options {
+		option(c)
+	}
+	return c
+}
+
+// Error is an error response of the API
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("collector: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// IsNotFound reports whether err is the API's answer for an unknown
+// device.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Reading is a device's reading with the values the collector derived
+// from it
+type Reading struct {
+	Temperature float64   `json:"temperature"` // °C
+	Humidity    float64   `json:"humidity"`    // %
+	CO2         int       `json:"co2"`         // ppm
+	PM25        float64   `json:"pm25"`        // μg/m³
+	PM10        float64   `json:"pm10"`        // μg/m³
+	TVOC        float64   `json:"tvoc"`        // ppb
+	Battery     int       `json:"battery"`     // %
+	Timestamp   time.Time `json:"timestamp"`
+	AQI         *AQI      `json:"aqi,omitempty"`
+	// Values holds every reported and derived value by key, e.g. co2 or
+	// dew_point
+	Values map[string]float64 `json:"values,omitempty"`
+}
+
+// AQI is the air quality index of a reading per the configured standard
+type AQI struct {
+	Standard   string             `json:"standard"`
+	Index      float64            `json:"index"`
+	SubIndices map[string]float64 `json:"sub_indices"`
+	Level      int                `json:"level"` // 1 for the best category
+	Category   string             `json:"category"`
+	Label      string             `json:"label"`
+	Color      string             `json:"color"`
+}
+
+// MaintenanceWindow is a time in which a device raises no alerts
+type MaintenanceWindow struct {
+	Since  time.Time  `json:"since,omitzero"`
+	Until  *time.Time `json:"until,omitempty"` // open-ended if unset
+	Reason string     `json:"reason,omitempty"`
+	// Config is set for maintenance set in the config file, which can't be
+	// ended through the API
+	Config bool `json:"config,omitempty"`
+}
+
+// Location places a device on a map, a floorplan or both
+type Location struct {
+	Latitude  *float64 `json:"lat,omitempty"`
+	Longitude *float64 `json:"lon,omitempty"`
+	Floor     string   `json:"floor,omitempty"`
+	X         *float64 `json:"x,omitempty"`
+	Y         *float64 `json:"y,omitempty"`
+}
+
+// Device is a configured device with its latest reading
+type Device struct {
+	// SeriesID stays the same across renames and hardware swaps; every
+	// method taking a device name also takes it
+	SeriesID    string             `json:"series_id"`
+	Name        string             `json:"name"`
+	Model       string             `json:"model"`
+	Tags        []string           `json:"tags,omitempty"`
+	Online      bool               `json:"online"`
+	LastSeen    *time.Time         `json:"last_seen,omitempty"`
+	AgeSeconds  *float64           `json:"age_seconds,omitempty"`
+	Reading     *Reading           `json:"reading,omitempty"`
+	Maintenance *MaintenanceWindow `json:"maintenance,omitempty"`
+	Location    *Location          `json:"location,omitempty"`
+}
+
+// Snapshot is the latest reading of a device with how the collector
+// received it
+type Snapshot struct {
+	Device  string  `json:"device"`
+	Reading Reading `json:"reading"`
+	// Received is when the collector got the reading; Reading.Timestamp is
+	// when the device took it
+	Received time.Time `json:"received"`
+	Source   string    `json:"source"` // mqtt, ble or cloud
+	Topic    string    `json:"topic,omitempty"`
+	Type     string    `json:"type,omitempty"`
+}
+
+// Sample is a stored reading of a device
+type Sample struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// Query selects and aggregates stored readings. Zero fields use the API's
+// defaults: all devices and sensors of the last 24 hours, one bucket,
+// averaged per device.
+type Query struct {
+	Devices      []string
+	Sensors      []string
+	From, To     time.Time
+	Step         time.Duration
+	Aggregations []string // avg, min, max, sum, count, first, last, p50, p90, p95 or p99
+	// GroupDevices pools the devices into series with device "*"
+	GroupDevices bool
+}
+
+// QueryPoint is a bucket with a value per aggregation
+type QueryPoint struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// QuerySeries is a sensor of one device, or of all of them with device "*"
+type QuerySeries struct {
+	Device string       `json:"device"`
+	Sensor string       `json:"sensor"`
+	Points []QueryPoint `json:"points"`
+}
+
+// QueryResult is the answer to a Query
+type QueryResult struct {
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Step   string        `json:"step,omitempty"`
+	Series []QuerySeries `json:"series"`
+}
+
+// Burst is a started burst of fast reports
+type Burst struct {
+	Device   string `json:"device"`
+	Interval string `json:"interval"`
+	Duration string `json:"duration"`
+}
+
+// ErrorExample is one occurrence of a runtime error
+type ErrorExample struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device,omitempty"`
+	Source  string    `json:"source,omitempty"`
+	Message string    `json:"message"`
+}
+
+// ErrorSummary is a runtime error code with its count since the collector
+// started and its recent examples, newest first
+type ErrorSummary struct {
+	Code        string         `json:"code"`
+	Description string         `json:"description"`
+	Count       int            `json:"count"`
+	Recent      []ErrorExample `json:"recent"`
+}
+
+// Devices returns every device with its latest reading.
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	var resp struct {
+		Devices []Device `json:"devices"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/devices", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Devices, nil
+}
+
+// Device returns a device with its latest reading.
+func (c *Client) Device(ctx context.Context, name string) (*Device, error) {
+	var device Device
+	if err := c.do(ctx, http.MethodGet, "/api/v1/devices/"+url.PathEscape(name), nil, nil, &device); err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+// Latest returns the latest reading of a device with how it was received.
+// A device that hasn't reported yet is not found, like an unknown one.
+func (c *Client) Latest(ctx context.Context, name string) (*Snapshot, error) {
+	var snapshot Snapshot
+	if err := c.do(ctx, http.MethodGet, "/api/v1/devices/"+url.PathEscape(name)+"/latest", nil, nil, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// Readings returns the stored readings of a device between from and to.
+func (c *Client) Readings(ctx context.Context, device string, from, to time.Time) ([]Sample, error) {
+	params := url.Values{"device": {device}, "format": {"json"}}
+	params.Set("from", from.Format(time.RFC3339))
+	params.Set("to", to.Format(time.RFC3339))
+	var resp struct {
+		Samples []Sample `json:"samples"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/v1/export", params, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Samples, nil
+}
+
+// Query aggregates stored readings.
+func (c *Client) Query(ctx context.Context, q Query) (*QueryResult, error) {
+	params := url.Values{}
+	if len(q.Devices) > 0 {
+		params.Set("devices", strings.Join(q.Devices, ","))
+	}
+	if len(q.Sensors) > 0 {
+		params.Set("sensors", strings.Join(q.Sensors, ","))
+	}
+	if !q.From.IsZero() {
+		params.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		params.Set("to", q.To.Format(time.RFC3339))
+	}
+	if q.Step > 0 {
+		params.Set("step", q.Step.String())
+	}
+	if len(q.Aggregations) > 0 {
+		params.Set("agg", strings.Join(q.Aggregations, ","))
+	}
+	if q.GroupDevices {
+		params.Set("group", "none")
+	}
+	var result QueryResult
+	if err := c.do(ctx, http.MethodGet, "/api/v1/query", params, nil, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Trigger asks a device for a short burst of fast reports.
+func (c *Client) Trigger(ctx context.Context, name string) (*Burst, error) {
+	var burst Burst
+	if err := c.do(ctx, http.MethodPost, "/api/devices/"+url.PathEscape(name)+"/trigger", nil, nil, &burst); err != nil {
+		return nil, err
+	}
+	return &burst, nil
+}
+
+// StartMaintenance suppresses the alerts of a device for duration, or
+// until ended with 0. It returns the window in force.
+func (c *Client) StartMaintenance(ctx context.Context, name string, duration time.Duration, reason string) (*MaintenanceWindow, error) {
+	body := map[string]string{"reason": reason}
+	if duration > 0 {
+		body["duration"] = duration.String()
+	}
+	var window MaintenanceWindow
+	if err := c.do(ctx, http.MethodPut, "/api/v1/devices/"+url.PathEscape(name)+"/maintenance", nil, body, &window); err != nil {
+		return nil, err
+	}
+	return &window, nil
+}
+
+// EndMaintenance ends the maintenance of a device started through the API.
+func (c *Client) EndMaintenance(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/devices/"+url.PathEscape(name)+"/maintenance", nil, nil, nil)
+}
+
+// Errors returns every runtime error code with its recent examples.
+func (c *Client) Errors(ctx context.Context) ([]ErrorSummary, error) {
+	var resp struct {
+		Errors []ErrorSummary `json:"errors"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/api/errors", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Errors, nil
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into out, unless out is nil.
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, body, out any) error {
+	target := c.baseURL + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		var payload struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&payload); err == nil {
+			apiErr.Message = payload.Error
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("collector: decode %s response: %w", path, err)
+	}
+	return nil
+}
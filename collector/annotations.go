@@ -0,0 +1,235 @@
+package collector
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Annotation is a manually recorded event like "opened windows" or "new
+// filter installed", to correlate with the readings.
+type Annotation struct {
+	ID      int64      `json:"id"`
+	Time    time.Time  `json:"time"`
+	TimeEnd *time.Time `json:"time_end,omitempty"` // set for periods, e.g. cooking
+	Text    string     `json:"text"`
+	Tags    []string   `json:"tags,omitempty"`
+	Device  string     `json:"device,omitempty"` // empty means every device
+}
+
+// end is when the annotation ends, its time for a single event.
+func (a Annotation) end() time.Time {
+	if a.TimeEnd != nil {
+		return *a.TimeEnd
+	}
+	return a.Time
+}
+
+// annotationStore keeps annotations, in memory or next to the history in
+// the SQLite database.
+type annotationStore interface {
+	AddAnnotation(a Annotation) (Annotation, error)
+	// Annotations returns the annotations overlapping [from, to], oldest first.
+	Annotations(from, to time.Time) ([]Annotation, error)
+	DeleteAnnotation(id int64) (bool, error)
+}
+
+type memoryAnnotations struct {
+	mu    sync.Mutex
+	next  int64
+	items []Annotation
+}
+
+func newMemoryAnnotations() *memoryAnnotations {
+	return &memoryAnnotations{next: 1}
+}
+
+func (m *memoryAnnotations) AddAnnotation(a Annotation) (Annotation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a.ID = m.next
+	m.next++
+	m.items = append(m.items, a)
+	sort.SliceStable(m.items, func(i, j int) bool { return m.items[i].Time.Before(m.items[j].Time) })
+	return a, nil
+}
+
+func (m *memoryAnnotations) Annotations(from, to time.Time) ([]Annotation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var found []Annotation
+	for _, a := range m.items {
+		if !a.Time.After(to) && !a.end().Before(from) {
+			found = append(found, a)
+		}
+	}
+	return found, nil
+}
+
+func (m *memoryAnnotations) DeleteAnnotation(id int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, a := range m.items {
+		if a.ID == id {
+			m.items = slices.Delete(m.items, i, i+1)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// handleAddAnnotation serves POST /api/annotations. The time defaults to now.
+func (c *collector) handleAddAnnotation(w http.ResponseWriter, r *http.Request) {
+	var a Annotation
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&a); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid annotation: "+err.Error())
+		return
+	}
+	a.Text = strings.TrimSpace(a.Text)
+	if a.Text == "" {
+		writeError(w, http.StatusBadRequest, "text is required")
+		return
+	}
+	if a.Device != "" {
+		device := c.deviceByName(a.Device)
+		if device == nil {
+			writeError(w, http.StatusBadRequest, "unknown device")
+			return
+		}
+		a.Device = device.Name
+	}
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	if a.TimeEnd != nil && a.TimeEnd.Before(a.Time) {
+		writeError(w, http.StatusBadRequest, "time_end must not be before time")
+		return
+	}
+
+	a, err := c.annotations.AddAnnotation(a)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, a)
+}
+
+// handleAnnotations serves GET /api/annotations?from=...&to=...&device=NAME&tags=a,b,
+// by default the last 24 hours. With device, annotations for every device
+// are included; with tags, only annotations carrying one of them.
+func (c *collector) handleAnnotations(w http.ResponseWriter, r *http.Request) {
+	to, err := parseTime(r, "to", time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTime(r, "from", to.Add(-24*time.Hour))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	found, err := c.findAnnotations(from, to, r.URL.Query().Get("device"), splitList(r.URL.Query().Get("tags")))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"annotations": found})
+}
+
+// handleDeleteAnnotation serves DELETE /api/annotations/{id}
+func (c *collector) handleDeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid id")
+		return
+	}
+	deleted, err := c.annotations.DeleteAnnotation(id)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !deleted {
+		writeError(w, http.StatusNotFound, "unknown annotation")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *collector) findAnnotations(from, to time.Time, device string, tags []string) ([]Annotation, error) {
+	all, err := c.annotations.Annotations(from, to)
+	if err != nil {
+		return nil, err
+	}
+	found := make([]Annotation, 0, len(all))
+	for _, a := range all {
+		if device != "" && a.Device != "" && a.Device != device {
+			continue
+		}
+		if len(tags) > 0 && !slices.ContainsFunc(tags, func(tag string) bool { return slices.Contains(a.Tags, tag) }) {
+			continue
+		}
+		found = append(found, a)
+	}
+	return found, nil
+}
+
+// grafanaAnnotationQuery is the request of the Grafana JSON datasource
+type grafanaAnnotationQuery struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Annotation struct {
+		// Query is an optional device name
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+// grafanaAnnotation is an annotation as the Grafana JSON datasource expects it
+type grafanaAnnotation struct {
+	Time    int64    `json:"time"` // unix milliseconds
+	TimeEnd int64    `json:"timeEnd,omitempty"`
+	Title   string   `json:"title"`
+	Text    string   `json:"text"`
+	Tags    []string `json:"tags"`
+}
+
+// handleGrafanaAnnotations serves POST /api/grafana/annotations, so the
+// collector can be added to Grafana as a JSON datasource with the URL
+// http://collector:9273/api/grafana.
+func (c *collector) handleGrafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	var query grafanaAnnotationQuery
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&query); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid query: "+err.Error())
+		return
+	}
+	found, err := c.findAnnotations(query.Range.From, query.Range.To, strings.TrimSpace(query.Annotation.Query), nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	out := make([]grafanaAnnotation, 0, len(found))
+	for _, a := range found {
+		ga := grafanaAnnotation{Time: a.Time.UnixMilli(), Title: a.Text, Text: a.Text, Tags: a.Tags}
+		if a.TimeEnd != nil {
+			ga.TimeEnd = a.TimeEnd.UnixMilli()
+		}
+		if a.Device != "" {
+			ga.Tags = append(slices.Clone(a.Tags), a.Device)
+		}
+		if ga.Tags == nil {
+			ga.Tags = []string{}
+		}
+		out = append(out, ga)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
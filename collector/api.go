@@ -0,0 +1,298 @@
+package collector
+
+import (
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAPIToken guards the full API with a bearer token when API_TOKEN
+// is set. The public status page and probes are never wrapped.
+func requireAPIToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="qingping-collector"`)
+			writeError(w, http.StatusUnauthorized, "missing or invalid API token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenFromQuery lets clients that can't set headers, like a browser's
+// EventSource, pass the API token as ?access_token=.
+func tokenFromQuery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get("access_token"); token != "" && r.Header.Get("Authorization") == "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("Failed to write API response", "error", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// deviceByName finds a device by its name or, for integrations that must
+// not break on renames, its series ID.
+func (c *collector) deviceByName(name string) *Device {
+	// Devices are renamed under the lock when DEVICE_NAMES changes
+	c.lastUpdateMutex.RLock()
+	defer c.lastUpdateMutex.RUnlock()
+	for _, device := range c.config.Devices {
+		if device.Name == name {
+			return device
+		}
+	}
+	for _, device := range c.config.Devices {
+		if device.SeriesID != "" && device.SeriesID == name {
+			return device
+		}
+	}
+	return nil
+}
+
+// DeviceStatus is a device with its latest reading, as returned by
+// /api/v1/devices
+type DeviceStatus struct {
+	// SeriesID stays the same across renames and hardware swaps
+	SeriesID string   `json:"series_id"`
+	Name     string   `json:"name"`
+	Model    string   `json:"model"`
+	Tags     []string `json:"tags,omitempty"`
+	// Online is false once the device missed two update intervals
+	Online   bool       `json:"online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+	// AgeSeconds is how old the reading is
+	AgeSeconds *float64   `json:"age_seconds,omitempty"`
+	Reading    *CGDN1Data `json:"reading,omitempty"`
+	// Maintenance is set while the device raises no alerts
+	Maintenance *MaintenanceWindow `json:"maintenance,omitempty"`
+	Location    *Location          `json:"location,omitempty"`
+}
+
+func (c *collector) deviceStatus(device *Device, now time.Time) DeviceStatus {
+	c.lastUpdateMutex.RLock()
+	defer c.lastUpdateMutex.RUnlock()
+
+	status := DeviceStatus{SeriesID: device.SeriesID, Name: device.Name, Model: device.Model, Tags: device.Tags, Location: device.Location}
+	if window, ok := c.maintenance.window(device, now); ok {
+		status.Maintenance = &window
+	}
+
+	snapshot, ok := c.latest[device.Name]
+	if !ok {
+		return status
+	}
+	reading := snapshot.Reading
+	age := now.Sub(reading.Timestamp).Seconds()
+	expiration := c.config.staleAfter()
+	status.Online = !c.offline[device.Name] && now.Sub(reading.Timestamp) <= expiration
+	status.LastSeen = &reading.Timestamp
+	status.AgeSeconds = &age
+	status.Reading = &reading
+	return status
+}
+
+// handleDevices serves GET /api/v1/devices
+func (c *collector) handleDevices(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	devices := []DeviceStatus{}
+	for _, device := range c.devices() {
+		devices = append(devices, c.deviceStatus(device, now))
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"devices": devices})
+}
+
+// handleDevice serves GET /api/v1/devices/{name}
+func (c *collector) handleDevice(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.PathValue("name"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	writeJSON(w, http.StatusOK, c.deviceStatus(device, time.Now()))
+}
+
+// parseWindow reads the ?window= query parameter as a duration.
+func parseWindow(r *http.Request, fallback time.Duration) (time.Duration, bool) {
+	value := r.URL.Query().Get("window")
+	if value == "" {
+		return fallback, true
+	}
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, false
+	}
+	return window, true
+}
+
+// handleSuggestions serves GET /api/devices/{name}/suggestions?window=168h
+func (c *collector) handleSuggestions(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.PathValue("name"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	window, ok := parseWindow(r, device.policy.retentionOr(c.config.HistoryRetention))
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid window")
+		return
+	}
+
+	to := time.Now()
+	from := to.Add(-window)
+	samples, err := c.history.Samples(device.Name, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	suggestions, insufficient := suggestThresholds(samples)
+	writeJSON(w, http.StatusOK, SuggestionsResponse{
+		Device:       device.Name,
+		From:         from,
+		To:           to,
+		Suggestions:  suggestions,
+		Insufficient: insufficient,
+	})
+}
+
+// handleTrigger serves POST /api/devices/{name}/trigger: the device is
+// asked for a short burst of fast reports and then returns to normal.
+func (c *collector) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.PathValue("name"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	if !device.commandable() {
+		writeError(w, http.StatusConflict, "device can't be sent commands")
+		return
+	}
+	if err := c.startBurst(device, c.config.TriggerInterval, c.config.TriggerDuration); err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]any{
+		"device":   device.Name,
+		"interval": c.config.TriggerInterval.String(),
+		"duration": c.config.TriggerDuration.String(),
+	})
+}
+
+// parseTime reads a query parameter as RFC 3339 or unix seconds.
+func parseTime(r *http.Request, key string, fallback time.Time) (time.Time, error) {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s: want RFC 3339 or unix seconds", key)
+}
+
+// handleExport serves GET /api/v1/export?device=NAME&from=...&to=...&format=csv
+// with the device's stored history, the last 24 hours by default.
+func (c *collector) handleExport(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.URL.Query().Get("device"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	to, err := parseTime(r, "to", time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTime(r, "from", to.Add(-24*time.Hour))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	samples, err := c.history.Samples(device.Name, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		filename := fmt.Sprintf("%s_%s_%s.csv", device.Name, from.UTC().Format("20060102T150405Z"), to.UTC().Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		if err := writeCSV(w, samples); err != nil {
+			slog.Debug("Failed to write CSV export", "device", device.Name, "error", err)
+		}
+	case "json":
+		writeJSON(w, http.StatusOK, map[string]any{"device": device.Name, "from": from, "to": to, "samples": samples})
+	default:
+		writeError(w, http.StatusBadRequest, "format must be csv or json")
+	}
+}
+
+// writeCSV writes one row per sample with a column for every value that
+// occurs in any of them; missing values are left empty.
+func writeCSV(w io.Writer, samples []Sample) error {
+	seen := make(map[string]bool)
+	var columns []string
+	for _, sample := range samples {
+		for key := range sample.Values {
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+	}
+	sort.Strings(columns)
+
+	out := csv.NewWriter(w)
+	if err := out.Write(append([]string{"time"}, columns...)); err != nil {
+		return err
+	}
+	row := make([]string, len(columns)+1)
+	for _, sample := range samples {
+		row[0] = sample.Time.UTC().Format(time.RFC3339)
+		for i, key := range columns {
+			row[i+1] = ""
+			if value, ok := sample.Values[key]; ok {
+				row[i+1] = strconv.FormatFloat(value, 'f', -1, 64)
+			}
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,632 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// App is the whole collector wired from a config: sinks, MQTT connections,
+// background work and HTTP handlers. main runs one as a standalone
+// process; a larger program can instead serve Handler on its own server
+// and tie Start and Stop to its own lifecycle. Metrics and error counts
+// are process-wide, so a process runs one app.
+type App struct {
+	config Config
+	c      *collector
+	mux    *http.ServeMux
+	client mqtt.Client
+	sinks  []Sink
+
+	health        *health
+	failover      *brokerFailover
+	homeAssistant *homeAssistantSink
+	outputs       *indicators
+	broker        *mochi.Server
+	settings      *configValues
+	reports       *reporter
+	derived       *derivedStates
+
+	// cancel stops the background work started by Start
+	cancel context.CancelFunc
+}
+
+// New wires a collector from config without connecting to anything.
+// Its metrics go to a registry of its own, served by Handler; the metric
+// naming, fields and units it sets up are process-wide.
+func New(config Config) (*App, error) {
+	mux := http.NewServeMux()
+	registry, err := newRegistry()
+	if err != nil {
+		return nil, fmt.Errorf("register metrics: %w", err)
+	}
+	if err := setupMetricNaming(config.MetricNamespace, config.MetricLabels, config.SeriesIDLabel); err != nil {
+		return nil, fmt.Errorf("invalid metric naming: %w", err)
+	}
+	if err := setupRuntimeMetrics(config.RuntimeMetrics, config.RuntimeMetricsPath, mux, registry); err != nil {
+		return nil, fmt.Errorf("invalid runtime metrics configuration: %w", err)
+	}
+
+	if err := registerFields(config.Fields, registry); err != nil {
+		return nil, fmt.Errorf("invalid fields: %w", err)
+	}
+	if err := setupUnits(config.TemperatureUnit, config.TVOCUnit, registry); err != nil {
+		return nil, fmt.Errorf("invalid units: %w", err)
+	}
+
+	notifier, err := newNotifier(config.Notifications, config.Locale)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notifications: %w", err)
+	}
+	if err := validateAlertRoutes(config.Routes, notifier.channelNames()); err != nil {
+		return nil, fmt.Errorf("invalid routes: %w", err)
+	}
+	maintenance := newMaintenance()
+	notifier.maintenance = maintenance
+
+	var history historyStore = newMemoryHistory(config.HistoryRetention)
+	var annotations annotationStore = newMemoryAnnotations()
+	var filters filterStore = newMemoryFilters()
+	var seriesIDs seriesIDStore = newMemorySeriesIDs()
+	var states stateStore
+	if config.HistoryDB != "" {
+		db, err := newSQLiteHistory(config.HistoryDB, config.HistoryRetention)
+		if err != nil {
+			return nil, fmt.Errorf("open history database %s: %w", config.HistoryDB, err)
+		}
+		history = db
+		annotations = db
+		filters = db
+		seriesIDs = db
+		states = db
+		slog.Info("Persisting history", "path", config.HistoryDB)
+	}
+	if err := assignSeriesIDs(config.Devices, seriesIDs); err != nil {
+		return nil, fmt.Errorf("assign series IDs: %w", err)
+	}
+	setDeviceLabels(config.Devices)
+	stream := newStreamSink()
+	battery := newBatterySink()
+	var downsample *downsampler
+	if config.RapidDownsample > 0 {
+		downsample = newDownsampler(config.RapidDownsample)
+	}
+	sinks := []Sink{prometheusSink{downsample: downsample}, history, stream, battery}
+	if len(config.CompareSensors) > 0 {
+		comparison, err := newComparisonSink(config.CompareSensors, history, registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid comparison settings: %w", err)
+		}
+		sinks = append(sinks, comparison)
+	}
+	if len(config.RollingSensors) > 0 {
+		rolling, err := newRollingSink(config.RollingSensors, config.RollingWindows, history, registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rolling averages: %w", err)
+		}
+		sinks = append(sinks, rolling)
+	}
+	if config.DailyExtremes {
+		daily, err := newDailySink(config.DailyTimezone, history, registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid daily extremes: %w", err)
+		}
+		sinks = append(sinks, daily)
+	}
+	if len(config.Percentiles) > 0 {
+		percentiles, err := newPercentileSink(config.Percentiles, config.PercentileWindow, history, registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentile settings: %w", err)
+		}
+		if config.HistoryRetention < config.PercentileWindow {
+			slog.Warn("HISTORY_RETENTION is shorter than PERCENTILE_WINDOW, ranks only cover the retention",
+				"retention", config.HistoryRetention, "window", config.PercentileWindow)
+		}
+		sinks = append(sinks, percentiles)
+	}
+	if len(config.Histograms) > 0 {
+		histograms, err := newHistogramSink(config.Histograms, registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid histograms: %w", err)
+		}
+		sinks = append(sinks, histograms)
+	}
+	var exposure *exposureSink
+	if len(config.ExposureSensors) > 0 {
+		exposure, err = newExposureSink(config.ExposureSensors, config.staleAfter(), registry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exposure sensors: %w", err)
+		}
+		sinks = append(sinks, exposure)
+	}
+	if config.RemoteWrite.URL != "" {
+		sinks = append(sinks, newRemoteWriteSink(config.RemoteWrite))
+		slog.Info("Pushing samples via remote_write", "url", config.RemoteWrite.URL)
+	}
+	if config.Graphite.Address != "" {
+		graphite, err := newGraphiteSink(config.Graphite)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Graphite settings: %w", err)
+		}
+		sinks = append(sinks, graphite)
+		slog.Info("Sending readings to Graphite", "address", config.Graphite.Address, "protocol", config.Graphite.Protocol)
+	}
+	if config.StatsD.Address != "" {
+		statsd, err := newStatsDSink(config.StatsD)
+		if err != nil {
+			return nil, fmt.Errorf("invalid StatsD settings: %w", err)
+		}
+		sinks = append(sinks, statsd)
+		slog.Info("Sending readings to StatsD", "address", config.StatsD.Address, "tags", config.StatsD.Tags)
+	}
+	if config.StatusPage {
+		status := newStatusSink(config.aqi, config.Locale)
+		sinks = append(sinks, status)
+		mux.HandleFunc("/status", status.serveHTML)
+		mux.HandleFunc("/status.json", status.serveJSON)
+	}
+	var homeAssistant *homeAssistantSink
+	if config.HomeAssistant.Enabled {
+		config.HomeAssistant.AvailabilityTopic = config.StatusTopic
+		config.HomeAssistant.DeviceAvailability = config.Availability
+		homeAssistant = newHomeAssistantSink(config.HomeAssistant)
+		sinks = append(sinks, homeAssistant)
+	}
+	var republish *republishSink
+	if config.Republish.Topic != "" {
+		republish, err = newRepublishSink(config.Republish)
+		if err != nil {
+			return nil, fmt.Errorf("invalid republish settings: %w", err)
+		}
+		sinks = append(sinks, republish)
+		slog.Info("Republishing readings", "topic", config.Republish.Topic)
+	}
+	var crossCheck *crossCheckSink
+	if len(config.Colocated) > 0 {
+		maxAge := config.staleAfter()
+		crossCheck, err = newCrossCheckSink(config.Colocated, config.Devices, notifier, maxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid colocated devices: %w", err)
+		}
+		sinks = append(sinks, crossCheck)
+	}
+	var thresholds *thresholdSink
+	// Device configs over MQTT may bring their own thresholds
+	if len(config.Thresholds) > 0 || config.DeviceConfig != "" {
+		thresholds, err = newThresholdSink(config.Thresholds, notifier, config.AlertTopic)
+		if err != nil {
+			return nil, fmt.Errorf("invalid thresholds: %w", err)
+		}
+		thresholds.maintenance = maintenance
+		sinks = append(sinks, thresholds)
+	}
+	var ventilation *ventilationSink
+	if len(config.Ventilation) > 0 {
+		ventilation, err = newVentilationSink(config.Ventilation, config.Devices)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ventilation: %w", err)
+		}
+		sinks = append(sinks, ventilation)
+	}
+	var purifiers *purifierSink
+	if len(config.Purifiers) > 0 {
+		maxGap := time.Duration(2*config.UpdateInterval) * time.Second
+		purifiers, err = newPurifierSink(config.Purifiers, config.Devices, filters, maxGap)
+		if err != nil {
+			return nil, fmt.Errorf("invalid purifiers: %w", err)
+		}
+		sinks = append(sinks, purifiers)
+	}
+	var outputs *indicators
+	if len(config.Indicators) > 0 {
+		if thresholds == nil {
+			return nil, errors.New("indicators need thresholds in the config file")
+		}
+		outputs, err = newIndicators(config.Indicators, thresholds, config.Devices)
+		if err != nil {
+			return nil, fmt.Errorf("invalid indicators: %w", err)
+		}
+		thresholds.onChange = outputs.update
+	}
+	if err := resolvePolicies(config.Devices, config.Routes, sinks); err != nil {
+		return nil, fmt.Errorf("invalid routes: %w", err)
+	}
+
+	// Homes with their own broker are connected separately, every other
+	// device is on the main broker
+	var homes []string
+	for _, home := range config.Homes {
+		if home.Broker != "" {
+			homes = append(homes, home.Name)
+		}
+	}
+	health := newHealth(len(config.Devices), homes...)
+	c := &collector{
+		config:          config,
+		sinks:           sinks,
+		health:          health,
+		notifier:        notifier,
+		history:         history,
+		annotations:     annotations,
+		seriesIDs:       seriesIDs,
+		stream:          stream,
+		stats:           newStatsCache(),
+		maintenance:     maintenance,
+		started:         time.Now(),
+		lastUpdateTimes: make(map[string]time.Time),
+		offline:         make(map[string]bool),
+		latest:          make(map[string]*Snapshot),
+		availability:    make(map[string]string),
+		bursts:          make(map[string]*burst),
+		renewals:        make(map[string]*renewal),
+		batteryLevels:   make(map[string]float64),
+		onBattery:       make(map[string]bool),
+		homeClients:     make(map[string]mqtt.Client),
+	}
+	// Reloads swap in updated devices, so sinks look them up by name
+	if crossCheck != nil {
+		crossCheck.device = c.deviceByName
+	}
+	if outputs != nil {
+		outputs.device = c.deviceByName
+	}
+	c.deadbands, err = newDeadbandFilter(config.Deadbands, config.DeadbandMaxSilence)
+	if err != nil {
+		return nil, fmt.Errorf("invalid deadbands: %w", err)
+	}
+	c.filter, err = newValueFilter(config.Filter, registry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter settings: %w", err)
+	}
+	if config.DeviceConfig != "" {
+		c.remote, err = newRemoteConfigs(config.DeviceConfig, thresholds)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device config topic: %w", err)
+		}
+	}
+	// Only a history database keeps derived state across restarts
+	var derived *derivedStates
+	if states != nil {
+		derived = &derivedStates{store: states, components: map[string]derivedState{"battery": battery}}
+		if exposure != nil {
+			derived.components["exposure"] = exposure
+		}
+		if c.deadbands != nil {
+			derived.components["deadband"] = c.deadbands
+		}
+		if c.filter != nil {
+			derived.components["filter"] = c.filter
+		}
+		derived.load()
+	}
+	if downsample != nil {
+		downsample.active = func(device *Device) bool { return c.rapidInterval(device) > 0 }
+	}
+	battery.profile = func(device *Device) string {
+		if !device.commandable() {
+			return ""
+		}
+		return strconv.Itoa(int(c.reportingInterval(device) / time.Second))
+	}
+	if thresholds != nil && config.BurstDuration > 0 {
+		// Report faster while something is happening
+		thresholds.onAlert = func(device *Device, rule ThresholdRule) {
+			if err := c.startBurst(device, config.BurstInterval, config.BurstDuration); err != nil {
+				slog.Warn("Failed to start alert burst", "device", device.Name, "rule", rule.Name, "error", err)
+			}
+		}
+	}
+
+	// HTTP handlers, served by main or by the embedding program
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(registry, metricsHandler(registry)))
+	mux.Handle("/healthz", probeHandler(health.alive))
+	mux.Handle("/readyz", probeHandler(health.ready))
+	mux.Handle("GET /api/v1/devices", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleDevices)))
+	mux.Handle("GET /api/v1/export", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleExport)))
+	mux.Handle("GET /api/v1/query", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleQuery)))
+	mux.Handle("GET /api/v1/stream", tokenFromQuery(requireAPIToken(config.APIToken, http.HandlerFunc(c.handleStream))))
+	mux.Handle("GET /api/v1/devices/{name}", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleDevice)))
+	mux.Handle("GET /api/v1/devices/{name}/latest", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleLatest)))
+	mux.Handle("PUT /api/v1/devices/{name}/maintenance", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleStartMaintenance)))
+	mux.Handle("DELETE /api/v1/devices/{name}/maintenance", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleEndMaintenance)))
+	mux.Handle("GET /api/devices/{name}/stats", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleStats)))
+	mux.Handle("GET /api/devices/{name}/suggestions", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleSuggestions)))
+	mux.Handle("POST /api/devices/{name}/trigger", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleTrigger)))
+	if purifiers != nil {
+		mux.Handle("GET /api/purifiers", requireAPIToken(config.APIToken, http.HandlerFunc(purifiers.handleList)))
+		mux.Handle("POST /api/purifiers/{name}/reset", requireAPIToken(config.APIToken, http.HandlerFunc(purifiers.handleReset)))
+	}
+	var reports *reporter
+	if len(config.Reports) > 0 {
+		reports, err = newReporter(c, config.Reports, config.Thresholds, config.Reporting)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reports: %w", err)
+		}
+		longest := 7 * 24 * time.Hour
+		if slices.ContainsFunc(config.Reports, func(report ReportConfig) bool { return report.Period == reportMonth }) {
+			longest = 31 * 24 * time.Hour
+		}
+		for _, device := range config.Devices {
+			if retention := device.policy.retentionOr(config.HistoryRetention); retention < longest {
+				slog.Warn("History retention is shorter than the period of a report, it only covers the retention",
+					"device", device.Name, "retention", retention)
+			}
+		}
+		mux.Handle("GET /api/v1/reports/{name}", requireAPIToken(config.APIToken, http.HandlerFunc(reports.handleReport)))
+	}
+	settings := newConfigValues(config)
+	mux.Handle("GET /api/config", requireAPIToken(config.APIToken, http.HandlerFunc(settings.handleList)))
+	mux.Handle("PUT /api/config/{name}", requireAPIToken(config.APIToken, http.HandlerFunc(settings.handleSet)))
+	mux.Handle("DELETE /api/config/{name}", requireAPIToken(config.APIToken, http.HandlerFunc(settings.handleReset)))
+	mux.Handle("GET /api/errors", requireAPIToken(config.APIToken, http.HandlerFunc(handleErrors)))
+	mux.Handle("GET /api/map", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleMap)))
+	mux.Handle("GET /api/annotations", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleAnnotations)))
+	mux.Handle("POST /api/annotations", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleAddAnnotation)))
+	mux.Handle("DELETE /api/annotations/{id}", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleDeleteAnnotation)))
+	// Grafana's JSON datasource tests the connection with GET on its URL
+	mux.Handle("GET /api/grafana", requireAPIToken(config.APIToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})))
+	mux.Handle("POST /api/grafana/annotations", requireAPIToken(config.APIToken, http.HandlerFunc(c.handleGrafanaAnnotations)))
+
+	// Setup MQTT client
+	opts := mqttOptions(config.MQTTBroker, config.MQTTPort, config.MQTTUsername, config.MQTTPassword, "qingping_collector")
+	store := mqtt.NewMemoryStore()
+	opts.SetStore(store)
+	if err := errors.Join(
+		registry.Register(resourceCollector{store: store, sinks: sinks}),
+		registry.Register(locationCollector{c}),
+	); err != nil {
+		return nil, fmt.Errorf("register metrics: %w", err)
+	}
+
+	if config.StatusTopic != "" {
+		setStatusWill(opts, config.StatusTopic)
+	}
+	failover := newBrokerFailover("", opts)
+	opts.OnConnect = func(client mqtt.Client) {
+		slog.Info("Connected to MQTT broker", "broker", failover.connected())
+		health.setConnected("", true)
+		if config.StatusTopic != "" {
+			// Replaces the will the broker may have published
+			publishStatus(client, config.StatusTopic, statusOnline)
+		}
+		health.subscribeLoopback(client)
+		if purifiers != nil {
+			purifiers.subscribe(client)
+		}
+		if republish != nil {
+			republish.subscribe(client)
+		}
+		c.startDevices(client, "", c.devicesOn(""))
+		if c.remote != nil {
+			c.subscribeRemoteConfig(client)
+		}
+		if homeAssistant != nil {
+			homeAssistant.publishDiscovery(client, c.devices())
+		}
+	}
+
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		slog.Warn("Connection lost", "error", err)
+		health.setConnected("", false)
+		failover.lost()
+	}
+
+	client := mqtt.NewClient(opts)
+	c.client = client
+	if homeAssistant != nil {
+		homeAssistant.client = client
+	}
+	if republish != nil {
+		republish.client = client
+	}
+	if ventilation != nil {
+		ventilation.client = client
+	}
+	if thresholds != nil {
+		thresholds.client = client
+	}
+
+	return &App{
+		config:        config,
+		c:             c,
+		mux:           mux,
+		client:        client,
+		sinks:         sinks,
+		health:        health,
+		failover:      failover,
+		homeAssistant: homeAssistant,
+		outputs:       outputs,
+		settings:      settings,
+		reports:       reports,
+		derived:       derived,
+	}, nil
+}
+
+// Handler serves /metrics, the probes, /api and the status page.
+func (a *App) Handler() http.Handler {
+	return a.mux
+}
+
+// Ready reports whether the collector is connected and subscribed to
+// every device topic, as /readyz does.
+func (a *App) Ready() error {
+	return a.health.ready()
+}
+
+// Alive reports whether the MQTT client still delivers messages, as
+// /healthz does.
+func (a *App) Alive() error {
+	return a.health.alive()
+}
+
+// Start connects to the brokers and starts listening to devices. ctx
+// bounds the connection to the main broker; the work started runs until
+// Stop.
+func (a *App) Start(ctx context.Context) error {
+	config, c := a.config, a.c
+	if config.EmbeddedBroker != "" {
+		broker, err := startEmbeddedBroker(config.EmbeddedBroker, config.MQTTUsername, config.MQTTPassword)
+		if err != nil {
+			return fmt.Errorf("start embedded MQTT broker: %w", err)
+		}
+		a.broker = broker
+		slog.Info("Embedded MQTT broker listening", "address", config.EmbeddedBroker)
+	}
+
+	for _, home := range config.Homes {
+		if home.Broker != "" {
+			c.connectHome(home)
+			slog.Info("Connecting to home broker", "home", home.Name, "broker", home.Broker, "devices", len(home.Devices))
+		}
+	}
+	token := a.client.Connect()
+	select {
+	case <-token.Done():
+		if err := token.Error(); err != nil {
+			return fmt.Errorf("connect to MQTT broker: %w", err)
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	background, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	if slices.ContainsFunc(config.Devices, func(device *Device) bool { return device.BLE }) {
+		if err := c.listenBLE(background, config.BLEAdapter); err != nil {
+			return fmt.Errorf("listen for BLE advertisements: %w", err)
+		}
+		slog.Info("Listening for BLE advertisements", "adapter", config.BLEAdapter)
+	}
+	if slices.ContainsFunc(config.Devices, func(device *Device) bool { return device.Cloud }) {
+		go newCloudPoller(c, config.Cloud).run(background)
+		slog.Info("Polling the Qingping cloud", "interval", config.Cloud.Interval)
+	}
+
+	go a.health.runLoopback(background, a.client)
+	go a.failover.watch(background, a.health)
+	if config.HeartbeatURL != "" {
+		go c.runHeartbeat(background, config.HeartbeatURL, config.HeartbeatInterval)
+	}
+	if config.DeviceNames != "" {
+		go c.watchDeviceNames(background, config.DeviceNames)
+	}
+
+	slog.Info("Qingping CGDN1 collector started", "devices", len(config.Devices))
+	if config.Duration == 0 {
+		// Continuous mode: every device renews its own request before it expires
+		slog.Info("Requesting data", "interval", config.UpdateInterval, "duration", "continuous")
+	} else {
+		slog.Info("Requesting data", "interval", config.UpdateInterval, "duration", config.Duration)
+	}
+	// Keeps devices reporting and sends the scheduled commands
+	go c.runSchedules(background)
+	if a.reports != nil {
+		go a.reports.run(background)
+		slog.Info("Storing reports", "reports", len(config.Reports), "timezone", config.Reporting.Timezone)
+	}
+
+	if a.derived != nil {
+		go a.derived.run(background)
+	}
+
+	// Check every updateInterval seconds for expired metrics
+	go every(background, time.Duration(config.UpdateInterval)*time.Second, c.cleanupStaleMetrics)
+	return nil
+}
+
+// Reload applies a newly loaded config, see collector.reload, and its log
+// settings.
+func (a *App) Reload(next Config) error {
+	added, err := a.c.reload(next)
+	if err != nil {
+		return err
+	}
+	if err := a.settings.reload(next); err != nil {
+		return err
+	}
+	if a.homeAssistant != nil && len(added) > 0 {
+		a.homeAssistant.publishDiscovery(a.client, added)
+	}
+	return nil
+}
+
+// Stop stops the background work, disconnects and flushes what sinks
+// still have queued. It gives up waiting once ctx is done.
+func (a *App) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.stop()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *App) stop() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+	if a.config.StopOnShutdown {
+		a.c.stopReporting()
+	}
+	// The broker only publishes the will when the connection breaks
+	if a.config.StatusTopic != "" && a.client.IsConnectionOpen() {
+		publishStatus(a.client, a.config.StatusTopic, statusOffline)
+	}
+	a.client.Disconnect(250)
+	for _, home := range a.c.homeClients {
+		home.Disconnect(250)
+	}
+
+	// Before the history database closes with the sinks
+	if a.derived != nil {
+		a.derived.save()
+	}
+	// Flush anything sinks still have queued
+	for _, sink := range a.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				slog.Error("Failed to close sink", "sink", sink.Name(), "error", err)
+			}
+		}
+	}
+	if a.outputs != nil {
+		if err := a.outputs.Close(); err != nil {
+			slog.Error("Failed to turn off indicators", "error", err)
+		}
+	}
+	if a.broker != nil {
+		a.broker.Close()
+	}
+	a.c.notifier.Close()
+}
+
+// every calls fn every interval until ctx is done.
+func every(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
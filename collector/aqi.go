@@ -0,0 +1,301 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// aqiCategory is one band of an air quality index standard
+type aqiCategory struct {
+	Key   string  // stable identifier, e.g. "unhealthy"
+	Color string  // hex color code defined by the standard
+	Max   float64 // highest index value still in this category
+}
+
+// aqiSegment maps the concentration range [CLo, CHi] linearly onto the
+// index range [ILo, IHi].
+type aqiSegment struct {
+	CLo, CHi float64
+	ILo, IHi float64
+}
+
+// aqiStandard defines an air quality index: how pollutant concentrations
+// (µg/m³) translate into sub-indices and which category an index falls in.
+// The overall index is the highest sub-index.
+type aqiStandard struct {
+	Name       string
+	Categories []aqiCategory // ordered from best to worst
+	Segments   map[string][]aqiSegment
+}
+
+var aqiStandards = map[string]*aqiStandard{
+	// US EPA, using the 2024 PM2.5 breakpoints
+	"epa": {
+		Name: "epa",
+		Categories: []aqiCategory{
+			{"good", "#00E400", 50},
+			{"moderate", "#FFFF00", 100},
+			{"unhealthy_sensitive", "#FF7E00", 150},
+			{"unhealthy", "#FF0000", 200},
+			{"very_unhealthy", "#8F3F97", 300},
+			{"hazardous", "#7E0023", 500},
+		},
+		Segments: map[string][]aqiSegment{
+			"pm25": {
+				{0, 9.0, 0, 50},
+				{9.1, 35.4, 51, 100},
+				{35.5, 55.4, 101, 150},
+				{55.5, 125.4, 151, 200},
+				{125.5, 225.4, 201, 300},
+				{225.5, 325.4, 301, 500},
+			},
+			"pm10": {
+				{0, 54, 0, 50},
+				{55, 154, 51, 100},
+				{155, 254, 101, 150},
+				{255, 354, 151, 200},
+				{355, 424, 201, 300},
+				{425, 604, 301, 500},
+			},
+		},
+	},
+	// European Environment Agency European Air Quality Index. It has no
+	// numeric scale, so the index is the category level 1-6.
+	"eu": {
+		Name: "eu",
+		Categories: []aqiCategory{
+			{"good", "#50F0E6", 1},
+			{"fair", "#50CCAA", 2},
+			{"moderate", "#F0E641", 3},
+			{"poor", "#FF5050", 4},
+			{"very_poor", "#960032", 5},
+			{"extremely_poor", "#7D2181", 6},
+		},
+		Segments: map[string][]aqiSegment{
+			"pm25": {
+				{0, 5, 1, 1},
+				{5, 15, 2, 2},
+				{15, 50, 3, 3},
+				{50, 90, 4, 4},
+				{90, 140, 5, 5},
+				{140, 800, 6, 6},
+			},
+			"pm10": {
+				{0, 15, 1, 1},
+				{15, 45, 2, 2},
+				{45, 120, 3, 3},
+				{120, 195, 4, 4},
+				{195, 270, 5, 5},
+				{270, 1200, 6, 6},
+			},
+		},
+	},
+	// China Ministry of Ecology and Environment HJ 633-2012, 24h values
+	"china": {
+		Name: "china",
+		Categories: []aqiCategory{
+			{"excellent", "#00E400", 50},
+			{"good", "#FFFF00", 100},
+			{"lightly_polluted", "#FF7E00", 150},
+			{"moderately_polluted", "#FF0000", 200},
+			{"heavily_polluted", "#99004C", 300},
+			{"severely_polluted", "#7E0023", 500},
+		},
+		Segments: map[string][]aqiSegment{
+			"pm25": {
+				{0, 35, 0, 50},
+				{35, 75, 50, 100},
+				{75, 115, 100, 150},
+				{115, 150, 150, 200},
+				{150, 250, 200, 300},
+				{250, 350, 300, 400},
+				{350, 500, 400, 500},
+			},
+			"pm10": {
+				{0, 50, 0, 50},
+				{50, 150, 50, 100},
+				{150, 250, 100, 150},
+				{250, 350, 150, 200},
+				{350, 420, 200, 300},
+				{420, 500, 300, 400},
+				{500, 600, 400, 500},
+			},
+		},
+	},
+}
+
+// aqiLabels translates category keys into display labels per locale.
+// Unknown locales fall back to English.
+var aqiLabels = map[string]map[string]string{
+	"en": {
+		"good":                "Good",
+		"moderate":            "Moderate",
+		"unhealthy_sensitive": "Unhealthy for Sensitive Groups",
+		"unhealthy":           "Unhealthy",
+		"very_unhealthy":      "Very Unhealthy",
+		"hazardous":           "Hazardous",
+		"fair":                "Fair",
+		"poor":                "Poor",
+		"very_poor":           "Very Poor",
+		"extremely_poor":      "Extremely Poor",
+		"excellent":           "Excellent",
+		"lightly_polluted":    "Lightly Polluted",
+		"moderately_polluted": "Moderately Polluted",
+		"heavily_polluted":    "Heavily Polluted",
+		"severely_polluted":   "Severely Polluted",
+	},
+	"de": {
+		"good":                "Gut",
+		"moderate":            "Mäßig",
+		"unhealthy_sensitive": "Ungesund für empfindliche Gruppen",
+		"unhealthy":           "Ungesund",
+		"very_unhealthy":      "Sehr ungesund",
+		"hazardous":           "Gefährlich",
+		"fair":                "Akzeptabel",
+		"poor":                "Schlecht",
+		"very_poor":           "Sehr schlecht",
+		"extremely_poor":      "Extrem schlecht",
+		"excellent":           "Ausgezeichnet",
+		"lightly_polluted":    "Leicht belastet",
+		"moderately_polluted": "Mäßig belastet",
+		"heavily_polluted":    "Stark belastet",
+		"severely_polluted":   "Sehr stark belastet",
+	},
+	"fr": {
+		"good":                "Bon",
+		"moderate":            "Modéré",
+		"unhealthy_sensitive": "Mauvais pour les groupes sensibles",
+		"unhealthy":           "Mauvais",
+		"very_unhealthy":      "Très mauvais",
+		"hazardous":           "Dangereux",
+		"fair":                "Moyen",
+		"poor":                "Dégradé",
+		"very_poor":           "Très dégradé",
+		"extremely_poor":      "Extrêmement dégradé",
+		"excellent":           "Excellent",
+		"lightly_polluted":    "Légèrement pollué",
+		"moderately_polluted": "Modérément pollué",
+		"heavily_polluted":    "Fortement pollué",
+		"severely_polluted":   "Gravement pollué",
+	},
+	"es": {
+		"good":                "Buena",
+		"moderate":            "Moderada",
+		"unhealthy_sensitive": "Dañina para grupos sensibles",
+		"unhealthy":           "Dañina",
+		"very_unhealthy":      "Muy dañina",
+		"hazardous":           "Peligrosa",
+		"fair":                "Razonable",
+		"poor":                "Mala",
+		"very_poor":           "Muy mala",
+		"extremely_poor":      "Extremadamente mala",
+		"excellent":           "Excelente",
+		"lightly_polluted":    "Ligeramente contaminada",
+		"moderately_polluted": "Moderadamente contaminada",
+		"heavily_polluted":    "Muy contaminada",
+		"severely_polluted":   "Gravemente contaminada",
+	},
+	"zh": {
+		"good":                "良",
+		"moderate":            "中等",
+		"unhealthy_sensitive": "对敏感人群不健康",
+		"unhealthy":           "不健康",
+		"very_unhealthy":      "非常不健康",
+		"hazardous":           "危险",
+		"fair":                "尚可",
+		"poor":                "差",
+		"very_poor":           "很差",
+		"extremely_poor":      "极差",
+		"excellent":           "优",
+		"lightly_polluted":    "轻度污染",
+		"moderately_polluted": "中度污染",
+		"heavily_polluted":    "重度污染",
+		"severely_polluted":   "严重污染",
+	},
+}
+
+// AQIResult is the index and category of a reading under a standard
+type AQIResult struct {
+	Standard   string             `json:"standard"`
+	Index      float64            `json:"index"`
+	SubIndices map[string]float64 `json:"sub_indices"`
+	Level      int                `json:"level"` // 1 for the best category
+	Category   string             `json:"category"`
+	Label      string             `json:"label"`
+	Color      string             `json:"color"`
+}
+
+func lookupAQIStandard(name string) (*aqiStandard, error) {
+	standard, ok := aqiStandards[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown AQI standard %q (want epa, eu or china)", name)
+	}
+	return standard, nil
+}
+
+// SubIndex interpolates a pollutant concentration onto the index scale.
+// Concentrations beyond the last segment are capped at the top of the scale.
+func (s *aqiStandard) SubIndex(pollutant string, concentration float64) float64 {
+	segments := s.Segments[pollutant]
+	for _, seg := range segments {
+		if concentration > seg.CHi {
+			continue
+		}
+		// Values in the gap between two segments (e.g. 9.05) belong to the
+		// lower end of the next one
+		if concentration <= seg.CLo {
+			return seg.ILo
+		}
+		return seg.ILo + (seg.IHi-seg.ILo)/(seg.CHi-seg.CLo)*(concentration-seg.CLo)
+	}
+	return segments[len(segments)-1].IHi
+}
+
+// Classify computes the index from the pollutants present in values and
+// the category it falls into, or false when none of them were reported.
+func (s *aqiStandard) Classify(values map[string]float64, locale string) (AQIResult, bool) {
+	result := AQIResult{Standard: s.Name, SubIndices: make(map[string]float64)}
+	for pollutant := range s.Segments {
+		if value, ok := values[pollutant]; ok {
+			sub := math.Round(s.SubIndex(pollutant, value))
+			result.SubIndices[pollutant] = sub
+			result.Index = max(result.Index, sub)
+		}
+	}
+	if len(result.SubIndices) == 0 {
+		return AQIResult{}, false
+	}
+
+	level := len(s.Categories) - 1
+	for i, category := range s.Categories {
+		if result.Index <= category.Max {
+			level = i
+			break
+		}
+	}
+	category := s.Categories[level]
+	result.Level = level + 1
+	result.Category = category.Key
+	result.Label = aqiLabel(category.Key, locale)
+	result.Color = category.Color
+	return result, true
+}
+
+func aqiLabel(key, locale string) string {
+	if labels, ok := aqiLabels[localeLanguage(locale)]; ok {
+		if label, ok := labels[key]; ok {
+			return label
+		}
+	}
+	return aqiLabels["en"][key]
+}
+
+// localeLanguage reduces "de_DE.UTF-8" or "pt-BR" to the language code.
+func localeLanguage(locale string) string {
+	locale = strings.ToLower(locale)
+	if i := strings.IndexAny(locale, "_-."); i >= 0 {
+		locale = locale[:i]
+	}
+	return locale
+}
@@ -0,0 +1,50 @@
+package collector
+
+import (
+	"log/slog"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// availabilityTopic is the device's AVAILABILITY_TOPIC, with {device} and
+// {mac} replaced.
+func availabilityTopic(template string, device *Device) string {
+	return strings.NewReplacer("{device}", device.Name, "{mac}", device.MAC).Replace(template)
+}
+
+// setAvailability publishes the device's retained online or offline status
+// when it changes. The caller holds lastUpdateMutex; it doesn't wait, so
+// messages keep their order.
+func (c *collector) setAvailability(device *Device, status string) {
+	if c.config.Availability == "" || c.availability[device.Name] == status {
+		return
+	}
+	c.availability[device.Name] = status
+	c.publishAvailability(c.clientFor(device), device, status)
+}
+
+func (c *collector) publishAvailability(client mqtt.Client, device *Device, status string) {
+	topic := availabilityTopic(c.config.Availability, device)
+	token := client.Publish(topic, 1, true, status)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Failed to publish availability", "device", device.Name, "topic", topic, "error", token.Error())
+		}
+	}()
+}
+
+// republishAvailability publishes the known status of devices again after
+// a (re)connect, in case it was lost while disconnected.
+func (c *collector) republishAvailability(client mqtt.Client, devices []*Device) {
+	if c.config.Availability == "" {
+		return
+	}
+	c.lastUpdateMutex.RLock()
+	defer c.lastUpdateMutex.RUnlock()
+	for _, device := range devices {
+		if status, ok := c.availability[device.Name]; ok {
+			c.publishAvailability(client, device, status)
+		}
+	}
+}
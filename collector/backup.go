@@ -0,0 +1,275 @@
+package collector
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// backupVersion is bumped when the archive layout changes
+const backupVersion = 1
+
+// backupManifest is stored as manifest.json in every backup. Files maps
+// the archive entries to where they were taken from.
+type backupManifest struct {
+	Version int               `json:"version"`
+	Created time.Time         `json:"created"`
+	Host    string            `json:"host"`
+	Files   map[string]string `json:"files"`
+}
+
+// Archive entries of the files a collector is made of
+const (
+	backupConfig  = "config.json"
+	backupNames   = "device-names.json"
+	backupHistory = "history.db"
+)
+
+// stateFlagNames are the flags naming the files of the archive entries
+var stateFlagNames = map[string]string{
+	backupConfig:  "config-file",
+	backupNames:   "device-names",
+	backupHistory: "history-db",
+}
+
+// stateFlags registers the flags naming the collector's files.
+func stateFlags(fs *flag.FlagSet) {
+	fs.String(stateFlagNames[backupConfig], "", "config file ($CONFIG_FILE)")
+	fs.String(stateFlagNames[backupNames], "", "device names file ($DEVICE_NAMES)")
+	fs.String(stateFlagNames[backupHistory], "", "SQLite history with annotations and derived state ($HISTORY_DB)")
+}
+
+// statePaths returns the collector's files by archive entry, taken from
+// the flags of stateFlags and otherwise the collector's settings, with the
+// config file's options read by readFile.
+func statePaths(fs *flag.FlagSet, readFile func(string) ([]byte, error)) (map[string]string, error) {
+	settings, _, err := loadSettings(sharedFlags(fs, slices.Collect(maps.Values(stateFlagNames))...), readFile)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		backupConfig:  settings.ConfigFile,
+		backupNames:   settings.DeviceNames,
+		backupHistory: settings.HistoryDB,
+	}, nil
+}
+
+// runBackup implements "backup [-o FILE]": write the config, device names
+// and history database into one .tar.gz, safe to run next to a live
+// collector.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "qingping-backup-"+time.Now().Format("20060102-150405")+".tar.gz", "archive to write")
+	stateFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	paths, err := statePaths(fs, os.ReadFile)
+	if err != nil {
+		return err
+	}
+
+	host, _ := os.Hostname()
+	manifest := backupManifest{Version: backupVersion, Created: time.Now().UTC(), Host: host, Files: make(map[string]string)}
+	for entry, path := range paths {
+		if path != "" {
+			manifest.Files[entry] = path
+		}
+	}
+	if len(manifest.Files) == 0 {
+		return fmt.Errorf("nothing to back up: set CONFIG_FILE, DEVICE_NAMES or HISTORY_DB")
+	}
+
+	// The database may be written to right now; VACUUM INTO takes a
+	// consistent copy including the WAL
+	var snapshot string
+	if path, ok := manifest.Files[backupHistory]; ok {
+		dir, err := os.MkdirTemp("", "qingping-backup")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		snapshot = filepath.Join(dir, backupHistory)
+		db, err := newSQLiteHistory(path, 0)
+		if err != nil {
+			return err
+		}
+		_, err = db.db.Exec(`VACUUM INTO ?`, snapshot)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", path, err)
+		}
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	err = writeBackup(tw, manifest, snapshot)
+	err = errors.Join(err, tw.Close(), gz.Close(), f.Close())
+	if err != nil {
+		os.Remove(*out)
+		return err
+	}
+	fmt.Printf("Wrote %s (%d files)\n", *out, len(manifest.Files))
+	return nil
+}
+
+func writeBackup(tw *tar.Writer, manifest backupManifest, snapshot string) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := addTarFile(tw, "manifest.json", data, manifest.Created); err != nil {
+		return err
+	}
+	for entry, path := range manifest.Files {
+		if entry == backupHistory {
+			path = snapshot
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := addTarFile(tw, entry, data, manifest.Created); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addTarFile(tw *tar.Writer, name string, data []byte, modified time.Time) error {
+	header := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: modified}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// runRestore implements "restore [-force] ARCHIVE": put the files of a
+// backup where this host's collector expects them. The collector must be
+// stopped while restoring.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := fs.Bool("force", false, "overwrite existing files")
+	stateFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: %s restore [-force] [-config-file PATH] [-device-names PATH] [-history-db PATH] ARCHIVE", os.Args[0])
+	}
+
+	files, manifest, err := readBackup(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if manifest.Version != backupVersion {
+		return fmt.Errorf("backup version %d, want %d", manifest.Version, backupVersion)
+	}
+	// The options of the restored config file are what the collector will
+	// go by
+	paths, err := statePaths(fs, func(path string) ([]byte, error) {
+		if data, ok := files[backupConfig]; ok {
+			return data, nil
+		}
+		return os.ReadFile(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Files go where this host's settings say, or where they came from.
+	// Every target is checked before anything is written.
+	targets := make(map[string]string)
+	for entry := range files {
+		target := paths[entry]
+		if target == "" {
+			target = manifest.Files[entry]
+		}
+		if target == "" {
+			return fmt.Errorf("no path for %s, pass -%s", entry, stateFlagNames[entry])
+		}
+		_, err := os.Stat(target)
+		switch {
+		case err == nil && !*force:
+			return fmt.Errorf("%s exists, use -force to overwrite it", target)
+		case err != nil && !os.IsNotExist(err):
+			return err
+		}
+		targets[entry] = target
+	}
+	for entry, target := range targets {
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, files[entry], 0o600); err != nil {
+			return err
+		}
+		if entry == backupHistory {
+			// A stale WAL would be replayed over the restored database
+			os.Remove(target + "-wal")
+			os.Remove(target + "-shm")
+		}
+		fmt.Printf("Restored %s\n", target)
+	}
+	fmt.Printf("Backup of %s from %s restored\n", manifest.Host, manifest.Created.Format(time.RFC3339))
+	return nil
+}
+
+// readBackup returns the files of an archive by entry name, and its
+// manifest.
+func readBackup(path string) (map[string][]byte, backupManifest, error) {
+	var manifest backupManifest
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, manifest, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, manifest, err
+	}
+	tr := tar.NewReader(gz)
+
+	files := make(map[string][]byte)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, manifest, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, manifest, err
+		}
+		switch header.Name {
+		case "manifest.json":
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, manifest, fmt.Errorf("manifest: %w", err)
+			}
+		case backupConfig, backupNames, backupHistory:
+			files[header.Name] = data
+		default:
+			return nil, manifest, fmt.Errorf("unexpected file %q in backup", header.Name)
+		}
+	}
+	if manifest.Version == 0 {
+		return nil, manifest, fmt.Errorf("%s is not a collector backup", path)
+	}
+	return files, manifest, nil
+}
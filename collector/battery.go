@@ -0,0 +1,164 @@
+package collector
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// batterySmoothing is the weight of the newest discharge rate in the
+	// moving average
+	batterySmoothing = 0.3
+	// batteryChargeJump is the rise in percent taken as a charge or swap
+	// rather than measurement noise
+	batteryChargeJump = 5
+)
+
+// batteryState tracks when the battery level last dropped and the smoothed
+// discharge rate in percent per second, overall and per reporting profile.
+type batteryState struct {
+	level    float64
+	since    time.Time
+	anchored bool // since is the time of an actual drop
+	rate     float64
+
+	profile string             // reporting profile since the last drop
+	mixed   bool               // the profile changed since the last drop
+	drain   map[string]float64 // rate measured under a single profile
+}
+
+// batterySink estimates the time until a device's battery is empty from an
+// exponential moving average of its discharge rate. The level is reported
+// in whole percent, so a rate is only measured between two drops.
+type batterySink struct {
+	mu     sync.Mutex
+	states map[string]*batteryState
+
+	// profile names the device's current reporting profile, if set
+	profile func(device *Device) string
+}
+
+func newBatterySink() *batterySink {
+	return &batterySink{states: make(map[string]*batteryState)}
+}
+
+func (s *batterySink) Name() string { return "battery" }
+
+func (s *batterySink) Write(device *Device, data CGDN1Data) {
+	level, ok := data.Values["battery"]
+	if !ok {
+		return
+	}
+
+	var profile string
+	if s.profile != nil {
+		profile = s.profile(device)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.states[device.Name]
+	switch {
+	case state == nil:
+		s.states[device.Name] = newBatteryState(level, data.Timestamp, profile)
+		return
+	case level >= state.level+batteryChargeJump:
+		slog.Info("Battery charged or replaced, restarting estimate", "device", device.Name, "from", state.level, "to", level)
+		// Drain per profile stays valid for the new battery
+		drain := state.drain
+		state = newBatteryState(level, data.Timestamp, profile)
+		state.drain = drain
+		s.states[device.Name] = state
+		batteryRemaining.DeleteLabelValues(device.Name)
+		return
+	case profile != state.profile:
+		state.mixed = true
+	}
+	if level >= state.level {
+		return
+	}
+
+	// The level dropped; the time since the previous drop gives a rate
+	if elapsed := data.Timestamp.Sub(state.since).Seconds(); state.anchored && elapsed > 0 {
+		rate := (state.level - level) / elapsed
+		state.rate = smooth(state.rate, rate)
+		// Only a period spent entirely in one profile says what it costs
+		if !state.mixed && profile != "" {
+			state.drain[profile] = smooth(state.drain[profile], rate)
+			batteryDrain.WithLabelValues(device.Name, profile).Set(state.drain[profile] * 86400)
+		}
+	}
+	state.level, state.since, state.anchored = level, data.Timestamp, true
+	state.profile, state.mixed = profile, false
+
+	if state.rate > 0 {
+		batteryRemaining.WithLabelValues(device.Name).Set(level / state.rate)
+	}
+}
+
+// Forget drops the exported estimates but keeps the measured rates, so a
+// device that comes back doesn't start over.
+func (s *batterySink) Forget(device *Device) {
+	batteryRemaining.DeleteLabelValues(device.Name)
+	batteryDrain.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+}
+
+func newBatteryState(level float64, now time.Time, profile string) *batteryState {
+	return &batteryState{level: level, since: now, profile: profile, drain: make(map[string]float64)}
+}
+
+// smooth adds a new rate to an exponential moving average, which starts
+// at the first rate.
+func smooth(average, rate float64) float64 {
+	if average == 0 {
+		return rate
+	}
+	return batterySmoothing*rate + (1-batterySmoothing)*average
+}
+
+// savedBattery is a batteryState as kept in the history database
+type savedBattery struct {
+	Level    float64            `json:"level"`
+	Since    time.Time          `json:"since"`
+	Anchored bool               `json:"anchored"`
+	Rate     float64            `json:"rate"`
+	Profile  string             `json:"profile"`
+	Mixed    bool               `json:"mixed"`
+	Drain    map[string]float64 `json:"drain"`
+}
+
+func (s *batterySink) saveState() (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := make(map[string]savedBattery, len(s.states))
+	for device, state := range s.states {
+		saved[device] = savedBattery{state.level, state.since, state.anchored, state.rate, state.profile, state.mixed, state.drain}
+	}
+	return encodeStates(saved)
+}
+
+func (s *batterySink) loadState(states map[string][]byte) error {
+	saved, err := decodeStates[savedBattery](states)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for device, b := range saved {
+		state := newBatteryState(b.Level, b.Since, b.Profile)
+		state.anchored, state.rate, state.mixed = b.Anchored, b.Rate, b.Mixed
+		for profile, rate := range b.Drain {
+			state.drain[profile] = rate
+			batteryDrain.WithLabelValues(device, profile).Set(rate * 86400)
+		}
+		if state.rate > 0 {
+			batteryRemaining.WithLabelValues(device).Set(state.level / state.rate)
+		}
+		s.states[device] = state
+	}
+	return nil
+}
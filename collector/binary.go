@@ -0,0 +1,125 @@
+package collector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Qingping's private binary protocol frames a message as
+//
+//	"CG" | command (1) | length (2) | TLVs (length bytes) | checksum (2)
+//
+// with little-endian integers and the checksum being the 16-bit sum of all
+// preceding bytes. Each TLV is key (1) | length (2) | value.
+var binaryMagic = []byte("CG")
+
+const (
+	binaryHeaderLen = 5
+
+	// TLV keys carrying sensor samples
+	binaryKeyRealtime = 0x14
+	binaryKeyHistory  = 0x03
+
+	// A sensor block is timestamp (4) | interval (2) followed by samples
+	binarySamplesOffset = 6
+	// temperature/humidity (3) | co2 (2) | pm25 (2) | pm10 (2) | tvoc (2) | battery (1)
+	binarySampleLen = 12
+
+	// binaryMissing marks a 16-bit field the device did not measure
+	binaryMissing = 0xffff
+)
+
+// decodeBinaryMessage decodes a binary frame into the same type and entries
+// a JSON message would have produced: every sample of its realtime and
+// history TLVs, oldest first. The type is the command byte in decimal, as
+// JSON messages have it, so a 0x11 settings response is "17".
+func decodeBinaryMessage(frame []byte) (string, []map[string]float64, error) {
+	if len(frame) < binaryHeaderLen+2 {
+		return "", nil, fmt.Errorf("binary frame too short (%d bytes)", len(frame))
+	}
+	command := frame[2]
+	length := int(binary.LittleEndian.Uint16(frame[3:5]))
+	if len(frame) != binaryHeaderLen+length+2 {
+		return "", nil, fmt.Errorf("binary frame length %d does not match header (%d)", len(frame), length)
+	}
+
+	var sum uint16
+	for _, b := range frame[:binaryHeaderLen+length] {
+		sum += uint16(b)
+	}
+	if got := binary.LittleEndian.Uint16(frame[binaryHeaderLen+length:]); got != sum {
+		return "", nil, fmt.Errorf("binary frame checksum %#04x, want %#04x", got, sum)
+	}
+
+	msgType := strconv.Itoa(int(command))
+	tlvs := frame[binaryHeaderLen : binaryHeaderLen+length]
+	// History comes before realtime data, so without timestamps the
+	// realtime sample still ends up newest
+	var history, realtime []map[string]float64
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return "", nil, fmt.Errorf("truncated TLV header")
+		}
+		key := tlvs[0]
+		size := int(binary.LittleEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+size {
+			return "", nil, fmt.Errorf("TLV %#02x: truncated value", key)
+		}
+		value := tlvs[3 : 3+size]
+		tlvs = tlvs[3+size:]
+
+		if key != binaryKeyRealtime && key != binaryKeyHistory {
+			continue
+		}
+		samples, err := decodeBinarySamples(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("TLV %#02x: %w", key, err)
+		}
+		if key == binaryKeyRealtime {
+			realtime = append(realtime, samples...)
+		} else {
+			history = append(history, samples...)
+		}
+	}
+	entries := append(history, realtime...)
+	sortEntries(entries)
+	return msgType, entries, nil
+}
+
+// decodeBinarySamples returns every sample of a sensor block, oldest
+// first. When the device's clock is set, the block's timestamp is of its
+// first sample and each following one is an interval later.
+func decodeBinarySamples(block []byte) ([]map[string]float64, error) {
+	size := len(block) - binarySamplesOffset
+	if size < binarySampleLen || size%binarySampleLen != 0 {
+		return nil, fmt.Errorf("sensor block of %d bytes is not a whole number of samples", len(block))
+	}
+	timestamp := binary.LittleEndian.Uint32(block[0:4])
+	interval := binary.LittleEndian.Uint16(block[4:6])
+
+	var samples []map[string]float64
+	for i := 0; i < size/binarySampleLen; i++ {
+		sample := block[binarySamplesOffset+i*binarySampleLen:][:binarySampleLen]
+
+		// Temperature and humidity share 24 bits: 12 bits of (°C*10 + 500)
+		// followed by 12 bits of %RH*10
+		packed := uint32(sample[0]) | uint32(sample[1])<<8 | uint32(sample[2])<<16
+		values := map[string]float64{
+			"temperature": float64(int(packed>>12)-500) / 10,
+			"humidity":    float64(packed&0xfff) / 10,
+		}
+		for j, key := range []string{"co2", "pm25", "pm10", "tvoc"} {
+			raw := binary.LittleEndian.Uint16(sample[3+2*j:])
+			if raw != binaryMissing {
+				values[key] = float64(raw)
+			}
+		}
+		values["battery"] = float64(sample[11])
+		if timestamp != 0 {
+			values["timestamp"] = float64(timestamp) + float64(interval)*float64(i)
+		}
+		samples = append(samples, values)
+	}
+	return samples, nil
+}
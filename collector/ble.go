@@ -0,0 +1,191 @@
+package collector
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Qingping monitors broadcast their readings as service data of this UUID:
+//
+//	frame control (1) | product ID (1) | MAC, reversed (6) | readings
+//
+// with each reading being id (1) | length (1) | value, integers in little
+// endian.
+const qingpingServiceUUID = "0000fdcd-0000-1000-8000-00805f9b34fb"
+
+const (
+	bleHeaderLen = 8
+
+	// Reading ids
+	bleTemperatureHumidity = 0x01 // temperature (2, signed, 0.1 °C) | humidity (2, 0.1 %)
+	bleBattery             = 0x02 // percent (1)
+	blePM                  = 0x12 // pm25 (2) | pm10 (2)
+	bleCO2                 = 0x13 // ppm (2)
+)
+
+// decodeAdvertisement decodes the service data of a Qingping advertisement
+// into the MAC of the sender and its readings. Readings it doesn't know are
+// skipped.
+func decodeAdvertisement(data []byte) (string, map[string]float64, error) {
+	if len(data) < bleHeaderLen {
+		return "", nil, fmt.Errorf("advertisement too short (%d bytes)", len(data))
+	}
+	address := slices.Clone(data[2:bleHeaderLen])
+	slices.Reverse(address)
+	mac := strings.ToUpper(hex.EncodeToString(address))
+
+	values := make(map[string]float64)
+	readings := data[bleHeaderLen:]
+	for len(readings) > 0 {
+		if len(readings) < 2 || len(readings) < 2+int(readings[1]) {
+			return "", nil, fmt.Errorf("truncated reading")
+		}
+		id, value := readings[0], readings[2:2+readings[1]]
+		readings = readings[2+len(value):]
+
+		switch {
+		case id == bleTemperatureHumidity && len(value) == 4:
+			values["temperature"] = float64(int16(binary.LittleEndian.Uint16(value))) / 10
+			values["humidity"] = float64(binary.LittleEndian.Uint16(value[2:])) / 10
+		case id == bleBattery && len(value) == 1:
+			values["battery"] = float64(value[0])
+		case id == blePM && len(value) == 4:
+			values["pm25"] = float64(binary.LittleEndian.Uint16(value))
+			values["pm10"] = float64(binary.LittleEndian.Uint16(value[2:]))
+		case id == bleCO2 && len(value) == 2:
+			values["co2"] = float64(binary.LittleEndian.Uint16(value))
+		}
+	}
+	return mac, values, nil
+}
+
+// bleListener feeds the advertisements of BLE devices into the same
+// pipeline as MQTT messages, through BlueZ on the system bus.
+type bleListener struct {
+	c *collector
+
+	mu sync.Mutex
+	// last accepted advertisement by device name; devices advertise every
+	// few seconds but are read once per UPDATE_INTERVAL like over MQTT
+	last map[string]time.Time
+}
+
+// listenBLE starts discovery of Qingping devices on a BlueZ adapter, e.g.
+// hci0, and keeps handling their advertisements in the background until
+// ctx is done.
+func (c *collector) listenBLE(ctx context.Context, adapter string) error {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return fmt.Errorf("connect to system bus: %w", err)
+	}
+	path := dbus.ObjectPath("/org/bluez/" + adapter)
+
+	// Known devices report new service data as property changes, new
+	// ones as added interfaces
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchPathNamespace(path),
+	); err != nil {
+		return err
+	}
+	if err := conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.DBus.ObjectManager"),
+		dbus.WithMatchMember("InterfacesAdded"),
+	); err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 64)
+	conn.Signal(signals)
+
+	obj := conn.Object("org.bluez", path)
+	filter := map[string]dbus.Variant{
+		"Transport": dbus.MakeVariant("le"),
+		"UUIDs":     dbus.MakeVariant([]string{qingpingServiceUUID}),
+		// Report every advertisement, not only changed ones
+		"DuplicateData": dbus.MakeVariant(true),
+	}
+	if err := obj.Call("org.bluez.Adapter1.SetDiscoveryFilter", 0, filter).Err; err != nil {
+		return fmt.Errorf("%s: set discovery filter: %w", adapter, err)
+	}
+	if err := obj.Call("org.bluez.Adapter1.StartDiscovery", 0).Err; err != nil {
+		return fmt.Errorf("%s: start discovery: %w", adapter, err)
+	}
+
+	l := &bleListener{c: c, last: make(map[string]time.Time)}
+	go func() {
+		// Closing the connection closes signals
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		for signal := range signals {
+			if data, ok := serviceData(signal); ok {
+				l.advertised(data)
+			}
+		}
+	}()
+	return nil
+}
+
+// serviceData returns the Qingping service data a BlueZ signal carries.
+func serviceData(signal *dbus.Signal) ([]byte, bool) {
+	var props map[string]dbus.Variant
+	switch signal.Name {
+	case "org.freedesktop.DBus.Properties.PropertiesChanged":
+		if len(signal.Body) < 2 || signal.Body[0] != "org.bluez.Device1" {
+			return nil, false
+		}
+		props, _ = signal.Body[1].(map[string]dbus.Variant)
+	case "org.freedesktop.DBus.ObjectManager.InterfacesAdded":
+		if len(signal.Body) < 2 {
+			return nil, false
+		}
+		interfaces, _ := signal.Body[1].(map[string]map[string]dbus.Variant)
+		props = interfaces["org.bluez.Device1"]
+	}
+	services, ok := props["ServiceData"].Value().(map[string]dbus.Variant)
+	if !ok {
+		return nil, false
+	}
+	data, ok := services[qingpingServiceUUID].Value().([]byte)
+	return data, ok
+}
+
+func (l *bleListener) advertised(data []byte) {
+	mac, values, err := decodeAdvertisement(data)
+	if err != nil {
+		slog.Debug("Failed to decode BLE advertisement", "error", err)
+		return
+	}
+	var device *Device
+	for _, d := range l.c.devices() {
+		if d.BLE && normalizeMAC(d.MAC) == mac {
+			device = d
+			break
+		}
+	}
+	if device == nil || len(values) == 0 {
+		return
+	}
+
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.last[device.Name]) < time.Duration(l.c.config.UpdateInterval)*time.Second {
+		l.mu.Unlock()
+		return
+	}
+	l.last[device.Name] = now
+	l.mu.Unlock()
+
+	l.c.handleValues(device, values, origin{Source: "ble"})
+}
@@ -0,0 +1,51 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// embeddedBrokerClient is the address the collector's own client reaches
+// an embedded broker listening on address at.
+func embeddedBrokerClient(address string) (host, port string, err error) {
+	host, port, err = net.SplitHostPort(address)
+	if err != nil {
+		return "", "", fmt.Errorf("EMBEDDED_BROKER must be host:port or :port, got %q", address)
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return host, port, nil
+}
+
+// startEmbeddedBroker runs an MQTT broker inside the collector, so devices
+// can publish to it directly without a separate Mosquitto. With a username
+// every client has to log in with it, the devices as well as the
+// collector itself.
+func startEmbeddedBroker(address, username, password string) (*mochi.Server, error) {
+	server := mochi.New(&mochi.Options{Logger: slog.Default().With("component", "broker")})
+	var err error
+	if username == "" {
+		err = server.AddHook(new(auth.AllowHook), nil)
+	} else {
+		err = server.AddHook(new(auth.Hook), &auth.Options{Ledger: &auth.Ledger{
+			Auth: auth.AuthRules{{Username: auth.RString(username), Password: auth.RString(password), Allow: true}},
+		}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: address})); err != nil {
+		return nil, err
+	}
+	// Serve starts the listeners and returns
+	if err := server.Serve(); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
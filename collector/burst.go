@@ -0,0 +1,74 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// burst is a temporary faster reporting profile of a device
+type burst struct {
+	timer    *time.Timer
+	interval time.Duration
+}
+
+// startBurst temporarily switches a device to a faster reporting profile
+// and restores the normal one once duration has passed. Starting a new
+// burst on a bursting device replaces the old one.
+func (c *collector) startBurst(device *Device, interval, duration time.Duration) error {
+	secs := func(d time.Duration) int { return int(d.Round(time.Second) / time.Second) }
+	if secs(interval) < 1 || secs(duration) < secs(interval) {
+		return fmt.Errorf("invalid burst: interval %v, duration %v", interval, duration)
+	}
+
+	if !device.commandable() {
+		return fmt.Errorf("device %s can't be sent commands", device.Name)
+	}
+
+	c.burstMutex.Lock()
+	defer c.burstMutex.Unlock()
+
+	if b, ok := c.bursts[device.Name]; ok {
+		b.timer.Stop()
+		delete(c.bursts, device.Name)
+	}
+	if err := c.publishReportingConfig(device, secs(interval), secs(duration)); err != nil {
+		return err
+	}
+
+	slog.Info("Started burst", "device", device.Name, "interval", interval, "duration", duration)
+	c.bursts[device.Name] = &burst{
+		timer:    time.AfterFunc(duration, c.later(device, c.endBurst)),
+		interval: interval.Round(time.Second),
+	}
+	return nil
+}
+
+func (c *collector) endBurst(device *Device) {
+	c.burstMutex.Lock()
+	delete(c.bursts, device.Name)
+	c.burstMutex.Unlock()
+
+	slog.Info("Burst ended, restoring normal reporting", "device", device.Name)
+	c.sendConfigMessage(device)
+}
+
+func (c *collector) bursting(name string) bool {
+	c.burstMutex.Lock()
+	defer c.burstMutex.Unlock()
+	_, ok := c.bursts[name]
+	return ok
+}
+
+// reportingInterval is the interval the device was last asked to report at.
+func (c *collector) reportingInterval(device *Device) time.Duration {
+	c.burstMutex.Lock()
+	defer c.burstMutex.Unlock()
+	if b, ok := c.bursts[device.Name]; ok {
+		return b.interval
+	}
+	if rapid := c.rapidInterval(device); rapid > 0 {
+		return rapid
+	}
+	return time.Duration(c.config.UpdateInterval) * time.Second
+}
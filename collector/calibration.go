@@ -0,0 +1,34 @@
+package collector
+
+import "fmt"
+
+// validateCalibration checks that offsets only name sensors the device
+// reports; derived values follow from the calibrated sensors.
+func validateCalibration(device *Device, offsets map[string]float64) error {
+	for key := range offsets {
+		if !device.reports(key) {
+			return fmt.Errorf("calibration of %q, which the device doesn't report", key)
+		}
+	}
+	return nil
+}
+
+// calibrate adds the device's offsets to the raw values, keeping them in
+// their physical range.
+func calibrate(values map[string]float64, offsets map[string]float64) {
+	for key, offset := range offsets {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		value += offset
+		switch {
+		case key == "temperature":
+		case key == "humidity" && value > 100:
+			value = 100
+		case value < 0:
+			value = 0
+		}
+		values[key] = value
+	}
+}
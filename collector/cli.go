@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Subcommands run instead of the collector when named as first argument,
+// with the arguments that follow.
+var Subcommands = map[string]func(args []string) error{
+	"trigger": runTrigger,
+	"corpus":  runCorpus,
+	"gen":     runGen,
+	"import":  runImport,
+	"backup":  runBackup,
+	"restore": runRestore,
+}
+
+// sharedFlags returns the flags set on a subcommand that the collector has
+// too, as arguments for loadSettings, so they win over the environment and
+// the config file like they would for the collector.
+func sharedFlags(fs *flag.FlagSet, names ...string) []string {
+	var args []string
+	fs.Visit(func(f *flag.Flag) {
+		if slices.Contains(names, f.Name) {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
+
+// collectorURL is where the CLI subcommands reach a running collector
+// with the given settings.
+func collectorURL(settings Config) string {
+	return strings.TrimSuffix(getEnv("COLLECTOR_URL", "http://localhost:"+settings.MetricsPort), "/")
+}
+
+// apiRequest calls the running collector's API and returns the body.
+func apiRequest(method, path string) ([]byte, error) {
+	settings, _, err := loadSettings(nil, os.ReadFile)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, collectorURL(settings)+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if settings.APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+settings.APIToken)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// runTrigger implements "trigger DEVICE": ask the running collector for an
+// immediate reading from the device.
+func runTrigger(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s trigger DEVICE", os.Args[0])
+	}
+	body, err := apiRequest(http.MethodPost, "/api/devices/"+url.PathEscape(args[0])+"/trigger")
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(body))
+	return nil
+}
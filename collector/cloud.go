@@ -0,0 +1,201 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CloudConfig configures polling of the Qingping developer cloud API, see
+// https://developer.qingping.co
+type CloudConfig struct {
+	AppKey    string
+	AppSecret string
+	Interval  time.Duration // time between polls
+}
+
+const (
+	cloudTokenURL   = "https://oauth.cleargrass.com/oauth2/token"
+	cloudDevicesURL = "https://apis.cleargrass.com/v1/apis/devices"
+	cloudPageSize   = 50
+)
+
+// cloudDevice is a device in the cloud API's device list. Data holds the
+// latest reading by key, including its timestamp in seconds.
+type cloudDevice struct {
+	Info struct {
+		MAC  string `json:"mac"`
+		Name string `json:"name"`
+	} `json:"info"`
+	Data map[string]SensorValue `json:"data"`
+}
+
+// cloudPoller feeds the readings of devices bound to the Qingping+ app into
+// the same pipeline as MQTT messages, by polling the cloud API.
+type cloudPoller struct {
+	c      *collector
+	config CloudConfig
+	client *http.Client
+
+	token   string
+	expires time.Time
+	// timestamp of the last reading taken by device name; the cloud repeats
+	// the latest reading until the device uploads a new one
+	last map[string]float64
+}
+
+func newCloudPoller(c *collector, config CloudConfig) *cloudPoller {
+	return &cloudPoller{
+		c:      c,
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		last:   make(map[string]float64),
+	}
+}
+
+// run polls the cloud every interval, starting right away, until ctx is
+// done.
+func (p *cloudPoller) run(ctx context.Context) {
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.poll(ctx); err != nil {
+			slog.Warn("Failed to poll the Qingping cloud", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll takes the new readings of every cloud device.
+func (p *cloudPoller) poll(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Interval)
+	defer cancel()
+
+	devices, err := p.devices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, cd := range devices {
+		mac := normalizeMAC(cd.Info.MAC)
+		var device *Device
+		for _, d := range p.c.devices() {
+			if d.Cloud && normalizeMAC(d.MAC) == mac {
+				device = d
+				break
+			}
+		}
+		if device == nil {
+			slog.Debug("Ignoring unconfigured cloud device", "mac", mac, "name", cd.Info.Name)
+			continue
+		}
+
+		if timestamp, ok := cd.Data["timestamp"]; ok {
+			if timestamp.Value <= p.last[device.Name] {
+				continue
+			}
+			p.last[device.Name] = timestamp.Value
+		}
+
+		// The timestamp is taken as the time of the reading
+		values := make(map[string]float64, len(cd.Data))
+		for key, value := range cd.Data {
+			values[key] = value.Value
+		}
+		if len(values) > 1 {
+			p.c.handleValues(device, values, origin{Source: "cloud"})
+		}
+	}
+	return nil
+}
+
+// devices returns every device bound to the app's account with its latest
+// reading.
+func (p *cloudPoller) devices(ctx context.Context) ([]cloudDevice, error) {
+	token, err := p.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []cloudDevice
+	for offset := 0; ; offset += cloudPageSize {
+		params := url.Values{}
+		params.Set("timestamp", strconv.FormatInt(time.Now().UnixMilli(), 10))
+		params.Set("limit", strconv.Itoa(cloudPageSize))
+		params.Set("offset", strconv.Itoa(offset))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, cloudDevicesURL+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		var page struct {
+			Total   int           `json:"total"`
+			Devices []cloudDevice `json:"devices"`
+		}
+		if err := p.do(req, &page); err != nil {
+			return nil, fmt.Errorf("list devices: %w", err)
+		}
+		devices = append(devices, page.Devices...)
+		if len(page.Devices) == 0 || len(devices) >= page.Total {
+			return devices, nil
+		}
+	}
+}
+
+// accessToken returns an OAuth access token of the app, fetching a new
+// one shortly before the last one expires.
+func (p *cloudPoller) accessToken(ctx context.Context) (string, error) {
+	if p.token != "" && time.Until(p.expires) > time.Minute {
+		return p.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {"device_full_access"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cloudTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(p.config.AppKey, p.config.AppSecret)
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"` // seconds
+	}
+	if err := p.do(req, &resp); err != nil {
+		return "", fmt.Errorf("get access token: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("get access token: no token in response")
+	}
+	p.token = resp.AccessToken
+	p.expires = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return p.token, nil
+}
+
+func (p *cloudPoller) do(req *http.Request, out any) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// The token was revoked early; get a new one next time
+		p.token = ""
+	}
+	if resp.StatusCode/100 != 2 {
+		return errors.New(resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
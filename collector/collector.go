@@ -0,0 +1,481 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// collector holds the runtime state shared by the MQTT handlers
+type collector struct {
+	config   Config
+	client   mqtt.Client
+	sinks    []Sink
+	health   *health
+	notifier *notifier
+	history  historyStore
+	stream   *streamSink
+	stats    *statsCache
+	// Devices currently raising no alerts
+	maintenance *maintenance
+	// Manually recorded events, stored next to the history
+	annotations annotationStore
+	// Series IDs of devices by every MAC and topic they were known by
+	seriesIDs seriesIDStore
+
+	// When the collector started, for STARTUP_GRACE
+	started time.Time
+	// Whether devices that never reported have been looked for
+	absentChecked bool
+
+	// Track last update time for each device to expire stale metrics
+	lastUpdateTimes map[string]time.Time
+	// Devices whose metrics expired, so their return can be announced
+	offline map[string]bool
+	// Latest reading of every device, kept after it goes offline
+	latest map[string]*Snapshot
+	// Last status published on AVAILABILITY_TOPIC by device name
+	availability    map[string]string
+	lastUpdateMutex sync.RWMutex
+
+	// Restore timers of devices temporarily reporting faster
+	bursts     map[string]*burst
+	burstMutex sync.Mutex
+
+	// Request chains of devices in continuous or rapid mode
+	renewals     map[string]*renewal
+	renewalMutex sync.Mutex
+
+	// Battery levels of devices in rapid mode, to tell whether they run
+	// on battery
+	batteryLevels map[string]float64
+	onBattery     map[string]bool
+	powerMutex    sync.Mutex
+
+	// Clients of the homes with their own broker, by home name
+	homeClients map[string]mqtt.Client
+
+	// Serializes changes to the device list (SIGHUP, DEVICE_NAMES,
+	// DEVICE_CONFIG_TOPIC)
+	reloadMutex sync.Mutex
+	// Device configs received over MQTT, if DEVICE_CONFIG_TOPIC is set
+	remote *remoteConfigs
+	// Holds back small changes, if DEADBANDS is set
+	deadbands *deadbandFilter
+	// Rejects and smooths sensor values, if FILTER_MODE or
+	// FILTER_MAX_JUMPS is set
+	filter *valueFilter
+}
+
+func (c *collector) subscribeToCGDN1(client mqtt.Client, device *Device) bool {
+	// Subscribe to the /up topic where device publishes data
+	upTopic := device.upTopic()
+
+	token := client.Subscribe(upTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+		// A reload may have swapped in an updated device since
+		if current := c.currentDevice(device); current != nil {
+			c.handleCGDN1Message(msg, current)
+		}
+	})
+
+	if err := waitSubscribed(token, upTopic, device.Name); err != nil {
+		slog.Error("Failed to subscribe", "device", device.Name, "topic", upTopic, "error", err)
+		return false
+	}
+	slog.Info("Subscribed", "device", device.Name, "topic", upTopic)
+	return true
+}
+
+func (c *collector) sendConfigMessage(device *Device) {
+	// Foreign sensors and BLE devices report on their own schedule
+	if !device.commandable() {
+		return
+	}
+	// A running burst restores the normal profile itself when it ends
+	if c.bursting(device.Name) {
+		slog.Debug("Skipping config refresh during burst", "device", device.Name)
+		return
+	}
+	if c.config.Duration == 0 || c.rapidInterval(device) > 0 {
+		c.renew(device)
+		return
+	}
+	c.publishReportingConfig(device, c.config.UpdateInterval, c.config.Duration)
+}
+
+// stopReporting winds every device down before the collector goes away:
+// a Type 12 with a duration of 0 ends realtime reporting, returning the
+// device to its own upload schedule.
+func (c *collector) stopReporting() {
+	c.burstMutex.Lock()
+	for name, b := range c.bursts {
+		b.timer.Stop()
+		delete(c.bursts, name)
+	}
+	c.burstMutex.Unlock()
+	c.renewalMutex.Lock()
+	for name, r := range c.renewals {
+		r.timer.Stop()
+		delete(c.renewals, name)
+	}
+	c.renewalMutex.Unlock()
+
+	for _, device := range c.devices() {
+		// Publishing on a broker that is down would hold up the shutdown
+		if !device.commandable() || !c.clientFor(device).IsConnectionOpen() {
+			continue
+		}
+		if err := c.publishReportingConfig(device, c.config.UpdateInterval, 0); err == nil {
+			slog.Info("Asked device to stop reporting", "device", device.Name)
+		}
+	}
+}
+
+// reportingMessage builds the Type 12 message: request data at the
+// specified interval for the specified duration, both in seconds.
+func reportingMessage(interval, duration int) QingpingConfigMessage {
+	return QingpingConfigMessage{
+		Type:     "12",
+		UpItvl:   fmt.Sprintf("%d", interval),
+		Duration: fmt.Sprintf("%d", duration),
+	}
+}
+
+// publishReportingConfig sends a Type 12 message asking the device to
+// report every interval seconds for duration seconds.
+func (c *collector) publishReportingConfig(device *Device, interval, duration int) error {
+	downTopic := device.downTopic()
+
+	configMsg := reportingMessage(interval, duration)
+
+	payload, err := json.Marshal(configMsg)
+	if err != nil {
+		slog.Error("Failed to marshal config message", "device", device.Name, "error", err)
+		return err
+	}
+
+	token := c.clientFor(device).Publish(downTopic, 0, false, payload)
+	if err := waitCommand(token, device, downTopic); err != nil {
+		slog.Error("Failed to publish config", "device", device.Name, "topic", downTopic, "type", configMsg.Type, "error", err)
+		return err
+	}
+	slog.Info("Sent config", "device", device.Name, "topic", downTopic, "type", configMsg.Type,
+		"interval", interval, "duration", duration)
+	return nil
+}
+
+func (c *collector) cleanupStaleMetrics() {
+	now := time.Now()
+	if grace := c.config.StartupGrace; grace > 0 {
+		// Devices are still getting their first request after a restart
+		if now.Sub(c.started) < grace {
+			return
+		}
+		c.reportAbsent(now)
+	}
+
+	// Expire metrics after STALE_TIMEOUT, unless disabled
+	if c.config.StaleTimeout == 0 {
+		return
+	}
+	expirationDuration := c.config.StaleTimeout
+
+	c.lastUpdateMutex.Lock()
+	defer c.lastUpdateMutex.Unlock()
+
+	for _, device := range c.config.Devices {
+		lastTime, ok := c.lastUpdateTimes[device.Name]
+		if !ok || now.Sub(lastTime) <= expirationDuration {
+			continue
+		}
+		deviceUp.WithLabelValues(device.Name).Set(0)
+		if c.config.StaleMode == "keep" {
+			slog.Warn("Device has not responded, keeping its last values", "device", device.Name, "silent_for", now.Sub(lastTime).Round(time.Second))
+		} else {
+			slog.Warn("Device has not responded, removing stale metrics", "device", device.Name, "silent_for", now.Sub(lastTime).Round(time.Second))
+
+			// Delete all metrics for this device from every sink that keeps them
+			for _, sink := range device.policy.Sinks {
+				if forgetter, ok := sink.(Forgetter); ok {
+					forgetter.Forget(device)
+				}
+			}
+		}
+
+		// Remove from tracking map
+		delete(c.lastUpdateTimes, device.Name)
+		c.deadbands.forget(device)
+		c.filter.forget(device)
+		c.offline[device.Name] = true
+		c.setAvailability(device, statusOffline)
+
+		c.notifier.Notify(device, Notification{
+			Event:    EventOffline,
+			Duration: now.Sub(lastTime).Round(time.Second).String(),
+		})
+	}
+}
+
+// reportAbsent reports the devices that have not reported once since
+// startup as offline, once the startup grace period is over.
+func (c *collector) reportAbsent(now time.Time) {
+	c.lastUpdateMutex.Lock()
+	defer c.lastUpdateMutex.Unlock()
+	if c.absentChecked {
+		return
+	}
+	c.absentChecked = true
+
+	for _, device := range c.config.Devices {
+		if _, ok := c.lastUpdateTimes[device.Name]; ok || c.offline[device.Name] {
+			continue
+		}
+		slog.Warn("Device has not reported since startup", "device", device.Name, "grace", c.config.StartupGrace)
+		deviceUp.WithLabelValues(device.Name).Set(0)
+		c.offline[device.Name] = true
+		c.setAvailability(device, statusOffline)
+		c.notifier.Notify(device, Notification{
+			Event:    EventOffline,
+			Duration: now.Sub(c.started).Round(time.Second).String(),
+		})
+	}
+}
+
+func (c *collector) handleCGDN1Message(msg mqtt.Message, device *Device) {
+	payload := msg.Payload()
+	if c.config.SigningKey != "" {
+		verified, err := verifySignature(c.config.SigningKey, msg.Topic(), payload)
+		if err != nil {
+			slog.Warn("Rejected unauthenticated message", "device", device.Name, "topic", msg.Topic(), "error", err)
+			recordError(codeUnauthenticated, ErrorExample{Device: device.Name, Source: msg.Topic(), Message: err.Error()})
+			return
+		}
+		payload = verified
+	}
+
+	decode := decodeUpMessage
+	if device.foreign() {
+		decode = device.decodeMapped
+	}
+	msgType, entries, err := decode(payload)
+	if err != nil {
+		slog.Warn("Failed to parse message", "device", device.Name, "topic", msg.Topic(), "error", err,
+			"payload", limitString(string(payload), 200))
+		recordError(codeParseFailure, ErrorExample{Device: device.Name, Source: msg.Topic(), Message: err.Error()})
+		return
+	}
+	if !device.foreign() {
+		updateDeviceInfo(device, decodeDeviceInfo(payload))
+	}
+
+	// Skip Type 17 and Type 13 (config responses without sensor data)
+	if isConfigResponse(msgType) {
+		slog.Debug("Skipping config response", "device", device.Name, "topic", msg.Topic(), "type", msgType)
+		return
+	}
+
+	// Check if there's sensor data in the message
+	if len(entries) == 0 {
+		slog.Debug("No sensor data in message", "device", device.Name, "topic", msg.Topic(), "type", msgType)
+		return
+	}
+	if len(entries) > 1 {
+		slog.Debug("Message with buffered readings", "device", device.Name, "topic", msg.Topic(), "readings", len(entries))
+	}
+	// Readings buffered before the newest one only fill the gaps of sinks
+	// that keep every reading with its time
+	newest := len(entries) - 1
+	for _, raw := range entries[:newest] {
+		c.backfillValues(device, raw)
+	}
+	c.handleValues(device, entries[newest], origin{Source: "mqtt", Topic: msg.Topic(), Type: msgType})
+}
+
+// handleValues runs the sensor values of a device through the pipeline,
+// wherever they came from.
+func (c *collector) handleValues(device *Device, raw map[string]float64, from origin) {
+	deviceName := device.Name
+	now := time.Now()
+	taken := readingTime(device, raw, now, c.config.DeviceTimestamps)
+	c.lastUpdateMutex.RLock()
+	latest, ok := c.latest[deviceName]
+	c.lastUpdateMutex.RUnlock()
+	if ok && taken.Before(latest.Reading.Timestamp) {
+		c.confirmRenewal(device, now)
+		c.backfill(device, raw, taken)
+		return
+	}
+	// A buffered message from before the device went stale doesn't bring
+	// it back
+	late := now.Sub(taken) > c.config.staleAfter()
+	if late {
+		slog.Debug("Late reading", "device", deviceName, "taken", taken)
+	} else {
+		c.trackPower(device, raw)
+	}
+	if !c.deadbands.apply(device, raw, taken) {
+		// Nothing moved; the device is still alive
+		slog.Debug("Suppressed reading within deadbands", "device", deviceName)
+		c.confirmRenewal(device, now)
+		c.lastUpdateMutex.Lock()
+		c.seen(deviceName, taken)
+		c.lastUpdateMutex.Unlock()
+		return
+	}
+	sensorData := c.newReading(device, raw, taken)
+
+	// Hand the reading to every sink this device is routed to
+	for _, sink := range device.policy.Sinks {
+		sink.Write(device, sensorData)
+	}
+	c.markMaintenance(device, now)
+	c.confirmRenewal(device, now)
+
+	// Track update time for metric expiration
+	c.lastUpdateMutex.Lock()
+	c.seen(deviceName, taken)
+	// Sinks may hold on to the reading, so the snapshot gets its own copy
+	c.latest[deviceName] = &Snapshot{
+		Device:   deviceName,
+		Reading:  sensorData.clone(),
+		Received: now,
+		Source:   from.Source,
+		Topic:    from.Topic,
+		Type:     from.Type,
+	}
+	wasOffline := c.offline[deviceName] && !late
+	if !late {
+		delete(c.offline, deviceName)
+		c.setAvailability(device, statusOnline)
+	}
+	c.lastUpdateMutex.Unlock()
+
+	if wasOffline {
+		c.notifier.Notify(device, Notification{Event: EventOnline, Reading: sensorData})
+	}
+
+	// Log the data; every few seconds in rapid mode is only worth a debug
+	level := slog.LevelInfo
+	if c.rapidInterval(device) > 0 {
+		level = slog.LevelDebug
+	}
+	attrs := append([]any{"device", deviceName}, from.logAttrs()...)
+	slog.Log(context.Background(), level, "Reading", append(attrs,
+		"temperature", sensorData.Temperature,
+		"humidity", sensorData.Humidity,
+		"co2", sensorData.CO2,
+		"pm25", sensorData.PM25,
+		"pm10", sensorData.PM10,
+		"tvoc", sensorData.TVOC,
+		"battery", sensorData.Battery,
+	)...)
+}
+
+// backfillValues is handleValues for a reading buffered by the device
+// before a newer one. Without a timestamp from the device it can't be
+// placed in time and is dropped.
+func (c *collector) backfillValues(device *Device, raw map[string]float64) {
+	now := time.Now()
+	taken := readingTime(device, raw, now, c.config.DeviceTimestamps)
+	if !taken.Before(now) {
+		slog.Debug("Dropping buffered reading without a timestamp", "device", device.Name)
+		return
+	}
+	c.backfill(device, raw, taken)
+}
+
+// backfill hands a reading older than the device's latest to the sinks
+// that keep every reading with its own time, leaving gauges, alerts and
+// other current state alone.
+func (c *collector) backfill(device *Device, raw map[string]float64, taken time.Time) {
+	var reading *CGDN1Data
+	for _, sink := range device.policy.Sinks {
+		backfiller, ok := sink.(Backfiller)
+		if !ok {
+			continue
+		}
+		if reading == nil {
+			past := c.pastReading(device, raw, taken)
+			reading = &past
+		}
+		backfiller.Backfill(device, *reading)
+	}
+	slog.Debug("Backfilled reading", "device", device.Name, "taken", taken, "sent", reading != nil)
+}
+
+// seen records when a device's newest reading was taken, for expiration;
+// a late reading doesn't move it back. The caller holds lastUpdateMutex.
+func (c *collector) seen(device string, taken time.Time) {
+	if taken.After(c.lastUpdateTimes[device]) {
+		c.lastUpdateTimes[device] = taken
+	}
+}
+
+// newReading turns the raw sensor values of a message into a reading,
+// including derived values and the AQI.
+func (c *collector) newReading(device *Device, raw map[string]float64, now time.Time) CGDN1Data {
+	return c.reading(device, raw, now, true)
+}
+
+// pastReading is newReading for a reading older than the device's latest.
+// It skips the filter and the rates, which follow the live readings.
+func (c *collector) pastReading(device *Device, raw map[string]float64, taken time.Time) CGDN1Data {
+	return c.reading(device, raw, taken, false)
+}
+
+func (c *collector) reading(device *Device, raw map[string]float64, now time.Time, live bool) CGDN1Data {
+	sensorData := CGDN1Data{
+		Timestamp: now,
+		Values:    make(map[string]float64, len(raw)),
+	}
+
+	// Drop known sensors the device's model doesn't have; unknown keys are
+	// kept so they show up as unmapped values
+	for key, value := range raw {
+		if _, known := sensorMetrics[key]; known && !device.reports(key) {
+			continue
+		}
+		sensorData.Values[key] = value
+	}
+	values := sensorData.Values
+	calibrate(values, device.Calibration)
+	if live {
+		c.filter.apply(device, values)
+	}
+
+	if val, ok := values["temperature"]; ok {
+		sensorData.Temperature = val
+	}
+	if val, ok := values["humidity"]; ok {
+		sensorData.Humidity = val
+	}
+	if val, ok := values["co2"]; ok {
+		sensorData.CO2 = int(val)
+	}
+	if val, ok := values["pm25"]; ok {
+		sensorData.PM25 = val
+	}
+	if val, ok := values["pm10"]; ok {
+		sensorData.PM10 = val
+	}
+	if val, ok := values["tvoc"]; ok {
+		sensorData.TVOC = val
+	}
+	if val, ok := values["battery"]; ok {
+		sensorData.Battery = int(val)
+	}
+	deriveValues(values)
+	if live {
+		c.deriveRates(device, values, now)
+	}
+	convertUnits(values)
+	if result, ok := c.config.aqi.Classify(values, c.config.Locale); ok {
+		sensorData.AQI = &result
+	}
+	return sensorData
+}
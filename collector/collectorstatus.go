@@ -0,0 +1,35 @@
+package collector
+
+import (
+	"log/slog"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Payloads of STATUS_TOPIC, the ones Home Assistant expects by default
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// setStatusWill has the broker publish offline on topic when the
+// collector goes away without disconnecting, like when it crashes or
+// loses its network.
+func setStatusWill(opts *mqtt.ClientOptions, topic string) {
+	opts.SetWill(topic, statusOffline, 1, true)
+}
+
+// publishStatus sets the collector's retained status on topic.
+func publishStatus(client mqtt.Client, topic, status string) {
+	token := client.Publish(topic, 1, true, status)
+	if !token.WaitTimeout(5 * time.Second) {
+		slog.Warn("Timed out publishing collector status", "topic", topic, "status", status)
+		return
+	}
+	if err := token.Error(); err != nil {
+		slog.Warn("Failed to publish collector status", "topic", topic, "status", status, "error", err)
+		return
+	}
+	slog.Debug("Published collector status", "topic", topic, "status", status)
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// compareWindow is the span around the same time of an earlier day whose
+// average a reading is compared with, so a single odd sample doesn't
+// dominate.
+const compareWindow = 15 * time.Minute
+
+// comparePeriods are how far back readings are compared, by metric suffix
+var comparePeriods = []struct {
+	Suffix string
+	Label  string
+	Ago    time.Duration
+}{
+	{"vs_yesterday", "the same time yesterday", 24 * time.Hour},
+	{"vs_last_week", "the same time last week", 7 * 24 * time.Hour},
+}
+
+// comparisonSink exports how far each compared sensor is from its value
+// at the same time of an earlier day, read back from the history.
+type comparisonSink struct {
+	history historyStore
+	// gauges by sensor key, one per entry in comparePeriods
+	gauges map[string][]*prometheus.GaugeVec
+}
+
+// newComparisonSink registers e.g. qingping_co2_ppm_vs_yesterday for every
+// sensor. It runs once at startup, after fields and units are set up.
+func newComparisonSink(sensors []string, history historyStore, registerer prometheus.Registerer) (*comparisonSink, error) {
+	s := &comparisonSink{history: history, gauges: make(map[string][]*prometheus.GaugeVec)}
+	for _, key := range sensors {
+		metric, ok := sensorMetrics[key]
+		if !ok {
+			return nil, fmt.Errorf("COMPARE_SENSORS: no metric for sensor %q", key)
+		}
+		if _, ok := s.gauges[key]; ok {
+			continue
+		}
+		for _, period := range comparePeriods {
+			gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: metric.Name + "_" + period.Suffix,
+				Help: fmt.Sprintf("%s minus its average at %s", metric.Help, period.Label),
+			}, []string{"device"})
+			if err := registerer.Register(gauge); err != nil {
+				return nil, fmt.Errorf("COMPARE_SENSORS: %w", err)
+			}
+			s.gauges[key] = append(s.gauges[key], gauge)
+		}
+	}
+	return s, nil
+}
+
+func (s *comparisonSink) Name() string { return "comparison" }
+
+func (s *comparisonSink) Write(device *Device, data CGDN1Data) {
+	for i, period := range comparePeriods {
+		then := data.Timestamp.Add(-period.Ago)
+		samples, err := s.history.Samples(device.Name, then.Add(-compareWindow), then.Add(compareWindow))
+		if err != nil {
+			slog.Error("Failed to read history", "sink", s.Name(), "device", device.Name, "error", err)
+			return
+		}
+
+		for key, gauges := range s.gauges {
+			value, ok := data.Values[key]
+			if !ok {
+				continue
+			}
+			var sum float64
+			var n int
+			for _, sample := range samples {
+				if v, ok := sample.Values[key]; ok {
+					sum += v
+					n++
+				}
+			}
+			// No history that far back (yet): better no series than a wrong one
+			if n == 0 {
+				gauges[i].DeleteLabelValues(device.Name)
+				continue
+			}
+			gauges[i].WithLabelValues(device.Name).Set(value - sum/float64(n))
+		}
+	}
+}
+
+func (s *comparisonSink) Forget(device *Device) {
+	for _, gauges := range s.gauges {
+		for _, gauge := range gauges {
+			gauge.DeleteLabelValues(device.Name)
+		}
+	}
+}
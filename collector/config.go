@@ -0,0 +1,661 @@
+package collector
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	MQTTBroker       string
+	MQTTPort         string
+	MQTTUsername     string
+	MQTTPassword     string
+	SigningKey       string // shared secret device messages must be signed with, if set
+	EmbeddedBroker   string // address to run a broker on, e.g. :1883
+	DeviceMAC        string // MAC address of your CGDN1
+	DeviceName       string
+	DeviceTags       []string // tags for the single DEVICE_MAC device
+	DeviceModel      string   // model of the single DEVICE_MAC device
+	DeviceBLE        bool     // read the single DEVICE_MAC device over BLE
+	BLEAdapter       string   // Bluetooth adapter BLE devices are heard on
+	DeviceCloud      bool     // read the single DEVICE_MAC device from the Qingping cloud
+	Passive          bool     // never send any device commands
+	UpdateInterval   int      // seconds between data requests (Type 12)
+	Duration         int      // how long device should keep reporting (seconds)
+	MetricsPort      string   // Prometheus metrics port
+	ConfigFile       string   // optional JSON file with devices and routes
+	DeviceNames      string   // optional JSON file mapping MACs to names, reloaded on change
+	DeviceConfig     string   // retained MQTT topic with per-device overrides, {mac} is replaced
+	AlertTopic       string   // retained MQTT topic with the state of each threshold rule
+	StatusTopic      string   // retained MQTT topic with the collector's online or offline status
+	Availability     string   // retained MQTT topic with each device's online or offline status, {device} is replaced
+	RemoteWrite      RemoteWriteConfig
+	Graphite         GraphiteConfig
+	StatsD           StatsDConfig
+	HomeAssistant    HomeAssistantConfig
+	Republish        RepublishConfig
+	Filter           FilterConfig
+	Cloud            CloudConfig
+	Reporting        ReportingConfig
+	StatusPage       bool   // serve the public /status page
+	StopOnShutdown   bool   // ask devices to wind down reporting on shutdown
+	DeviceTimestamps bool   // take readings' times from the device's clock
+	AQIStandard      string // epa, eu or china
+	Locale           string // language for human readable labels
+	LogLevel         string // debug, info, warn or error
+	LogFormat        string // text or json
+	APIToken         string // bearer token required by /api, if set
+
+	MetricNamespace string   // replaces the qingping_ prefix of metric names
+	MetricLabels    []string // name=value labels added to every series
+	SeriesIDLabel   bool     // add the series_id label to every device series
+	TemperatureUnit string   // celsius, fahrenheit or both
+	TVOCUnit        string   // ppb, mgm3 or both
+
+	RuntimeMetrics     string // default, off or extended Go runtime metrics
+	RuntimeMetricsPath string // serve runtime metrics here instead of /metrics
+	HeartbeatURL       string // pinged while the collector works, if set
+	HeartbeatInterval  time.Duration
+
+	Deadbands          []string      // sensor=deadband pairs held back before any sink
+	DeadbandMaxSilence time.Duration // longest a value goes without reaching the sinks
+
+	StaleTimeout     time.Duration // silence after which a device's metrics expire, 0 never
+	StaleMode        string        // delete or keep the metrics of a stale device
+	StartupGrace     time.Duration // time after startup in which no device goes stale or offline
+	HistoryRetention time.Duration // default retention of the history
+	HistoryDB        string        // SQLite file to keep history in, instead of memory
+	CompareSensors   []string      // sensors compared with yesterday and last week
+	RollingSensors   []string      // sensors averaged over RollingWindows
+	RollingWindows   []string      // e.g. 15m, 1h, 24h
+	DailyExtremes    bool          // export each sensor's minimum and maximum of the day
+	DailyTimezone    string        // whose midnight starts the day
+	Percentiles      []string      // sensors ranked in their own history
+	PercentileWindow time.Duration // history the rank is computed over
+	Histograms       []string      // sensors recorded into histograms, with optional buckets
+	ExposureSensors  []string      // sensors integrated over time into exposure counters
+	TriggerInterval  time.Duration // reporting interval of an on-demand reading
+	TriggerDuration  time.Duration // how long an on-demand burst lasts
+	BurstInterval    time.Duration // reporting interval while a threshold alert fires
+	BurstDuration    time.Duration // how long an alert burst lasts, 0 disables
+	RapidDownsample  time.Duration // window rapid mode readings are averaged over for Prometheus
+
+	Devices       []*Device
+	Routes        []RouteConfig
+	Notifications NotificationsConfig
+	Colocated     []ColocatedConfig
+	Thresholds    []ThresholdRule
+	Indicators    []IndicatorConfig
+	Ventilation   []VentilationConfig
+	Purifiers     []PurifierConfig
+	Settings      DeviceSettings
+	Fields        map[string]FieldConfig
+	Homes         []*HomeConfig
+	Schedules     []ScheduleConfig
+	Reports       []ReportConfig
+
+	aqi *aqiStandard
+	// provenance lists every setting with where its value came from
+	provenance []ConfigValue
+}
+
+// FileConfig is the JSON document read from CONFIG_FILE.
+type FileConfig struct {
+	Devices       []*Device           `json:"devices"`
+	Routes        []RouteConfig       `json:"routes"`
+	Notifications NotificationsConfig `json:"notifications"`
+	Colocated     []ColocatedConfig   `json:"colocated"`
+	Thresholds    []ThresholdRule     `json:"thresholds"`
+	Indicators    []IndicatorConfig   `json:"indicators"`
+	Ventilation   []VentilationConfig `json:"ventilation"`
+	Purifiers     []PurifierConfig    `json:"purifiers"`
+	// Settings are pushed to every device, merged with its own settings
+	Settings DeviceSettings `json:"settings"`
+	// Fields map extra sensorData keys to metrics
+	Fields map[string]FieldConfig `json:"fields"`
+	// Homes have their own broker, devices and labels
+	Homes []HomeConfig `json:"homes"`
+	// Schedules send commands to devices on cron schedules
+	Schedules []ScheduleConfig `json:"schedules"`
+	// Reports are rendered every week or month and stored
+	Reports []ReportConfig `json:"reports"`
+	// Naming derives the names of devices listed without one
+	Naming []NamingRule `json:"naming"`
+	// Options set settings by environment variable name, below the
+	// environment and flags
+	Options map[string]json.RawMessage `json:"options"`
+}
+
+// Duration is a time.Duration that unmarshals from strings like "24h".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"24h\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// staleAfter is how long a device may stay silent before it counts as
+// offline. It is STALE_TIMEOUT, or two reports when expiration is disabled.
+func (c Config) staleAfter() time.Duration {
+	if c.StaleTimeout > 0 {
+		return c.StaleTimeout
+	}
+	return time.Duration(2*c.UpdateInterval) * time.Second
+}
+
+// loadSettings layers the settings of the flags in args, the environment
+// and the options of the config file read by readFile. LoadConfig takes the
+// devices from the returned file; the CLI subcommands only need the
+// settings, and work without any devices configured.
+func loadSettings(args []string, readFile func(string) ([]byte, error)) (Config, FileConfig, error) {
+	var config Config
+	var file FileConfig
+	fs := flag.NewFlagSet("qingping-collector", flag.ContinueOnError)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s [flags]\n", fs.Name())
+		for _, sub := range []string{"trigger DEVICE", "gen TYPE [flags]", "corpus add|check ...", "import -device NAME FILE...", "backup [-o FILE]", "restore [-force] ARCHIVE"} {
+			fmt.Fprintf(out, "       %s %s\n", fs.Name(), sub)
+		}
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "Every flag can also be set through the environment variable shown in parentheses, or under")
+		fmt.Fprintln(out, "that name in the options of the config file. Flags win over the environment, and the")
+		fmt.Fprintln(out, "environment over the config file.")
+		fmt.Fprintln(out)
+		fs.PrintDefaults()
+	}
+
+	// settings are the options in the order they are registered, for
+	// layering and /api/config
+	type setting struct {
+		flag, env string
+		secret    bool
+	}
+	var settings []setting
+	str := func(p *string, name, env, fallback, usage string) {
+		fs.StringVar(p, name, fallback, usage+" ($"+env+")")
+		settings = append(settings, setting{flag: name, env: env})
+	}
+	num := func(p *int, name, env string, fallback int, usage string) {
+		fs.IntVar(p, name, fallback, usage+" ($"+env+")")
+		settings = append(settings, setting{flag: name, env: env})
+	}
+	float := func(p *float64, name, env string, fallback float64, usage string) {
+		fs.Float64Var(p, name, fallback, usage+" ($"+env+")")
+		settings = append(settings, setting{flag: name, env: env})
+	}
+	boolean := func(p *bool, name, env string, fallback bool, usage string) {
+		fs.BoolVar(p, name, fallback, usage+" ($"+env+")")
+		settings = append(settings, setting{flag: name, env: env})
+	}
+	// secrets have no defaults and never show in /api/config
+	secret := func(p *string, name, env, usage string) {
+		fs.StringVar(p, name, "", usage+" ($"+env+")")
+		settings = append(settings, setting{flag: name, env: env, secret: true})
+	}
+	duration := func(p *time.Duration, name, env string, fallback time.Duration, usage string) {
+		*p = fallback
+		fs.Var((*durationFlag)(p), name, usage+" ($"+env+")")
+		settings = append(settings, setting{flag: name, env: env})
+	}
+	list := func(p *[]string, name, env, usage string) {
+		fs.Var((*listFlag)(p), name, usage+" ($"+env+")")
+		settings = append(settings, setting{flag: name, env: env})
+	}
+
+	str(&config.MQTTBroker, "mqtt-broker", "MQTT_BROKER", "mosquitto", "MQTT broker host, or a comma-separated list of hosts (host or host:port) to fail over between")
+	str(&config.MQTTPort, "mqtt-port", "MQTT_PORT", "1883", "MQTT broker port")
+	str(&config.MQTTUsername, "mqtt-username", "MQTT_USERNAME", "", "MQTT username")
+	secret(&config.MQTTPassword, "mqtt-password", "MQTT_PASSWORD", "MQTT password")
+	secret(&config.SigningKey, "mqtt-signing-key", "MQTT_SIGNING_KEY", "shared secret every message on a device topic must carry an HMAC-SHA256 signature of")
+	str(&config.EmbeddedBroker, "embedded-broker", "EMBEDDED_BROKER", "", "address to run a built-in MQTT broker on, e.g. :1883, instead of connecting to -mqtt-broker")
+	str(&config.DeviceMAC, "device-mac", "DEVICE_MAC", "", "MAC address of a single device, e.g. 582D34123456")
+	str(&config.DeviceName, "device-name", "DEVICE_NAME", "living_room", "name of the -device-mac device")
+	str(&config.DeviceModel, "device-model", "DEVICE_MODEL", "cgdn1", "model of the -device-mac device: cgdn1, cgs1, cgs2 or generic")
+	list(&config.DeviceTags, "device-tags", "DEVICE_TAGS", "comma-separated tags of the -device-mac device")
+	boolean(&config.DeviceBLE, "device-ble", "DEVICE_BLE", false, "read the -device-mac device from its Bluetooth LE advertisements instead of MQTT")
+	str(&config.BLEAdapter, "ble-adapter", "BLE_ADAPTER", "hci0", "BlueZ adapter to listen for BLE advertisements on")
+	boolean(&config.DeviceCloud, "device-cloud", "DEVICE_CLOUD", false, "read the -device-mac device from the Qingping cloud API instead of MQTT")
+	str(&config.Cloud.AppKey, "qingping-app-key", "QINGPING_APP_KEY", "", "app key of the Qingping developer cloud API")
+	secret(&config.Cloud.AppSecret, "qingping-app-secret", "QINGPING_APP_SECRET", "app secret of the Qingping developer cloud API")
+	duration(&config.Cloud.Interval, "qingping-cloud-interval", "QINGPING_CLOUD_INTERVAL", 5*time.Minute, "time between polls of the Qingping cloud API")
+	boolean(&config.Passive, "passive", "PASSIVE", false, "never publish to the devices' /down topics, only listen; for devices another controller configures")
+	num(&config.UpdateInterval, "update-interval", "UPDATE_INTERVAL", 60, "seconds between device reports")
+	duration(&config.StaleTimeout, "stale-timeout", "STALE_TIMEOUT", 0, "silence after which a device's metrics are removed, 0 never (default 2x the update interval)")
+	duration(&config.StartupGrace, "startup-grace", "STARTUP_GRACE", 0, "time after startup in which no device goes stale or offline; devices still silent after it are reported offline")
+	str(&config.StaleMode, "stale-mode", "STALE_MODE", "delete", "what happens to a stale device's metrics: delete, or keep the last values and set qingping_device_up to 0")
+	num(&config.Duration, "duration", "DURATION", 21600, "seconds a device keeps reporting per request, 0 renews continuously")
+	str(&config.MetricsPort, "metrics-port", "METRICS_PORT", "9273", "port of the metrics and API server")
+	str(&config.ConfigFile, "config-file", "CONFIG_FILE", "", "JSON file with devices, routes, notifications and more")
+	str(&config.DeviceConfig, "device-config-topic", "DEVICE_CONFIG_TOPIC", "", "retained per-device config topic, e.g. qingping-collector/devices/{mac}/config")
+	str(&config.AlertTopic, "alert-topic", "ALERT_TOPIC", "", "retained topic with the state of each threshold rule, e.g. qingping-collector/alerts/{device}/{rule}")
+	str(&config.StatusTopic, "status-topic", "STATUS_TOPIC", "", "retained topic with the collector's online or offline status, e.g. qingping-collector/status")
+	str(&config.Availability, "availability-topic", "AVAILABILITY_TOPIC", "", "retained topic with each device's online or offline status, e.g. airquality/{device}/availability")
+	str(&config.DeviceNames, "device-names", "DEVICE_NAMES", "", "JSON file mapping MAC addresses to names and labels, reloaded on change")
+	boolean(&config.StopOnShutdown, "stop-on-shutdown", "STOP_ON_SHUTDOWN", false, "ask every device to stop fast reporting before shutting down")
+	boolean(&config.DeviceTimestamps, "device-timestamps", "DEVICE_TIMESTAMPS", true, "take the time of a reading from the device's timestamp when it sends one")
+	boolean(&config.StatusPage, "status-page", "STATUS_PAGE", false, "serve the public /status page")
+	str(&config.AQIStandard, "aqi-standard", "AQI_STANDARD", "epa", "AQI standard: epa, eu or china")
+	str(&config.Locale, "locale", "LOCALE", "en", "language of labels and notifications")
+	str(&config.LogLevel, "log-level", "LOG_LEVEL", "info", "log level: debug, info, warn or error")
+	str(&config.LogFormat, "log-format", "LOG_FORMAT", "text", "log format: text or json")
+	secret(&config.APIToken, "api-token", "API_TOKEN", "bearer token required by /api")
+	str(&config.MetricNamespace, "metric-namespace", "METRIC_NAMESPACE", "qingping", "prefix of metric names")
+	list(&config.MetricLabels, "metric-labels", "METRIC_LABELS", "comma-separated name=value labels added to every metric")
+	boolean(&config.SeriesIDLabel, "series-id-label", "SERIES_ID_LABEL", false, "add each device's stable series_id label to its metrics")
+	str(&config.TemperatureUnit, "metric-temperature-unit", "METRIC_TEMPERATURE_UNIT", "celsius", "exported temperature unit: celsius, fahrenheit or both")
+	str(&config.TVOCUnit, "metric-tvoc-unit", "METRIC_TVOC_UNIT", "ppb", "exported TVOC unit: ppb, mgm3 or both")
+	str(&config.RuntimeMetrics, "runtime-metrics", "RUNTIME_METRICS", "default", "Go runtime and process metrics: default, off or extended")
+	str(&config.RuntimeMetricsPath, "runtime-metrics-path", "RUNTIME_METRICS_PATH", "", "serve runtime metrics on this path instead of /metrics")
+	str(&config.HeartbeatURL, "heartbeat-url", "HEARTBEAT_URL", "", "URL pinged while connected and devices report (e.g. healthchecks.io)")
+	duration(&config.HeartbeatInterval, "heartbeat-interval", "HEARTBEAT_INTERVAL", time.Minute, "time between heartbeat pings")
+	list(&config.Deadbands, "deadbands", "DEADBANDS", "changes to hold back before any sink, e.g. temperature=0.2,humidity=1")
+	duration(&config.DeadbandMaxSilence, "deadband-max-silence", "DEADBAND_MAX_SILENCE", 15*time.Minute, "longest time a value or device goes without an update to the sinks")
+	str(&config.Filter.Mode, "filter-mode", "FILTER_MODE", "none", "smoothing of sensor values: none, median or ewma")
+	num(&config.Filter.Samples, "filter-samples", "FILTER_SAMPLES", 5, "readings the median filter is taken over")
+	float(&config.Filter.Alpha, "filter-alpha", "FILTER_ALPHA", 0.3, "weight of a new reading in the ewma filter")
+	list(&config.Filter.Sensors, "filter-sensors", "FILTER_SENSORS", "sensors smoothed by the filter (default co2,pm25,pm10,tvoc)")
+	list(&config.Filter.MaxJumps, "filter-max-jumps", "FILTER_MAX_JUMPS", "jumps to reject unless the next reading confirms them, e.g. pm25=200,co2=1500")
+	boolean(&config.Filter.Raw, "filter-raw", "FILTER_RAW", false, "also export unfiltered values as *_raw metrics")
+	duration(&config.HistoryRetention, "history-retention", "HISTORY_RETENTION", 7*24*time.Hour, "default retention of the reading history")
+	str(&config.HistoryDB, "history-db", "HISTORY_DB", "", "SQLite file persisting the history across restarts")
+	list(&config.CompareSensors, "compare-sensors", "COMPARE_SENSORS", "sensors to export compared with the same time yesterday and last week, e.g. co2,pm25")
+	list(&config.RollingSensors, "rolling-sensors", "ROLLING_SENSORS", "sensors to export rolling averages of, e.g. co2,pm25")
+	list(&config.RollingWindows, "rolling-windows", "ROLLING_WINDOWS", "windows of the rolling averages (default 15m,1h,24h)")
+	boolean(&config.DailyExtremes, "daily-extremes", "DAILY_EXTREMES", false, "export every sensor's minimum and maximum since midnight")
+	str(&config.DailyTimezone, "daily-timezone", "DAILY_TIMEZONE", "Local", "time zone whose midnight resets the daily minimum and maximum, e.g. Europe/Berlin")
+	list(&config.Percentiles, "percentile-sensors", "PERCENTILE_SENSORS", "sensors to export the percentile rank in the device's own history of, e.g. pm25,co2")
+	duration(&config.PercentileWindow, "percentile-window", "PERCENTILE_WINDOW", 30*24*time.Hour, "history the percentile rank is computed over")
+	list(&config.Histograms, "histograms", "HISTOGRAMS", "sensors to record into histograms, with optional buckets, e.g. co2=600:800:1000:1500,pm25")
+	list(&config.ExposureSensors, "exposure-sensors", "EXPOSURE_SENSORS", "sensors to integrate over time into exposure counters, e.g. co2,pm25")
+	duration(&config.TriggerInterval, "trigger-interval", "TRIGGER_INTERVAL", 5*time.Second, "reporting interval of an on-demand reading")
+	duration(&config.TriggerDuration, "trigger-duration", "TRIGGER_DURATION", 30*time.Second, "how long an on-demand reading burst lasts")
+	duration(&config.BurstInterval, "burst-interval", "BURST_INTERVAL", 10*time.Second, "reporting interval while a threshold alert fires")
+	duration(&config.BurstDuration, "burst-duration", "BURST_DURATION", 15*time.Minute, "how long an alert burst lasts, 0 disables")
+	duration(&config.RapidDownsample, "rapid-downsample", "RAPID_DOWNSAMPLE", 0, "window readings of devices in rapid mode are averaged over before Prometheus, 0 disables")
+
+	str(&config.RemoteWrite.URL, "remote-write-url", "REMOTE_WRITE_URL", "", "Prometheus remote_write endpoint")
+	str(&config.RemoteWrite.Username, "remote-write-username", "REMOTE_WRITE_USERNAME", "", "remote_write basic auth user")
+	secret(&config.RemoteWrite.Password, "remote-write-password", "REMOTE_WRITE_PASSWORD", "remote_write basic auth password")
+	secret(&config.RemoteWrite.BearerToken, "remote-write-bearer-token", "REMOTE_WRITE_BEARER_TOKEN", "remote_write bearer token")
+	num(&config.RemoteWrite.BatchSize, "remote-write-batch-size", "REMOTE_WRITE_BATCH_SIZE", 500, "samples per remote_write request")
+	duration(&config.RemoteWrite.FlushInterval, "remote-write-flush-interval", "REMOTE_WRITE_FLUSH_INTERVAL", 15*time.Second, "longest time samples wait before being pushed")
+
+	str(&config.Graphite.Address, "graphite-address", "GRAPHITE_ADDRESS", "", "host:port of Graphite/Carbon, e.g. graphite:2003")
+	str(&config.Graphite.Protocol, "graphite-protocol", "GRAPHITE_PROTOCOL", "plaintext", "Graphite protocol: plaintext or pickle")
+	str(&config.Graphite.Prefix, "graphite-prefix", "GRAPHITE_PREFIX", "qingping", "prefix of Graphite metric paths")
+	duration(&config.Graphite.FlushInterval, "graphite-flush-interval", "GRAPHITE_FLUSH_INTERVAL", 15*time.Second, "time between sends to Graphite")
+
+	str(&config.StatsD.Address, "statsd-address", "STATSD_ADDRESS", "", "host:port of a StatsD server, e.g. localhost:8125")
+	str(&config.StatsD.Prefix, "statsd-prefix", "STATSD_PREFIX", "qingping", "prefix of StatsD metric names")
+	str(&config.StatsD.Tags, "statsd-tags", "STATSD_TAGS", "dogstatsd", "StatsD tag format: dogstatsd or none (device in the name)")
+
+	str(&config.Reporting.Timezone, "report-timezone", "REPORT_TIMEZONE", "Local", "time zone whose midnight starts the weeks and months of reports, e.g. Europe/Berlin")
+	str(&config.Reporting.S3Endpoint, "report-s3-endpoint", "REPORT_S3_ENDPOINT", "", "endpoint of S3 compatible storage for reports (default AWS)")
+	str(&config.Reporting.S3Region, "report-s3-region", "REPORT_S3_REGION", "us-east-1", "S3 region of reports")
+	str(&config.Reporting.S3AccessKey, "report-s3-access-key", "REPORT_S3_ACCESS_KEY", "", "S3 access key of reports")
+	secret(&config.Reporting.S3SecretKey, "report-s3-secret-key", "REPORT_S3_SECRET_KEY", "S3 secret key of reports")
+	str(&config.Reporting.WebDAVUsername, "report-webdav-username", "REPORT_WEBDAV_USERNAME", "", "WebDAV basic auth user of reports")
+	secret(&config.Reporting.WebDAVPassword, "report-webdav-password", "REPORT_WEBDAV_PASSWORD", "WebDAV basic auth password of reports")
+
+	boolean(&config.HomeAssistant.Enabled, "ha-discovery", "HA_DISCOVERY", false, "publish Home Assistant MQTT discovery")
+	str(&config.HomeAssistant.DiscoveryPrefix, "ha-discovery-prefix", "HA_DISCOVERY_PREFIX", "homeassistant", "Home Assistant discovery prefix")
+	str(&config.HomeAssistant.StatePrefix, "ha-state-prefix", "HA_STATE_PREFIX", "qingping-collector", "topic prefix of published device state")
+
+	str(&config.Republish.Topic, "republish-topic", "REPUBLISH_TOPIC", "", "publish normalized readings here, e.g. airquality/{device}/state")
+	num(&config.Republish.QoS, "republish-qos", "REPUBLISH_QOS", 0, "QoS of republished readings")
+	boolean(&config.Republish.Retain, "republish-retain", "REPUBLISH_RETAIN", false, "retain republished readings")
+	boolean(&config.Republish.Delta, "republish-delta", "REPUBLISH_DELTA", false, "republish only changed values, for metered uplinks")
+	list(&config.Republish.Deadbands, "republish-deadbands", "REPUBLISH_DEADBANDS", "changes to ignore in delta mode, e.g. temperature=0.2,co2=20")
+	duration(&config.Republish.FullSync, "republish-full-sync", "REPUBLISH_FULL_SYNC", time.Hour, "time between full readings in delta mode")
+	str(&config.Republish.AckTopic, "republish-ack-topic", "REPUBLISH_ACK_TOPIC", "", "topic consumers confirm republished readings on, e.g. airquality/ack")
+	list(&config.Republish.AckConsumers, "republish-ack-consumers", "REPUBLISH_ACK_CONSUMERS", "consumers expected to confirm every republished reading")
+	duration(&config.Republish.AckTimeout, "republish-ack-timeout", "REPUBLISH_ACK_TIMEOUT", 30*time.Second, "time a consumer has to confirm a republished reading")
+
+	if err := fs.Parse(args); err != nil {
+		return config, file, err
+	}
+
+	// Every setting takes its value from the first of flags, the
+	// environment, the options of CONFIG_FILE and its default. The config
+	// file itself can only be named by a flag or the environment.
+	sources := make(map[string]string, len(settings))
+	fs.Visit(func(f *flag.Flag) { sources[f.Name] = sourceFlag })
+	if value, ok := os.LookupEnv("CONFIG_FILE"); ok && sources["config-file"] == "" {
+		config.ConfigFile = value
+		sources["config-file"] = sourceEnv
+	}
+	if config.ConfigFile != "" {
+		data, err := readFile(config.ConfigFile)
+		if err != nil {
+			return config, file, fmt.Errorf("read config file: %w", err)
+		}
+		if err := json.Unmarshal(data, &file); err != nil {
+			return config, file, fmt.Errorf("parse config file %s: %w", config.ConfigFile, err)
+		}
+	}
+	known := make(map[string]bool, len(settings))
+	for _, s := range settings {
+		known[s.env] = true
+		if sources[s.flag] != "" {
+			continue
+		}
+		// Invalid values in the environment are ignored
+		if value, ok := os.LookupEnv(s.env); ok && fs.Set(s.flag, value) == nil {
+			sources[s.flag] = sourceEnv
+			continue
+		}
+		if raw, ok := file.Options[s.env]; ok {
+			value, err := optionText(raw)
+			if err != nil {
+				return config, file, fmt.Errorf("config file option %s: %w", s.env, err)
+			}
+			if err := fs.Set(s.flag, value); err != nil {
+				return config, file, fmt.Errorf("config file option %s: invalid value %q: %w", s.env, value, err)
+			}
+			sources[s.flag] = sourceFile
+			continue
+		}
+		sources[s.flag] = sourceDefault
+	}
+	for name := range file.Options {
+		if !known[name] || name == "CONFIG_FILE" {
+			return config, file, fmt.Errorf("config file option %s: no such setting", name)
+		}
+	}
+
+	// Devices are polled and renewed on a ticker of this interval
+	if config.UpdateInterval <= 0 {
+		return config, file, fmt.Errorf("UPDATE_INTERVAL must be positive")
+	}
+	// Without an explicit STALE_TIMEOUT metrics expire after two missed reports
+	if sources["stale-timeout"] == sourceDefault {
+		config.StaleTimeout = time.Duration(2*config.UpdateInterval) * time.Second
+	}
+	if config.StaleTimeout < 0 {
+		return config, file, fmt.Errorf("STALE_TIMEOUT must be 0 (never) or positive")
+	}
+	if config.EmbeddedBroker != "" {
+		host, port, err := embeddedBrokerClient(config.EmbeddedBroker)
+		if err != nil {
+			return config, file, err
+		}
+		// The collector is a client of its own broker
+		config.MQTTBroker, config.MQTTPort = host, port
+	}
+	if config.StartupGrace < 0 {
+		return config, file, fmt.Errorf("STARTUP_GRACE must be 0 (none) or positive")
+	}
+	if config.StaleMode != "delete" && config.StaleMode != "keep" {
+		return config, file, fmt.Errorf("STALE_MODE must be delete or keep, got %q", config.StaleMode)
+	}
+	if config.Duration < 0 {
+		return config, file, fmt.Errorf("DURATION must be 0 (continuous) or positive")
+	}
+	if config.Availability != "" && !strings.Contains(config.Availability, "{device}") && !strings.Contains(config.Availability, "{mac}") {
+		return config, file, fmt.Errorf("AVAILABILITY_TOPIC must contain {device} or {mac}")
+	}
+	if config.HeartbeatURL != "" && config.HeartbeatInterval <= 0 {
+		return config, file, fmt.Errorf("HEARTBEAT_INTERVAL must be positive")
+	}
+	if config.SigningKey != "" && len(config.SigningKey) < minSigningKeyLen {
+		return config, file, fmt.Errorf("MQTT_SIGNING_KEY must be at least %d characters", minSigningKeyLen)
+	}
+	if config.Cloud.Interval <= 0 {
+		return config, file, fmt.Errorf("QINGPING_CLOUD_INTERVAL must be positive")
+	}
+	if fs.NArg() > 0 {
+		return config, file, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	for _, s := range settings {
+		value := fs.Lookup(s.flag).Value.String()
+		if s.secret && value != "" {
+			value = secretSet
+		}
+		config.provenance = append(config.provenance, ConfigValue{
+			Name:    s.env,
+			Flag:    s.flag,
+			Value:   value,
+			Source:  sources[s.flag],
+			Runtime: runtimeSettings[s.env],
+		})
+	}
+
+	aqi, err := lookupAQIStandard(config.AQIStandard)
+	if err != nil {
+		return config, file, err
+	}
+	config.aqi = aqi
+
+	return config, file, nil
+}
+
+// LoadConfig reads the configuration from command-line flags. Every flag
+// defaults to its environment variable, so flags win over the environment
+// and the environment over built-in defaults.
+func LoadConfig(args []string) (Config, error) {
+	config, file, err := loadSettings(args, os.ReadFile)
+	if err != nil {
+		return config, err
+	}
+
+	var naming []NamingRule
+	if config.ConfigFile != "" {
+		config.Devices = file.Devices
+		config.Routes = file.Routes
+		config.Notifications = file.Notifications
+		config.Colocated = file.Colocated
+		config.Thresholds = file.Thresholds
+		config.Indicators = file.Indicators
+		config.Ventilation = file.Ventilation
+		config.Purifiers = file.Purifiers
+		config.Settings = file.Settings
+		config.Schedules = file.Schedules
+		config.Reports = file.Reports
+		config.Fields = file.Fields
+		if err := config.addHomes(file.Homes); err != nil {
+			return config, err
+		}
+		naming = file.Naming
+	}
+
+	// DEVICE_MAC keeps working on its own and can be combined with the file
+	if config.DeviceMAC != "" {
+		config.Devices = append(config.Devices, &Device{
+			MAC:   config.DeviceMAC,
+			Name:  config.DeviceName,
+			Tags:  config.DeviceTags,
+			Model: config.DeviceModel,
+			BLE:   config.DeviceBLE,
+			Cloud: config.DeviceCloud,
+		})
+	}
+
+	if err := applyNamingRules(config.Devices, naming); err != nil {
+		return config, err
+	}
+
+	if len(config.Devices) == 0 {
+		return config, fmt.Errorf("DEVICE_MAC (-device-mac) or devices or homes in CONFIG_FILE is required")
+	}
+
+	if config.DeviceNames != "" {
+		names, err := loadDeviceNames(config.DeviceNames)
+		if err != nil {
+			return config, fmt.Errorf("device names: %w", err)
+		}
+		if err := applyDeviceNames(config.Devices, names); err != nil {
+			return config, fmt.Errorf("device names: %w", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, device := range config.Devices {
+		switch {
+		case device.foreign():
+			if device.MAC != "" {
+				return config, fmt.Errorf("device %q has both mac and topic", device.Name)
+			}
+			if device.Name == "" || len(device.Fields) == 0 {
+				return config, fmt.Errorf("device on topic %q needs a name and fields", device.Topic)
+			}
+			if device.Model == "" {
+				device.Model = "generic"
+			}
+		case device.MAC == "":
+			return config, fmt.Errorf("device %q has no mac or topic", device.Name)
+		case device.Name == "":
+			device.Name = device.MAC
+		}
+		if seen[device.Name] {
+			return config, fmt.Errorf("duplicate device name %q", device.Name)
+		}
+		seen[device.Name] = true
+
+		if device.BLE && device.foreign() {
+			return config, fmt.Errorf("device %q: only devices with a mac can be read over BLE", device.Name)
+		}
+		if device.Cloud && device.foreign() {
+			return config, fmt.Errorf("device %q: only devices with a mac can be read from the cloud", device.Name)
+		}
+		if device.Cloud && device.BLE {
+			return config, fmt.Errorf("device %q: can't be read both over BLE and from the cloud", device.Name)
+		}
+		if device.Cloud && (config.Cloud.AppKey == "" || config.Cloud.AppSecret == "") {
+			return config, fmt.Errorf("device %q: QINGPING_APP_KEY and QINGPING_APP_SECRET are required to read from the cloud", device.Name)
+		}
+		if len(device.Replaces) > 0 && device.foreign() {
+			return config, fmt.Errorf("device %q: only devices with a mac can replace others", device.Name)
+		}
+		for i, mac := range device.Replaces {
+			device.Replaces[i] = normalizeMAC(mac)
+			if device.Replaces[i] == normalizeMAC(device.MAC) {
+				return config, fmt.Errorf("device %q replaces its own mac", device.Name)
+			}
+		}
+
+		if device.Model, err = lookupModel(device.Model); err != nil {
+			return config, fmt.Errorf("device %q: %w", device.Name, err)
+		}
+
+		for name := range device.Labels {
+			if !validLabelName(name) || name == "device" {
+				return config, fmt.Errorf("device %q: invalid label name %q", device.Name, name)
+			}
+		}
+		if err := validateCalibration(device, device.Calibration); err != nil {
+			return config, fmt.Errorf("device %q: %w", device.Name, err)
+		}
+		if device.Location != nil {
+			if err := device.Location.validate(); err != nil {
+				return config, fmt.Errorf("device %q: %w", device.Name, err)
+			}
+		}
+		placeDevice(device)
+		device.Passive = device.Passive || config.Passive
+		if device.Rapid != 0 {
+			if rapid := time.Duration(device.Rapid); rapid < time.Second || rapid >= rapidMaxInterval {
+				return config, fmt.Errorf("device %q: rapid must be at least 1s and under %v, got %v", device.Name, rapidMaxInterval, rapid)
+			}
+			if !device.commandable() {
+				return config, fmt.Errorf("device %q: rapid mode needs a device that can be sent commands", device.Name)
+			}
+		}
+		for i := range device.Schedules {
+			if len(device.Schedules[i].Tags) > 0 {
+				return config, fmt.Errorf("device %q schedule %d: tags only apply to the config file's schedules", device.Name, i)
+			}
+			if err := device.Schedules[i].validate(); err != nil {
+				return config, fmt.Errorf("device %q schedule %d: %w", device.Name, i, err)
+			}
+		}
+
+		device.Settings = config.Settings.merge(device.Settings)
+		if err := device.Settings.validate(); err != nil {
+			return config, fmt.Errorf("device %q settings: %w", device.Name, err)
+		}
+	}
+	if err := checkReplacements(config.Devices); err != nil {
+		return config, err
+	}
+	if err := normalizeReports(config.Reports); err != nil {
+		return config, err
+	}
+	for i := range config.Schedules {
+		if err := config.Schedules[i].validate(); err != nil {
+			return config, fmt.Errorf("schedule %d: %w", i, err)
+		}
+	}
+
+	return config, nil
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// parseDuration parses values like "168h"; bare numbers are seconds.
+func parseDuration(value string) (time.Duration, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, nil
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return 0, fmt.Errorf("invalid duration %q", value)
+}
+
+// durationFlag is a duration flag that also takes bare seconds, like the
+// environment always did
+type durationFlag time.Duration
+
+func (d *durationFlag) String() string { return time.Duration(*d).String() }
+
+func (d *durationFlag) Set(value string) error {
+	parsed, err := parseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = durationFlag(parsed)
+	return nil
+}
+
+// listFlag is a comma-separated list flag
+type listFlag []string
+
+func (l *listFlag) String() string { return strings.Join(*l, ",") }
+
+func (l *listFlag) Set(value string) error {
+	*l = splitList(value)
+	return nil
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,192 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Sources of a setting's value, from the lowest priority to the highest
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+	sourceAPI     = "api"
+)
+
+// secretSet stands in for the value of a secret that is set
+const secretSet = "(set)"
+
+// runtimeSettings can be changed through /api/config while the collector
+// runs; everything else is wired at startup
+var runtimeSettings = map[string]bool{
+	"LOG_LEVEL":  true,
+	"LOG_FORMAT": true,
+}
+
+// ConfigValue is the effective value of a setting and where it came from
+type ConfigValue struct {
+	Name    string `json:"name"` // environment variable
+	Flag    string `json:"flag"`
+	Value   string `json:"value"`
+	Source  string `json:"source"`            // default, file, env, flag or api
+	Runtime bool   `json:"runtime,omitempty"` // can be changed through the API
+}
+
+// optionText turns a value under options in the config file into the text
+// the setting's flag takes: strings as they are, numbers and booleans as
+// written and lists of strings joined by commas.
+func optionText(raw json.RawMessage) (string, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text, nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return strings.Join(list, ","), nil
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] == '{' || raw[0] == '[' || string(raw) == "null" {
+		return "", fmt.Errorf("want a string, number, boolean or list of strings")
+	}
+	return string(raw), nil
+}
+
+// configValues are the settings of a running collector, with the changes
+// made through the API on top of what it was started or reloaded with.
+type configValues struct {
+	mu        sync.Mutex
+	loaded    []ConfigValue
+	overrides map[string]string // by name
+}
+
+func newConfigValues(config Config) *configValues {
+	return &configValues{loaded: config.provenance, overrides: make(map[string]string)}
+}
+
+// effective returns every setting with the API's changes applied.
+func (v *configValues) effective() []ConfigValue {
+	values := make([]ConfigValue, len(v.loaded))
+	for i, value := range v.loaded {
+		if override, ok := v.overrides[value.Name]; ok {
+			value.Value, value.Source = override, sourceAPI
+		}
+		values[i] = value
+	}
+	return values
+}
+
+func (v *configValues) value(name string) string {
+	if override, ok := v.overrides[name]; ok {
+		return override
+	}
+	for _, value := range v.loaded {
+		if value.Name == name {
+			return value.Value
+		}
+	}
+	return ""
+}
+
+// apply puts the runtime settings into effect. The caller holds mu.
+func (v *configValues) apply() error {
+	return SetupLogging(v.value("LOG_LEVEL"), v.value("LOG_FORMAT"))
+}
+
+// reload takes the settings of a reloaded config, keeping the API's
+// changes on top.
+func (v *configValues) reload(config Config) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.loaded = config.provenance
+	return v.apply()
+}
+
+// set changes a runtime setting, or reverts it to its loaded value with
+// revert. Values that don't apply are refused and leave it as it was.
+func (v *configValues) set(name, value string, revert bool) error {
+	if !runtimeSettings[name] {
+		return fmt.Errorf("%s can't be changed while running", name)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	previous, overridden := v.overrides[name]
+	if revert {
+		delete(v.overrides, name)
+	} else {
+		v.overrides[name] = value
+	}
+	err := v.apply()
+	if err != nil {
+		if overridden {
+			v.overrides[name] = previous
+		} else {
+			delete(v.overrides, name)
+		}
+		v.apply()
+	}
+	return err
+}
+
+func (v *configValues) lookup(name string) (ConfigValue, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, value := range v.effective() {
+		if value.Name == name {
+			return value, true
+		}
+	}
+	return ConfigValue{}, false
+}
+
+// handleList serves GET /api/config with every setting's effective value
+// and source.
+func (v *configValues) handleList(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	values := v.effective()
+	v.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"settings": values})
+}
+
+// handleSet serves PUT /api/config/{name}, changing a runtime setting to
+// {"value": "..."} until the collector restarts.
+func (v *configValues) handleSet(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := v.lookup(name); !ok {
+		writeError(w, http.StatusNotFound, "unknown setting")
+		return
+	}
+	var req struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Value == nil {
+		writeError(w, http.StatusBadRequest, `body must be {"value": "..."}`)
+		return
+	}
+	if err := v.set(name, *req.Value, false); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	value, _ := v.lookup(name)
+	writeJSON(w, http.StatusOK, value)
+}
+
+// handleReset serves DELETE /api/config/{name}, reverting a setting
+// changed through the API.
+func (v *configValues) handleReset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := v.lookup(name); !ok {
+		writeError(w, http.StatusNotFound, "unknown setting")
+		return
+	}
+	if err := v.set(name, "", true); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	value, _ := v.lookup(name)
+	writeJSON(w, http.StatusOK, value)
+}
@@ -0,0 +1,336 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// corpusVersion is bumped when the case format changes
+const corpusVersion = 1
+
+// corpusEpoch is the reading time of the first message of every case, so
+// golden files don't depend on when they were generated.
+var corpusEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// corpusCase is a recorded exchange with a device, stored as NAME.json
+// next to its expected series in NAME.golden.
+type corpusCase struct {
+	Version  int             `json:"version"`
+	Model    string          `json:"model"`
+	Messages []corpusMessage `json:"messages"`
+}
+
+type corpusMessage struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	// Hex is set when the payload was binary and is stored hex encoded
+	Hex bool `json:"hex,omitempty"`
+}
+
+var upTopicPattern = regexp.MustCompile(`^qingping/([0-9A-Fa-f]{12})/up$`)
+
+func runCorpus(args []string) error {
+	usage := fmt.Errorf("usage: %s corpus add [-dir DIR] [-model MODEL] NAME CAPTURE\n       %s corpus check [-dir DIR] [-update]", os.Args[0], os.Args[0])
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "add":
+		return runCorpusAdd(args[1:])
+	case "check":
+		return runCorpusCheck(args[1:])
+	}
+	return usage
+}
+
+// runCorpusAdd turns a capture of `mosquitto_sub -v -t 'qingping/+/up'`
+// (one "topic payload" per line) into a corpus case with anonymized MACs.
+func runCorpusAdd(args []string) error {
+	fs := flag.NewFlagSet("corpus add", flag.ContinueOnError)
+	dir := fs.String("dir", "collector/testdata/corpus", "corpus directory")
+	model := fs.String("model", "cgdn1", "model of the recorded device")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("corpus add needs NAME and CAPTURE")
+	}
+	name, capture := fs.Arg(0), fs.Arg(1)
+	if _, err := lookupModel(*model); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(capture)
+	if err != nil {
+		return err
+	}
+	messages, err := parseCapture(data)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("no /up messages in %s", capture)
+	}
+
+	out, err := json.MarshalIndent(corpusCase{Version: corpusVersion, Model: *model, Messages: messages}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(*dir, name+".json")
+	if err := os.WriteFile(path, append(out, '\n'), 0o644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s with %d messages; run \"corpus check -update\" to create its golden file\n", path, len(messages))
+	return nil
+}
+
+// parseCapture keeps the /up messages of a capture, replacing every MAC
+// with a stable placeholder in topics and payloads.
+func parseCapture(data []byte) ([]corpusMessage, error) {
+	macs := make(map[string]string)
+	var messages []corpusMessage
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		topic, payload, ok := strings.Cut(scanner.Text(), " ")
+		match := upTopicPattern.FindStringSubmatch(topic)
+		if !ok || match == nil {
+			continue
+		}
+		mac := strings.ToUpper(match[1])
+		if _, seen := macs[mac]; !seen {
+			macs[mac] = fmt.Sprintf("000000%06X", len(macs)+1)
+		}
+
+		message := corpusMessage{Topic: "qingping/" + macs[mac] + "/up", Payload: payload}
+		if !utf8.ValidString(payload) {
+			message.Payload, message.Hex = hex.EncodeToString([]byte(payload)), true
+		}
+		messages = append(messages, message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		for mac, anon := range macs {
+			for _, form := range []string{mac, strings.ToLower(mac)} {
+				messages[i].Payload = strings.ReplaceAll(messages[i].Payload, form, anon)
+			}
+		}
+	}
+	return messages, nil
+}
+
+// runCorpusCheck runs every case through the parse and metric pipeline and
+// compares the resulting series with the golden files.
+func runCorpusCheck(args []string) error {
+	fs := flag.NewFlagSet("corpus check", flag.ContinueOnError)
+	dir := fs.String("dir", "collector/testdata/corpus", "corpus directory")
+	update := fs.Bool("update", false, "rewrite golden files instead of comparing")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(*dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no cases in %s", *dir)
+	}
+
+	var failed []string
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		got, err := replayCase(name, path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		golden := strings.TrimSuffix(path, ".json") + ".golden"
+		if *update {
+			if err := os.WriteFile(golden, got, 0o644); err != nil {
+				return err
+			}
+			fmt.Printf("updated %s\n", golden)
+			continue
+		}
+
+		want, err := os.ReadFile(golden)
+		if err != nil {
+			return fmt.Errorf("%s: %w (run with -update to create it)", name, err)
+		}
+		if diff := diffLines(string(want), string(got)); diff != "" {
+			fmt.Printf("--- %s\n%s", name, diff)
+			failed = append(failed, name)
+			continue
+		}
+		fmt.Printf("ok  %s\n", name)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d cases differ from their golden files", len(failed), len(paths))
+	}
+	return nil
+}
+
+// replayCase feeds a case through decoding, reading and the Prometheus
+// sink and returns the device's series after every message.
+func replayCase(name, path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cc corpusCase
+	if err := json.Unmarshal(data, &cc); err != nil {
+		return nil, err
+	}
+	if cc.Version != corpusVersion {
+		return nil, fmt.Errorf("case version %d, want %d", cc.Version, corpusVersion)
+	}
+	model, err := lookupModel(cc.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := newRegistry()
+	if err != nil {
+		return nil, err
+	}
+	aqi, _ := lookupAQIStandard("epa")
+	c := &collector{config: Config{aqi: aqi, Locale: "en"}}
+	device := &Device{Name: "corpus_" + name, Model: model}
+	sink := prometheusSink{}
+	defer sink.Forget(device)
+
+	var out bytes.Buffer
+	for i, message := range cc.Messages {
+		payload := []byte(message.Payload)
+		if message.Hex {
+			if payload, err = hex.DecodeString(message.Payload); err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+		}
+
+		fmt.Fprintf(&out, "# message %d\n", i)
+		msgType, entries, err := decodeUpMessage(payload)
+		if err != nil {
+			fmt.Fprintf(&out, "error: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(&out, "type: %s\n", msgType)
+		if isConfigResponse(msgType) || len(entries) == 0 {
+			continue
+		}
+
+		// Like live messages, only the newest reading reaches the gauges
+		raw := entries[len(entries)-1]
+		taken := readingTime(device, raw, corpusEpoch.Add(time.Duration(i)*time.Minute), false)
+		sink.Write(device, c.newReading(device, raw, taken))
+		series, err := deviceSeries(registry, device.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range series {
+			fmt.Fprintln(&out, line)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// deviceSeries renders the device's qingping_* series, one
+// "name{labels} value" per line.
+func deviceSeries(gatherer prometheus.Gatherer, device string) ([]string, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, family := range families {
+		name := family.GetName()
+		if !strings.HasPrefix(name, "qingping_") || strings.HasPrefix(name, "qingping_collector_") {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			ours := false
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "device" {
+					ours = label.GetValue() == device
+					continue
+				}
+				labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+			}
+			if !ours || metric.GetGauge() == nil {
+				continue
+			}
+			value := strconv.FormatFloat(metric.GetGauge().GetValue(), 'g', -1, 64)
+			series := name
+			if len(labels) > 0 {
+				series += "{" + strings.Join(labels, ",") + "}"
+			}
+			lines = append(lines, series+" "+value)
+		}
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// diffLines lists lines only in want (-) or only in got (+), in order.
+func diffLines(want, got string) string {
+	if want == got {
+		return ""
+	}
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+
+	// Longest common subsequence, good enough for files of this size
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i, j = i+1, j+1
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(&diff, "+ %s\n", b[j])
+			j++
+		default:
+			fmt.Fprintf(&diff, "- %s\n", a[i])
+			i++
+		}
+	}
+	return diff.String()
+}
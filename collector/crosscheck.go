@@ -0,0 +1,132 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ColocatedConfig declares devices that sit next to each other and should
+// read the same values within the given bands.
+type ColocatedConfig struct {
+	Devices []string           `json:"devices"`
+	Bands   map[string]float64 `json:"bands"` // sensor -> allowed absolute deviation
+}
+
+// crossCheckSink compares the latest readings of co-located devices,
+// exports their pairwise deviation and notifies when a pair diverges
+// beyond its band and when it converges again.
+type crossCheckSink struct {
+	groups   []ColocatedConfig
+	notifier *notifier
+	// device looks a device up by name; the collector swaps in updated
+	// devices on reload
+	device func(name string) *Device
+	// maxAge is how old a peer's reading may be to still be compared
+	maxAge time.Duration
+
+	mu       sync.Mutex
+	latest   map[string]CGDN1Data
+	diverged map[string]bool // "device|peer|sensor"
+}
+
+func newCrossCheckSink(groups []ColocatedConfig, devices []*Device, notifier *notifier, maxAge time.Duration) (*crossCheckSink, error) {
+	byName := make(map[string]*Device, len(devices))
+	for _, device := range devices {
+		byName[device.Name] = device
+	}
+	for i, group := range groups {
+		if len(group.Devices) < 2 {
+			return nil, fmt.Errorf("colocated group %d needs at least two devices", i)
+		}
+		for _, name := range group.Devices {
+			if byName[name] == nil {
+				return nil, fmt.Errorf("colocated group %d references unknown device %q", i, name)
+			}
+		}
+	}
+
+	return &crossCheckSink{
+		groups:   groups,
+		notifier: notifier,
+		device:   func(name string) *Device { return byName[name] },
+		maxAge:   maxAge,
+		latest:   make(map[string]CGDN1Data),
+		diverged: make(map[string]bool),
+	}, nil
+}
+
+func (s *crossCheckSink) Name() string { return "crosscheck" }
+
+func (s *crossCheckSink) Write(device *Device, data CGDN1Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latest[device.Name] = data
+
+	for _, group := range s.groups {
+		for i, a := range group.Devices {
+			for _, b := range group.Devices[i+1:] {
+				if a == device.Name || b == device.Name {
+					s.compare(a, b, group.Bands)
+				}
+			}
+		}
+	}
+}
+
+// compare checks one pair; a is always the device listed first in the
+// group, so metrics and notifications are stable regardless of which
+// device reported last. Notifications follow a's routing.
+func (s *crossCheckSink) compare(a, b string, bands map[string]float64) {
+	readingA, okA := s.latest[a]
+	readingB, okB := s.latest[b]
+	if !okA || !okB {
+		return
+	}
+	if gap := readingA.Timestamp.Sub(readingB.Timestamp).Abs(); gap > s.maxAge {
+		return
+	}
+
+	for sensor, band := range bands {
+		valueA, okA := readingA.Values[sensor]
+		valueB, okB := readingB.Values[sensor]
+		if !okA || !okB {
+			continue
+		}
+
+		deviation := valueA - valueB
+		colocatedDeviation.WithLabelValues(a, b, sensor).Set(deviation)
+
+		key := a + "|" + b + "|" + sensor
+		diverged := math.Abs(deviation) > band
+		if diverged {
+			colocatedDiverged.WithLabelValues(a, b, sensor).Set(1)
+		} else {
+			colocatedDiverged.WithLabelValues(a, b, sensor).Set(0)
+		}
+
+		if diverged == s.diverged[key] {
+			continue
+		}
+		s.diverged[key] = diverged
+
+		event := EventConverged
+		if diverged {
+			event = EventDiverged
+		}
+		device := s.device(a)
+		if device == nil {
+			continue
+		}
+		s.notifier.Notify(device, Notification{
+			Event:     event,
+			Peer:      b,
+			Sensor:    sensor,
+			Value:     deviation,
+			Threshold: band,
+			Reading:   readingA,
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dailySink tracks the lowest and highest value of every sensor since the
+// last local midnight, e.g. qingping_co2_ppm_daily_max.
+type dailySink struct {
+	location *time.Location
+	history  historyStore
+	// gauges by sensor key: minimum and maximum
+	gauges map[string][2]*prometheus.GaugeVec
+
+	mu     sync.Mutex
+	states map[string]*dailyState // by device name
+}
+
+// dailyState is a device's extremes since day began
+type dailyState struct {
+	day      time.Time
+	min, max map[string]float64
+}
+
+func newDailyState(day time.Time) *dailyState {
+	return &dailyState{day: day, min: make(map[string]float64), max: make(map[string]float64)}
+}
+
+func (d *dailyState) add(key string, value float64) {
+	if low, ok := d.min[key]; !ok || value < low {
+		d.min[key] = value
+	}
+	if high, ok := d.max[key]; !ok || value > high {
+		d.max[key] = value
+	}
+}
+
+// newDailySink registers a minimum and maximum gauge per exported sensor.
+// It runs once at startup, after fields and units are set up.
+func newDailySink(timezone string, history historyStore, registerer prometheus.Registerer) (*dailySink, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("DAILY_TIMEZONE: %w", err)
+	}
+	s := &dailySink{
+		location: location,
+		history:  history,
+		gauges:   make(map[string][2]*prometheus.GaugeVec),
+		states:   make(map[string]*dailyState),
+	}
+	for key, metric := range sensorMetrics {
+		if !exported(key) {
+			continue
+		}
+		var gauges [2]*prometheus.GaugeVec
+		for i, extreme := range [2][2]string{{"min", "lowest"}, {"max", "highest"}} {
+			gauges[i] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: metric.Name + "_daily_" + extreme[0],
+				Help: fmt.Sprintf("%s, %s since midnight", metric.Help, extreme[1]),
+			}, []string{"device"})
+			if err := registerer.Register(gauges[i]); err != nil {
+				return nil, err
+			}
+		}
+		s.gauges[key] = gauges
+	}
+	return s, nil
+}
+
+func (s *dailySink) Name() string { return "daily" }
+
+// midnight is the start of the local day t falls on.
+func (s *dailySink) midnight(t time.Time) time.Time {
+	year, month, day := t.In(s.location).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, s.location)
+}
+
+func (s *dailySink) Write(device *Device, data CGDN1Data) {
+	day := s.midnight(data.Timestamp)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := s.states[device.Name]
+	switch {
+	case state == nil:
+		// Pick up where the day left off before a restart
+		state = s.load(device, day, data.Timestamp)
+		s.states[device.Name] = state
+	case !state.day.Equal(day):
+		state = newDailyState(day)
+		s.states[device.Name] = state
+	}
+
+	for key, gauges := range s.gauges {
+		value, ok := data.Values[key]
+		if !ok {
+			continue
+		}
+		state.add(key, value)
+		gauges[0].WithLabelValues(device.Name).Set(state.min[key])
+		gauges[1].WithLabelValues(device.Name).Set(state.max[key])
+	}
+}
+
+// load returns the extremes of a device's stored readings in [day, until).
+func (s *dailySink) load(device *Device, day, until time.Time) *dailyState {
+	state := newDailyState(day)
+	samples, err := s.history.Samples(device.Name, day, until)
+	if err != nil {
+		slog.Error("Failed to read history", "sink", s.Name(), "device", device.Name, "error", err)
+		return state
+	}
+	for _, sample := range samples {
+		if !sample.Time.Before(until) {
+			continue
+		}
+		for key := range s.gauges {
+			if value, ok := sample.Values[key]; ok {
+				state.add(key, value)
+			}
+		}
+	}
+	return state
+}
+
+// Forget removes a silent device's gauges. Its extremes are read back
+// from the history once it reports again.
+func (s *dailySink) Forget(device *Device) {
+	s.mu.Lock()
+	delete(s.states, device.Name)
+	s.mu.Unlock()
+	for _, gauges := range s.gauges {
+		gauges[0].DeleteLabelValues(device.Name)
+		gauges[1].DeleteLabelValues(device.Name)
+	}
+}
@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseDeadbands parses sensor=deadband pairs, e.g. temperature=0.2.
+func parseDeadbands(pairs []string) (map[string]float64, error) {
+	deadbands := make(map[string]float64, len(pairs))
+	for _, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		deadband, err := strconv.ParseFloat(value, 64)
+		if key == "" || err != nil || deadband < 0 {
+			return nil, fmt.Errorf("invalid entry %q, want sensor=deadband", pair)
+		}
+		deadbands[key] = deadband
+	}
+	return deadbands, nil
+}
+
+// deadbandFilter holds sensor values that moved less than their deadband
+// at the value last handed to the sinks, and drops readings in which
+// nothing moved. A value, and a reading, is passed on at least every
+// maxSilence so nothing goes stale.
+type deadbandFilter struct {
+	deadbands  map[string]float64
+	maxSilence time.Duration
+
+	mu   sync.Mutex
+	sent map[string]*deadbandState // by device name
+}
+
+// deadbandState is what the sinks last received from a device.
+type deadbandState struct {
+	values  map[string]float64
+	updated map[string]time.Time
+	sent    time.Time
+}
+
+// newDeadbandFilter returns nil when no deadband is configured.
+func newDeadbandFilter(pairs []string, maxSilence time.Duration) (*deadbandFilter, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	deadbands, err := parseDeadbands(pairs)
+	if err != nil {
+		return nil, fmt.Errorf("DEADBANDS: %w", err)
+	}
+	if maxSilence <= 0 {
+		return nil, fmt.Errorf("DEADBAND_MAX_SILENCE must be positive")
+	}
+	return &deadbandFilter{
+		deadbands:  deadbands,
+		maxSilence: maxSilence,
+		sent:       make(map[string]*deadbandState),
+	}, nil
+}
+
+// apply replaces the raw values of a message that stayed within their
+// deadband by the ones last passed on, and reports whether the reading
+// should reach the sinks at all. Values without a deadband only count as
+// unchanged when they are equal.
+func (f *deadbandFilter) apply(device *Device, raw map[string]float64, now time.Time) bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := f.sent[device.Name]
+	if state == nil {
+		state = &deadbandState{values: make(map[string]float64), updated: make(map[string]time.Time)}
+		f.sent[device.Name] = state
+	}
+
+	changed := false
+	for key, value := range raw {
+		last, ok := state.values[key]
+		if ok && math.Abs(value-last) <= f.deadbands[key] && now.Sub(state.updated[key]) < f.maxSilence {
+			raw[key] = last
+			continue
+		}
+		state.values[key] = value
+		state.updated[key] = now
+		changed = true
+	}
+
+	if !changed && now.Sub(state.sent) < f.maxSilence {
+		readingsSuppressed.WithLabelValues(device.Name).Inc()
+		return false
+	}
+	state.sent = now
+	return true
+}
+
+// forget drops the state of a device that went silent, so its next
+// reading is passed on as is.
+func (f *deadbandFilter) forget(device *Device) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sent, device.Name)
+}
+
+// savedDeadband is a deadbandState as kept in the history database
+type savedDeadband struct {
+	Values  map[string]float64   `json:"values"`
+	Updated map[string]time.Time `json:"updated"`
+	Sent    time.Time            `json:"sent"`
+}
+
+func (f *deadbandFilter) saveState() (map[string][]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	saved := make(map[string]savedDeadband, len(f.sent))
+	for device, state := range f.sent {
+		saved[device] = savedDeadband{state.values, state.updated, state.sent}
+	}
+	return encodeStates(saved)
+}
+
+func (f *deadbandFilter) loadState(states map[string][]byte) error {
+	saved, err := decodeStates[savedDeadband](states)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for device, state := range saved {
+		if state.Values == nil || state.Updated == nil {
+			continue
+		}
+		f.sent[device] = &deadbandState{values: state.Values, updated: state.Updated, sent: state.Sent}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package collector
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// decodeUpMessage parses a payload from the /up topic into its message
+// type and the sensor values of every sensorData entry, oldest first; a
+// device that was offline sends the readings it buffered in one message.
+// Firmwares speaking the private binary protocol (raw or hex encoded) are
+// decoded into the same shape as JSON ones.
+func decodeUpMessage(payload []byte) (string, []map[string]float64, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return decodeJSONMessage(trimmed)
+	}
+
+	if bytes.HasPrefix(trimmed, []byte("4347")) {
+		raw := make([]byte, hex.DecodedLen(len(trimmed)))
+		if _, err := hex.Decode(raw, trimmed); err != nil {
+			return "", nil, fmt.Errorf("hex payload: %w", err)
+		}
+		payload = raw
+	}
+	if bytes.HasPrefix(payload, binaryMagic) {
+		return decodeBinaryMessage(payload)
+	}
+	return "", nil, fmt.Errorf("payload is neither JSON nor a binary frame")
+}
+
+// isConfigResponse reports whether a message type only acknowledges a
+// command (Type 17 settings, Type 13) and carries no reading to export.
+func isConfigResponse(msgType string) bool {
+	return msgType == "17" || msgType == "13"
+}
+
+func decodeJSONMessage(payload []byte) (string, []map[string]float64, error) {
+	var upMsg QingpingUpMessage
+	if err := json.Unmarshal(payload, &upMsg); err != nil {
+		return "", nil, err
+	}
+
+	var entries []map[string]float64
+	for _, data := range upMsg.SensorData {
+		if len(data) == 0 {
+			continue
+		}
+		values := make(map[string]float64, len(data))
+		for key, val := range data {
+			values[key] = val.Value
+		}
+		entries = append(entries, values)
+	}
+	// Entries are usually oldest first, but nothing says so
+	sortEntries(entries)
+	return upMsg.Type, entries, nil
+}
+
+// sortEntries orders decoded entries by their timestamp. Entries without
+// one can't be placed in time and are taken as current: they go last, in
+// the order they came in.
+func sortEntries(entries []map[string]float64) {
+	slices.SortStableFunc(entries, func(a, b map[string]float64) int {
+		ta, okA := a["timestamp"]
+		tb, okB := b["timestamp"]
+		switch {
+		case okA && okB:
+			return cmp.Compare(ta, tb)
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return 0
+	})
+}
+
+// decodeMapped reads a foreign sensor's JSON payload through the device's
+// field mapping. Paths use dots for nested objects; numbers may also be
+// sent as strings. Mapped fields missing from a payload are skipped.
+func (d *Device) decodeMapped(payload []byte) (string, []map[string]float64, error) {
+	var doc any
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return "", nil, err
+	}
+
+	values := make(map[string]float64, len(d.Fields))
+	for key, path := range d.Fields {
+		switch v := lookupPath(doc, path).(type) {
+		case float64:
+			values[key] = v
+		case string:
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				values[key] = f
+			}
+		}
+	}
+	if len(values) == 0 {
+		return "", nil, nil
+	}
+	return "", []map[string]float64{values}, nil
+}
+
+// lookupPath returns the value at a dotted path in a decoded JSON
+// document, or nil if there is none.
+func lookupPath(doc any, path string) any {
+	node := doc
+	for _, part := range strings.Split(path, ".") {
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+		node = object[part]
+	}
+	return node
+}
@@ -0,0 +1,88 @@
+package collector
+
+import (
+	"math"
+	"time"
+)
+
+// deriveValues adds values computed from the raw sensors to values, so
+// every sink exports them like any other sensor.
+func deriveValues(values map[string]float64) {
+	t, hasT := values["temperature"]
+	rh, hasRH := values["humidity"]
+	if hasT && hasRH && rh > 0 {
+		values["dew_point"] = dewPoint(t, rh)
+		values["absolute_humidity"] = absoluteHumidity(t, rh)
+		values["heat_index"] = heatIndex(t, rh)
+		values["humidex"] = humidex(t, values["dew_point"])
+	}
+}
+
+// minRateInterval is the least time between readings a rate is derived
+// from; closer ones are retransmissions or several records of a message.
+const minRateInterval = 5 * time.Second
+
+// deriveRates adds how fast CO2 changes, from the device's previous
+// reading: a jump means someone came in, a drop that ventilation started.
+// Readings further apart than a device may stay silent give no rate.
+func (c *collector) deriveRates(device *Device, values map[string]float64, now time.Time) {
+	co2, ok := values["co2"]
+	if !ok {
+		return
+	}
+	c.lastUpdateMutex.RLock()
+	previous, ok := c.latest[device.Name]
+	c.lastUpdateMutex.RUnlock()
+	if !ok {
+		return
+	}
+	last, ok := previous.Reading.Values["co2"]
+	elapsed := now.Sub(previous.Reading.Timestamp)
+	if !ok || elapsed < minRateInterval || elapsed > c.config.staleAfter() {
+		return
+	}
+	values["co2_rate"] = (co2 - last) / elapsed.Minutes()
+}
+
+// dewPoint uses the Magnus formula with the Sonntag constants, accurate
+// to about 0.35°C between -45°C and 60°C.
+func dewPoint(t, rh float64) float64 {
+	const a, b = 17.62, 243.12
+	gamma := math.Log(rh/100) + a*t/(b+t)
+	return b * gamma / (a - gamma)
+}
+
+// absoluteHumidity returns grams of water vapour per cubic meter of air.
+func absoluteHumidity(t, rh float64) float64 {
+	saturation := 6.112 * math.Exp(17.67*t/(t+243.5)) // hPa
+	return saturation * rh * 2.1674 / (273.15 + t)
+}
+
+// heatIndex implements the US National Weather Service algorithm: the
+// Steadman approximation, switching to the Rothfusz regression with its
+// adjustments once that exceeds 80°F. Input and output are in Celsius.
+func heatIndex(t, rh float64) float64 {
+	f := t*9/5 + 32
+	hi := 0.5 * (f + 61 + (f-68)*1.2 + rh*0.094)
+
+	if (hi+f)/2 >= 80 {
+		hi = -42.379 + 2.04901523*f + 10.14333127*rh -
+			0.22475541*f*rh - 0.00683783*f*f - 0.05481717*rh*rh +
+			0.00122874*f*f*rh + 0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+
+		switch {
+		case rh < 13 && f >= 80 && f <= 112:
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+		case rh > 85 && f >= 80 && f <= 87:
+			hi += (rh - 85) / 10 * (87 - f) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// humidex is the Environment Canada comfort index from temperature and
+// dew point in Celsius. It is dimensionless but reads like degrees.
+func humidex(t, dewPoint float64) float64 {
+	e := 6.11 * math.Exp(5417.7530*(1/273.16-1/(273.15+dewPoint)))
+	return t + 0.5555*(e-10)
+}
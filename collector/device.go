@@ -0,0 +1,180 @@
+package collector
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Device is a single configured Qingping monitor, or another vendor's
+// sensor publishing JSON on its own topic
+type Device struct {
+	MAC  string   `json:"mac,omitempty"`
+	Name string   `json:"name"`
+	Tags []string `json:"tags,omitempty"`
+	// Model is cgdn1 (default), cgs1, cgs2 or generic
+	Model string `json:"model,omitempty"`
+	// Settings override the file-wide settings pushed on connect
+	Settings DeviceSettings `json:"settings,omitzero"`
+	// Labels are attached to every metric of the device, e.g. {"room": "bedroom", "floor": "1"}
+	Labels map[string]string `json:"labels,omitempty"`
+	// Calibration offsets are added to the raw sensor values, e.g.
+	// {"temperature": -1.5, "humidity": 3}
+	Calibration map[string]float64 `json:"calibration,omitempty"`
+	// Maintenance keeps the device reporting without raising alerts, e.g.
+	// while it is moved, charged or calibrated
+	Maintenance bool `json:"maintenance,omitempty"`
+	// Replaces lists the MACs of the hardware this device took over from,
+	// oldest first; its name, state and history carry over
+	Replaces []string `json:"replaces,omitempty"`
+	// Location places the device on a map or floorplan, see /api/map
+	Location *Location `json:"location,omitempty"`
+	// BLE takes the readings from the device's Bluetooth LE advertisements
+	// instead of MQTT, for devices without private MQTT settings
+	BLE bool `json:"ble,omitempty"`
+	// SeriesID identifies the device in the API and, with SERIES_ID_LABEL,
+	// its metrics, independent of its name and hardware. It is assigned
+	// automatically; set it only to keep an ID across something that
+	// changes every MAC and topic, like a foreign sensor's new topic.
+	SeriesID string `json:"series_id,omitempty"`
+	// Cloud takes the readings from the Qingping cloud API instead of MQTT,
+	// for devices still bound to the Qingping+ app
+	Cloud bool `json:"cloud,omitempty"`
+	// Passive never sends the device commands, for devices whose reporting
+	// and settings another controller manages
+	Passive bool `json:"passive,omitempty"`
+	// Schedules send the device commands on cron schedules, in addition
+	// to the config file's own schedules
+	Schedules []ScheduleConfig `json:"schedules,omitempty"`
+	// Rapid is a reporting interval under 15s the device keeps while
+	// plugged in, falling back to UPDATE_INTERVAL on battery
+	Rapid Duration `json:"rapid,omitempty"`
+
+	// Topic and Fields describe a non-Qingping sensor: readings are taken
+	// from JSON published on Topic, Fields maps metric keys to paths in the
+	// payload, e.g. {"co2": "rco2", "pm25": "pm.pm25"}
+	Topic  string            `json:"topic,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+
+	// policy is resolved from the routes once the config is loaded
+	policy Policy
+	// home is the home the device belongs to, if any
+	home *HomeConfig
+}
+
+func (d *Device) model() deviceModel {
+	return deviceModels[d.Model]
+}
+
+// reports tells whether key is expected in the device's readings: it is
+// part of its model or mapped in the config file. Foreign sensors report
+// exactly their mapped fields.
+func (d *Device) reports(key string) bool {
+	if d.foreign() {
+		_, ok := d.Fields[key]
+		return ok
+	}
+	return mappedFields[key] || d.model().reports(key)
+}
+
+// foreign reports whether the device is another vendor's sensor; those
+// only publish and can't be sent commands.
+func (d *Device) foreign() bool {
+	return d.Topic != ""
+}
+
+// commandable reports whether the device can be sent commands; foreign
+// sensors, devices heard over BLE or read from the cloud and passive ones
+// only report on their own schedule.
+func (d *Device) commandable() bool {
+	return !d.foreign() && !d.BLE && !d.Cloud && !d.Passive
+}
+
+// id identifies the device towards other systems, e.g. Home Assistant
+func (d *Device) id() string {
+	if d.foreign() {
+		return d.Name
+	}
+	return strings.ToLower(d.originalMAC())
+}
+
+// normalizeMAC uppercases a MAC address and drops its colons.
+func normalizeMAC(mac string) string {
+	return strings.ToUpper(strings.ReplaceAll(mac, ":", ""))
+}
+
+// originalMAC is the MAC of the first hardware behind the device, which
+// names and identifies it across replacements.
+func (d *Device) originalMAC() string {
+	if len(d.Replaces) > 0 {
+		return normalizeMAC(d.Replaces[0])
+	}
+	return d.MAC
+}
+
+// checkReplacements verifies that replaced hardware is neither still
+// configured nor replaced twice.
+func checkReplacements(devices []*Device) error {
+	owners := make(map[string]string) // MAC to device name
+	for _, device := range devices {
+		if !device.foreign() {
+			owners[normalizeMAC(device.MAC)] = device.Name
+		}
+	}
+	replacedBy := make(map[string]string)
+	for _, device := range devices {
+		for _, mac := range device.Replaces {
+			if owner, ok := owners[mac]; ok {
+				return fmt.Errorf("device %q replaces %s, which is still configured as %q", device.Name, mac, owner)
+			}
+			if other, ok := replacedBy[mac]; ok {
+				return fmt.Errorf("devices %q and %q both replace %s", other, device.Name, mac)
+			}
+			replacedBy[mac] = device.Name
+		}
+	}
+	return nil
+}
+
+// knownAs reports whether mac is the device's MAC or one it replaced.
+func (d *Device) knownAs(mac string) bool {
+	if d.foreign() {
+		return false
+	}
+	mac = normalizeMAC(mac)
+	return normalizeMAC(d.MAC) == mac || slices.ContainsFunc(d.Replaces, func(old string) bool { return normalizeMAC(old) == mac })
+}
+
+func (d *Device) upTopic() string {
+	if d.foreign() {
+		return d.Topic
+	}
+	return fmt.Sprintf("qingping/%s/up", d.MAC)
+}
+
+func (d *Device) downTopic() string {
+	return fmt.Sprintf("qingping/%s/down", d.MAC)
+}
+
+func (d *Device) hasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnyTag reports whether the device carries one of tags; an empty list
+// matches every device.
+func (d *Device) hasAnyTag(tags []string) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		if d.hasTag(tag) {
+			return true
+		}
+	}
+	return false
+}
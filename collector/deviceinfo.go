@@ -0,0 +1,101 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// deviceInfo is what a JSON up message tells about the device itself
+// rather than the air: its firmware, Wi-Fi signal and power supply.
+// Firmware puts them in different places, so some fields have a fallback:
+//
+//	{"type":"10","firmware_version":"4.3.6","wifi_info":{"ssid":"home","rssi":-62}}
+//	{"type":"12","version":"4.3.6","rssi":-62,"usb_power":1,"charging":0,"sensorData":[...]}
+type deviceInfo struct {
+	FirmwareVersion string   `json:"firmware_version"`
+	Version         string   `json:"version"`
+	RSSI            *float64 `json:"rssi"`
+	WiFi            struct {
+		RSSI *float64 `json:"rssi"`
+	} `json:"wifi_info"`
+	USBPower jsonFlag `json:"usb_power"`
+	Charging jsonFlag `json:"charging"`
+}
+
+// jsonFlag is a boolean firmware sends as true or false, 1 or 0, or either
+// as a string. set is false when it is missing or something else.
+type jsonFlag struct {
+	set, value bool
+}
+
+func (f *jsonFlag) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true", "1":
+		*f = jsonFlag{set: true, value: true}
+	case "false", "0":
+		*f = jsonFlag{set: true, value: false}
+	}
+	return nil
+}
+
+// gauge is the flag as a gauge value.
+func (f jsonFlag) gauge() float64 {
+	if f.value {
+		return 1
+	}
+	return 0
+}
+
+// decodeDeviceInfo reads the device information of a JSON up message.
+// Binary frames and invalid JSON yield an empty deviceInfo.
+func decodeDeviceInfo(payload []byte) deviceInfo {
+	var info deviceInfo
+	if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '{' {
+		_ = json.Unmarshal(trimmed, &info)
+	}
+	return info
+}
+
+func (i deviceInfo) firmware() string {
+	if i.FirmwareVersion != "" {
+		return i.FirmwareVersion
+	}
+	return i.Version
+}
+
+func (i deviceInfo) rssi() *float64 {
+	if i.WiFi.RSSI != nil {
+		return i.WiFi.RSSI
+	}
+	return i.RSSI
+}
+
+// updateDeviceInfo exports what a message tells about the device, keeping
+// the previous values for what it doesn't.
+func updateDeviceInfo(device *Device, info deviceInfo) {
+	if firmware := info.firmware(); firmware != "" {
+		deviceFirmwareInfo.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+		deviceFirmwareInfo.WithLabelValues(device.Name, firmware).Set(1)
+	}
+	if rssi := info.rssi(); rssi != nil {
+		wifiRSSI.WithLabelValues(device.Name).Set(*rssi)
+	}
+	if info.USBPower.set {
+		usbPower.WithLabelValues(device.Name).Set(info.USBPower.gauge())
+	}
+	if info.Charging.set {
+		batteryCharging.WithLabelValues(device.Name).Set(info.Charging.gauge())
+	}
+}
+
+// forgetDeviceInfo removes the device information of a removed or renamed
+// device.
+func forgetDeviceInfo(name string) {
+	deviceFirmwareInfo.DeletePartialMatch(prometheus.Labels{"device": name})
+	wifiRSSI.DeleteLabelValues(name)
+	usbPower.DeleteLabelValues(name)
+	batteryCharging.DeleteLabelValues(name)
+}
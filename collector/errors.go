@@ -0,0 +1,144 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Error codes classify runtime errors for qingping_errors_total and
+// /api/errors. They are stable, so alerts can rely on them.
+const (
+	codeBrokerAuth      = "broker_auth"
+	codeSubscribeDenied = "subscribe_denied"
+	codeParseFailure    = "parse_failure"
+	codeSinkRejected    = "sink_rejected"
+	codeCommandTimeout  = "command_timeout"
+	codeUnauthenticated = "unauthenticated"
+)
+
+// errorCodes describes every error code
+var errorCodes = map[string]string{
+	codeBrokerAuth:      "A broker refused the collector's username or password",
+	codeSubscribeDenied: "A broker refused a subscription, usually for lack of ACL permissions",
+	codeParseFailure:    "A message on a device topic could not be decoded",
+	codeSinkRejected:    "A sink failed to deliver or store readings",
+	codeCommandTimeout:  "A command to a device was not taken by the broker in time",
+	codeUnauthenticated: "A message on a device topic was not signed with MQTT_SIGNING_KEY",
+}
+
+// commandTimeout is how long a command to a device may take to reach the
+// broker
+const commandTimeout = 10 * time.Second
+
+// recentErrorsPerCode is how many examples of each code /api/errors keeps
+const recentErrorsPerCode = 10
+
+// ErrorExample is one occurrence of an error
+type ErrorExample struct {
+	Time    time.Time `json:"time"`
+	Device  string    `json:"device,omitempty"`
+	Source  string    `json:"source,omitempty"` // sink, broker or topic
+	Message string    `json:"message"`
+}
+
+// ErrorSummary is an error code with its count since startup and its most
+// recent examples, newest first
+type ErrorSummary struct {
+	Code        string         `json:"code"`
+	Description string         `json:"description"`
+	Count       int            `json:"count"`
+	Recent      []ErrorExample `json:"recent"`
+}
+
+// errorLog keeps the recent examples of every error code. It is shared by
+// everything that runs into errors, like the metrics are.
+var errorLog = struct {
+	mu       sync.Mutex
+	counts   map[string]int
+	examples map[string][]ErrorExample
+}{counts: make(map[string]int), examples: make(map[string][]ErrorExample)}
+
+// recordError counts an error under its code and keeps it as an example.
+func recordError(code string, example ErrorExample) {
+	if example.Time.IsZero() {
+		example.Time = time.Now()
+	}
+	errorsTotal.WithLabelValues(code).Inc()
+
+	errorLog.mu.Lock()
+	defer errorLog.mu.Unlock()
+	errorLog.counts[code]++
+	examples := append(errorLog.examples[code], example)
+	if len(examples) > recentErrorsPerCode {
+		examples = examples[len(examples)-recentErrorsPerCode:]
+	}
+	errorLog.examples[code] = examples
+}
+
+// recordConnectionErrors is a paho connection notification handler that
+// records refused credentials.
+func recordConnectionErrors(broker string) mqtt.ConnectionNotificationHandler {
+	return func(client mqtt.Client, notification mqtt.ConnectionNotification) {
+		failed, ok := notification.(mqtt.ConnectionNotificationFailed)
+		if !ok {
+			return
+		}
+		if errors.Is(failed.Reason, packets.ErrorRefusedBadUsernameOrPassword) || errors.Is(failed.Reason, packets.ErrorRefusedNotAuthorised) {
+			recordError(codeBrokerAuth, ErrorExample{Source: broker, Message: failed.Reason.Error()})
+		}
+	}
+}
+
+// waitSubscribed waits for a subscription to complete and returns its
+// error, counting subscriptions the broker refused with a failure return
+// code, which paho doesn't treat as an error.
+func waitSubscribed(token mqtt.Token, topic, device string) error {
+	token.Wait()
+	if err := token.Error(); err != nil {
+		return err
+	}
+	if sub, ok := token.(*mqtt.SubscribeToken); ok && sub.Result()[topic] == 0x80 {
+		err := errors.New("subscription refused by the broker")
+		recordError(codeSubscribeDenied, ErrorExample{Device: device, Source: topic, Message: err.Error()})
+		return err
+	}
+	return nil
+}
+
+// waitCommand waits for a command to a device to reach the broker and
+// returns its error, counting commands that time out.
+func waitCommand(token mqtt.Token, device *Device, topic string) error {
+	if !token.WaitTimeout(commandTimeout) {
+		err := fmt.Errorf("not taken by the broker within %v", commandTimeout)
+		recordError(codeCommandTimeout, ErrorExample{Device: device.Name, Source: topic, Message: err.Error()})
+		return err
+	}
+	return token.Error()
+}
+
+// handleErrors serves GET /api/errors with every error code, how often it
+// occurred since startup and its recent examples.
+func handleErrors(w http.ResponseWriter, r *http.Request) {
+	errorLog.mu.Lock()
+	summaries := make([]ErrorSummary, 0, len(errorCodes))
+	for code, description := range errorCodes {
+		recent := slices.Clone(errorLog.examples[code])
+		slices.Reverse(recent)
+		if recent == nil {
+			recent = []ErrorExample{}
+		}
+		summaries = append(summaries, ErrorSummary{Code: code, Description: description, Count: errorLog.counts[code], Recent: recent})
+	}
+	errorLog.mu.Unlock()
+
+	slices.SortFunc(summaries, func(a, b ErrorSummary) int { return strings.Compare(a.Code, b.Code) })
+	writeJSON(w, http.StatusOK, map[string]any{"errors": summaries})
+}
@@ -0,0 +1,165 @@
+package collector
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exposureSample is the previous reading of a sensor an interval is
+// integrated from
+type exposureSample struct {
+	value float64
+	time  time.Time
+}
+
+// exposureSink integrates some sensors over time into counters, e.g.
+// qingping_co2_ppm_hours_total in ppm·h, weighting every reading by the
+// actual time to the next instead of assuming a steady report interval.
+// increase() over any range then gives the exposure of that range, and
+// dividing by its length the time-weighted average.
+type exposureSink struct {
+	counters map[string]*prometheus.CounterVec // by sensor key
+	// maxGap is the longest interval integrated; across longer silences
+	// the level in between is unknown
+	maxGap time.Duration
+
+	mu   sync.Mutex
+	last map[string]map[string]exposureSample // by device name, then sensor
+	// totals are the counters' values, by device name, then sensor
+	totals map[string]map[string]float64
+}
+
+// newExposureSink registers a counter per sensor. It runs once at startup,
+// after fields and units are set up.
+func newExposureSink(sensors []string, maxGap time.Duration, registerer prometheus.Registerer) (*exposureSink, error) {
+	s := &exposureSink{
+		counters: make(map[string]*prometheus.CounterVec),
+		maxGap:   maxGap,
+		last:     make(map[string]map[string]exposureSample),
+		totals:   make(map[string]map[string]float64),
+	}
+	for _, key := range sensors {
+		metric, ok := sensorMetrics[key]
+		if !ok {
+			return nil, fmt.Errorf("EXPOSURE_SENSORS: no metric for sensor %q", key)
+		}
+		counter := prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: metric.Name + "_hours_total",
+			Help: fmt.Sprintf("%s, integrated over time into exposure in unit·hours", metric.Help),
+		}, []string{"device"})
+		if err := registerer.Register(counter); err != nil {
+			return nil, fmt.Errorf("EXPOSURE_SENSORS: %w", err)
+		}
+		s.counters[key] = counter
+	}
+	return s, nil
+}
+
+func (s *exposureSink) Name() string { return "exposure" }
+
+func (s *exposureSink) Write(device *Device, data CGDN1Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := s.last[device.Name]
+	if last == nil {
+		last = make(map[string]exposureSample)
+		s.last[device.Name] = last
+	}
+	for key, counter := range s.counters {
+		value, ok := data.Values[key]
+		if !ok {
+			continue
+		}
+		previous, seen := last[key]
+		if seen && !data.Timestamp.After(previous.time) {
+			// A retransmission or a late record; the interval is counted
+			continue
+		}
+		last[key] = exposureSample{value: value, time: data.Timestamp}
+		if !seen {
+			continue
+		}
+		elapsed := data.Timestamp.Sub(previous.time)
+		if s.maxGap > 0 && elapsed > s.maxGap {
+			continue
+		}
+		// Trapezoidal rule: the level is taken to move linearly between
+		// the two readings
+		exposure := (previous.value + value) / 2 * elapsed.Hours()
+		counter.WithLabelValues(device.Name).Add(exposure)
+		if s.totals[device.Name] == nil {
+			s.totals[device.Name] = make(map[string]float64)
+		}
+		s.totals[device.Name][key] += exposure
+	}
+}
+
+// Forget drops the counters of a device along with its last readings, so
+// integration restarts with its next reading.
+func (s *exposureSink) Forget(device *Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.last, device.Name)
+	delete(s.totals, device.Name)
+	for _, counter := range s.counters {
+		counter.DeleteLabelValues(device.Name)
+	}
+}
+
+// savedExposure is a device's exposure as kept in the history database
+type savedExposure struct {
+	Totals map[string]float64             `json:"totals"`
+	Last   map[string]savedExposureSample `json:"last"`
+}
+
+type savedExposureSample struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+}
+
+func (s *exposureSink) saveState() (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := make(map[string]savedExposure, len(s.last))
+	for device, last := range s.last {
+		state := savedExposure{Totals: s.totals[device], Last: make(map[string]savedExposureSample, len(last))}
+		for key, sample := range last {
+			state.Last[key] = savedExposureSample{sample.value, sample.time}
+		}
+		saved[device] = state
+	}
+	return encodeStates(saved)
+}
+
+// loadState restores the counters to their saved totals, so a device's
+// lifetime exposure carries on instead of starting over at zero.
+func (s *exposureSink) loadState(states map[string][]byte) error {
+	saved, err := decodeStates[savedExposure](states)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for device, state := range saved {
+		last := make(map[string]exposureSample, len(state.Last))
+		for key, sample := range state.Last {
+			last[key] = exposureSample{value: sample.Value, time: sample.Time}
+		}
+		s.last[device] = last
+		totals := make(map[string]float64, len(state.Totals))
+		for key, total := range state.Totals {
+			counter, ok := s.counters[key]
+			if !ok {
+				continue
+			}
+			counter.WithLabelValues(device).Add(total)
+			totals[key] = total
+		}
+		s.totals[device] = totals
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// brokerAddresses turns a comma-separated list of broker hosts, each with
+// an optional port of its own, into host:port addresses.
+func brokerAddresses(brokers, port string) []string {
+	var addresses []string
+	for _, broker := range splitList(brokers) {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			broker = net.JoinHostPort(broker, port)
+		}
+		addresses = append(addresses, broker)
+	}
+	return addresses
+}
+
+// brokerFailover keeps track of the broker a connection is on. With more
+// than one broker it also decides where to go when that broker fails: paho
+// tries its brokers in order on every reconnect, so the one that failed is
+// moved to the end first, and a broker that accepts the connection but no
+// longer delivers messages is left by closing the connection.
+type brokerFailover struct {
+	home    string
+	brokers []string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	active string // broker of conn
+}
+
+// newBrokerFailover hooks into the options of a connection to the given
+// home ("" for the main broker), after its brokers were added.
+func newBrokerFailover(home string, opts *mqtt.ClientOptions) *brokerFailover {
+	f := &brokerFailover{home: home}
+	for _, server := range opts.Servers {
+		f.brokers = append(f.brokers, server.Host)
+	}
+	if len(f.brokers) == 1 {
+		f.active = f.brokers[0]
+		return f
+	}
+	opts.SetCustomOpenConnectionFn(f.open)
+	opts.SetReconnectingHandler(f.reconnecting)
+	return f
+}
+
+// open dials a broker and remembers the connection, so that it can be
+// closed to fail over.
+func (f *brokerFailover) open(uri *url.URL, options mqtt.ClientOptions) (net.Conn, error) {
+	conn, err := options.Dialer.Dial("tcp", uri.Host)
+	if err != nil {
+		slog.Warn("Failed to connect to MQTT broker, trying the next", "home", f.home, "broker", uri.Host, "error", err)
+		return nil, err
+	}
+	f.mu.Lock()
+	f.conn, f.active = conn, uri.Host
+	f.mu.Unlock()
+	return conn, nil
+}
+
+// reconnecting moves the broker that was lost behind the others, so the
+// next attempt starts with the broker after it.
+func (f *brokerFailover) reconnecting(client mqtt.Client, opts *mqtt.ClientOptions) {
+	f.mu.Lock()
+	active := f.active
+	f.mu.Unlock()
+	for i, server := range opts.Servers {
+		if server.Host == active {
+			opts.Servers = append(slices.Clone(opts.Servers[i+1:]), opts.Servers[:i+1]...)
+			return
+		}
+	}
+}
+
+// connected marks the broker the connection was made to as active and
+// returns it.
+func (f *brokerFailover) connected() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, broker := range f.brokers {
+		if broker == f.active {
+			mqttBrokerActive.WithLabelValues(f.home, broker).Set(1)
+		} else {
+			mqttBrokerActive.WithLabelValues(f.home, broker).Set(0)
+		}
+	}
+	return f.active
+}
+
+// lost marks every broker as inactive until the connection is back.
+func (f *brokerFailover) lost() {
+	for _, broker := range f.brokers {
+		mqttBrokerActive.WithLabelValues(f.home, broker).Set(0)
+	}
+}
+
+// watch fails over when the main connection stays up but stops delivering
+// its own loopback messages. Only the main connection has a loopback.
+func (f *brokerFailover) watch(ctx context.Context, h *health) {
+	if len(f.brokers) < 2 {
+		return
+	}
+	ticker := time.NewTicker(loopbackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		err := h.alive()
+		if err == nil {
+			continue
+		}
+		f.mu.Lock()
+		conn, active := f.conn, f.active
+		f.mu.Unlock()
+		if conn != nil {
+			slog.Warn("MQTT broker stopped delivering messages, failing over", "broker", active, "error", err)
+			conn.Close()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package collector
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FieldConfig maps a sensorData key the collector has no built-in metric
+// for, e.g. from a newer model, to a metric of its own.
+type FieldConfig struct {
+	Metric string `json:"metric"`         // e.g. qingping_light_lux
+	Help   string `json:"help,omitempty"` // defaults to the key
+	Unit   string `json:"unit,omitempty"` // shown in Home Assistant
+}
+
+// mappedFields are the keys configured under "fields"; they are accepted
+// from every model.
+var mappedFields = make(map[string]bool)
+
+// registerFields adds the configured fields to the exported sensors. It
+// runs once at startup, before any reading is handled.
+func registerFields(fields map[string]FieldConfig, registerer prometheus.Registerer) error {
+	for key, field := range fields {
+		if _, ok := sensorMetrics[key]; ok {
+			return fmt.Errorf("field %q already has a built-in metric", key)
+		}
+		if field.Metric == "" {
+			return fmt.Errorf("field %q has no metric name", key)
+		}
+		help := field.Help
+		if help == "" {
+			help = fmt.Sprintf("Value of the %q sensorData field", key)
+		}
+
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: field.Metric,
+			Help: help,
+		}, []string{"device"})
+		if err := registerer.Register(gauge); err != nil {
+			return fmt.Errorf("field %q: %w", key, err)
+		}
+
+		sensorMetrics[key] = sensorMetric{field.Metric, help}
+		sensorGauges[key] = gauge
+		haSensors[key] = haSensor{Name: key, Unit: field.Unit}
+		mappedFields[key] = true
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package collector
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FilterConfig configures the filter stage that cleans up sensor values
+// before anything sees them
+type FilterConfig struct {
+	Mode     string   // none, median or ewma smoothing
+	Samples  int      // readings the median is taken over
+	Alpha    float64  // weight of a new reading in the EWMA
+	Sensors  []string // sensors smoothed, default co2, pm25, pm10 and tvoc
+	MaxJumps []string // sensor=jump pairs, larger jumps are rejected once
+	Raw      bool     // also export the unfiltered values as *_raw
+}
+
+// defaultFilterSensors spike now and then; temperature and humidity
+// rarely do and would only lag behind
+var defaultFilterSensors = []string{"co2", "pm25", "pm10", "tvoc"}
+
+// valueFilter rejects implausible jumps and smooths sensor values, after
+// calibration and before derived values, metrics and every sink.
+type valueFilter struct {
+	config   FilterConfig
+	smoothed map[string]bool    // sensor keys
+	maxJumps map[string]float64 // by sensor key
+
+	mu     sync.Mutex
+	states map[string]*filterState // by device name
+}
+
+// filterState is what the filter remembers of a device
+type filterState struct {
+	accepted map[string]float64 // last value within its max jump
+	// pending is a rejected jump; it is accepted when the next reading
+	// confirms the new level
+	pending map[string]float64
+	recent  map[string][]float64 // the last Samples values, for the median
+	average map[string]float64   // the EWMA
+}
+
+// parseMaxJumps parses sensor=jump pairs, e.g. pm25=200.
+func parseMaxJumps(pairs []string) (map[string]float64, error) {
+	jumps := make(map[string]float64, len(pairs))
+	for _, pair := range pairs {
+		key, value, _ := strings.Cut(pair, "=")
+		jump, err := strconv.ParseFloat(value, 64)
+		if key == "" || err != nil || jump <= 0 {
+			return nil, fmt.Errorf("invalid entry %q, want sensor=jump", pair)
+		}
+		jumps[key] = jump
+	}
+	return jumps, nil
+}
+
+// newValueFilter returns nil when neither smoothing nor jump rejection is
+// configured. With Raw it registers the *_raw metrics, so it runs once at
+// startup after the sinks, which don't need to know about them.
+func newValueFilter(config FilterConfig, registerer prometheus.Registerer) (*valueFilter, error) {
+	switch config.Mode {
+	case "", "none":
+		config.Mode = "none"
+	case "median":
+		if config.Samples < 2 {
+			return nil, fmt.Errorf("FILTER_SAMPLES must be at least 2")
+		}
+	case "ewma":
+		if config.Alpha <= 0 || config.Alpha > 1 {
+			return nil, fmt.Errorf("FILTER_ALPHA must be in (0, 1]")
+		}
+	default:
+		return nil, fmt.Errorf("unknown FILTER_MODE %q (want none, median or ewma)", config.Mode)
+	}
+	maxJumps, err := parseMaxJumps(config.MaxJumps)
+	if err != nil {
+		return nil, fmt.Errorf("FILTER_MAX_JUMPS: %w", err)
+	}
+	if config.Mode == "none" && len(maxJumps) == 0 {
+		return nil, nil
+	}
+
+	f := &valueFilter{
+		config:   config,
+		smoothed: make(map[string]bool),
+		maxJumps: maxJumps,
+		states:   make(map[string]*filterState),
+	}
+	if config.Mode != "none" {
+		sensors := config.Sensors
+		if len(sensors) == 0 {
+			sensors = defaultFilterSensors
+		}
+		for _, key := range sensors {
+			f.smoothed[key] = true
+		}
+	}
+
+	keys := make(map[string]bool, len(f.smoothed)+len(maxJumps))
+	for key := range f.smoothed {
+		keys[key] = true
+	}
+	for key := range maxJumps {
+		keys[key] = true
+	}
+	for key := range keys {
+		metric, ok := sensorMetrics[key]
+		if !ok {
+			return nil, fmt.Errorf("filter: no metric for sensor %q", key)
+		}
+		if !config.Raw {
+			continue
+		}
+		raw := sensorMetric{metric.Name + "_raw", metric.Help + ", before filtering"}
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: raw.Name, Help: raw.Help}, []string{"device"})
+		if err := registerer.Register(gauge); err != nil {
+			return nil, fmt.Errorf("FILTER_RAW: %w", err)
+		}
+		sensorMetrics[key+"_raw"] = raw
+		sensorGauges[key+"_raw"] = gauge
+	}
+	return f, nil
+}
+
+// apply filters the values of a reading in place. Rejected values are
+// removed, so their metrics keep the previous value. It is safe on a nil
+// filter.
+func (f *valueFilter) apply(device *Device, values map[string]float64) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	state := f.states[device.Name]
+	if state == nil {
+		state = &filterState{
+			accepted: make(map[string]float64),
+			pending:  make(map[string]float64),
+			recent:   make(map[string][]float64),
+			average:  make(map[string]float64),
+		}
+		f.states[device.Name] = state
+	}
+
+	for key, value := range values {
+		jump, limited := f.maxJumps[key]
+		if !limited && !f.smoothed[key] {
+			continue
+		}
+		if f.config.Raw {
+			values[key+"_raw"] = value
+		}
+
+		if limited {
+			last, ok := state.accepted[key]
+			if ok && math.Abs(value-last) > jump {
+				// A real change persists; a glitch is gone with the
+				// next reading
+				pending, confirming := state.pending[key]
+				if !confirming || math.Abs(value-pending) > jump {
+					state.pending[key] = value
+					delete(values, key)
+					valuesRejected.WithLabelValues(device.Name, key).Inc()
+					continue
+				}
+			}
+			delete(state.pending, key)
+			state.accepted[key] = value
+		}
+
+		if !f.smoothed[key] {
+			continue
+		}
+		switch f.config.Mode {
+		case "median":
+			recent := append(state.recent[key], value)
+			if len(recent) > f.config.Samples {
+				recent = recent[len(recent)-f.config.Samples:]
+			}
+			state.recent[key] = recent
+			values[key] = round2(percentile(slices.Sorted(slices.Values(recent)), 50))
+		case "ewma":
+			if average, ok := state.average[key]; ok {
+				value = f.config.Alpha*value + (1-f.config.Alpha)*average
+			}
+			state.average[key] = value
+			values[key] = round2(value)
+		}
+	}
+}
+
+// forget drops the state of a device that went silent, so it starts over
+// with its next reading.
+func (f *valueFilter) forget(device *Device) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.states, device.Name)
+}
+
+// savedFilter is a filterState as kept in the history database
+type savedFilter struct {
+	Accepted map[string]float64   `json:"accepted"`
+	Pending  map[string]float64   `json:"pending"`
+	Recent   map[string][]float64 `json:"recent"`
+	Average  map[string]float64   `json:"average"`
+}
+
+func (f *valueFilter) saveState() (map[string][]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	saved := make(map[string]savedFilter, len(f.states))
+	for device, state := range f.states {
+		saved[device] = savedFilter{state.accepted, state.pending, state.recent, state.average}
+	}
+	return encodeStates(saved)
+}
+
+func (f *valueFilter) loadState(states map[string][]byte) error {
+	saved, err := decodeStates[savedFilter](states)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for device, state := range saved {
+		restored := &filterState{
+			accepted: make(map[string]float64),
+			pending:  make(map[string]float64),
+			recent:   make(map[string][]float64),
+			average:  make(map[string]float64),
+		}
+		maps.Copy(restored.accepted, state.Accepted)
+		maps.Copy(restored.pending, state.Pending)
+		maps.Copy(restored.recent, state.Recent)
+		maps.Copy(restored.average, state.Average)
+		f.states[device] = restored
+	}
+	return nil
+}
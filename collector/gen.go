@@ -0,0 +1,91 @@
+package collector
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// commandGenerators build the payload of a device command from flags.
+// New message types only need an entry here to be available in "gen".
+var commandGenerators = map[string]func(fs *flag.FlagSet, args []string) (any, error){
+	"12": genReporting,
+	"17": genSettings,
+}
+
+// runGen implements "gen TYPE [flags]": print the JSON of a device command
+// without connecting anywhere, e.g. for mosquitto_pub.
+func runGen(args []string) error {
+	types := make([]string, 0, len(commandGenerators))
+	for t := range commandGenerators {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	if len(args) == 0 || commandGenerators[args[0]] == nil {
+		return fmt.Errorf("usage: %s gen TYPE [-mac MAC] [flags], TYPE is one of %s; see gen TYPE -help",
+			os.Args[0], strings.Join(types, ", "))
+	}
+
+	fs := flag.NewFlagSet("gen "+args[0], flag.ContinueOnError)
+	mac := fs.String("mac", "", "print a mosquitto_pub command for this device instead of the bare JSON")
+	msg, err := commandGenerators[args[0]](fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if *mac == "" {
+		fmt.Println(string(payload))
+		return nil
+	}
+	device := &Device{MAC: strings.ToUpper(*mac)}
+	fmt.Printf("mosquitto_pub -t '%s' -m '%s'\n", device.downTopic(), payload)
+	return nil
+}
+
+func genReporting(fs *flag.FlagSet, args []string) (any, error) {
+	interval := fs.Duration("interval", time.Minute, "how often the device reports")
+	duration := fs.Duration("duration", 6*time.Hour, "how long the device keeps reporting")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *interval < time.Second || *duration < *interval {
+		return nil, fmt.Errorf("interval must be at least 1s and duration at least the interval")
+	}
+	return reportingMessage(int(interval.Seconds()), int(duration.Seconds())), nil
+}
+
+func genSettings(fs *flag.FlagSet, args []string) (any, error) {
+	var settings DeviceSettings
+	reportInterval := fs.Duration("report-interval", 0, "time between uploads when not requested via Type 12, e.g. 15m")
+	collectInterval := fs.Duration("collect-interval", 0, "time between measurements, e.g. 1m")
+	fs.StringVar(&settings.TemperatureUnit, "temperature-unit", "", "C or F")
+	fs.StringVar(&settings.TVOCUnit, "tvoc-unit", "", "ppb, mg/m3 or index")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *reportInterval > 0 {
+		secs := int(reportInterval.Seconds())
+		settings.ReportInterval = &secs
+	}
+	if *collectInterval > 0 {
+		secs := int(collectInterval.Seconds())
+		settings.CollectInterval = &secs
+	}
+	if settings.empty() {
+		return nil, fmt.Errorf("set at least one setting")
+	}
+	if err := settings.validate(); err != nil {
+		return nil, err
+	}
+	return settings.message()
+}
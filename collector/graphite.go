@@ -0,0 +1,200 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GraphiteConfig configures pushing readings to Graphite/Carbon.
+type GraphiteConfig struct {
+	Address       string // host:port of carbon, e.g. graphite:2003
+	Protocol      string // plaintext or pickle
+	Prefix        string // metric paths are {Prefix}.{device}.{value}
+	FlushInterval time.Duration
+}
+
+// graphiteQueueLimit caps the points kept while carbon is unreachable
+const graphiteQueueLimit = 10000
+
+// graphitePoint is a single value waiting to be sent
+type graphitePoint struct {
+	Path      string
+	Value     float64
+	Timestamp time.Time
+}
+
+// graphiteSink queues every value of a reading and sends the queue to
+// carbon every FlushInterval over a fresh TCP connection.
+type graphiteSink struct {
+	config GraphiteConfig
+
+	mu      sync.Mutex
+	pending []graphitePoint
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newGraphiteSink(config GraphiteConfig) (*graphiteSink, error) {
+	switch config.Protocol {
+	case "", "plaintext":
+		config.Protocol = "plaintext"
+	case "pickle":
+	default:
+		return nil, fmt.Errorf("unknown Graphite protocol %q (want plaintext or pickle)", config.Protocol)
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 15 * time.Second
+	}
+	config.Prefix = strings.Trim(config.Prefix, ".")
+
+	s := &graphiteSink{config: config, done: make(chan struct{})}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *graphiteSink) Name() string { return "graphite" }
+
+// graphiteNode makes a string safe as a single node of a metric path.
+var graphiteNode = strings.NewReplacer(".", "_", " ", "_", "/", "_")
+
+func (s *graphiteSink) path(parts ...string) string {
+	nodes := make([]string, 0, len(parts)+1)
+	if s.config.Prefix != "" {
+		nodes = append(nodes, s.config.Prefix)
+	}
+	for _, part := range parts {
+		nodes = append(nodes, graphiteNode.Replace(part))
+	}
+	return strings.Join(nodes, ".")
+}
+
+func (s *graphiteSink) Write(device *Device, data CGDN1Data) {
+	points := make([]graphitePoint, 0, len(data.Values)+1)
+	for key, value := range data.Values {
+		if !exported(key) {
+			continue
+		}
+		points = append(points, graphitePoint{s.path(device.Name, key), value, data.Timestamp})
+	}
+	if data.AQI != nil {
+		points = append(points, graphitePoint{s.path(device.Name, "aqi"), data.AQI.Index, data.Timestamp})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, points...)
+	if dropped := len(s.pending) - graphiteQueueLimit; dropped > 0 {
+		s.pending = s.pending[dropped:]
+		slog.Warn("Graphite queue full, dropped oldest points", "dropped", dropped)
+	}
+}
+
+func (s *graphiteSink) Buffered() (int, int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var memory int64
+	for _, point := range s.pending {
+		memory += int64(64 + len(point.Path))
+	}
+	return len(s.pending), memory, 0
+}
+
+func (s *graphiteSink) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.send()
+		case <-s.done:
+			s.send()
+			return
+		}
+	}
+}
+
+// send delivers the queued points, putting them back at the front of the
+// queue if carbon can't be reached so they are retried on the next flush.
+func (s *graphiteSink) send() {
+	s.mu.Lock()
+	points := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	if len(points) == 0 {
+		return
+	}
+
+	var payload []byte
+	if s.config.Protocol == "pickle" {
+		payload = encodeGraphitePickle(points)
+	} else {
+		payload = encodeGraphitePlaintext(points)
+	}
+	if err := s.push(payload); err != nil {
+		slog.Warn("Failed to send points to Graphite", "points", len(points), "address", s.config.Address, "error", err)
+		recordError(codeSinkRejected, ErrorExample{Source: s.Name(), Message: err.Error()})
+		s.mu.Lock()
+		s.pending = append(points, s.pending...)
+		s.mu.Unlock()
+	}
+}
+
+func (s *graphiteSink) push(payload []byte) error {
+	conn, err := net.DialTimeout("tcp", s.config.Address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err = conn.Write(payload)
+	return err
+}
+
+// Close sends any queued points and stops the background sender.
+func (s *graphiteSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+// encodeGraphitePlaintext renders points as "path value timestamp" lines.
+func encodeGraphitePlaintext(points []graphitePoint) []byte {
+	var buf bytes.Buffer
+	for _, point := range points {
+		fmt.Fprintf(&buf, "%s %g %d\n", point.Path, point.Value, point.Timestamp.Unix())
+	}
+	return buf.Bytes()
+}
+
+// encodeGraphitePickle renders points as a length-prefixed pickle (protocol
+// 2) of [(path, (timestamp, value)), ...], as carbon's pickle receiver
+// expects.
+func encodeGraphitePickle(points []graphitePoint) []byte {
+	pickle := []byte{0x80, 2, ']', '('} // PROTO 2, EMPTY_LIST, MARK
+	for _, point := range points {
+		pickle = append(pickle, 'X') // BINUNICODE
+		pickle = binary.LittleEndian.AppendUint32(pickle, uint32(len(point.Path)))
+		pickle = append(pickle, point.Path...)
+		pickle = append(pickle, 'J') // BININT
+		pickle = binary.LittleEndian.AppendUint32(pickle, uint32(point.Timestamp.Unix()))
+		pickle = append(pickle, 'G') // BINFLOAT
+		pickle = binary.BigEndian.AppendUint64(pickle, math.Float64bits(point.Value))
+		pickle = append(pickle, 0x86, 0x86) // TUPLE2 twice
+	}
+	pickle = append(pickle, 'e', '.') // APPENDS, STOP
+
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(pickle))), pickle...)
+}
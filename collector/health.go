@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	// loopbackTopic is published to and subscribed by the collector itself
+	// to prove the client can still move messages end to end.
+	loopbackTopic    = "qingping_collector/healthcheck"
+	loopbackInterval = 30 * time.Second
+	// loopbackTimeout is how long a connected client may go without a
+	// loopback message before it is considered wedged
+	loopbackTimeout = 3 * loopbackInterval
+)
+
+// health tracks MQTT state for the /healthz and /readyz endpoints
+type health struct {
+	mu           sync.Mutex
+	connected    bool
+	connectedAt  time.Time
+	lastLoopback time.Time
+	devices      int
+	// brokers holds the subscribed topics per broker, keyed by home name
+	// and "" for the main broker; a broker is missing while disconnected
+	brokers map[string]map[string]bool
+	homes   []string
+}
+
+// newHealth tracks the main broker and those of the given homes.
+func newHealth(devices int, homes ...string) *health {
+	return &health{brokers: make(map[string]map[string]bool), devices: devices, homes: homes}
+}
+
+// setConnected records the connection state of the main broker ("") or a
+// home's broker.
+func (h *health) setConnected(broker string, connected bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if broker == "" {
+		h.connected = connected
+		if connected {
+			h.connectedAt = time.Now()
+		}
+	}
+	// Subscriptions have to be made again after every reconnect
+	delete(h.brokers, broker)
+	if connected {
+		h.brokers[broker] = make(map[string]bool)
+	}
+}
+
+func (h *health) setSubscribed(broker, topic string) {
+	h.mu.Lock()
+	if topics, ok := h.brokers[broker]; ok {
+		topics[topic] = true
+	}
+	h.mu.Unlock()
+}
+
+func (h *health) setUnsubscribed(broker, topic string) {
+	h.mu.Lock()
+	delete(h.brokers[broker], topic)
+	h.mu.Unlock()
+}
+
+// setDevices updates the number of device topics to subscribe to.
+func (h *health) setDevices(devices int) {
+	h.mu.Lock()
+	h.devices = devices
+	h.mu.Unlock()
+}
+
+func (h *health) loopbackReceived() {
+	h.mu.Lock()
+	h.lastLoopback = time.Now()
+	h.mu.Unlock()
+}
+
+// ready reports whether every client is connected and subscribed to every
+// device topic.
+func (h *health) ready() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.connected {
+		return fmt.Errorf("not connected to MQTT broker")
+	}
+	for _, home := range h.homes {
+		if _, ok := h.brokers[home]; !ok {
+			return fmt.Errorf("not connected to the MQTT broker of home %q", home)
+		}
+	}
+	subscribed := 0
+	for _, topics := range h.brokers {
+		subscribed += len(topics)
+	}
+	if subscribed < h.devices {
+		return fmt.Errorf("subscribed to %d of %d device topics", subscribed, h.devices)
+	}
+	return nil
+}
+
+// alive fails only when the client claims to be connected but has not
+// delivered its own loopback messages for a while. A disconnected client
+// is still alive as long as it keeps retrying.
+func (h *health) alive() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.connected {
+		return nil
+	}
+	last := h.lastLoopback
+	if last.Before(h.connectedAt) {
+		last = h.connectedAt
+	}
+	if since := time.Since(last); since > loopbackTimeout {
+		return fmt.Errorf("no loopback message for %v", since.Round(time.Second))
+	}
+	return nil
+}
+
+// subscribeLoopback subscribes to the healthcheck topic on connect.
+func (h *health) subscribeLoopback(client mqtt.Client) {
+	token := client.Subscribe(loopbackTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+		h.loopbackReceived()
+	})
+	if err := waitSubscribed(token, loopbackTopic, ""); err != nil {
+		slog.Error("Failed to subscribe", "topic", loopbackTopic, "error", err)
+	}
+}
+
+// runLoopback periodically publishes to the healthcheck topic.
+func (h *health) runLoopback(ctx context.Context, client mqtt.Client) {
+	ticker := time.NewTicker(loopbackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !client.IsConnectionOpen() {
+			continue
+		}
+		token := client.Publish(loopbackTopic, 0, false, time.Now().Format(time.RFC3339))
+		if !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+			slog.Warn("Healthcheck publish did not complete", "topic", loopbackTopic, "error", token.Error())
+		}
+	}
+}
+
+func probeHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
@@ -0,0 +1,60 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// runHeartbeat pings url every interval, healthchecks.io style, but only
+// while the collector is actually doing its job. A missing ping then
+// means the collector, the broker or every device is gone, which is
+// caught even when Prometheus itself is down.
+func (c *collector) runHeartbeat(ctx context.Context, url string, interval time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := c.working(); err != nil {
+			slog.Debug("Skipping heartbeat", "reason", err)
+			continue
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			slog.Warn("Heartbeat failed", "error", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			slog.Warn("Heartbeat failed", "status", resp.Status)
+			continue
+		}
+		slog.Debug("Heartbeat sent")
+	}
+}
+
+// working reports whether the collector is connected, subscribed and at
+// least one device has reported recently.
+func (c *collector) working() error {
+	if err := c.health.ready(); err != nil {
+		return err
+	}
+
+	expiration := c.config.staleAfter()
+	c.lastUpdateMutex.RLock()
+	defer c.lastUpdateMutex.RUnlock()
+	for _, last := range c.lastUpdateTimes {
+		if time.Since(last) <= expiration {
+			return nil
+		}
+	}
+	return fmt.Errorf("no device reported in the last %v", expiration)
+}
@@ -0,0 +1,100 @@
+package collector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultHistogramBuckets are used for sensors listed in HISTOGRAMS without
+// their own buckets, at the bands guidance usually talks about
+var defaultHistogramBuckets = map[string][]float64{
+	"co2":         {600, 800, 1000, 1500, 2000},
+	"pm25":        {5, 12, 35.5, 55.5, 150.5},
+	"pm10":        {15, 45, 54, 154, 254},
+	"tvoc":        {65, 220, 660, 2200},
+	"temperature": {16, 18, 20, 22, 24, 26, 28},
+	"humidity":    {30, 40, 50, 60, 70},
+	"noise":       {35, 45, 55, 70},
+}
+
+// histogramSink records every reading of some sensors into a histogram,
+// e.g. qingping_co2_ppm_readings_bucket{le="1000"}, so the share of
+// readings within a band can be queried over any range.
+type histogramSink struct {
+	histograms map[string]*prometheus.HistogramVec // by sensor key
+}
+
+// parseHistograms parses sensor or sensor=bucket:bucket:... entries, e.g.
+// co2=600:800:1000:1500.
+func parseHistograms(entries []string) (map[string][]float64, error) {
+	buckets := make(map[string][]float64, len(entries))
+	for _, entry := range entries {
+		key, bounds, ok := strings.Cut(entry, "=")
+		if !ok {
+			defaults, ok := defaultHistogramBuckets[key]
+			if !ok {
+				return nil, fmt.Errorf("no default buckets for %q, want %s=bucket:bucket:...", key, key)
+			}
+			buckets[key] = defaults
+			continue
+		}
+		var parsed []float64
+		for _, bound := range strings.Split(bounds, ":") {
+			value, err := strconv.ParseFloat(bound, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry %q, want sensor=bucket:bucket:...", entry)
+			}
+			if len(parsed) > 0 && value <= parsed[len(parsed)-1] {
+				return nil, fmt.Errorf("buckets of %q must be increasing", key)
+			}
+			parsed = append(parsed, value)
+		}
+		buckets[key] = parsed
+	}
+	return buckets, nil
+}
+
+// newHistogramSink registers a histogram per sensor. It runs once at
+// startup, after fields and units are set up.
+func newHistogramSink(entries []string, registerer prometheus.Registerer) (*histogramSink, error) {
+	buckets, err := parseHistograms(entries)
+	if err != nil {
+		return nil, fmt.Errorf("HISTOGRAMS: %w", err)
+	}
+	s := &histogramSink{histograms: make(map[string]*prometheus.HistogramVec)}
+	for key, bounds := range buckets {
+		metric, ok := sensorMetrics[key]
+		if !ok {
+			return nil, fmt.Errorf("HISTOGRAMS: no metric for sensor %q", key)
+		}
+		histogram := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    metric.Name + "_readings",
+			Help:    fmt.Sprintf("%s, every reading counted in its bucket", metric.Help),
+			Buckets: bounds,
+		}, []string{"device"})
+		if err := registerer.Register(histogram); err != nil {
+			return nil, fmt.Errorf("HISTOGRAMS: %w", err)
+		}
+		s.histograms[key] = histogram
+	}
+	return s, nil
+}
+
+func (s *histogramSink) Name() string { return "histogram" }
+
+func (s *histogramSink) Write(device *Device, data CGDN1Data) {
+	for key, histogram := range s.histograms {
+		if value, ok := data.Values[key]; ok {
+			histogram.WithLabelValues(device.Name).Observe(value)
+		}
+	}
+}
+
+func (s *histogramSink) Forget(device *Device) {
+	for _, histogram := range s.histograms {
+		histogram.DeleteLabelValues(device.Name)
+	}
+}
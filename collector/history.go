@@ -0,0 +1,147 @@
+package collector
+
+import (
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sample is a stored reading
+type Sample struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// historyStore is implemented by sinks that keep readings around for the
+// API and derived metrics.
+type historyStore interface {
+	Sink
+	// Samples returns the device's samples in [from, to], oldest first.
+	Samples(device string, from, to time.Time) ([]Sample, error)
+}
+
+// memoryHistory keeps readings in memory for as long as the device's
+// route retention (or the default retention) says.
+type memoryHistory struct {
+	retention time.Duration
+
+	mu      sync.RWMutex
+	samples map[string][]Sample
+}
+
+func newMemoryHistory(retention time.Duration) *memoryHistory {
+	return &memoryHistory{
+		retention: retention,
+		samples:   make(map[string][]Sample),
+	}
+}
+
+func (h *memoryHistory) Name() string { return "history" }
+
+func (h *memoryHistory) Write(device *Device, data CGDN1Data) {
+	retention := device.policy.retentionOr(h.retention)
+
+	values := make(map[string]float64, len(data.Values))
+	for key, value := range data.Values {
+		values[key] = value
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	samples := append(h.samples[device.Name], Sample{Time: data.Timestamp, Values: values})
+	cutoff := data.Timestamp.Add(-retention)
+	expired := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(cutoff) })
+	if expired > 0 {
+		samples = append([]Sample(nil), samples[expired:]...)
+	}
+	h.samples[device.Name] = samples
+}
+
+// Backfill inserts a reading older than the device's latest in time
+// order, unless it has expired or one is already kept for its time.
+func (h *memoryHistory) Backfill(device *Device, data CGDN1Data) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	samples := h.samples[device.Name]
+	if len(samples) > 0 && data.Timestamp.Before(samples[len(samples)-1].Time.Add(-device.policy.retentionOr(h.retention))) {
+		return
+	}
+	i := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(data.Timestamp) })
+	if i < len(samples) && samples[i].Time.Equal(data.Timestamp) {
+		return
+	}
+	h.samples[device.Name] = slices.Insert(samples, i, Sample{Time: data.Timestamp, Values: maps.Clone(data.Values)})
+}
+
+func (h *memoryHistory) Samples(device string, from, to time.Time) ([]Sample, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	samples := h.samples[device]
+	start := sort.Search(len(samples), func(i int) bool { return !samples[i].Time.Before(from) })
+	end := sort.Search(len(samples), func(i int) bool { return samples[i].Time.After(to) })
+	if start >= end {
+		return nil, nil
+	}
+	return append([]Sample(nil), samples[start:end]...), nil
+}
+
+func (h *memoryHistory) Buffered() (int, int64, int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var items int
+	var memory int64
+	for _, samples := range h.samples {
+		items += len(samples)
+		for _, sample := range samples {
+			// Sample struct, map header and per-entry key, value and overhead
+			memory += 48 + 48 + int64(len(sample.Values))*40
+			for key := range sample.Values {
+				memory += int64(len(key))
+			}
+		}
+	}
+	return items, memory, 0
+}
+
+// sensorSeries extracts one sensor's values from samples.
+func sensorSeries(samples []Sample, sensor string) []float64 {
+	values := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		if value, ok := sample.Values[sensor]; ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// percentile returns the p-th percentile (0-100) of sorted values using
+// linear interpolation between closest ranks.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(rank)
+	if lower >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[lower+1]-sorted[lower])
+}
+
+// percentileRank returns the share (0-100) of sorted values below value,
+// counting equal values half.
+func percentileRank(sorted []float64, value float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	below := sort.SearchFloat64s(sorted, value)
+	equal := sort.Search(len(sorted), func(i int) bool { return sorted[i] > value }) - below
+	return (float64(below) + float64(equal)/2) / float64(len(sorted)) * 100
+}
@@ -0,0 +1,140 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// HomeConfig is a place with its own MQTT broker, e.g. a second house
+// monitored from the same collector. Its devices are merged with the
+// others and carry the home's labels.
+type HomeConfig struct {
+	Name string `json:"name"`
+	// Broker is the home's MQTT broker; without one the home's devices
+	// are on the main broker
+	Broker   string `json:"broker,omitempty"`
+	Port     string `json:"port,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// Labels are attached to every metric of the home's devices; a
+	// device's own labels win
+	Labels map[string]string `json:"labels,omitempty"`
+	// Location gives the home's devices coordinates unless they have
+	// their own
+	Location *Location `json:"location,omitempty"`
+	Devices  []*Device `json:"devices"`
+}
+
+// addHomes validates the homes and appends their devices to the config.
+func (config *Config) addHomes(homes []HomeConfig) error {
+	seen := make(map[string]bool, len(homes))
+	for i := range homes {
+		home := &homes[i]
+		if home.Name == "" {
+			return fmt.Errorf("home %d has no name", i+1)
+		}
+		if seen[home.Name] {
+			return fmt.Errorf("duplicate home %q", home.Name)
+		}
+		seen[home.Name] = true
+		if home.Port == "" {
+			home.Port = "1883"
+		}
+		for name := range home.Labels {
+			if !validLabelName(name) || name == "device" {
+				return fmt.Errorf("home %q: invalid label name %q", home.Name, name)
+			}
+		}
+		if home.Location != nil {
+			if err := home.Location.validate(); err != nil {
+				return fmt.Errorf("home %q: %w", home.Name, err)
+			}
+		}
+
+		for _, device := range home.Devices {
+			device.home = home
+			device.Labels = homeLabels(device, device.Labels)
+		}
+		config.Devices = append(config.Devices, home.Devices...)
+		config.Homes = append(config.Homes, home)
+	}
+	return nil
+}
+
+// homeLabels returns labels on top of the labels of the device's home.
+func homeLabels(device *Device, labels map[string]string) map[string]string {
+	if device.home == nil || len(device.home.Labels) == 0 {
+		return labels
+	}
+	merged := maps.Clone(device.home.Labels)
+	maps.Copy(merged, labels)
+	return merged
+}
+
+// mqttOptions are the client options shared by every broker connection.
+// broker may list several brokers, which are tried in order.
+func mqttOptions(broker, port, username, password, clientID string) *mqtt.ClientOptions {
+	opts := mqtt.NewClientOptions()
+	for _, address := range brokerAddresses(broker, port) {
+		opts.AddBroker("tcp://" + address)
+	}
+	opts.SetClientID(clientID)
+	opts.SetUsername(username)
+	opts.SetPassword(password)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetConnectionNotificationHandler(recordConnectionErrors(broker))
+	return opts
+}
+
+// clientFor returns the client of the broker the device is on.
+func (c *collector) clientFor(device *Device) mqtt.Client {
+	if device.home != nil {
+		if client, ok := c.homeClients[device.home.Name]; ok {
+			return client
+		}
+	}
+	return c.client
+}
+
+// startDevices subscribes to the devices on a broker and starts their
+// reporting, after every (re)connect.
+func (c *collector) startDevices(client mqtt.Client, broker string, devices []*Device) {
+	for _, device := range devices {
+		if c.subscribeToCGDN1(client, device) {
+			c.health.setSubscribed(broker, device.upTopic())
+		}
+		// Put the device in its configured state, then start reporting
+		c.sendSettings(device)
+		c.sendConfigMessage(device)
+	}
+	c.republishAvailability(client, devices)
+}
+
+// connectHome connects to the broker of a home and starts its devices
+// once connected. The client keeps retrying in the background.
+func (c *collector) connectHome(home *HomeConfig) {
+	opts := mqttOptions(home.Broker, home.Port, home.Username, home.Password, "qingping_collector_"+home.Name)
+	failover := newBrokerFailover(home.Name, opts)
+	opts.OnConnect = func(client mqtt.Client) {
+		slog.Info("Connected to MQTT broker", "home", home.Name, "broker", failover.connected())
+		c.health.setConnected(home.Name, true)
+		c.startDevices(client, home.Name, c.devicesOn(home.Name))
+	}
+	opts.OnConnectionLost = func(client mqtt.Client, err error) {
+		slog.Warn("Connection lost", "home", home.Name, "error", err)
+		c.health.setConnected(home.Name, false)
+		failover.lost()
+	}
+
+	client := mqtt.NewClient(opts)
+	c.homeClients[home.Name] = client
+	// ConnectRetry makes the token complete only once connected; don't
+	// hold up the other homes for a broker that is down
+	client.Connect()
+}
@@ -0,0 +1,230 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// HomeAssistantConfig configures MQTT discovery for Home Assistant
+type HomeAssistantConfig struct {
+	Enabled         bool
+	DiscoveryPrefix string // usually "homeassistant"
+	StatePrefix     string // state is published to {StatePrefix}/{device}/state
+	// AvailabilityTopic marks the entities unavailable while the collector
+	// is offline, if set
+	AvailabilityTopic string
+	// DeviceAvailability marks them unavailable while their device is, if
+	// set; {device} and {mac} are replaced
+	DeviceAvailability string
+}
+
+// haSensor describes a sensorData key as a Home Assistant sensor entity
+type haSensor struct {
+	Name        string
+	Unit        string
+	DeviceClass string
+}
+
+var haSensors = map[string]haSensor{
+	"temperature": {"Temperature", "°C", "temperature"},
+	"humidity":    {"Humidity", "%", "humidity"},
+	"co2":         {"CO2", "ppm", "carbon_dioxide"},
+	"pm25":        {"PM2.5", "µg/m³", "pm25"},
+	"pm10":        {"PM10", "µg/m³", "pm10"},
+	"tvoc":        {"TVOC", "ppb", "volatile_organic_compounds_parts"},
+	"battery":     {"Battery", "%", "battery"},
+	"tvoc_index":  {"TVOC index", "", "aqi"},
+	"noise":       {"Noise", "dB", "sound_pressure"},
+}
+
+// haConvertedSensors are the sensors of the converted units in units.go,
+// discovered when METRIC_TEMPERATURE_UNIT or METRIC_TVOC_UNIT enable them
+var haConvertedSensors = map[string]haSensor{
+	"temperature_f": {"Temperature", "°F", "temperature"},
+	"tvoc_mgm3":     {"TVOC", "mg/m³", "volatile_organic_compounds"},
+}
+
+// haEnabledSensors returns the sensors in the units the metrics are
+// exported in, by the key of their value. With both units of a quantity
+// enabled, the converted one is named after its unit.
+func haEnabledSensors() map[string]haSensor {
+	sensors := make(map[string]haSensor, len(haSensors)+len(haConvertedSensors))
+	for key, sensor := range haSensors {
+		if exported(key) {
+			sensors[key] = sensor
+		}
+	}
+	for key, sensor := range haConvertedSensors {
+		conversion, ok := conversions[key]
+		if !ok {
+			continue
+		}
+		if exported(conversion.From) {
+			sensor.Name += " (" + sensor.Unit + ")"
+		}
+		sensors[key] = sensor
+	}
+	return sensors
+}
+
+// haSensorSource is the key of the value a sensor is converted from, or
+// the sensor's own key.
+func haSensorSource(key string) string {
+	if conversion, ok := temperatureConversions[key]; ok {
+		return conversion.From
+	}
+	if conversion, ok := tvocConversions[key]; ok {
+		return conversion.From
+	}
+	return key
+}
+
+// haDiscoveryPayload is the body of a homeassistant/sensor/.../config topic
+type haDiscoveryPayload struct {
+	Name              string           `json:"name"`
+	UniqueID          string           `json:"unique_id"`
+	ObjectID          string           `json:"object_id"`
+	StateTopic        string           `json:"state_topic"`
+	ValueTemplate     string           `json:"value_template"`
+	UnitOfMeasurement string           `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string           `json:"device_class,omitempty"`
+	StateClass        string           `json:"state_class"`
+	Availability      []haAvailability `json:"availability,omitempty"`
+	AvailabilityMode  string           `json:"availability_mode,omitempty"` // all needs the collector and device online
+	Device            haDevice         `json:"device"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type haDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+// homeAssistantSink publishes discovery configs on connect and the latest
+// values of every reading as a JSON state document.
+type homeAssistantSink struct {
+	config  HomeAssistantConfig
+	client  mqtt.Client
+	sensors map[string]haSensor
+}
+
+func newHomeAssistantSink(config HomeAssistantConfig) *homeAssistantSink {
+	if config.DiscoveryPrefix == "" {
+		config.DiscoveryPrefix = "homeassistant"
+	}
+	if config.StatePrefix == "" {
+		config.StatePrefix = "qingping-collector"
+	}
+	return &homeAssistantSink{config: config, sensors: haEnabledSensors()}
+}
+
+func (s *homeAssistantSink) Name() string { return "homeassistant" }
+
+func (s *homeAssistantSink) stateTopic(device *Device) string {
+	return fmt.Sprintf("%s/%s/state", s.config.StatePrefix, device.Name)
+}
+
+// publishDiscovery announces every sensor of every device routed to this
+// sink. Configs are retained so Home Assistant picks them up after restarts.
+func (s *homeAssistantSink) publishDiscovery(client mqtt.Client, devices []*Device) {
+	for _, device := range devices {
+		if !routesTo(device, s) {
+			continue
+		}
+		objectPrefix := "qingping_" + device.id()
+		var availability []haAvailability
+		if s.config.AvailabilityTopic != "" {
+			availability = append(availability, haAvailability{Topic: s.config.AvailabilityTopic})
+		}
+		if s.config.DeviceAvailability != "" {
+			availability = append(availability, haAvailability{Topic: availabilityTopic(s.config.DeviceAvailability, device)})
+		}
+		availabilityMode := ""
+		if len(availability) > 1 {
+			availabilityMode = "all"
+		}
+		manufacturer, model := "Qingping", device.model().Name
+		if device.foreign() {
+			manufacturer, model = "", ""
+		}
+		// A unit switched off leaves no stale entity behind
+		for _, known := range []map[string]haSensor{haSensors, haConvertedSensors} {
+			for key := range known {
+				if _, ok := s.sensors[key]; ok || !device.reports(haSensorSource(key)) {
+					continue
+				}
+				topic := fmt.Sprintf("%s/sensor/%s/%s/config", s.config.DiscoveryPrefix, objectPrefix, key)
+				token := client.Publish(topic, 0, true, "")
+				if token.Wait() && token.Error() != nil {
+					slog.Error("Failed to remove discovery config", "device", device.Name, "topic", topic, "error", token.Error())
+				}
+			}
+		}
+		for key, sensor := range s.sensors {
+			if !device.reports(haSensorSource(key)) {
+				continue
+			}
+			payload, err := json.Marshal(haDiscoveryPayload{
+				Name:              sensor.Name,
+				UniqueID:          objectPrefix + "_" + key,
+				ObjectID:          device.Name + "_" + key,
+				StateTopic:        s.stateTopic(device),
+				ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", key),
+				UnitOfMeasurement: sensor.Unit,
+				DeviceClass:       sensor.DeviceClass,
+				StateClass:        "measurement",
+				Availability:      availability,
+				AvailabilityMode:  availabilityMode,
+				Device: haDevice{
+					Identifiers:  []string{objectPrefix},
+					Name:         device.Name,
+					Manufacturer: manufacturer,
+					Model:        model,
+				},
+			})
+			if err != nil {
+				slog.Error("Failed to marshal discovery config", "device", device.Name, "error", err)
+				continue
+			}
+
+			topic := fmt.Sprintf("%s/sensor/%s/%s/config", s.config.DiscoveryPrefix, objectPrefix, key)
+			token := client.Publish(topic, 0, true, payload)
+			if token.Wait() && token.Error() != nil {
+				slog.Error("Failed to publish discovery config", "device", device.Name, "topic", topic, "error", token.Error())
+			}
+		}
+		slog.Info("Published Home Assistant discovery", "device", device.Name)
+	}
+}
+
+func (s *homeAssistantSink) Write(device *Device, data CGDN1Data) {
+	if s.client == nil {
+		return
+	}
+
+	state := make(map[string]float64, len(data.Values))
+	for key, value := range data.Values {
+		if _, ok := s.sensors[key]; ok {
+			state[key] = value
+		}
+	}
+	payload, err := json.Marshal(state)
+	if err != nil {
+		slog.Error("Failed to marshal state", "device", device.Name, "error", err)
+		return
+	}
+
+	topic := s.stateTopic(device)
+	token := s.client.Publish(topic, 0, true, payload)
+	if token.Wait() && token.Error() != nil {
+		slog.Error("Failed to publish state", "device", device.Name, "topic", topic, "error", token.Error())
+	}
+}
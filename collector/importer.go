@@ -0,0 +1,292 @@
+package collector
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// importColumns maps the column names of Qingping+ app and cloud exports,
+// without their unit, to reading keys. Exports come in the app's language.
+var importColumns = map[string]string{
+	"time":        "time",
+	"date":        "time",
+	"timestamp":   "time",
+	"时间":          "time",
+	"temperature": "temperature",
+	"temp":        "temperature",
+	"温度":          "temperature",
+	"humidity":    "humidity",
+	"湿度":          "humidity",
+	"co2":         "co2",
+	"二氧化碳":        "co2",
+	"pm2.5":       "pm25",
+	"pm25":        "pm25",
+	"pm10":        "pm10",
+	"tvoc":        "tvoc",
+	"noise":       "noise",
+	"噪音":          "noise",
+	"battery":     "battery",
+	"电量":          "battery",
+}
+
+// importTimeLayouts are tried in order for the time column.
+var importTimeLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006/01/02 15:04:05",
+	"2006/01/02 15:04",
+	"2006/1/2 15:04",
+	time.RFC3339,
+}
+
+// importColumn is a recognised column of an export.
+type importColumn struct {
+	index      int
+	key        string
+	fahrenheit bool
+}
+
+// parseExportHeader finds the time and sensor columns. Headers look like
+// "Temperature(℃)" or "PM2.5 (μg/m³)"; unknown columns are returned so
+// they can be reported.
+func parseExportHeader(header []string) (timeIndex int, columns []importColumn, unknown []string, err error) {
+	timeIndex = -1
+	for i, title := range header {
+		title = strings.TrimPrefix(strings.TrimSpace(title), "\ufeff")
+		name, unit := title, ""
+		if open := strings.IndexAny(title, "(（"); open >= 0 {
+			name, unit = title[:open], title[open:]
+		}
+		key, ok := importColumns[strings.ToLower(strings.TrimSpace(name))]
+		switch {
+		case !ok:
+			if title != "" {
+				unknown = append(unknown, title)
+			}
+		case key == "time":
+			timeIndex = i
+		default:
+			columns = append(columns, importColumn{
+				index:      i,
+				key:        key,
+				fahrenheit: strings.Contains(unit, "F") || strings.Contains(unit, "℉"),
+			})
+		}
+	}
+	if timeIndex < 0 {
+		return 0, nil, nil, fmt.Errorf("no time column in header %q", header)
+	}
+	if len(columns) == 0 {
+		return 0, nil, nil, fmt.Errorf("no known sensor columns in header %q", header)
+	}
+	return timeIndex, columns, unknown, nil
+}
+
+// parseExportTime reads a time in one of importTimeLayouts or as unix
+// seconds or milliseconds.
+func parseExportTime(value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if n > 1e12 {
+			return time.UnixMilli(n), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	for _, layout := range importTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised time %q", value)
+}
+
+// readExport parses a Qingping+ CSV export into raw readings, oldest
+// first. Empty or "-" cells are left out of a reading.
+func readExport(r io.Reader, loc *time.Location) ([]Sample, []string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("read header: %w", err)
+	}
+	timeIndex, columns, unknown, err := parseExportHeader(header)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var samples []Sample
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if timeIndex >= len(record) || strings.TrimSpace(record[timeIndex]) == "" {
+			continue
+		}
+		t, err := parseExportTime(record[timeIndex], loc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		values := make(map[string]float64, len(columns))
+		for _, column := range columns {
+			if column.index >= len(record) {
+				continue
+			}
+			cell := strings.TrimSpace(record[column.index])
+			if cell == "" || cell == "-" || cell == "--" {
+				continue
+			}
+			value, err := strconv.ParseFloat(cell, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("line %d: %s: %w", line, header[column.index], err)
+			}
+			if column.fahrenheit {
+				value = (value - 32) * 5 / 9
+			}
+			values[column.key] = value
+		}
+		if len(values) > 0 {
+			samples = append(samples, Sample{Time: t, Values: values})
+		}
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	return samples, unknown, nil
+}
+
+// runImport implements "import -device NAME FILE...": backfill history
+// from Qingping+ exports into HISTORY_DB and optionally remote_write.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	name := fs.String("device", "", "name of the device the export belongs to (required)")
+	model := fs.String("model", "cgdn1", "model of the device")
+	fs.String("history-db", "", "SQLite history file to import into ($HISTORY_DB)")
+	remoteWrite := fs.Bool("remote-write", false, "also push the readings to $REMOTE_WRITE_URL")
+	zone := fs.String("timezone", "Local", "time zone of the export's times, e.g. Europe/Berlin")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s import -device NAME [flags] FILE...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || fs.NArg() == 0 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	// The history, units and remote_write endpoint are the collector's
+	settings, _, err := loadSettings(sharedFlags(fs, "history-db"), os.ReadFile)
+	if err != nil {
+		return err
+	}
+	historyDB := settings.HistoryDB
+	if historyDB == "" && !*remoteWrite {
+		return fmt.Errorf("nothing to import into: set -history-db (HISTORY_DB) or -remote-write")
+	}
+	loc, err := time.LoadLocation(*zone)
+	if err != nil {
+		return err
+	}
+	deviceModel, err := lookupModel(*model)
+	if err != nil {
+		return err
+	}
+	var samples []Sample
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		read, unknown, err := readExport(f, loc)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if len(unknown) > 0 {
+			fmt.Fprintf(os.Stderr, "%s: ignoring columns %s\n", path, strings.Join(unknown, ", "))
+		}
+		samples = append(samples, read...)
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+	if len(samples) == 0 {
+		return fmt.Errorf("no readings found")
+	}
+
+	// Readings get the same derived values and AQI as live ones
+	device := &Device{Name: *name, Model: deviceModel}
+	c := &collector{config: Config{aqi: settings.aqi, Locale: settings.Locale}}
+	if err := setupUnits(settings.TemperatureUnit, settings.TVOCUnit, prometheus.NewRegistry()); err != nil {
+		return err
+	}
+	readings := make([]CGDN1Data, len(samples))
+	for i, sample := range samples {
+		readings[i] = c.newReading(device, sample.Values, sample.Time)
+	}
+
+	if historyDB != "" {
+		db, err := newSQLiteHistory(historyDB, 0)
+		if err != nil {
+			return err
+		}
+		added, err := db.Import(device, readings)
+		db.Close()
+		if err != nil {
+			return fmt.Errorf("import into %s: %w", historyDB, err)
+		}
+		fmt.Printf("Imported %d of %d readings into %s\n", added, len(readings), historyDB)
+	}
+	if *remoteWrite {
+		pushed, err := importRemoteWrite(settings.RemoteWrite, device, readings)
+		if err != nil {
+			return fmt.Errorf("remote_write: %w", err)
+		}
+		fmt.Printf("Pushed %d samples via remote_write\n", pushed)
+	}
+	return nil
+}
+
+// importRemoteWrite pushes readings batch by batch, waiting for each one
+// instead of queueing like the live sink.
+func importRemoteWrite(config RemoteWriteConfig, device *Device, readings []CGDN1Data) (int, error) {
+	if config.URL == "" {
+		return 0, fmt.Errorf("REMOTE_WRITE_URL is not set")
+	}
+	sink := &remoteWriteSink{config: config, client: &http.Client{Timeout: 30 * time.Second}}
+
+	var batch []remoteSample
+	pushed := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := sink.push(batch); err != nil {
+			return err
+		}
+		pushed += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for _, reading := range readings {
+		batch = append(batch, remoteSamples(device, reading)...)
+		if len(batch) >= config.BatchSize {
+			if err := flush(); err != nil {
+				return pushed, err
+			}
+		}
+	}
+	return pushed, flush()
+}
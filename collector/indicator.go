@@ -0,0 +1,166 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gpioRoot is the legacy sysfs GPIO interface
+const gpioRoot = "/sys/class/gpio"
+
+// IndicatorConfig drives a GPIO pin or LED of the collector host while
+// threshold rules fire, e.g. a red LED while CO2 is high.
+type IndicatorConfig struct {
+	Name      string   `json:"name,omitempty"`
+	GPIO      *int     `json:"gpio,omitempty"`  // sysfs GPIO number, exported and set as output
+	Path      string   `json:"path,omitempty"`  // file to write instead, e.g. /sys/class/leds/led0/brightness
+	Rules     []string `json:"rules,omitempty"` // empty means every rule
+	Tags      []string `json:"tags,omitempty"`  // empty means every device
+	ActiveLow bool     `json:"active_low,omitempty"`
+}
+
+// indicator is a prepared output and its current state
+type indicator struct {
+	config  IndicatorConfig
+	path    string
+	on, off string
+	lit     bool
+}
+
+// indicators switch their outputs whenever the firing threshold rules change.
+type indicators struct {
+	thresholds *thresholdSink
+	// device looks a device up by name; the collector swaps in updated
+	// devices on reload
+	device func(name string) *Device
+
+	mu      sync.Mutex
+	outputs []*indicator
+}
+
+func newIndicators(configs []IndicatorConfig, thresholds *thresholdSink, devices []*Device) (*indicators, error) {
+	byName := make(map[string]*Device, len(devices))
+	for _, device := range devices {
+		byName[device.Name] = device
+	}
+	in := &indicators{thresholds: thresholds, device: func(name string) *Device { return byName[name] }}
+
+	for i, config := range configs {
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("indicator %d", i)
+		}
+		for _, rule := range config.Rules {
+			if !thresholds.hasRule(rule) {
+				return nil, fmt.Errorf("%s references unknown threshold %q", config.Name, rule)
+			}
+		}
+		output, err := openIndicator(config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", config.Name, err)
+		}
+		in.outputs = append(in.outputs, output)
+	}
+
+	in.update()
+	return in, nil
+}
+
+// openIndicator prepares the output of config and works out what to write
+// to turn it on and off.
+func openIndicator(config IndicatorConfig) (*indicator, error) {
+	output := &indicator{config: config, path: config.Path, on: "1", off: "0"}
+	switch {
+	case config.GPIO != nil && config.Path != "":
+		return nil, fmt.Errorf("set gpio or path, not both")
+	case config.GPIO != nil:
+		pin := strconv.Itoa(*config.GPIO)
+		output.path = filepath.Join(gpioRoot, "gpio"+pin, "value")
+		if _, err := os.Stat(output.path); errors.Is(err, fs.ErrNotExist) {
+			if err := os.WriteFile(filepath.Join(gpioRoot, "export"), []byte(pin), 0); err != nil {
+				return nil, fmt.Errorf("export gpio %s: %w", pin, err)
+			}
+			// udev needs a moment to make the new files writable
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := os.WriteFile(filepath.Join(gpioRoot, "gpio"+pin, "direction"), []byte("out"), 0); err != nil {
+			return nil, fmt.Errorf("set gpio %s as output: %w", pin, err)
+		}
+	case config.Path == "":
+		return nil, fmt.Errorf("needs gpio or path")
+	case filepath.Base(config.Path) == "brightness":
+		// Detach the LED from kernel triggers like heartbeat and light it fully
+		dir := filepath.Dir(config.Path)
+		if err := os.WriteFile(filepath.Join(dir, "trigger"), []byte("none"), 0); err != nil {
+			slog.Debug("Failed to clear LED trigger", "path", dir, "error", err)
+		}
+		if brightness, err := os.ReadFile(filepath.Join(dir, "max_brightness")); err == nil {
+			output.on = strings.TrimSpace(string(brightness))
+		}
+	}
+	if config.ActiveLow {
+		output.on, output.off = output.off, output.on
+	}
+	return output, output.write(false)
+}
+
+func (o *indicator) write(lit bool) error {
+	value := o.off
+	if lit {
+		value = o.on
+	}
+	if err := os.WriteFile(o.path, []byte(value), 0); err != nil {
+		return err
+	}
+	o.lit = lit
+	return nil
+}
+
+// matches reports whether a firing rule on a device should light o.
+func (o *indicator) matches(device *Device, rule string) bool {
+	if len(o.config.Rules) > 0 && !slices.Contains(o.config.Rules, rule) {
+		return false
+	}
+	return device.hasAnyTag(o.config.Tags)
+}
+
+// update lights every output whose rules fire and turns off the others.
+func (in *indicators) update() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	for _, output := range in.outputs {
+		lit := in.thresholds.anyFiring(func(device, rule string) bool {
+			d := in.device(device)
+			return d != nil && output.matches(d, rule)
+		})
+		if lit == output.lit {
+			continue
+		}
+		if err := output.write(lit); err != nil {
+			slog.Error("Failed to switch indicator", "indicator", output.config.Name, "path", output.path, "error", err)
+			continue
+		}
+		slog.Info("Switched indicator", "indicator", output.config.Name, "on", lit)
+	}
+}
+
+// Close turns every output off.
+func (in *indicators) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	var errs []error
+	for _, output := range in.outputs {
+		errs = append(errs, output.write(false))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,146 @@
+package collector
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Location places a device on a map, a floorplan or both
+type Location struct {
+	Latitude  *float64 `json:"lat,omitempty"`
+	Longitude *float64 `json:"lon,omitempty"`
+	// Floor names the floorplan X and Y are on, e.g. "ground"
+	Floor string   `json:"floor,omitempty"`
+	X     *float64 `json:"x,omitempty"`
+	Y     *float64 `json:"y,omitempty"`
+}
+
+// validate checks that coordinates come in pairs and are in range.
+func (l *Location) validate() error {
+	if (l.Latitude == nil) != (l.Longitude == nil) {
+		return fmt.Errorf("location needs both lat and lon")
+	}
+	if l.Latitude != nil && (*l.Latitude < -90 || *l.Latitude > 90 || *l.Longitude < -180 || *l.Longitude > 180) {
+		return fmt.Errorf("location lat or lon out of range")
+	}
+	if (l.X == nil) != (l.Y == nil) {
+		return fmt.Errorf("location needs both x and y")
+	}
+	return nil
+}
+
+// geo reports whether the location has coordinates.
+func (l *Location) geo() bool {
+	return l != nil && l.Latitude != nil
+}
+
+// placeDevice gives a device without coordinates those of its home, so a
+// site only needs them once.
+func placeDevice(device *Device) {
+	if device.home == nil || !device.home.Location.geo() || device.Location.geo() {
+		return
+	}
+	location := Location{}
+	if device.Location != nil {
+		location = *device.Location
+	}
+	location.Latitude, location.Longitude = device.home.Location.Latitude, device.home.Location.Longitude
+	device.Location = &location
+}
+
+var deviceLocationDesc = prometheus.NewDesc(
+	"qingping_device_location",
+	"Always 1, with the device's configured location as labels for joins and map panels",
+	[]string{"device", "latitude", "longitude", "floor"}, nil)
+
+// locationCollector exports the location of every current device,
+// computed on every scrape so reloads and renames apply right away.
+type locationCollector struct{ c *collector }
+
+func (l locationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceLocationDesc
+}
+
+func (l locationCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, device := range l.c.devices() {
+		location := device.Location
+		if location == nil {
+			continue
+		}
+		var latitude, longitude string
+		if location.geo() {
+			latitude = strconv.FormatFloat(*location.Latitude, 'f', -1, 64)
+			longitude = strconv.FormatFloat(*location.Longitude, 'f', -1, 64)
+		}
+		ch <- prometheus.MustNewConstMetric(deviceLocationDesc, prometheus.GaugeValue, 1, device.Name, latitude, longitude, location.Floor)
+	}
+}
+
+// geoFeature is a device as a GeoJSON feature
+type geoFeature struct {
+	Type       string       `json:"type"` // always Feature
+	ID         string       `json:"id"`
+	Geometry   geoPoint     `json:"geometry"`
+	Properties DeviceStatus `json:"properties"`
+}
+
+type geoPoint struct {
+	Type        string     `json:"type"` // always Point
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// Floorplan lists the devices placed on one floor, their position being
+// in their location
+type Floorplan struct {
+	Floor   string         `json:"floor"`
+	Devices []DeviceStatus `json:"devices"`
+}
+
+// handleMap serves GET /api/map with every device that has coordinates as
+// a GeoJSON FeatureCollection, or with format=floorplan the devices with
+// floorplan positions grouped by floor. Both carry the latest readings.
+func (c *collector) handleMap(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	switch r.URL.Query().Get("format") {
+	case "", "geojson":
+		features := make([]geoFeature, 0)
+		for _, device := range c.devices() {
+			if !device.Location.geo() {
+				continue
+			}
+			features = append(features, geoFeature{
+				Type:       "Feature",
+				ID:         device.Name,
+				Geometry:   geoPoint{Type: "Point", Coordinates: [2]float64{*device.Location.Longitude, *device.Location.Latitude}},
+				Properties: c.deviceStatus(device, now),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"type": "FeatureCollection", "features": features})
+	case "floorplan":
+		floors := make(map[string]*Floorplan)
+		for _, device := range c.devices() {
+			if device.Location == nil || device.Location.X == nil {
+				continue
+			}
+			floor := floors[device.Location.Floor]
+			if floor == nil {
+				floor = &Floorplan{Floor: device.Location.Floor}
+				floors[device.Location.Floor] = floor
+			}
+			floor.Devices = append(floor.Devices, c.deviceStatus(device, now))
+		}
+		plans := make([]*Floorplan, 0, len(floors))
+		for _, floor := range floors {
+			plans = append(plans, floor)
+		}
+		sort.Slice(plans, func(i, j int) bool { return plans[i].Floor < plans[j].Floor })
+		writeJSON(w, http.StatusOK, map[string]any{"floors": plans})
+	default:
+		writeError(w, http.StatusBadRequest, "format must be geojson or floorplan")
+	}
+}
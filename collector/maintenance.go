@@ -0,0 +1,143 @@
+package collector
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// MaintenanceWindow is a period in which a device keeps reporting but
+// raises no alerts, e.g. while it's moved, charged or calibrated.
+type MaintenanceWindow struct {
+	Since  time.Time  `json:"since,omitzero"`
+	Until  *time.Time `json:"until,omitempty"` // open-ended if unset
+	Reason string     `json:"reason,omitempty"`
+	// Config is set for devices with "maintenance": true in the config file
+	Config bool `json:"config,omitempty"`
+}
+
+// maintenance tracks the maintenance windows started through the API.
+// They are kept in memory only.
+type maintenance struct {
+	mu      sync.Mutex
+	windows map[string]MaintenanceWindow // by deviceKey, so renames keep them
+}
+
+func newMaintenance() *maintenance {
+	return &maintenance{windows: make(map[string]MaintenanceWindow)}
+}
+
+// window returns the device's maintenance window at now, if it is in one.
+// The config file's flag wins over the API. It is safe on a nil maintenance.
+func (m *maintenance) window(device *Device, now time.Time) (MaintenanceWindow, bool) {
+	if device.Maintenance {
+		return MaintenanceWindow{Config: true}, true
+	}
+	if m == nil {
+		return MaintenanceWindow{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, ok := m.windows[deviceKey(device)]
+	if ok && w.Until != nil && !now.Before(*w.Until) {
+		delete(m.windows, deviceKey(device))
+		return MaintenanceWindow{}, false
+	}
+	return w, ok
+}
+
+func (m *maintenance) active(device *Device, now time.Time) bool {
+	_, ok := m.window(device, now)
+	return ok
+}
+
+func (m *maintenance) start(device *Device, w MaintenanceWindow) {
+	m.mu.Lock()
+	m.windows[deviceKey(device)] = w
+	m.mu.Unlock()
+}
+
+// end closes the device's window started through the API and reports
+// whether there was one.
+func (m *maintenance) end(device *Device) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, ok := m.windows[deviceKey(device)]
+	delete(m.windows, deviceKey(device))
+	return ok
+}
+
+// markMaintenance exports whether the device is in maintenance, so its
+// series can be told apart on dashboards.
+func (c *collector) markMaintenance(device *Device, now time.Time) {
+	if c.maintenance.active(device, now) {
+		deviceMaintenance.WithLabelValues(device.Name).Set(1)
+	} else {
+		deviceMaintenance.WithLabelValues(device.Name).Set(0)
+	}
+}
+
+// handleStartMaintenance serves PUT /api/v1/devices/{name}/maintenance with
+// an optional {"duration": "2h", "reason": "calibrating"}. Without a
+// duration maintenance lasts until it is ended.
+func (c *collector) handleStartMaintenance(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.PathValue("name"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	var body struct {
+		Duration Duration `json:"duration"`
+		Reason   string   `json:"reason"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid maintenance: "+err.Error())
+		return
+	}
+	if body.Duration < 0 {
+		writeError(w, http.StatusBadRequest, "duration must not be negative")
+		return
+	}
+
+	now := time.Now()
+	window := MaintenanceWindow{Since: now, Reason: body.Reason}
+	if body.Duration > 0 {
+		until := now.Add(time.Duration(body.Duration))
+		window.Until = &until
+	}
+	c.maintenance.start(device, window)
+	c.markMaintenance(device, now)
+	slog.Info("Device in maintenance, suppressing its alerts", "device", device.Name, "until", window.Until, "reason", window.Reason)
+
+	// The config file's flag may still be in force
+	window, _ = c.maintenance.window(device, now)
+	writeJSON(w, http.StatusOK, window)
+}
+
+// handleEndMaintenance serves DELETE /api/v1/devices/{name}/maintenance.
+// Maintenance set in the config file can only be ended there.
+func (c *collector) handleEndMaintenance(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.PathValue("name"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	if device.Maintenance {
+		writeError(w, http.StatusConflict, "maintenance is set in the config file")
+		return
+	}
+	if !c.maintenance.end(device) {
+		writeError(w, http.StatusNotFound, "device is not in maintenance")
+		return
+	}
+	c.markMaintenance(device, time.Now())
+	slog.Info("Device out of maintenance", "device", device.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,51 @@
+package collector
+
+import "time"
+
+// CGDN1Data represents the Air Monitor Lite sensor data
+type CGDN1Data struct {
+	Temperature float64   `json:"temperature"` // °C
+	Humidity    float64   `json:"humidity"`    // %
+	CO2         int       `json:"co2"`         // ppm
+	PM25        float64   `json:"pm25"`        // μg/m³
+	PM10        float64   `json:"pm10"`        // μg/m³
+	TVOC        float64   `json:"tvoc"`        // ppb
+	Battery     int       `json:"battery"`     // %
+	Timestamp   time.Time `json:"timestamp"`
+
+	AQI *AQIResult `json:"aqi,omitempty"`
+
+	// Values holds every numeric field reported in the sensorData entry,
+	// plus the derived ones
+	Values map[string]float64 `json:"values,omitempty"`
+}
+
+// QingpingConfigMessage represents the Type 12 message for requesting data
+type QingpingConfigMessage struct {
+	Type     string `json:"type"`
+	UpItvl   string `json:"up_itvl"`  // update interval in seconds
+	Duration string `json:"duration"` // how long to report (in seconds)
+}
+
+// QingpingSettingMessage represents Type 17 message for changing settings
+type QingpingSettingMessage struct {
+	Type    string                 `json:"type"`
+	Setting map[string]interface{} `json:"setting"`
+}
+
+// QingpingUpMessage represents the response from /up topic
+type QingpingUpMessage struct {
+	Type       string                   `json:"type"`
+	SensorData []map[string]SensorValue `json:"sensorData"`
+}
+
+type SensorValue struct {
+	Value float64 `json:"value"`
+}
+
+func limitString(s string, max int) string {
+	if len(s) > max {
+		return s[:max] + "..."
+	}
+	return s
+}
@@ -0,0 +1,441 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// sensorMetric describes how a sensorData payload key is exported
+type sensorMetric struct {
+	Name string
+	Help string
+}
+
+// sensorMetrics maps sensorData payload keys to their metric names
+var sensorMetrics = map[string]sensorMetric{
+	"temperature": {"qingping_temperature_celsius", "Temperature in Celsius"},
+	"humidity":    {"qingping_humidity_percent", "Humidity percentage"},
+	"co2":         {"qingping_co2_ppm", "CO2 level in parts per million"},
+	"pm25":        {"qingping_pm25_ugm3", "PM2.5 in micrograms per cubic meter"},
+	"pm10":        {"qingping_pm10_ugm3", "PM10 in micrograms per cubic meter"},
+	"tvoc":        {"qingping_tvoc_ppb", "TVOC in parts per billion"},
+	"battery":     {"qingping_battery_percent", "Battery percentage"},
+	"tvoc_index":  {"qingping_tvoc_index", "TVOC as VOC index (1-500, 100 is typical)"},
+	"noise":       {"qingping_noise_db", "Noise level in decibels"},
+
+	// Derived from the sensors above
+	"dew_point":         {"qingping_dew_point_celsius", "Dew point in Celsius"},
+	"absolute_humidity": {"qingping_absolute_humidity_gm3", "Absolute humidity in grams per cubic meter"},
+	"heat_index":        {"qingping_heat_index_celsius", "Heat index (NWS) in Celsius"},
+	"humidex":           {"qingping_humidex", "Humidex (Environment Canada)"},
+	"co2_rate":          {"qingping_co2_rate_ppm_per_min", "Change of CO2 since the previous reading in ppm per minute"},
+}
+
+const lastUpdateMetric = "qingping_last_update_timestamp"
+
+// packageMetrics are the metrics declared in this package. Every App
+// registers them on its own registry, so a program embedding the collector
+// keeps its default registry to itself.
+var packageMetrics []prometheus.Collector
+
+// registered adds a metric to packageMetrics.
+func registered[T prometheus.Collector](metric T) T {
+	packageMetrics = append(packageMetrics, metric)
+	return metric
+}
+
+// newRegistry returns a registry with every metric of packageMetrics.
+func newRegistry() (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	for _, metric := range packageMetrics {
+		if err := registry.Register(metric); err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
+var (
+	// sensorGauges holds one gauge per entry in sensorMetrics
+	sensorGauges = make(map[string]*prometheus.GaugeVec)
+
+	lastUpdate = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: lastUpdateMetric,
+		Help: "Timestamp of last sensor update",
+	}, []string{"device"}))
+
+	readingsSuppressed = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_readings_suppressed_total",
+		Help: "Readings not passed to any sink because no value moved beyond its deadband",
+	}, []string{"device"}))
+
+	valuesRejected = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_values_rejected_total",
+		Help: "Sensor values dropped by the filter for jumping further than FILTER_MAX_JUMPS allows",
+	}, []string{"device", "sensor"}))
+
+	republishMessages = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_republish_messages_total",
+		Help: "Republished readings by result: delivered (taken by the broker, acknowledged at QoS 1 and 2), failed or timeout",
+	}, []string{"device", "result"}))
+
+	republishAcks = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_republish_acks_total",
+		Help: "Republished readings confirmed by a consumer on the ack topic",
+	}, []string{"device", "consumer"}))
+
+	republishAcksMissing = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_republish_acks_missing_total",
+		Help: "Republished readings an expected consumer did not confirm in time, consumer * meaning any",
+	}, []string{"device", "consumer"}))
+
+	republishAckLatency = registered(prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "qingping_republish_ack_seconds",
+		Help:    "Time from republishing a reading to its confirmation by a consumer",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+	}, []string{"consumer"}))
+
+	republishLastAck = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_republish_last_ack_timestamp_seconds",
+		Help: "Time of the last confirmation by a consumer",
+	}, []string{"device", "consumer"}))
+
+	republishSuppressed = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_republish_suppressed_total",
+		Help: "Readings not republished in delta mode because no value moved beyond its deadband",
+	}, []string{"device"}))
+
+	deviceUp = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_device_up",
+		Help: "1 while the device reports, 0 once it has been silent for STALE_TIMEOUT",
+	}, []string{"device"}))
+
+	deviceMaintenance = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_device_maintenance",
+		Help: "1 while the device is in maintenance and raises no alerts",
+	}, []string{"device"}))
+
+	colocatedDeviation = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_colocated_deviation",
+		Help: "Difference between the latest readings of two co-located devices (device minus peer)",
+	}, []string{"device", "peer", "sensor"}))
+
+	colocatedDiverged = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_colocated_diverged",
+		Help: "1 if two co-located devices disagree by more than the configured band",
+	}, []string{"device", "peer", "sensor"}))
+
+	unmappedValue = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_unmapped_value",
+		Help: "Latest value of a sensorData field without a metric; map it under \"fields\" in the config file",
+	}, []string{"device", "field"}))
+
+	thresholdFiring = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_threshold_firing",
+		Help: "1 while a threshold rule is exceeded for the device",
+	}, []string{"device", "rule"}))
+
+	batteryRemaining = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_battery_seconds_remaining",
+		Help: "Estimated time until the battery is empty, from the smoothed discharge rate",
+	}, []string{"device"}))
+
+	batteryDrain = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_battery_drain_percent_per_day",
+		Help: "Smoothed battery drain measured while the device reported at the given interval",
+	}, []string{"device", "interval_seconds"}))
+
+	ventilationLevel = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_ventilation_level",
+		Help: "Level in percent a ventilation unit is asked to run at",
+	}, []string{"unit"}))
+
+	ventilationFrost = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_ventilation_frost_protection",
+		Help: "1 while frost protection caps a ventilation unit's level",
+	}, []string{"unit"}))
+
+	purifierRunning = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_purifier_running",
+		Help: "1 while a linked air purifier reports running",
+	}, []string{"purifier"}))
+
+	filterLoad = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_filter_load",
+		Help: "PM2.5 integrated over the time the purifier ran since the last filter change, in µg·h/m³",
+	}, []string{"purifier"}))
+
+	filterConsumed = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_filter_consumed_percent",
+		Help: "Estimated share of the purifier's filter life used up",
+	}, []string{"purifier"}))
+
+	renewalsTotal = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_renewals_total",
+		Help: "Type 12 renewals sent in continuous mode by result: confirmed (the device reported after it), unconfirmed or failed",
+	}, []string{"device", "result"}))
+
+	reportingExpiry = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_reporting_expiry_timestamp_seconds",
+		Help: "Time at which the device stops reporting unless its request is renewed",
+	}, []string{"device"}))
+
+	aqiIndex = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_aqi",
+		Help: "Air quality index computed from PM2.5 and PM10 per the selected standard",
+	}, []string{"device", "standard"}))
+
+	aqiSubIndex = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_aqi_subindex",
+		Help: "Air quality sub-index of a single pollutant per the selected standard",
+	}, []string{"device", "standard", "pollutant"}))
+
+	aqiCategoryInfo = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_aqi_category_info",
+		Help: "Current AQI category of the device with its label and color code, always 1",
+	}, []string{"device", "standard", "category", "label", "color"}))
+
+	aqiCategoryLevel = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_aqi_category_level",
+		Help: "Current AQI category as a number, 1 being the best",
+	}, []string{"device", "standard"}))
+
+	deviceFirmwareInfo = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_device_info",
+		Help: "Firmware version the device last reported, always 1",
+	}, []string{"device", "firmware"}))
+
+	wifiRSSI = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_wifi_rssi_dbm",
+		Help: "Wi-Fi signal strength the device last reported in dBm",
+	}, []string{"device"}))
+
+	usbPower = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_usb_power",
+		Help: "1 while the device runs on USB power, 0 on battery, as last reported",
+	}, []string{"device"}))
+
+	batteryCharging = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_battery_charging",
+		Help: "1 while the device's battery charges, as last reported",
+	}, []string{"device"}))
+
+	mqttBrokerActive = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "qingping_mqtt_broker_active",
+		Help: "1 for the broker a connection is on, 0 for its other brokers; home is empty for the main connection",
+	}, []string{"home", "broker"}))
+
+	errorsTotal = registered(prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "qingping_errors_total",
+		Help: "Runtime errors by code, see /api/errors for what they mean and recent examples",
+	}, []string{"code"}))
+)
+
+func init() {
+	for key, metric := range sensorMetrics {
+		sensorGauges[key] = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metric.Name,
+			Help: metric.Help,
+		}, []string{"device"}))
+	}
+	// Every code is exported from the start, so rates work from the first
+	// error on
+	for code := range errorCodes {
+		errorsTotal.WithLabelValues(code)
+	}
+}
+
+// setupRuntimeMetrics registers the Go runtime and process collectors
+// according to mode: "default" exports the usual series, "off" none and
+// "extended" every runtime/metrics series. With a path they are served
+// there on mux instead of with the other metrics of registerer.
+func setupRuntimeMetrics(mode, path string, mux *http.ServeMux, registerer prometheus.Registerer) error {
+	var goCollector prometheus.Collector
+	switch mode {
+	case "default":
+		goCollector = collectors.NewGoCollector()
+	case "extended":
+		goCollector = collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsAll))
+	case "off":
+		return nil
+	default:
+		return fmt.Errorf("unknown runtime metrics mode %q (want default, off or extended)", mode)
+	}
+
+	if path != "" {
+		registry := prometheus.NewRegistry()
+		mux.Handle(path, metricsHandler(registry))
+		registerer = registry
+	}
+	return errors.Join(
+		registerer.Register(goCollector),
+		registerer.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})),
+	)
+}
+
+// metricNamespace replaces the qingping_ prefix of exported metric names,
+// staticLabels are added to every exported series and deviceLabels to the
+// series of a device. They are applied on the way out, so the metrics
+// themselves keep their fixed names and labels.
+var (
+	metricNamespace = "qingping"
+	staticLabels    []*dto.LabelPair
+	deviceLabels    map[string][]*dto.LabelPair
+	// seriesIDLabel adds series_id to the labels of every device
+	seriesIDLabel bool
+
+	// deviceLabelsMutex guards deviceLabels, which changes when devices
+	// are renamed
+	deviceLabelsMutex sync.RWMutex
+)
+
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validLabelName reports whether name can be used as an extra label.
+func validLabelName(name string) bool {
+	return metricNamePattern.MatchString(name) && !strings.HasPrefix(name, "__")
+}
+
+// labelPairs converts labels to sorted label pairs.
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].GetName() < pairs[j].GetName() })
+	return pairs
+}
+
+// setDeviceLabels records the labels of every device, with its series ID
+// if SERIES_ID_LABEL is set.
+func setDeviceLabels(devices []*Device) {
+	labels := make(map[string][]*dto.LabelPair, len(devices))
+	for _, device := range devices {
+		own := device.Labels
+		if seriesIDLabel && device.SeriesID != "" {
+			own = maps.Clone(own)
+			if own == nil {
+				own = make(map[string]string, 1)
+			}
+			if _, ok := own["series_id"]; !ok {
+				own["series_id"] = device.SeriesID
+			}
+		}
+		if len(own) > 0 {
+			labels[device.Name] = labelPairs(own)
+		}
+	}
+	deviceLabelsMutex.Lock()
+	deviceLabels = labels
+	deviceLabelsMutex.Unlock()
+}
+
+// labelsOfDevice returns the extra labels of a device's series.
+func labelsOfDevice(device string) []*dto.LabelPair {
+	deviceLabelsMutex.RLock()
+	defer deviceLabelsMutex.RUnlock()
+	return deviceLabels[device]
+}
+
+// setupMetricNaming validates and applies METRIC_NAMESPACE, METRIC_LABELS,
+// the latter given as name=value pairs, and SERIES_ID_LABEL.
+func setupMetricNaming(namespace string, labels []string, seriesID bool) error {
+	if !metricNamePattern.MatchString(namespace) {
+		return fmt.Errorf("invalid metric namespace %q", namespace)
+	}
+	metricNamespace = namespace
+	seriesIDLabel = seriesID
+
+	static := make(map[string]string)
+	for _, pair := range labels {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !validLabelName(name) {
+			return fmt.Errorf("invalid metric label %q, want name=value", pair)
+		}
+		if _, ok := static[name]; ok {
+			return fmt.Errorf("duplicate metric label %q", name)
+		}
+		static[name] = value
+	}
+	staticLabels = labelPairs(static)
+	return nil
+}
+
+// exportedName is the name a metric is exported under.
+func exportedName(name string) string {
+	if rest, ok := strings.CutPrefix(name, "qingping_"); ok {
+		return metricNamespace + "_" + rest
+	}
+	return name
+}
+
+// exportedLabels adds the device and static labels to a series' labels.
+// Labels the series already has win, then the device's.
+func exportedLabels(labels map[string]string) {
+	for _, extra := range [][]*dto.LabelPair{labelsOfDevice(labels["device"]), staticLabels} {
+		for _, label := range extra {
+			if _, ok := labels[label.GetName()]; !ok {
+				labels[label.GetName()] = label.GetValue()
+			}
+		}
+	}
+}
+
+// namingGatherer applies the namespace and extra labels to everything the
+// wrapped gatherer returns.
+type namingGatherer struct{ prometheus.Gatherer }
+
+func (g namingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, family := range families {
+		name := exportedName(family.GetName())
+		family.Name = &name
+		deviceLabelsMutex.RLock()
+		plain := len(staticLabels) == 0 && len(deviceLabels) == 0
+		deviceLabelsMutex.RUnlock()
+		if plain {
+			continue
+		}
+		for _, metric := range family.Metric {
+			metric.Label = withExtraLabels(metric.Label)
+		}
+	}
+	return families, err
+}
+
+func withExtraLabels(labels []*dto.LabelPair) []*dto.LabelPair {
+	have := make(map[string]bool, len(labels))
+	var device string
+	for _, label := range labels {
+		have[label.GetName()] = true
+		if label.GetName() == "device" {
+			device = label.GetValue()
+		}
+	}
+	for _, extra := range [][]*dto.LabelPair{labelsOfDevice(device), staticLabels} {
+		for _, label := range extra {
+			if !have[label.GetName()] {
+				have[label.GetName()] = true
+				labels = append(labels, label)
+			}
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels
+}
+
+// metricsHandler serves the metrics of g in the exposition format.
+func metricsHandler(g prometheus.Gatherer) http.Handler {
+	return promhttp.HandlerFor(namingGatherer{g}, promhttp.HandlerOpts{})
+}
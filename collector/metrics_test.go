@@ -0,0 +1,1305 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// Every handled message logs a reading; only show them with -v
+	if !testing.Verbose() {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeMessage is the subset of an MQTT message the handlers look at
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 0 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 0 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+var metricsCases = []struct {
+	name     string
+	device   Device
+	payloads []string
+}{
+	{
+		name:   "cgdn1",
+		device: Device{MAC: "582D34000001", Model: "cgdn1"},
+		payloads: []string{
+			`{"type":"12","sensorData":[{"temperature":{"value":22.5},"humidity":{"value":45.2},"co2":{"value":650},"pm25":{"value":12.3},"pm10":{"value":15.7},"tvoc":{"value":120},"battery":{"value":85}}]}`,
+		},
+	},
+	{
+		name:   "cgdn1_update",
+		device: Device{MAC: "582D34000002", Model: "cgdn1"},
+		payloads: []string{
+			`{"type":"12","sensorData":[{"temperature":{"value":22.5},"humidity":{"value":45.2},"co2":{"value":650},"pm25":{"value":12.3},"pm10":{"value":15.7},"tvoc":{"value":120},"battery":{"value":85}}]}`,
+			`{"type":"13"}`,
+			`{"type":"12","sensorData":[{"temperature":{"value":31},"humidity":{"value":70},"co2":{"value":1450},"pm25":{"value":80},"pm10":{"value":160},"tvoc":{"value":400},"battery":{"value":84}}]}`,
+		},
+	},
+	{
+		name:   "cgs2",
+		device: Device{MAC: "582D34000003", Model: "cgs2"},
+		payloads: []string{
+			`{"type":"12","sensorData":[{"temperature":{"value":23.1},"humidity":{"value":50},"co2":{"value":800},"pm25":{"value":5},"pm10":{"value":7},"tvoc_index":{"value":110},"noise":{"value":38},"battery":{"value":100}}]}`,
+		},
+	},
+	{
+		name:   "unmapped",
+		device: Device{MAC: "582D34000004", Model: "cgdn1"},
+		payloads: []string{
+			`{"type":"12","sensorData":[{"temperature":{"value":-5.2},"humidity":{"value":30},"light":{"value":120}}]}`,
+		},
+	},
+	{
+		name:   "binary",
+		device: Device{MAC: "582D34000005", Model: "cgdn1"},
+		payloads: []string{
+			`4347411500141200000000000000c4512d8a020c000f00ffff554205`,
+		},
+	},
+	{
+		name:   "foreign",
+		device: Device{Topic: "airgradient/test/state", Fields: map[string]string{"co2": "rco2", "pm25": "pm02", "temperature": "atmp", "humidity": "rhum"}},
+		payloads: []string{
+			`{"rco2":512,"pm02":"3","atmp":21.4,"rhum":40,"wifi":-60}`,
+		},
+	},
+}
+
+// timestampLine matches the last update series, whose value is wall time
+var timestampLine = regexp.MustCompile(`(?m)^(qingping_last_update_timestamp\{[^}]*\}) .*$`)
+
+func TestMetricsGolden(t *testing.T) {
+	aqi, err := lookupAQIStandard("epa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range metricsCases {
+		t.Run(tc.name, func(t *testing.T) {
+			device := tc.device
+			device.Name = "test_" + tc.name
+			device.policy = Policy{Sinks: []Sink{prometheusSink{}}}
+			defer prometheusSink{}.Forget(&device)
+			defer lastUpdate.DeleteLabelValues(device.Name)
+			defer deviceUp.DeleteLabelValues(device.Name)
+
+			c := &collector{
+				config:          Config{aqi: aqi, Locale: "en", UpdateInterval: 60},
+				notifier:        &notifier{},
+				lastUpdateTimes: make(map[string]time.Time),
+				offline:         make(map[string]bool),
+				latest:          make(map[string]*Snapshot),
+			}
+			for _, payload := range tc.payloads {
+				c.handleCGDN1Message(fakeMessage{topic: device.upTopic(), payload: []byte(payload)}, &device)
+			}
+
+			got := timestampLine.ReplaceAll(gatherDevice(t, device.Name), []byte("$1 <timestamp>"))
+			golden := filepath.Join("testdata", "metrics", tc.name+".golden")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(golden), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if diff := diffLines(string(want), string(got)); diff != "" {
+				t.Errorf("/metrics differs from %s (run go test -update if intended):\n%s", golden, diff)
+			}
+		})
+	}
+}
+
+// gatherDevice renders the device's qingping_* families in the text
+// exposition format, as /metrics would serve them.
+func gatherDevice(t *testing.T, device string) []byte {
+	t.Helper()
+	registry, err := newRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "qingping_") || strings.HasPrefix(family.GetName(), "qingping_collector_") {
+			continue
+		}
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "device" && label.GetValue() == device {
+					metrics = append(metrics, metric)
+				}
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		family.Metric = metrics
+		if _, err := expfmt.MetricFamilyToText(&out, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes()
+}
+
+func TestCorpus(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "corpus", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		t.Run(name, func(t *testing.T) {
+			got, err := replayCase(name, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := os.ReadFile(strings.TrimSuffix(path, ".json") + ".golden")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := diffLines(string(want), string(got)); diff != "" {
+				t.Errorf("series differ (run corpus check -update if intended):\n%s", diff)
+			}
+		})
+	}
+}
+
+// binaryFrame wraps TLVs into a checksummed binary frame.
+func binaryFrame(command byte, tlvs ...[]byte) []byte {
+	body := bytes.Join(tlvs, nil)
+	frame := append([]byte("CG"), command, byte(len(body)), byte(len(body)>>8))
+	frame = append(frame, body...)
+	var sum uint16
+	for _, b := range frame {
+		sum += uint16(b)
+	}
+	return append(frame, byte(sum), byte(sum>>8))
+}
+
+// binarySensorTLV encodes samples of temperature, humidity and co2 into a
+// sensor block TLV starting at timestamp.
+func binarySensorTLV(key byte, timestamp uint32, interval uint16, samples ...[3]float64) []byte {
+	block := binary.LittleEndian.AppendUint32(nil, timestamp)
+	block = binary.LittleEndian.AppendUint16(block, interval)
+	for _, sample := range samples {
+		packed := uint32(sample[0]*10+500)<<12 | uint32(sample[1]*10)
+		block = append(block, byte(packed), byte(packed>>8), byte(packed>>16))
+		block = binary.LittleEndian.AppendUint16(block, uint16(sample[2]))
+		block = append(block, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 80)
+	}
+	return append([]byte{key, byte(len(block)), byte(len(block) >> 8)}, block...)
+}
+
+func TestDecodeBinaryBuffered(t *testing.T) {
+	frame := binaryFrame(0x41,
+		binarySensorTLV(binaryKeyRealtime, 1704070800, 0, [3]float64{23, 48, 900}),
+		binarySensorTLV(binaryKeyHistory, 1704067200, 600,
+			[3]float64{21, 40, 600}, [3]float64{21.5, 42, 700}, [3]float64{22, 44, 800}),
+	)
+
+	for _, payload := range [][]byte{frame, []byte(hex.EncodeToString(frame))} {
+		msgType, entries, err := decodeUpMessage(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != "65" {
+			t.Errorf("type %q, want 65", msgType)
+		}
+		want := []struct{ timestamp, temperature, co2 float64 }{
+			{1704067200, 21, 600},
+			{1704067800, 21.5, 700},
+			{1704068400, 22, 800},
+			{1704070800, 23, 900},
+		}
+		if len(entries) != len(want) {
+			t.Fatalf("got %d entries, want %d: %v", len(entries), len(want), entries)
+		}
+		for i, w := range want {
+			got := entries[i]
+			if got["timestamp"] != w.timestamp || got["temperature"] != w.temperature || got["co2"] != w.co2 {
+				t.Errorf("entry %d = %v, want timestamp %v, temperature %v, co2 %v", i, got, w.timestamp, w.temperature, w.co2)
+			}
+			if _, ok := got["pm25"]; ok {
+				t.Errorf("entry %d has pm25 the device did not measure", i)
+			}
+		}
+	}
+}
+
+func TestDecodeBinaryConfigResponse(t *testing.T) {
+	// A settings response echoes the report interval (TLV 0x04), no samples
+	frame := binaryFrame(0x11, []byte{0x04, 0x02, 0x00, 0x3c, 0x00})
+	msgType, entries, err := decodeUpMessage(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != "17" || !isConfigResponse(msgType) {
+		t.Errorf("type %q, want 17 taken for a config response", msgType)
+	}
+	if len(entries) != 0 {
+		t.Errorf("config response decoded into readings %v", entries)
+	}
+}
+
+func TestDecodeUntimestampedLast(t *testing.T) {
+	payload := `{"type":"12","sensorData":[{"co2":{"value":900}},{"timestamp":{"value":1704070800},"co2":{"value":800}},{"co2":{"value":1000}},{"timestamp":{"value":1704067200},"co2":{"value":700}}]}`
+	_, entries, err := decodeUpMessage([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []float64
+	for _, entry := range entries {
+		got = append(got, entry["co2"])
+	}
+	// Timestamped entries by time, then the others as they came
+	if want := []float64{700, 800, 900, 1000}; !slices.Equal(got, want) {
+		t.Errorf("co2 in order %v, want %v", got, want)
+	}
+}
+
+func TestDecodeBinaryMessage(t *testing.T) {
+	realtime := binarySensorTLV(binaryKeyRealtime, 1704070800, 0, [3]float64{23, 48, 900})
+	valid := binaryFrame(0x41, realtime)
+	badChecksum := slices.Clone(valid)
+	badChecksum[len(badChecksum)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		want    []map[string]float64
+		wantErr string
+	}{
+		{
+			name:  "realtime sample",
+			frame: valid,
+			want:  []map[string]float64{{"timestamp": 1704070800, "temperature": 23, "humidity": 48, "co2": 900, "battery": 80}},
+		},
+		{
+			// 0xffff fields were not measured and the clock is not set yet
+			name:  "missing fields and no clock",
+			frame: binaryFrame(0x41, binarySensorTLV(binaryKeyRealtime, 0, 0, [3]float64{-5.5, 30, 450})),
+			want:  []map[string]float64{{"temperature": -5.5, "humidity": 30, "co2": 450, "battery": 80}},
+		},
+		{
+			name:  "unknown TLV skipped",
+			frame: binaryFrame(0x41, []byte{0x04, 0x02, 0x00, 0x3c, 0x00}, realtime),
+			want:  []map[string]float64{{"timestamp": 1704070800, "temperature": 23, "humidity": 48, "co2": 900, "battery": 80}},
+		},
+		{
+			name:  "history spaced by interval",
+			frame: binaryFrame(0x41, binarySensorTLV(binaryKeyHistory, 1704067200, 900, [3]float64{21, 40, 600}, [3]float64{22, 41, 650})),
+			want: []map[string]float64{
+				{"timestamp": 1704067200, "temperature": 21, "humidity": 40, "co2": 600, "battery": 80},
+				{"timestamp": 1704068100, "temperature": 22, "humidity": 41, "co2": 650, "battery": 80},
+			},
+		},
+		{name: "too short", frame: []byte("CG"), wantErr: "too short"},
+		{name: "length mismatch", frame: append(slices.Clone(valid), 0), wantErr: "does not match header"},
+		{name: "checksum", frame: badChecksum, wantErr: "checksum"},
+		{name: "truncated TLV header", frame: binaryFrame(0x41, []byte{0x14, 0x05}), wantErr: "truncated TLV header"},
+		{name: "truncated TLV value", frame: binaryFrame(0x41, []byte{0x14, 0x10, 0x00, 1, 2}), wantErr: "truncated value"},
+		{name: "partial sample", frame: binaryFrame(0x41, []byte{0x14, 0x07, 0x00, 0, 0, 0, 0, 0, 0, 1}), wantErr: "not a whole number of samples"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgType, entries, err := decodeBinaryMessage(tt.frame)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgType != "65" {
+				t.Errorf("type %q, want 65", msgType)
+			}
+			if len(entries) != len(tt.want) {
+				t.Fatalf("%d entries, want %d: %v", len(entries), len(tt.want), entries)
+			}
+			for i, entry := range entries {
+				if !maps.Equal(entry, tt.want[i]) {
+					t.Errorf("entry %d is %v, want %v", i, entry, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeAdvertisement(t *testing.T) {
+	// frame control, product ID and the MAC 582D34000016 reversed
+	header := "8816" + "16000034" + "2d58"
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{name: "no readings", data: header, want: map[string]float64{}},
+		{
+			name: "all readings",
+			data: header + "0104eb00c801" + "020155" + "12040c001400" + "13026402",
+			want: map[string]float64{"temperature": 23.5, "humidity": 45.6, "battery": 85, "pm25": 12, "pm10": 20, "co2": 612},
+		},
+		{name: "below zero", data: header + "0104ccff2003", want: map[string]float64{"temperature": -5.2, "humidity": 80}},
+		{
+			// Unknown ids and readings of an unexpected length are skipped
+			name: "skipped readings",
+			data: header + "0f0100" + "02025500" + "13026402",
+			want: map[string]float64{"co2": 612},
+		},
+		{name: "short header", data: "881616000034", wantErr: true},
+		{name: "truncated reading", data: header + "130264", wantErr: true},
+		{name: "truncated reading id", data: header + "13", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mac, values, err := decodeAdvertisement(data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("decoded %s %v, want an error", mac, values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mac != "582D34000016" {
+				t.Errorf("mac %s, want 582D34000016", mac)
+			}
+			if !maps.Equal(values, tt.want) {
+				t.Errorf("values %v, want %v", values, tt.want)
+			}
+		})
+	}
+}
+
+// fakeClient records what the collector publishes instead of sending it
+type fakeClient struct {
+	mqtt.Client
+	mu        sync.Mutex
+	published []fakeMessage
+	handlers  map[string]mqtt.MessageHandler
+}
+
+func (f *fakeClient) IsConnectionOpen() bool { return true }
+
+func (f *fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var data []byte
+	switch p := payload.(type) {
+	case []byte:
+		data = p
+	case string:
+		data = []byte(p)
+	}
+	f.published = append(f.published, fakeMessage{topic: topic, payload: data})
+	return &mqtt.DummyToken{}
+}
+
+func TestStopReporting(t *testing.T) {
+	client := &fakeClient{}
+	device := &Device{Name: "test_stop", MAC: "582D34000010", Model: "cgdn1"}
+	c := &collector{
+		config: Config{UpdateInterval: 60, Duration: 21600, Devices: []*Device{device}},
+		client: client,
+	}
+	c.stopReporting()
+
+	if len(client.published) != 1 {
+		t.Fatalf("published %d messages, want 1", len(client.published))
+	}
+	got := client.published[0]
+	if got.topic != device.downTopic() {
+		t.Errorf("published on %q, want %q", got.topic, device.downTopic())
+	}
+	var msg QingpingConfigMessage
+	if err := json.Unmarshal(got.payload, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != "12" || msg.Duration != "0" {
+		t.Errorf("published %s, want a Type 12 with duration 0", got.payload)
+	}
+}
+
+func TestHomeAssistantUnits(t *testing.T) {
+	// METRIC_TEMPERATURE_UNIT=fahrenheit and METRIC_TVOC_UNIT=both
+	conversions["temperature_f"] = temperatureConversions["temperature_f"]
+	conversions["tvoc_mgm3"] = tvocConversions["tvoc_mgm3"]
+	hiddenValues["temperature"] = true
+	defer func() {
+		delete(conversions, "temperature_f")
+		delete(conversions, "tvoc_mgm3")
+		delete(hiddenValues, "temperature")
+	}()
+
+	client := &fakeClient{}
+	sink := newHomeAssistantSink(HomeAssistantConfig{Enabled: true})
+	device := &Device{Name: "test_ha", MAC: "582D34000011", Model: "cgdn1"}
+	device.policy = Policy{Sinks: []Sink{sink}}
+	sink.publishDiscovery(client, []*Device{device})
+
+	configs := make(map[string]haDiscoveryPayload)
+	removed := make(map[string]bool)
+	for _, msg := range client.published {
+		key := path.Base(path.Dir(msg.topic))
+		if len(msg.payload) == 0 {
+			removed[key] = true
+			continue
+		}
+		var config haDiscoveryPayload
+		if err := json.Unmarshal(msg.payload, &config); err != nil {
+			t.Fatal(err)
+		}
+		configs[key] = config
+	}
+	for key, want := range map[string]haSensor{
+		"temperature_f": {"Temperature", "°F", "temperature"},
+		"tvoc":          {"TVOC", "ppb", "volatile_organic_compounds_parts"},
+		"tvoc_mgm3":     {"TVOC (mg/m³)", "mg/m³", "volatile_organic_compounds"},
+		"humidity":      {"Humidity", "%", "humidity"},
+	} {
+		got, ok := configs[key]
+		if !ok {
+			t.Errorf("no discovery config for %s", key)
+			continue
+		}
+		if got.Name != want.Name || got.UnitOfMeasurement != want.Unit || got.DeviceClass != want.DeviceClass {
+			t.Errorf("%s: got %q in %q (%s), want %q in %q (%s)", key, got.Name, got.UnitOfMeasurement, got.DeviceClass,
+				want.Name, want.Unit, want.DeviceClass)
+		}
+	}
+	if _, ok := configs["temperature"]; ok || !removed["temperature"] {
+		t.Errorf("celsius temperature still discovered")
+	}
+
+	client.published = nil
+	sink.client = client
+	sink.Write(device, CGDN1Data{Values: map[string]float64{"temperature": 20, "temperature_f": 68, "tvoc": 100, "tvoc_mgm3": 0.45}})
+	var state map[string]float64
+	if err := json.Unmarshal(client.published[0].payload, &state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := state["temperature"]; ok || state["temperature_f"] != 68 || state["tvoc_mgm3"] != 0.45 {
+		t.Errorf("state %v, want temperature_f 68 and tvoc_mgm3 0.45 without celsius", state)
+	}
+}
+
+func TestDerivedStateRoundTrip(t *testing.T) {
+	db, err := newSQLiteHistory(filepath.Join(t.TempDir(), "history.db"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	device := &Device{Name: "test_state", MAC: "582D34000012", Model: "cgdn1"}
+	defer batteryRemaining.DeleteLabelValues(device.Name)
+	components := func() (*batterySink, *deadbandFilter, *valueFilter) {
+		deadbands, err := newDeadbandFilter([]string{"co2=10"}, 6*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filter, err := newValueFilter(FilterConfig{Mode: "ewma", Alpha: 0.5}, prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newBatterySink(), deadbands, filter
+	}
+
+	battery, deadbands, filter := components()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, level := range []float64{90, 89, 88} {
+		taken := start.Add(time.Duration(i) * time.Hour)
+		values := map[string]float64{"battery": level, "co2": 600 + float64(i)*100, "pm25": 10}
+		deadbands.apply(device, values, taken)
+		filter.apply(device, values)
+		battery.Write(device, CGDN1Data{Timestamp: taken, Values: values})
+	}
+	saved := &derivedStates{store: db, components: map[string]derivedState{"battery": battery, "deadband": deadbands, "filter": filter}}
+	saved.save()
+
+	battery2, deadbands2, filter2 := components()
+	restored := &derivedStates{store: db, components: map[string]derivedState{"battery": battery2, "deadband": deadbands2, "filter": filter2}}
+	restored.load()
+
+	if got, want := *battery2.states[device.Name], *battery.states[device.Name]; got.level != want.level ||
+		!got.since.Equal(want.since) || got.rate != want.rate || !got.anchored {
+		t.Errorf("battery state %+v, want %+v", got, want)
+	}
+	if got, want := deadbands2.sent[device.Name].values, deadbands.sent[device.Name].values; !maps.Equal(got, want) {
+		t.Errorf("deadband values %v, want %v", got, want)
+	}
+	if got, want := filter2.states[device.Name].average, filter.states[device.Name].average; !maps.Equal(got, want) {
+		t.Errorf("filter averages %v, want %v", got, want)
+	}
+
+	// The next reading carries on from the restored state
+	next := map[string]float64{"co2": 805, "pm25": 10}
+	if deadbands2.apply(device, next, start.Add(3*time.Hour)) {
+		t.Errorf("co2 within its deadband of the restored value passed")
+	}
+}
+
+// Subscribe hands the message handler to the test through handlers
+func (f *fakeClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.handlers == nil {
+		f.handlers = make(map[string]mqtt.MessageHandler)
+	}
+	f.handlers[topic] = callback
+	return &mqtt.DummyToken{}
+}
+
+func (f *fakeClient) Unsubscribe(topics ...string) mqtt.Token { return &mqtt.DummyToken{} }
+func (f *fakeClient) IsConnected() bool                       { return true }
+
+func TestReloadWhileHandling(t *testing.T) {
+	aqi, err := lookupAQIStandard("epa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const mac = "582D34000013"
+	config := func(tag string, offset float64) Config {
+		device := &Device{Name: "test_reload", MAC: mac, Model: "cgdn1", Tags: []string{tag},
+			Calibration: map[string]float64{"co2": offset}}
+		return Config{aqi: aqi, Locale: "en", UpdateInterval: 60, Devices: []*Device{device}}
+	}
+
+	client := &fakeClient{}
+	thresholds, err := newThresholdSink(nil, &notifier{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sinks := []Sink{prometheusSink{}, thresholds}
+	first := config("a", 0)
+	if err := resolvePolicies(first.Devices, nil, sinks); err != nil {
+		t.Fatal(err)
+	}
+	remote, err := newRemoteConfigs("qingping/{mac}/config", thresholds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A rule sent for this device only
+	above := 500.0
+	remote.configs[mac] = RemoteDeviceConfig{Thresholds: []ThresholdRule{{Name: "co2_high", Sensor: "co2", Above: &above}}}
+	c := &collector{
+		config:          first,
+		client:          client,
+		sinks:           sinks,
+		notifier:        &notifier{},
+		health:          newHealth(1),
+		seriesIDs:       newMemorySeriesIDs(),
+		maintenance:     newMaintenance(),
+		remote:          remote,
+		lastUpdateTimes: make(map[string]time.Time),
+		offline:         make(map[string]bool),
+		latest:          make(map[string]*Snapshot),
+		bursts:          make(map[string]*burst),
+		renewals:        make(map[string]*renewal),
+		batteryLevels:   make(map[string]float64),
+		onBattery:       make(map[string]bool),
+	}
+	device := first.Devices[0]
+	defer func() { c.removeDevice(c.currentDevice(device)) }()
+	c.reapplyRemoteConfigs()
+	c.subscribeToCGDN1(client, device)
+	handle := client.handlers[device.upTopic()]
+	payload := []byte(`{"type":"12","sensorData":[{"temperature":{"value":22.5},"co2":{"value":650}}]}`)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := range 50 {
+			if _, err := c.reload(config(string(rune('a'+i%2)), float64(i%2))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := range 50 {
+			c.renameDevices(map[string]DeviceName{mac: {Name: fmt.Sprintf("test_renamed_%d", i%2)}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 50 {
+			handle(client, fakeMessage{topic: device.upTopic(), payload: payload})
+		}
+	}()
+	wg.Wait()
+
+	// The device's own rule still applies under its new name
+	c.renameDevices(map[string]DeviceName{mac: {Name: "test_renamed"}})
+	handle(client, fakeMessage{topic: device.upTopic(), payload: payload})
+	if got := c.latest["test_renamed"]; got == nil {
+		t.Errorf("no reading handled after the rename")
+	}
+	thresholds.mu.Lock()
+	firing, rules := thresholds.firing["test_renamed|co2_high"], len(thresholds.deviceRules)
+	thresholds.mu.Unlock()
+	if !firing {
+		t.Errorf("device rule not evaluated after the rename")
+	}
+	if rules != 1 {
+		t.Errorf("rules kept for %d devices, want 1", rules)
+	}
+}
+
+func TestBackfillHistory(t *testing.T) {
+	aqi, err := lookupAQIStandard("epa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newSQLiteHistory(filepath.Join(t.TempDir(), "history.db"), 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// Readings stored before are counted when the database is opened
+	defer func() {
+		reopened, err := newSQLiteHistory(db.path, 24*time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer reopened.Close()
+		if items, _, _ := reopened.Buffered(); items != 5 {
+			t.Errorf("%d readings counted on open, want 5", items)
+		}
+	}()
+
+	now := time.Now().Truncate(time.Second)
+	entry := func(age time.Duration, co2 int) string {
+		return fmt.Sprintf(`{"timestamp":{"value":%d},"temperature":{"value":22},"co2":{"value":%d}}`, now.Add(-age).Unix(), co2)
+	}
+	for name, history := range map[string]historyStore{"memory": newMemoryHistory(24 * time.Hour), "sqlite": db} {
+		t.Run(name, func(t *testing.T) {
+			device := &Device{Name: "test_backfill_" + name, MAC: "582D34000014", Model: "cgdn1"}
+			device.policy = Policy{Sinks: []Sink{history}}
+			c := &collector{
+				config:          Config{aqi: aqi, Locale: "en", UpdateInterval: 60, DeviceTimestamps: true},
+				notifier:        &notifier{},
+				lastUpdateTimes: make(map[string]time.Time),
+				offline:         make(map[string]bool),
+				latest:          make(map[string]*Snapshot),
+			}
+			messages := []string{
+				// Buffered while offline, newest last
+				`{"type":"12","sensorData":[` + entry(40*time.Minute, 600) + `,` + entry(20*time.Minute, 800) + `,` + entry(0, 1000) + `]}`,
+				// Delivered late, between the buffered ones
+				`{"type":"12","sensorData":[` + entry(30*time.Minute, 700) + `]}`,
+				// Sent again with one that is new, both older than the latest
+				`{"type":"12","sensorData":[` + entry(20*time.Minute, 800) + `,` + entry(10*time.Minute, 900) + `]}`,
+			}
+			for _, payload := range messages {
+				c.handleCGDN1Message(fakeMessage{topic: device.upTopic(), payload: []byte(payload)}, device)
+			}
+
+			samples, err := history.Samples(device.Name, now.Add(-time.Hour), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []float64{600, 700, 800, 900, 1000}
+			if len(samples) != len(want) {
+				t.Fatalf("got %d samples, want %d: %v", len(samples), len(want), samples)
+			}
+			for i, co2 := range want {
+				if got := samples[i].Values["co2"]; got != co2 {
+					t.Errorf("sample %d co2 = %v, want %v", i, got, co2)
+				}
+			}
+			if items, _, _ := history.(Buffer).Buffered(); items != len(want) {
+				t.Errorf("%d readings counted, want %d", items, len(want))
+			}
+		})
+	}
+}
+
+// decodeWriteRequest reads back what encodeWriteRequest encoded
+func decodeWriteRequest(t *testing.T, buf []byte) []remoteSample {
+	t.Helper()
+	// field consumes one length-delimited or scalar field of a message
+	field := func(buf []byte) (protowire.Number, protowire.Type, []byte, uint64, []byte) {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+		}
+		buf = buf[n:]
+		var bytes []byte
+		var scalar uint64
+		switch typ {
+		case protowire.BytesType:
+			bytes, n = protowire.ConsumeBytes(buf)
+		case protowire.Fixed64Type:
+			scalar, n = protowire.ConsumeFixed64(buf)
+		case protowire.VarintType:
+			scalar, n = protowire.ConsumeVarint(buf)
+		default:
+			t.Fatalf("unexpected wire type %v", typ)
+		}
+		if n < 0 {
+			t.Fatalf("invalid field %d: %v", num, protowire.ParseError(n))
+		}
+		return num, typ, bytes, scalar, buf[n:]
+	}
+
+	var samples []remoteSample
+	for len(buf) > 0 {
+		_, _, series, _, rest := field(buf)
+		buf = rest
+		sample := remoteSample{Labels: make(map[string]string)}
+		for len(series) > 0 {
+			num, _, inner, _, rest := field(series)
+			series = rest
+			switch num {
+			case 1:
+				var name, value string
+				for len(inner) > 0 {
+					num, _, text, _, rest := field(inner)
+					inner = rest
+					if num == 1 {
+						name = string(text)
+					} else {
+						value = string(text)
+					}
+				}
+				sample.Labels[name] = value
+			case 2:
+				for len(inner) > 0 {
+					num, _, _, scalar, rest := field(inner)
+					inner = rest
+					if num == 1 {
+						sample.Value = math.Float64frombits(scalar)
+					} else {
+						sample.Timestamp = time.UnixMilli(int64(scalar))
+					}
+				}
+			}
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func TestRemoteWriteBackfillBatches(t *testing.T) {
+	var mu sync.Mutex
+	var pushes [][]remoteSample
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		pushes = append(pushes, decodeWriteRequest(t, data))
+		// The receiver has newer samples of the series already
+		if len(pushes) == 1 {
+			http.Error(w, "out of order sample", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sink := newRemoteWriteSink(RemoteWriteConfig{URL: server.URL, BatchSize: 1000, FlushInterval: time.Hour})
+	device := &Device{Name: "test_remote_write", MAC: "582D34000015", Model: "cgdn1"}
+	now := time.Now().Truncate(time.Millisecond)
+	past := now.Add(-10 * time.Minute)
+	sink.Write(device, CGDN1Data{Timestamp: now, Values: map[string]float64{"co2": 800, "temperature": 22}})
+	sink.Backfill(device, CGDN1Data{Timestamp: past.Add(5 * time.Minute), Values: map[string]float64{"co2": 700}})
+	sink.Backfill(device, CGDN1Data{Timestamp: past, Values: map[string]float64{"co2": 600}})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pushes) != 2 {
+		t.Fatalf("got %d pushes, want the backfill and the current samples apart", len(pushes))
+	}
+	backfill, current := pushes[0], pushes[1]
+	if len(backfill) != 4 || len(current) != 3 {
+		t.Errorf("pushed %d backfill and %d current samples, want 4 and 3", len(backfill), len(current))
+	}
+	for i, sample := range backfill {
+		if !sample.Timestamp.Before(now) {
+			t.Errorf("current sample %v pushed with the backfill", sample)
+		}
+		if i > 0 && sample.Timestamp.Before(backfill[i-1].Timestamp) {
+			t.Errorf("backfill sample %d at %v pushed after one at %v", i, sample.Timestamp, backfill[i-1].Timestamp)
+		}
+	}
+	for _, sample := range current {
+		if !sample.Timestamp.Equal(now) || sample.Labels["device"] != device.Name {
+			t.Errorf("unexpected current sample %v", sample)
+		}
+	}
+	if items, _, _ := sink.Buffered(); items != 0 {
+		t.Errorf("%d samples still queued", items)
+	}
+}
+
+func TestNewOwnRegistry(t *testing.T) {
+	config, err := LoadConfig([]string{"-device-mac", "582D34000016", "-runtime-metrics", "off", "-metric-namespace", "indoor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer setupMetricNaming("qingping", nil, false)
+	// A program embedding the collector may run it again, e.g. in tests
+	for i := range 2 {
+		a, err := New(config)
+		if err != nil {
+			t.Fatalf("app %d: %v", i, err)
+		}
+		rec := httptest.NewRecorder()
+		a.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if body := rec.Body.String(); !strings.Contains(body, "indoor_errors_total") || strings.Contains(body, "go_goroutines") {
+			t.Errorf("app %d serves no renamed errors or runtime metrics it should not:\n%s", i, body)
+		}
+	}
+
+	// The program's own registry is left alone
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var goroutines bool
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), "qingping_") || strings.HasPrefix(family.GetName(), "indoor_") {
+			t.Errorf("%s registered on the default registry", family.GetName())
+		}
+		goroutines = goroutines || family.GetName() == "go_goroutines"
+	}
+	if !goroutines {
+		t.Errorf("RUNTIME_METRICS=off removed the default registry's Go collector")
+	}
+}
+
+func TestExecChannelStopped(t *testing.T) {
+	stopped, stop := context.WithCancel(context.Background())
+	channel := execChannel{
+		command: []string{"sleep", "5"},
+		timeout: 100 * time.Millisecond,
+		slots:   make(chan struct{}, 1),
+		stopped: stopped,
+	}
+	if err := channel.Send("", Notification{}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("slow command: %v", err)
+	}
+
+	channel.timeout = 5 * time.Second
+	time.AfterFunc(100*time.Millisecond, stop)
+	if err := channel.Send("", Notification{}); err == nil || strings.Contains(err.Error(), "timed out") {
+		t.Errorf("command stopped with the collector: %v", err)
+	}
+}
+
+func TestImportConfigFileOptions(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	history := filepath.Join(dir, "history.db")
+	if err := os.WriteFile(configFile, []byte(`{"options": {"HISTORY_DB": "`+history+`"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	export := filepath.Join(dir, "export.csv")
+	csv := "Time,Temperature(℃),CO2(ppm)\n2024-01-01 10:00:00,21.5,600\n2024-01-01 10:15:00,21.7,650\n"
+	if err := os.WriteFile(export, []byte(csv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", configFile)
+
+	// HISTORY_DB comes from the config file like it would for the collector,
+	// and a flag wins over it
+	other := filepath.Join(dir, "other.db")
+	for _, args := range [][]string{{}, {"-history-db", other}} {
+		args = append(args, "-device", "bedroom", "-timezone", "UTC", export)
+		if err := runImport(args); err != nil {
+			t.Fatalf("import %v: %v", args, err)
+		}
+	}
+	for _, path := range []string{history, other} {
+		db, err := newSQLiteHistory(path, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples, err := db.Samples("bedroom", time.Time{}, time.Now())
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(samples) != 2 {
+			t.Errorf("%s: %d samples imported, want 2", path, len(samples))
+		}
+	}
+}
+
+func TestAQISubIndex(t *testing.T) {
+	tests := []struct {
+		standard, pollutant string
+		concentration, want float64
+	}{
+		{"epa", "pm25", 0, 0},
+		{"epa", "pm25", 9.0, 50},
+		// Between two segments belongs to the next one
+		{"epa", "pm25", 9.05, 51},
+		{"epa", "pm25", 12, 56.40},
+		{"epa", "pm25", 35.4, 100},
+		{"epa", "pm25", 35.5, 101},
+		{"epa", "pm25", 225.5, 301},
+		{"epa", "pm25", 1000, 500},
+		{"epa", "pm10", 54, 50},
+		{"epa", "pm10", 55, 51},
+		{"epa", "pm10", 100, 73.27},
+		{"eu", "pm25", 5, 1},
+		{"eu", "pm25", 5.1, 2},
+		{"eu", "pm25", 140, 5},
+		{"eu", "pm10", 1500, 6},
+		{"china", "pm25", 35, 50},
+		{"china", "pm25", 55, 75},
+		{"china", "pm10", 600, 500},
+		{"china", "pm10", 700, 500},
+	}
+	for _, tt := range tests {
+		standard, err := lookupAQIStandard(tt.standard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := standard.SubIndex(tt.pollutant, tt.concentration); math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("%s %s %v: sub-index %.2f, want %.2f", tt.standard, tt.pollutant, tt.concentration, got, tt.want)
+		}
+	}
+}
+
+func TestAQIClassify(t *testing.T) {
+	tests := []struct {
+		standard string
+		values   map[string]float64
+		locale   string
+		want     AQIResult
+	}{
+		{
+			standard: "epa",
+			values:   map[string]float64{"pm25": 9, "co2": 2000},
+			locale:   "en",
+			want:     AQIResult{Standard: "epa", Index: 50, SubIndices: map[string]float64{"pm25": 50}, Level: 1, Category: "good", Label: "Good", Color: "#00E400"},
+		},
+		{
+			// The worst pollutant decides
+			standard: "epa",
+			values:   map[string]float64{"pm25": 12, "pm10": 30},
+			locale:   "de_DE.UTF-8",
+			want:     AQIResult{Standard: "epa", Index: 56, SubIndices: map[string]float64{"pm25": 56, "pm10": 28}, Level: 2, Category: "moderate", Label: "Mäßig", Color: "#FFFF00"},
+		},
+		{
+			standard: "epa",
+			values:   map[string]float64{"pm25": 35.5},
+			locale:   "pt-BR",
+			want:     AQIResult{Standard: "epa", Index: 101, SubIndices: map[string]float64{"pm25": 101}, Level: 3, Category: "unhealthy_sensitive", Label: "Unhealthy for Sensitive Groups", Color: "#FF7E00"},
+		},
+		{
+			standard: "epa",
+			values:   map[string]float64{"pm25": 1000},
+			locale:   "fr",
+			want:     AQIResult{Standard: "epa", Index: 500, SubIndices: map[string]float64{"pm25": 500}, Level: 6, Category: "hazardous", Label: "Dangereux", Color: "#7E0023"},
+		},
+		{
+			standard: "eu",
+			values:   map[string]float64{"pm25": 20, "pm10": 10},
+			locale:   "en",
+			want:     AQIResult{Standard: "eu", Index: 3, SubIndices: map[string]float64{"pm25": 3, "pm10": 1}, Level: 3, Category: "moderate", Label: "Moderate", Color: "#F0E641"},
+		},
+		{
+			standard: "china",
+			values:   map[string]float64{"pm25": 76},
+			locale:   "zh-CN",
+			want:     AQIResult{Standard: "china", Index: 101, SubIndices: map[string]float64{"pm25": 101}, Level: 3, Category: "lightly_polluted", Label: "轻度污染", Color: "#FF7E00"},
+		},
+	}
+	for _, tt := range tests {
+		standard, err := lookupAQIStandard(tt.standard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := standard.Classify(tt.values, tt.locale)
+		if !ok {
+			t.Errorf("%s %v: not classified", tt.standard, tt.values)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %v: %+v, want %+v", tt.standard, tt.values, got, tt.want)
+		}
+	}
+
+	standard, _ := lookupAQIStandard("epa")
+	if result, ok := standard.Classify(map[string]float64{"co2": 800}, "en"); ok {
+		t.Errorf("classified a reading without particulates: %+v", result)
+	}
+	if _, err := lookupAQIStandard("who"); err == nil {
+		t.Errorf("unknown standard accepted")
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	// A Monday
+	from := time.Date(2024, 1, 15, 10, 7, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, 1, 15, 10, 15, 0, 0, time.UTC)},
+		{"5,10-12/2 * * * *", time.Date(2024, 1, 15, 10, 10, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"  0 12 * * *  ", time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"30 6 * * 1-5", time.Date(2024, 1, 16, 6, 30, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		// Sunday is 0 or 7
+		{"0 9 * * 7", time.Date(2024, 1, 21, 9, 0, 0, 0, time.UTC)},
+		// With both day fields restricted either one matching runs
+		{"0 0 13 * 5", time.Date(2024, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 */3 *", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@every 90s", time.Date(2024, 1, 15, 10, 9, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := schedule.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next run %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"@every 500ms",
+		"@every soon",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%q accepted", expr)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	const key = "0123456789abcdef"
+	const topic = "qingping/582D34000016/up"
+	payload := []byte(`{"type":"12"}`)
+	signed := func(key, topic string, payload []byte) []byte {
+		return []byte(string(payload) + signatureSuffix + hex.EncodeToString(signPayload(key, topic, payload)))
+	}
+
+	// HMAC-SHA256 over topic, newline and payload, as gateways compute it
+	if got := hex.EncodeToString(signPayload(key, topic, payload)); got != "c809350b679cb6014f11923519cd9ecfe7d987dac1b975eabb0a7b2ace10910e" {
+		t.Errorf("signature %s", got)
+	}
+
+	tests := []struct {
+		name    string
+		message []byte
+		wantErr string
+	}{
+		{name: "signed", message: signed(key, topic, payload)},
+		{name: "trailing newline", message: append(signed(key, topic, payload), '\n')},
+		{name: "unsigned", message: payload, wantErr: "not signed"},
+		{name: "malformed", message: []byte(string(payload) + signatureSuffix + "xyz"), wantErr: "malformed"},
+		{name: "other key", message: signed("fedcba9876543210", topic, payload), wantErr: "does not match"},
+		// Replayed as another device's message
+		{name: "other topic", message: signed(key, "qingping/582D34000017/up", payload), wantErr: "does not match"},
+		{name: "tampered", message: bytes.Replace(signed(key, topic, payload), []byte("12"), []byte("17"), 1), wantErr: "does not match"},
+	}
+	for _, tt := range tests {
+		body, err := verifySignature(key, topic, tt.message)
+		switch {
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.wantErr)
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.wantErr == "" && !bytes.Equal(body, payload):
+			t.Errorf("%s: body %q, want %q", tt.name, body, payload)
+		}
+	}
+}
+
+func TestGraphiteEncoding(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	tests := []struct {
+		name      string
+		points    []graphitePoint
+		plaintext string
+		// pickle is what carbon's pickle receiver unpickles into
+		// [('home.bedroom.co2', (1700000000, 612.0)), ...]
+		pickle string
+	}{
+		{name: "empty", plaintext: "", pickle: "0000000680025d28652e"},
+		{
+			name:      "one point",
+			points:    []graphitePoint{{"home.bedroom.co2", 612, at}},
+			plaintext: "home.bedroom.co2 612 1700000000\n",
+			pickle: "0000002b80025d28" +
+				"5810000000686f6d652e626564726f6f6d2e636f32" + "4a00f15365" + "474083200000000000" + "8686" +
+				"652e",
+		},
+		{
+			name:      "two points",
+			points:    []graphitePoint{{"home.bedroom.co2", 612, at}, {"home.bedroom.temperature", 21.5, at}},
+			plaintext: "home.bedroom.co2 612 1700000000\nhome.bedroom.temperature 21.5 1700000000\n",
+			pickle: "0000005880025d28" +
+				"5810000000686f6d652e626564726f6f6d2e636f32" + "4a00f15365" + "474083200000000000" + "8686" +
+				"5818000000686f6d652e626564726f6f6d2e74656d7065726174757265" + "4a00f15365" + "474035800000000000" + "8686" +
+				"652e",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(encodeGraphitePlaintext(tt.points)); got != tt.plaintext {
+			t.Errorf("%s: plaintext %q, want %q", tt.name, got, tt.plaintext)
+		}
+		if got := hex.EncodeToString(encodeGraphitePickle(tt.points)); got != tt.pickle {
+			t.Errorf("%s: pickle %s, want %s", tt.name, got, tt.pickle)
+		}
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	at := time.UnixMilli(1000)
+	tests := []struct {
+		name    string
+		samples []remoteSample
+		// want is the protobuf of a prometheus.WriteRequest, labels sorted
+		// by name; empty to only check the round trip
+		want string
+	}{
+		{name: "empty"},
+		{
+			name:    "one sample",
+			samples: []remoteSample{{Labels: map[string]string{"device": "bedroom", "__name__": "qingping_co2"}, Value: 1.5, Timestamp: at}},
+			want: "0a3b" +
+				"0a180a085f5f6e616d655f5f120c71696e6770696e675f636f32" +
+				"0a110a066465766963651207626564726f6f6d" +
+				"120c09000000000000f83f10e807",
+		},
+		{
+			name: "several samples",
+			samples: []remoteSample{
+				{Labels: map[string]string{"__name__": "qingping_co2", "device": "bedroom", "room": "upstairs"}, Value: 612, Timestamp: at},
+				{Labels: map[string]string{"__name__": "qingping_temperature_celsius", "device": "bedroom"}, Value: -3.25, Timestamp: time.UnixMilli(1704067200123)},
+				{Labels: map[string]string{"__name__": "qingping_battery"}, Value: 0, Timestamp: at},
+			},
+		},
+	}
+	for _, tt := range tests {
+		buf := encodeWriteRequest(tt.samples)
+		if tt.want != "" || len(tt.samples) == 0 {
+			if got := hex.EncodeToString(buf); got != tt.want {
+				t.Errorf("%s: encoded %s, want %s", tt.name, got, tt.want)
+			}
+		}
+		got := decodeWriteRequest(t, buf)
+		if len(got) != len(tt.samples) {
+			t.Fatalf("%s: decoded %d samples, want %d", tt.name, len(got), len(tt.samples))
+		}
+		for i, sample := range got {
+			want := tt.samples[i]
+			if !maps.Equal(sample.Labels, want.Labels) || sample.Value != want.Value || !sample.Timestamp.Equal(want.Timestamp) {
+				t.Errorf("%s: sample %d decoded as %+v, want %+v", tt.name, i, sample, want)
+			}
+		}
+	}
+}
+
+func TestLoadConfigUpdateInterval(t *testing.T) {
+	// A reload hands the interval to a ticker, which panics on 0
+	for _, interval := range []string{"0", "-60"} {
+		if _, err := LoadConfig([]string{"-device-mac", "582D34000016", "-update-interval", interval}); err == nil || !strings.Contains(err.Error(), "UPDATE_INTERVAL") {
+			t.Errorf("UPDATE_INTERVAL=%s: error %v", interval, err)
+		}
+	}
+	config, err := LoadConfig([]string{"-device-mac", "582D34000016", "-update-interval", "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.UpdateInterval != 30 {
+		t.Errorf("update interval %d, want 30", config.UpdateInterval)
+	}
+}
@@ -0,0 +1,47 @@
+package collector
+
+import (
+	"fmt"
+	"strings"
+)
+
+// deviceModel describes which sensorData keys a Qingping model reports.
+type deviceModel struct {
+	Name    string // as shown in Home Assistant
+	Sensors []string
+}
+
+// deviceModels are the supported models by their lower-case id. The
+// plug-in Air Monitors have no battery; the CGS2 adds a noise sensor and
+// reports TVOC as a Sensirion VOC index instead of ppb. The generic model
+// accepts every key, for models the collector doesn't know yet.
+var deviceModels = map[string]deviceModel{
+	"cgdn1":   {"CGDN1", []string{"temperature", "humidity", "co2", "pm25", "pm10", "tvoc", "battery"}},
+	"cgs1":    {"CGS1", []string{"temperature", "humidity", "co2", "pm25", "pm10", "tvoc"}},
+	"cgs2":    {"CGS2", []string{"temperature", "humidity", "co2", "pm25", "pm10", "tvoc_index", "noise"}},
+	"generic": {"Qingping", nil},
+}
+
+// lookupModel resolves a configured model id; empty means CGDN1.
+func lookupModel(id string) (string, error) {
+	if id == "" {
+		return "cgdn1", nil
+	}
+	id = strings.ToLower(id)
+	if _, ok := deviceModels[id]; !ok {
+		return "", fmt.Errorf("unknown model %q (want cgdn1, cgs1, cgs2 or generic)", id)
+	}
+	return id, nil
+}
+
+func (m deviceModel) reports(key string) bool {
+	if m.Sensors == nil {
+		return true
+	}
+	for _, sensor := range m.Sensors {
+		if sensor == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"time"
+)
+
+// deviceNamesPollInterval is how often the DEVICE_NAMES file is checked
+// for changes
+const deviceNamesPollInterval = 5 * time.Second
+
+// DeviceName is an entry of the DEVICE_NAMES file. It is either just the
+// name or an object with the name and labels.
+type DeviceName struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (n *DeviceName) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &n.Name)
+	}
+	type plain DeviceName
+	return json.Unmarshal(b, (*plain)(n))
+}
+
+// loadDeviceNames reads a JSON object mapping MAC addresses to names.
+func loadDeviceNames(path string) (map[string]DeviceName, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]DeviceName
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	names := make(map[string]DeviceName, len(raw))
+	for mac, name := range raw {
+		if name.Name == "" {
+			return nil, fmt.Errorf("%s: no name for %s", path, mac)
+		}
+		for label := range name.Labels {
+			if !validLabelName(label) || label == "device" {
+				return nil, fmt.Errorf("%s: invalid label name %q for %s", path, label, mac)
+			}
+		}
+		names[normalizeMAC(mac)] = name
+	}
+	return names, nil
+}
+
+// applyDeviceNames names the devices listed in names, checking that names
+// stay unique. Devices are only changed if all of them can be.
+func applyDeviceNames(devices []*Device, names map[string]DeviceName) error {
+	seen := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		name := device.Name
+		if entry, ok := deviceName(device, names); ok {
+			name = entry.Name
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate device name %q", name)
+		}
+		seen[name] = true
+	}
+
+	for _, device := range devices {
+		if entry, ok := deviceName(device, names); ok {
+			device.Name = entry.Name
+			if entry.Labels != nil {
+				device.Labels = homeLabels(device, entry.Labels)
+			}
+		}
+	}
+	return nil
+}
+
+// deviceName looks up the entry of a device by its MAC address, or else
+// by the MACs it replaced, newest first.
+func deviceName(device *Device, names map[string]DeviceName) (DeviceName, bool) {
+	if device.MAC == "" {
+		return DeviceName{}, false
+	}
+	if entry, ok := names[normalizeMAC(device.MAC)]; ok {
+		return entry, true
+	}
+	for i := len(device.Replaces) - 1; i >= 0; i-- {
+		if entry, ok := names[normalizeMAC(device.Replaces[i])]; ok {
+			return entry, true
+		}
+	}
+	return DeviceName{}, false
+}
+
+// watchDeviceNames reloads the DEVICE_NAMES file whenever it changes and
+// renames the devices accordingly.
+func (c *collector) watchDeviceNames(ctx context.Context, path string) {
+	last, _ := os.ReadFile(path)
+	ticker := time.NewTicker(deviceNamesPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || bytes.Equal(data, last) {
+			continue
+		}
+		last = data
+
+		names, err := loadDeviceNames(path)
+		if err != nil {
+			slog.Error("Failed to reload device names", "path", path, "error", err)
+			continue
+		}
+		c.renameDevices(names)
+	}
+}
+
+// renameDevices gives devices their new names and labels. A renamed
+// device's series are dropped and come back under the new name with its
+// next reading; its history stays under the old name.
+func (c *collector) renameDevices(names map[string]DeviceName) {
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	// Work on copies so a failed check leaves the devices alone
+	proposed := make([]*Device, len(c.config.Devices))
+	for i, device := range c.config.Devices {
+		copied := *device
+		proposed[i] = &copied
+	}
+	if err := applyDeviceNames(proposed, names); err != nil {
+		slog.Error("Not applying device names", "error", err)
+		return
+	}
+
+	for i, device := range c.config.Devices {
+		name, labels := proposed[i].Name, proposed[i].Labels
+		if name == device.Name && maps.Equal(labels, device.Labels) {
+			continue
+		}
+		c.renameDevice(device, name, labels)
+	}
+	setDeviceLabels(c.config.Devices)
+}
+
+// renameDevice moves the state of a device to its new name and swaps in
+// a copy of it under that name, which it returns.
+func (c *collector) renameDevice(device *Device, name string, labels map[string]string) *Device {
+	old := device.Name
+	slog.Info("Renaming device", "device", old, "name", name, "labels", labels)
+
+	// Hold off readings while the state moves to the new name
+	client := c.clientFor(device)
+	if client != nil {
+		if token := client.Unsubscribe(device.upTopic()); token.Wait() && token.Error() != nil {
+			slog.Warn("Failed to unsubscribe", "device", old, "error", token.Error())
+		}
+	}
+	for _, sink := range device.policy.Sinks {
+		if forgetter, ok := sink.(Forgetter); ok {
+			forgetter.Forget(device)
+		}
+	}
+	lastUpdate.DeleteLabelValues(old)
+	deviceUp.DeleteLabelValues(old)
+	deviceMaintenance.DeleteLabelValues(old)
+	forgetDeviceInfo(old)
+
+	c.lastUpdateMutex.Lock()
+	rekey(c.lastUpdateTimes, old, name)
+	rekey(c.latest, old, name)
+	rekey(c.offline, old, name)
+	c.lastUpdateMutex.Unlock()
+	renamed := *device
+	renamed.Name, renamed.Labels = name, labels
+	c.swapDevice(device, &renamed)
+
+	c.burstMutex.Lock()
+	rekey(c.bursts, old, name)
+	c.burstMutex.Unlock()
+	c.renewalMutex.Lock()
+	rekey(c.renewals, old, name)
+	c.renewalMutex.Unlock()
+
+	if client != nil {
+		c.subscribeToCGDN1(client, &renamed)
+	}
+	return &renamed
+}
+
+// rekey moves the entry of old to name.
+func rekey[V any](m map[string]V, old, name string) {
+	if value, ok := m[old]; ok {
+		delete(m, old)
+		m[name] = value
+	}
+}
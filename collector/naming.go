@@ -0,0 +1,120 @@
+package collector
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// NamingRule names devices from their MAC address (or topic, for other
+// vendors' sensors) so large fleets don't need every device listed with a
+// name. Match is a wildcard pattern whose "*"s are filled into Name and
+// Labels in order, e.g. "582D34*" and "office-*"; Regex is a regular
+// expression whose groups are referenced as $1 or ${name}.
+type NamingRule struct {
+	Match  string            `json:"match,omitempty"`
+	Regex  string            `json:"regex,omitempty"`
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	re *regexp.Regexp
+	// template is Name with wildcards turned into group references
+	template string
+	labels   map[string]string
+}
+
+// compile validates the rule and prepares its pattern and templates.
+func (r *NamingRule) compile() error {
+	if (r.Match == "") == (r.Regex == "") {
+		return fmt.Errorf("naming rule needs exactly one of match and regex")
+	}
+	if r.Name == "" {
+		return fmt.Errorf("naming rule %q has no name", r.Match+r.Regex)
+	}
+
+	pattern := r.Regex
+	r.template = r.Name
+	r.labels = r.Labels
+	if r.Match != "" {
+		parts := strings.Split(r.Match, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		pattern = "(?i)^" + strings.Join(parts, "(.*?)") + "$"
+		r.template = wildcardTemplate(r.Name)
+		r.labels = make(map[string]string, len(r.Labels))
+		for name, value := range r.Labels {
+			r.labels[name] = wildcardTemplate(value)
+		}
+	}
+
+	var err error
+	if r.re, err = regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("naming rule %q: %w", r.Regex, err)
+	}
+	return nil
+}
+
+// wildcardTemplate turns the n-th "*" of template into ${n}.
+func wildcardTemplate(template string) string {
+	parts := strings.Split(strings.ReplaceAll(template, "$", "$$"), "*")
+	var b strings.Builder
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteString("${" + strconv.Itoa(i) + "}")
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// apply names the device if the rule matches its MAC or topic. A device
+// that replaced others is named by the MAC of the first one.
+func (r *NamingRule) apply(device *Device) bool {
+	subject := device.originalMAC()
+	if device.foreign() {
+		subject = device.Topic
+	}
+	match := r.re.FindStringSubmatchIndex(subject)
+	if match == nil {
+		return false
+	}
+
+	device.Name = string(r.re.ExpandString(nil, r.template, subject, match))
+	if len(r.labels) > 0 {
+		labels := make(map[string]string, len(r.labels)+len(device.Labels))
+		for name, value := range r.labels {
+			labels[name] = string(r.re.ExpandString(nil, value, subject, match))
+		}
+		// The device's own labels win
+		maps.Copy(labels, device.Labels)
+		device.Labels = labels
+	}
+	return true
+}
+
+// applyNamingRules names every device without a name by the first rule
+// matching it.
+func applyNamingRules(devices []*Device, rules []NamingRule) error {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return err
+		}
+	}
+	for _, device := range devices {
+		if device.Name != "" {
+			continue
+		}
+		for i := range rules {
+			if rules[i].apply(device) {
+				if device.Name == "" {
+					return fmt.Errorf("naming rule %d gives device %s an empty name", i+1, device.MAC+device.Topic)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
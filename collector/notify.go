@@ -0,0 +1,638 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NotificationsConfig is the "notifications" block of the config file
+type NotificationsConfig struct {
+	// Locale selects the built-in templates and labels, e.g. "de"
+	Locale string `json:"locale,omitempty"`
+	// Templates override the built-in template per event for every channel
+	Templates map[string]string `json:"templates,omitempty"`
+	Channels  []ChannelConfig   `json:"channels,omitempty"`
+}
+
+// ChannelConfig describes a single notification target
+type ChannelConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"` // log, webhook, slack, discord, telegram, pushover, tts or exec
+	URL  string `json:"url,omitempty"`
+	// Token, MediaPlayer and TTSEntity make a tts channel speak through
+	// Home Assistant; without them it POSTs to a generic endpoint
+	Token       string `json:"token,omitempty"`
+	MediaPlayer string `json:"media_player,omitempty"` // e.g. media_player.kitchen
+	TTSEntity   string `json:"tts_entity,omitempty"`   // e.g. tts.google_translate_en_com
+	// ChatID is the Telegram chat a telegram channel's bot (Token) writes to
+	ChatID string `json:"chat_id,omitempty"`
+	// User and Priority address a pushover channel's messages, sent with
+	// the application Token
+	User     string `json:"user,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// Command is run by an exec channel, at most MaxConcurrent at a time
+	// and each for at most Timeout
+	Command       []string `json:"command,omitempty"`
+	MaxConcurrent int      `json:"max_concurrent,omitempty"`
+	Timeout       Duration `json:"timeout,omitempty"`
+	// Locale and Templates override the notifications-wide settings
+	Locale    string            `json:"locale,omitempty"`
+	Templates map[string]string `json:"templates,omitempty"`
+}
+
+// Notification events
+const (
+	EventOffline   = "offline"
+	EventOnline    = "online"
+	EventDiverged  = "diverged"
+	EventConverged = "converged"
+	EventAlert     = "alert"
+	EventResolved  = "resolved"
+)
+
+// Notification is the data every template is executed with
+type Notification struct {
+	Event    string    `json:"event"`
+	Device   string    `json:"device"`
+	Tags     []string  `json:"tags,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration,omitempty"` // how long the condition lasted
+	Reading  CGDN1Data `json:"reading"`
+
+	// Set for sensor related events
+	Sensor    string  `json:"sensor,omitempty"`
+	Value     float64 `json:"value,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+	Peer      string  `json:"peer,omitempty"` // the other device of a co-located pair
+	Rule      string  `json:"rule,omitempty"` // the threshold rule that fired
+
+	// channels limits delivery to these channels, if set
+	channels []string
+}
+
+// defaultTemplates are used when neither the channel nor the notifications
+// block overrides an event's template. Unknown locales fall back to English.
+var defaultTemplates = map[string]map[string]string{
+	"en": {
+		EventOffline:   `{{.Device}} has not reported for {{.Duration}}`,
+		EventOnline:    `{{.Device}} is reporting again`,
+		EventDiverged:  `{{.Device}} and {{.Peer}} disagree on {{.Sensor}} by {{printf "%.1f" .Value}} (allowed {{.Threshold}})`,
+		EventConverged: `{{.Device}} and {{.Peer}} agree on {{.Sensor}} again`,
+		EventAlert:     `{{.Device}}: {{.Sensor}} is {{printf "%.1f" .Value}} (threshold {{.Threshold}})`,
+		EventResolved:  `{{.Device}}: {{.Sensor}} is back to normal ({{printf "%.1f" .Value}})`,
+	},
+	"de": {
+		EventOffline:   `{{.Device}} hat seit {{.Duration}} keine Daten gesendet`,
+		EventOnline:    `{{.Device}} sendet wieder Daten`,
+		EventDiverged:  `{{.Device}} und {{.Peer}} weichen bei {{.Sensor}} um {{printf "%.1f" .Value}} ab (erlaubt {{.Threshold}})`,
+		EventConverged: `{{.Device}} und {{.Peer}} stimmen bei {{.Sensor}} wieder überein`,
+		EventAlert:     `{{.Device}}: {{.Sensor}} liegt bei {{printf "%.1f" .Value}} (Schwelle {{.Threshold}})`,
+		EventResolved:  `{{.Device}}: {{.Sensor}} ist wieder normal ({{printf "%.1f" .Value}})`,
+	},
+	"fr": {
+		EventOffline:   `{{.Device}} n'a rien envoyé depuis {{.Duration}}`,
+		EventOnline:    `{{.Device}} envoie à nouveau des données`,
+		EventDiverged:  `{{.Device}} et {{.Peer}} divergent sur {{.Sensor}} de {{printf "%.1f" .Value}} (toléré {{.Threshold}})`,
+		EventConverged: `{{.Device}} et {{.Peer}} concordent à nouveau sur {{.Sensor}}`,
+		EventAlert:     `{{.Device}} : {{.Sensor}} est à {{printf "%.1f" .Value}} (seuil {{.Threshold}})`,
+		EventResolved:  `{{.Device}} : {{.Sensor}} est revenu à la normale ({{printf "%.1f" .Value}})`,
+	},
+	"es": {
+		EventOffline:   `{{.Device}} no ha enviado datos desde hace {{.Duration}}`,
+		EventOnline:    `{{.Device}} vuelve a enviar datos`,
+		EventDiverged:  `{{.Device}} y {{.Peer}} difieren en {{.Sensor}} por {{printf "%.1f" .Value}} (permitido {{.Threshold}})`,
+		EventConverged: `{{.Device}} y {{.Peer}} vuelven a coincidir en {{.Sensor}}`,
+		EventAlert:     `{{.Device}}: {{.Sensor}} está en {{printf "%.1f" .Value}} (umbral {{.Threshold}})`,
+		EventResolved:  `{{.Device}}: {{.Sensor}} vuelve a la normalidad ({{printf "%.1f" .Value}})`,
+	},
+	"zh": {
+		EventOffline:   `{{.Device}} 已 {{.Duration}} 未上报数据`,
+		EventOnline:    `{{.Device}} 已恢复上报`,
+		EventDiverged:  `{{.Device}} 与 {{.Peer}} 的 {{.Sensor}} 相差 {{printf "%.1f" .Value}}（允许 {{.Threshold}}）`,
+		EventConverged: `{{.Device}} 与 {{.Peer}} 的 {{.Sensor}} 已恢复一致`,
+		EventAlert:     `{{.Device}}：{{.Sensor}} 为 {{printf "%.1f" .Value}}（阈值 {{.Threshold}}）`,
+		EventResolved:  `{{.Device}}：{{.Sensor}} 已恢复正常（{{printf "%.1f" .Value}}）`,
+	},
+}
+
+// spokenTemplates replace the built-in templates of tts channels with
+// phrases that sound natural when read out. Other events fall back to the
+// written templates.
+var spokenTemplates = map[string]map[string]string{
+	"en": {
+		EventAlert:    `{{spoken .Sensor}} in the {{spoken .Device}} is {{printf "%.0f" .Value}}{{if eq .Sensor "co2"}} ppm, open a window{{end}}`,
+		EventResolved: `{{spoken .Sensor}} in the {{spoken .Device}} is back to normal`,
+	},
+	"de": {
+		EventAlert:    `{{spoken .Sensor}} im Raum {{spoken .Device}} liegt bei {{printf "%.0f" .Value}}{{if eq .Sensor "co2"}} ppm, bitte lüften{{end}}`,
+		EventResolved: `{{spoken .Sensor}} im Raum {{spoken .Device}} ist wieder normal`,
+	},
+	"fr": {
+		EventAlert:    `{{spoken .Sensor}} dans {{spoken .Device}} : {{printf "%.0f" .Value}}{{if eq .Sensor "co2"}} ppm, ouvrez une fenêtre{{end}}`,
+		EventResolved: `{{spoken .Sensor}} dans {{spoken .Device}} est revenu à la normale`,
+	},
+	"es": {
+		EventAlert:    `{{spoken .Sensor}} en {{spoken .Device}} está en {{printf "%.0f" .Value}}{{if eq .Sensor "co2"}} ppm, abre una ventana{{end}}`,
+		EventResolved: `{{spoken .Sensor}} en {{spoken .Device}} vuelve a la normalidad`,
+	},
+	"zh": {
+		EventAlert:    `{{spoken .Device}}的{{spoken .Sensor}}为{{printf "%.0f" .Value}}{{if eq .Sensor "co2"}} ppm，请开窗通风{{end}}`,
+		EventResolved: `{{spoken .Device}}的{{spoken .Sensor}}已恢复正常`,
+	},
+}
+
+// spokenNames are how sensor keys are read out; other keys and device
+// names just lose their underscores.
+var spokenNames = map[string]string{
+	"co2":        "CO2",
+	"pm25":       "PM2.5",
+	"pm10":       "PM10",
+	"tvoc":       "TVOC",
+	"tvoc_index": "TVOC index",
+}
+
+func spoken(name string) string {
+	if s, ok := spokenNames[name]; ok {
+		return s
+	}
+	return strings.ReplaceAll(name, "_", " ")
+}
+
+// channel sends rendered notification text somewhere
+type channel interface {
+	Send(text string, n Notification) error
+}
+
+// logChannel writes notifications to the collector log
+type logChannel struct{ name string }
+
+func (c logChannel) Send(text string, n Notification) error {
+	slog.Info(text, "channel", c.name, "event", n.Event, "device", n.Device)
+	return nil
+}
+
+// webhookChannel POSTs {"text": ..., "notification": {...}} as JSON
+type webhookChannel struct {
+	url    string
+	client *http.Client
+}
+
+func (c webhookChannel) Send(text string, n Notification) error {
+	return postJSON(c.client, c.url, map[string]any{"text": text, "notification": n})
+}
+
+// postJSON POSTs body as JSON and fails on any status but 2xx.
+func postJSON(client *http.Client, url string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// eventColors mark problems red and recoveries green in chat messages
+var eventColors = map[string]int{
+	EventOffline:   0xd93f0b,
+	EventDiverged:  0xfbca04,
+	EventAlert:     0xd93f0b,
+	EventOnline:    0x2ea44f,
+	EventConverged: 0x2ea44f,
+	EventResolved:  0x2ea44f,
+}
+
+// chatFields are the details shown under the text of a chat message
+func chatFields(n Notification) [][2]string {
+	fields := [][2]string{{"Device", n.Device}}
+	if n.Sensor != "" {
+		fields = append(fields, [2]string{"Sensor", n.Sensor}, [2]string{"Value", fmt.Sprintf("%.1f", n.Value)})
+	}
+	if n.Threshold != 0 {
+		fields = append(fields, [2]string{"Threshold", fmt.Sprintf("%g", n.Threshold)})
+	}
+	if n.Duration != "" {
+		fields = append(fields, [2]string{"Duration", n.Duration})
+	}
+	return fields
+}
+
+// slackChannel posts to a Slack incoming webhook, with the details in a
+// colored attachment
+type slackChannel struct {
+	url    string
+	client *http.Client
+}
+
+func (c slackChannel) Send(text string, n Notification) error {
+	var fields []map[string]any
+	for _, field := range chatFields(n) {
+		fields = append(fields, map[string]any{"title": field[0], "value": field[1], "short": true})
+	}
+	return postJSON(c.client, c.url, map[string]any{
+		"text": text,
+		"attachments": []map[string]any{{
+			"color":  fmt.Sprintf("#%06x", eventColors[n.Event]),
+			"fields": fields,
+			"footer": n.Event,
+			"ts":     n.Time.Unix(),
+		}},
+	})
+}
+
+// discordChannel posts to a Discord webhook, with the details in an embed
+type discordChannel struct {
+	url    string
+	client *http.Client
+}
+
+func (c discordChannel) Send(text string, n Notification) error {
+	var fields []map[string]any
+	for _, field := range chatFields(n) {
+		fields = append(fields, map[string]any{"name": field[0], "value": field[1], "inline": true})
+	}
+	return postJSON(c.client, c.url, map[string]any{
+		"content": text,
+		"embeds": []map[string]any{{
+			"color":     eventColors[n.Event],
+			"fields":    fields,
+			"footer":    map[string]string{"text": n.Event},
+			"timestamp": n.Time.UTC().Format(time.RFC3339),
+		}},
+	})
+}
+
+// ttsChannel has the text spoken, either by a Home Assistant media player
+// through the tts.speak service or by POSTing {"message": ..., "notification":
+// {...}} to a generic endpoint.
+type ttsChannel struct {
+	config ChannelConfig
+	client *http.Client
+}
+
+func (c ttsChannel) Send(text string, n Notification) error {
+	url := c.config.URL
+	var body map[string]any
+	if c.config.MediaPlayer != "" {
+		url = strings.TrimSuffix(url, "/") + "/api/services/tts/speak"
+		body = map[string]any{
+			"entity_id":              c.config.TTSEntity,
+			"media_player_entity_id": c.config.MediaPlayer,
+			"message":                text,
+		}
+	} else {
+		body = map[string]any{"message": text, "notification": n}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("tts endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// telegramChannel sends through a Telegram bot. url defaults to the Bot
+// API.
+type telegramChannel struct {
+	config ChannelConfig
+	client *http.Client
+}
+
+func (c telegramChannel) Send(text string, n Notification) error {
+	base := c.config.URL
+	if base == "" {
+		base = "https://api.telegram.org"
+	}
+	err := postJSON(c.client, strings.TrimSuffix(base, "/")+"/bot"+c.config.Token+"/sendMessage", map[string]any{
+		"chat_id": c.config.ChatID,
+		"text":    text,
+	})
+	// The URL holds the bot token, keep it out of the log
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// pushoverChannel sends a Pushover message. Recoveries go out quietly, at
+// one priority below the configured one.
+type pushoverChannel struct {
+	config ChannelConfig
+	client *http.Client
+}
+
+func (c pushoverChannel) Send(text string, n Notification) error {
+	url := c.config.URL
+	if url == "" {
+		url = "https://api.pushover.net/1/messages.json"
+	}
+	priority := c.config.Priority
+	switch n.Event {
+	case EventOnline, EventConverged, EventResolved:
+		priority = max(priority-1, -2)
+	}
+	return postJSON(c.client, url, map[string]any{
+		"token":     c.config.Token,
+		"user":      c.config.User,
+		"message":   text,
+		"title":     n.Device,
+		"priority":  priority,
+		"timestamp": n.Time.Unix(),
+	})
+}
+
+// execChannel runs a command with {"text": ..., "notification": {...}} on
+// stdin, for scripts the collector has no dedicated channel for.
+type execChannel struct {
+	command []string
+	timeout time.Duration
+	slots   chan struct{}
+	// stopped is canceled when the collector stops, ending the commands
+	// still running
+	stopped context.Context
+}
+
+func (c execChannel) Send(text string, n Notification) error {
+	ctx, cancel := context.WithTimeout(c.stopped, c.timeout)
+	defer cancel()
+
+	// Waiting for a slot counts towards the timeout, so a hanging command
+	// can't queue up unbounded work
+	select {
+	case c.slots <- struct{}{}:
+		defer func() { <-c.slots }()
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return errors.New("collector stopped before the command could run")
+		}
+		return fmt.Errorf("%d commands still running", cap(c.slots))
+	}
+
+	input, err := json.Marshal(map[string]any{"text": text, "notification": n})
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, c.command[0], c.command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), "QINGPING_EVENT="+n.Event, "QINGPING_DEVICE="+n.Device)
+	output, err := cmd.CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("command timed out after %s", c.timeout)
+	}
+	if ctx.Err() != nil {
+		return errors.New("command stopped with the collector")
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, limitString(strings.TrimSpace(string(output)), 200))
+	}
+	return nil
+}
+
+// notifyChannel is a configured channel with its templates parsed
+type notifyChannel struct {
+	name      string
+	locale    string
+	templates map[string]*template.Template
+	channel   channel
+}
+
+// notifier renders notifications per channel and delivers them to the
+// channels the device is routed to.
+type notifier struct {
+	channels []*notifyChannel
+	// maintenance silences devices while they are in it
+	maintenance *maintenance
+	// stop cancels what channels still run, see Close
+	stop context.CancelFunc
+}
+
+func newNotifier(config NotificationsConfig, fallbackLocale string) (*notifier, error) {
+	if config.Locale == "" {
+		config.Locale = fallbackLocale
+	}
+
+	stopped, stop := context.WithCancel(context.Background())
+	n := &notifier{stop: stop}
+	seen := make(map[string]bool)
+	for _, cc := range config.Channels {
+		if cc.Name == "" {
+			return nil, fmt.Errorf("notification channel without a name")
+		}
+		if seen[cc.Name] {
+			return nil, fmt.Errorf("duplicate notification channel %q", cc.Name)
+		}
+		seen[cc.Name] = true
+
+		var ch channel
+		switch cc.Type {
+		case "log", "":
+			ch = logChannel{name: cc.Name}
+		case "webhook":
+			if cc.URL == "" {
+				return nil, fmt.Errorf("channel %q: webhook needs a url", cc.Name)
+			}
+			ch = webhookChannel{url: cc.URL, client: &http.Client{Timeout: 10 * time.Second}}
+		case "slack", "discord":
+			if cc.URL == "" {
+				return nil, fmt.Errorf("channel %q: %s needs a webhook url", cc.Name, cc.Type)
+			}
+			client := &http.Client{Timeout: 10 * time.Second}
+			if cc.Type == "slack" {
+				ch = slackChannel{url: cc.URL, client: client}
+			} else {
+				ch = discordChannel{url: cc.URL, client: client}
+			}
+		case "tts":
+			if cc.URL == "" {
+				return nil, fmt.Errorf("channel %q: tts needs a url", cc.Name)
+			}
+			if cc.MediaPlayer != "" && cc.TTSEntity == "" {
+				return nil, fmt.Errorf("channel %q: tts with a media_player needs a tts_entity", cc.Name)
+			}
+			ch = ttsChannel{config: cc, client: &http.Client{Timeout: 10 * time.Second}}
+		case "telegram":
+			if cc.Token == "" || cc.ChatID == "" {
+				return nil, fmt.Errorf("channel %q: telegram needs a token and chat_id", cc.Name)
+			}
+			ch = telegramChannel{config: cc, client: &http.Client{Timeout: 10 * time.Second}}
+		case "pushover":
+			if cc.Token == "" || cc.User == "" {
+				return nil, fmt.Errorf("channel %q: pushover needs a token and user", cc.Name)
+			}
+			// Emergency priority 2 would need retry and expire parameters
+			if cc.Priority < -2 || cc.Priority > 1 {
+				return nil, fmt.Errorf("channel %q: pushover priority must be between -2 and 1", cc.Name)
+			}
+			ch = pushoverChannel{config: cc, client: &http.Client{Timeout: 10 * time.Second}}
+		case "exec":
+			if len(cc.Command) == 0 {
+				return nil, fmt.Errorf("channel %q: exec needs a command", cc.Name)
+			}
+			if cc.MaxConcurrent < 0 || cc.Timeout < 0 {
+				return nil, fmt.Errorf("channel %q: max_concurrent and timeout must not be negative", cc.Name)
+			}
+			if cc.MaxConcurrent == 0 {
+				cc.MaxConcurrent = 1
+			}
+			if cc.Timeout == 0 {
+				cc.Timeout = Duration(10 * time.Second)
+			}
+			ch = execChannel{
+				command: cc.Command,
+				timeout: time.Duration(cc.Timeout),
+				slots:   make(chan struct{}, cc.MaxConcurrent),
+				stopped: stopped,
+			}
+		default:
+			return nil, fmt.Errorf("channel %q: unknown type %q", cc.Name, cc.Type)
+		}
+
+		locale := cc.Locale
+		if locale == "" {
+			locale = config.Locale
+		}
+		layers := []map[string]string{config.Templates, cc.Templates}
+		if cc.Type == "tts" {
+			layers = append([]map[string]string{spokenTemplates["en"], spokenTemplates[localeLanguage(locale)]}, layers...)
+		}
+		templates, err := parseTemplates(locale, layers...)
+		if err != nil {
+			return nil, fmt.Errorf("channel %q: %w", cc.Name, err)
+		}
+
+		n.channels = append(n.channels, &notifyChannel{
+			name:      cc.Name,
+			locale:    locale,
+			templates: templates,
+			channel:   ch,
+		})
+	}
+	return n, nil
+}
+
+// parseTemplates layers the built-in templates for locale, the shared
+// overrides and the channel overrides, later ones winning.
+func parseTemplates(locale string, layers ...map[string]string) (map[string]*template.Template, error) {
+	sources := make(map[string]string)
+	for event, text := range defaultTemplates["en"] {
+		sources[event] = text
+	}
+	for event, text := range defaultTemplates[localeLanguage(locale)] {
+		sources[event] = text
+	}
+	for _, layer := range layers {
+		for event, text := range layer {
+			sources[event] = text
+		}
+	}
+
+	funcs := template.FuncMap{
+		"upper":  strings.ToUpper,
+		"spoken": spoken,
+		"lower":  strings.ToLower,
+		"aqiLabel": func(key string) string {
+			return aqiLabel(key, locale)
+		},
+	}
+
+	templates := make(map[string]*template.Template, len(sources))
+	for event, text := range sources {
+		t, err := template.New(event).Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", event, err)
+		}
+		templates[event] = t
+	}
+	return templates, nil
+}
+
+// channelNames lists the configured channel names, for validating routes.
+// Close ends the commands exec channels still run, when the collector
+// stops.
+func (n *notifier) Close() {
+	if n.stop != nil {
+		n.stop()
+	}
+}
+
+func (n *notifier) channelNames() map[string]bool {
+	names := make(map[string]bool, len(n.channels))
+	for _, ch := range n.channels {
+		names[ch.name] = true
+	}
+	return names
+}
+
+// Notify renders and sends the notification on every channel the device's
+// policy allows. Delivery happens in the background.
+func (n *notifier) Notify(device *Device, note Notification) {
+	note.Device = device.Name
+	note.Tags = device.Tags
+	if note.Time.IsZero() {
+		note.Time = time.Now()
+	}
+	if n.maintenance.active(device, note.Time) {
+		slog.Debug("Suppressed notification during maintenance", "device", device.Name, "event", note.Event)
+		return
+	}
+
+	for _, ch := range n.channels {
+		if !device.policy.AlertsTo(ch.name) {
+			continue
+		}
+		if len(note.channels) > 0 && !slices.Contains(note.channels, ch.name) {
+			continue
+		}
+		t, ok := ch.templates[note.Event]
+		if !ok {
+			slog.Warn("No template for event", "channel", ch.name, "event", note.Event)
+			continue
+		}
+		var text strings.Builder
+		if err := t.Execute(&text, note); err != nil {
+			slog.Error("Failed to render notification", "channel", ch.name, "event", note.Event, "device", note.Device, "error", err)
+			continue
+		}
+
+		go func(ch *notifyChannel, text string) {
+			if err := ch.channel.Send(text, note); err != nil {
+				slog.Error("Failed to send notification", "channel", ch.name, "event", note.Event, "device", note.Device, "error", err)
+			}
+		}(ch, text.String())
+	}
+}
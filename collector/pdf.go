@@ -0,0 +1,206 @@
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A4 in points
+const (
+	pdfWidth  = 595
+	pdfHeight = 842
+	pdfMargin = 50
+)
+
+// pdfDocument writes a minimal PDF of Helvetica text and lines, which is
+// all the reports need, without pulling in a PDF library.
+type pdfDocument struct {
+	pages []*bytes.Buffer
+	// y is where the next line goes on the last page
+	y float64
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, new(bytes.Buffer))
+	d.y = pdfHeight - pdfMargin
+}
+
+// need starts a new page unless height fits above the bottom margin.
+func (d *pdfDocument) need(height float64) {
+	if len(d.pages) == 0 || d.y-height < pdfMargin {
+		d.newPage()
+	}
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// text writes s at x and the current line, in bold or regular Helvetica.
+func (d *pdfDocument) text(x, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.page(), "BT /%s %g Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, d.y, pdfString(s))
+}
+
+// polyline strokes points, relative to x and y, in the given RGB color.
+func (d *pdfDocument) polyline(x, y float64, points [][2]float64, color [3]float64, dashed bool) {
+	page := d.page()
+	fmt.Fprintf(page, "q %g %g %g RG 0.8 w", color[0], color[1], color[2])
+	if dashed {
+		page.WriteString(" [4 3] 0 d")
+	}
+	for i, point := range points {
+		op := "l"
+		if i == 0 {
+			op = "m"
+		}
+		fmt.Fprintf(page, " %.2f %.2f %s", x+point[0], y+point[1], op)
+	}
+	page.WriteString(" S Q\n")
+}
+
+// pdfString escapes s for a PDF string in WinAnsiEncoding, replacing what
+// the encoding lacks.
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r >= 0x20 && r < 0x7f || r >= 0xa0 && r <= 0xff:
+			b.WriteByte(byte(r))
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// bytes returns the finished document.
+func (d *pdfDocument) bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+	// Objects 1 to 4 are the catalog, page tree and fonts, then each page
+	// is followed by its content
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	for i, page := range d.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+			pdfWidth, pdfHeight, 6+2*i))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.Bytes()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
+
+// renderReportPDF lays the report out like its HTML version, each device
+// starting on a new page.
+func renderReportPDF(data reportData) []byte {
+	var d pdfDocument
+	title := func(size float64, s string) {
+		d.text(pdfMargin, size, true, s)
+		d.y -= size + 6
+	}
+	row := func(columns []float64, bold bool, cells ...string) {
+		d.need(14)
+		for i, cell := range cells {
+			d.text(columns[i], 9, bold, cell)
+		}
+		d.y -= 14
+	}
+	period := fmt.Sprintf("%s to %s (%s), generated %s", data.From.Format("Mon, Jan 2, 2006"),
+		data.To.Add(-time.Nanosecond).Format("Mon, Jan 2, 2006"), data.From.Location(), data.Generated.Format("2006-01-02 15:04"))
+
+	summary := []float64{pdfMargin, 290, 345, 395, 455, 505}
+	exceedances := []float64{pdfMargin, 190, 260, 345, 400, 470}
+	for _, device := range data.Devices {
+		d.newPage()
+		title(16, "Air Quality Report "+data.Name+": "+device.Device)
+		d.text(pdfMargin, 9, false, period)
+		d.y -= 24
+		if len(device.Sensors) == 0 {
+			d.text(pdfMargin, 10, false, "No readings in this period.")
+			continue
+		}
+
+		row(summary, true, "Sensor", "Readings", "Min", "Average", "95th pct", "Max")
+		for _, sensor := range device.Sensors {
+			label := sensor.Label
+			if len(label) > 45 {
+				label = label[:44] + "..."
+			}
+			row(summary, false, label, fmt.Sprint(sensor.Count), fmt.Sprintf("%.1f", sensor.Min),
+				fmt.Sprintf("%.1f", sensor.Avg), fmt.Sprintf("%.1f", sensor.P95), fmt.Sprintf("%.1f", sensor.Max))
+		}
+		d.y -= 10
+
+		if len(device.Exceedances) > 0 {
+			d.need(40)
+			title(12, "Threshold exceedances")
+			row(exceedances, true, "Rule", "Sensor", "Limit", "Episodes", "Time exceeded", "Worst")
+			for _, e := range device.Exceedances {
+				worst := "-"
+				if e.Episodes > 0 {
+					worst = fmt.Sprintf("%.1f", e.Worst)
+				}
+				row(exceedances, false, e.Rule, e.Sensor, e.Limit, fmt.Sprint(e.Episodes), reportHours(e.Duration), worst)
+			}
+			d.y -= 10
+		}
+
+		const width, height = pdfWidth - 2*pdfMargin - 30, 100
+		for _, sensor := range device.Sensors {
+			d.need(height + 50)
+			title(10, sensor.Label)
+			d.y -= height
+			x := float64(pdfMargin + 30)
+			segments, lo, hi := chartSegments(sensor, data.From, data.To, width, height)
+			gray := [3]float64{0.8, 0.8, 0.8}
+			d.polyline(x, d.y, [][2]float64{{0, 0}, {width, 0}, {width, height}, {0, height}, {0, 0}}, gray, false)
+			for _, limit := range sensor.Limits {
+				y := (limit - lo) / (hi - lo) * height
+				d.polyline(x, d.y, [][2]float64{{0, y}, {width, y}}, [3]float64{0.8, 0, 0}, true)
+			}
+			for _, segment := range segments {
+				d.polyline(x, d.y, segment, [3]float64{0.2, 0.4, 0.8}, false)
+			}
+			d.text(pdfMargin, 8, false, fmt.Sprintf("%.0f", lo))
+			d.y += height - 8
+			d.text(pdfMargin, 8, false, fmt.Sprintf("%.0f", hi))
+			d.y -= height + 4
+			d.text(x, 8, false, data.From.Format("Jan 2"))
+			d.text(x+width-30, 8, false, data.To.Add(-time.Nanosecond).Format("Jan 2"))
+			d.y -= 20
+		}
+	}
+	if len(d.pages) == 0 {
+		d.newPage()
+		title(16, "Air Quality Report "+data.Name)
+		d.text(pdfMargin, 10, false, "No devices in this report.")
+	}
+	return d.bytes()
+}
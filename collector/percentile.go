@@ -0,0 +1,123 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// percentileRefresh is how often a device's distribution is read
+	// back from the history
+	percentileRefresh = time.Hour
+	// percentileMinSamples is the least history a rank is exported for
+	percentileMinSamples = 100
+)
+
+// percentileSink exports where each reading falls in the device's own
+// distribution over the window, e.g. qingping_pm25_ugm3_percentile 92
+// means only 8% of the readings in the last 30 days were worse.
+type percentileSink struct {
+	history historyStore
+	window  time.Duration
+	gauges  map[string]*prometheus.GaugeVec // by sensor key
+
+	mu    sync.Mutex
+	dists map[string]*distribution // by device name
+}
+
+// distribution holds a device's sorted values per sensor
+type distribution struct {
+	loaded time.Time
+	sorted map[string][]float64
+}
+
+// newPercentileSink registers a percentile gauge per sensor. It runs once
+// at startup, after fields and units are set up.
+func newPercentileSink(sensors []string, window time.Duration, history historyStore, registerer prometheus.Registerer) (*percentileSink, error) {
+	if window < 24*time.Hour {
+		return nil, fmt.Errorf("PERCENTILE_WINDOW must be at least 24h")
+	}
+	s := &percentileSink{
+		history: history,
+		window:  window,
+		gauges:  make(map[string]*prometheus.GaugeVec),
+		dists:   make(map[string]*distribution),
+	}
+	for _, key := range sensors {
+		metric, ok := sensorMetrics[key]
+		if !ok {
+			return nil, fmt.Errorf("PERCENTILE_SENSORS: no metric for sensor %q", key)
+		}
+		if _, ok := s.gauges[key]; ok {
+			continue
+		}
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metric.Name + "_percentile",
+			Help: fmt.Sprintf("%s, as percentile rank (0-100) in the device's own readings of the last %s", metric.Help, window),
+		}, []string{"device"})
+		if err := registerer.Register(gauge); err != nil {
+			return nil, fmt.Errorf("PERCENTILE_SENSORS: %w", err)
+		}
+		s.gauges[key] = gauge
+	}
+	return s, nil
+}
+
+func (s *percentileSink) Name() string { return "percentile" }
+
+func (s *percentileSink) Write(device *Device, data CGDN1Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dist := s.dists[device.Name]
+	if dist == nil || data.Timestamp.Sub(dist.loaded) >= percentileRefresh {
+		var err error
+		if dist, err = s.load(device, data.Timestamp); err != nil {
+			slog.Error("Failed to read history", "sink", s.Name(), "device", device.Name, "error", err)
+			return
+		}
+		s.dists[device.Name] = dist
+	}
+
+	for key, gauge := range s.gauges {
+		value, ok := data.Values[key]
+		if !ok {
+			continue
+		}
+		sorted := dist.sorted[key]
+		if len(sorted) < percentileMinSamples {
+			gauge.DeleteLabelValues(device.Name)
+			continue
+		}
+		gauge.WithLabelValues(device.Name).Set(percentileRank(sorted, value))
+	}
+}
+
+// load reads the device's distribution over the window up to now.
+func (s *percentileSink) load(device *Device, now time.Time) (*distribution, error) {
+	samples, err := s.history.Samples(device.Name, now.Add(-s.window), now)
+	if err != nil {
+		return nil, err
+	}
+	dist := &distribution{loaded: now, sorted: make(map[string][]float64, len(s.gauges))}
+	for key := range s.gauges {
+		values := sensorSeries(samples, key)
+		slices.Sort(values)
+		dist.sorted[key] = values
+	}
+	return dist, nil
+}
+
+func (s *percentileSink) Forget(device *Device) {
+	s.mu.Lock()
+	delete(s.dists, device.Name)
+	s.mu.Unlock()
+	for _, gauge := range s.gauges {
+		gauge.DeleteLabelValues(device.Name)
+	}
+}
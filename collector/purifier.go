@@ -0,0 +1,259 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// PurifierConfig links an air purifier to the device measuring its room,
+// so the particles its filter takes in can be tracked while it runs.
+type PurifierConfig struct {
+	Name       string  `json:"name"`
+	Device     string  `json:"device"`                // sensor in the purifier's room
+	StateTopic string  `json:"state_topic"`           // MQTT topic with the purifier's power state
+	StateField string  `json:"state_field,omitempty"` // path in a JSON state payload, e.g. "state"
+	On         string  `json:"on,omitempty"`          // state meaning running, default ON
+	RatedHours float64 `json:"rated_hours"`           // filter life per the manufacturer
+	RatedPM25  float64 `json:"rated_pm25,omitempty"`  // PM2.5 in µg/m³ the rating assumes, default 35
+}
+
+// capacity is the PM2.5 load in µg·h/m³ a filter is good for.
+func (p PurifierConfig) capacity() float64 {
+	return p.RatedHours * p.RatedPM25
+}
+
+// filterStore keeps the load of every filter across restarts
+type filterStore interface {
+	// FilterLoad returns the load of a filter and when it was last reset;
+	// unknown filters are new.
+	FilterLoad(name string) (float64, time.Time, error)
+	SetFilterLoad(name string, load float64, since time.Time) error
+}
+
+type memoryFilters struct {
+	mu    sync.Mutex
+	loads map[string]float64
+	since map[string]time.Time
+}
+
+func newMemoryFilters() *memoryFilters {
+	return &memoryFilters{loads: make(map[string]float64), since: make(map[string]time.Time)}
+}
+
+func (m *memoryFilters) FilterLoad(name string) (float64, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loads[name], m.since[name], nil
+}
+
+func (m *memoryFilters) SetFilterLoad(name string, load float64, since time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.loads[name], m.since[name] = load, since
+	return nil
+}
+
+// PurifierStatus is a purifier as returned by /api/purifiers
+type PurifierStatus struct {
+	Name    string `json:"name"`
+	Device  string `json:"device"`
+	Running bool   `json:"running"`
+	// Load is the integral of PM2.5 while running, in µg·h/m³
+	Load     float64   `json:"load"`
+	Consumed float64   `json:"consumed_percent"`
+	Since    time.Time `json:"since,omitzero"` // last filter change
+}
+
+type purifier struct {
+	config  PurifierConfig
+	running bool
+	load    float64
+	since   time.Time
+	last    time.Time // previous reading of the device
+}
+
+// purifierSink integrates the PM2.5 of a purifier's room over the time it
+// runs, which estimates how much of its filter is used up.
+type purifierSink struct {
+	store filterStore
+	// maxGap caps the time a single reading is counted for
+	maxGap time.Duration
+
+	mu        sync.Mutex
+	purifiers []*purifier
+}
+
+func newPurifierSink(configs []PurifierConfig, devices []*Device, store filterStore, maxGap time.Duration) (*purifierSink, error) {
+	known := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		known[device.Name] = true
+	}
+
+	s := &purifierSink{store: store, maxGap: maxGap}
+	seen := make(map[string]bool)
+	for i, config := range configs {
+		switch {
+		case config.Name == "" || config.StateTopic == "":
+			return nil, fmt.Errorf("purifier %d needs a name and state_topic", i)
+		case seen[config.Name]:
+			return nil, fmt.Errorf("duplicate purifier name %q", config.Name)
+		case !known[config.Device]:
+			return nil, fmt.Errorf("purifier %q references unknown device %q", config.Name, config.Device)
+		case config.RatedHours <= 0:
+			return nil, fmt.Errorf("purifier %q needs rated_hours", config.Name)
+		}
+		seen[config.Name] = true
+		if config.On == "" {
+			config.On = "ON"
+		}
+		if config.RatedPM25 <= 0 {
+			config.RatedPM25 = 35
+		}
+
+		load, since, err := store.FilterLoad(config.Name)
+		if err != nil {
+			return nil, fmt.Errorf("purifier %q: %w", config.Name, err)
+		}
+		p := &purifier{config: config, load: load, since: since}
+		s.purifiers = append(s.purifiers, p)
+		s.export(p)
+	}
+	return s, nil
+}
+
+func (s *purifierSink) Name() string { return "purifiers" }
+
+func (s *purifierSink) Write(device *Device, data CGDN1Data) {
+	pm25, ok := data.Values["pm25"]
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.purifiers {
+		if p.config.Device != device.Name {
+			continue
+		}
+		if p.running && !p.last.IsZero() {
+			elapsed := min(data.Timestamp.Sub(p.last), s.maxGap)
+			if elapsed > 0 {
+				p.load += pm25 * elapsed.Hours()
+				if err := s.store.SetFilterLoad(p.config.Name, p.load, p.since); err != nil {
+					slog.Error("Failed to store filter load", "purifier", p.config.Name, "error", err)
+				}
+				s.export(p)
+			}
+		}
+		p.last = data.Timestamp
+	}
+}
+
+// subscribe follows the power state of every purifier; call on connect.
+func (s *purifierSink) subscribe(client mqtt.Client) {
+	for _, p := range s.purifiers {
+		token := client.Subscribe(p.config.StateTopic, 0, func(client mqtt.Client, msg mqtt.Message) {
+			s.setRunning(p, p.config.isOn(msg.Payload()))
+		})
+		if err := waitSubscribed(token, p.config.StateTopic, ""); err != nil {
+			slog.Error("Failed to subscribe", "purifier", p.config.Name, "topic", p.config.StateTopic, "error", err)
+		}
+	}
+}
+
+// isOn reports whether a state payload says the purifier runs.
+func (p PurifierConfig) isOn(payload []byte) bool {
+	state := strings.TrimSpace(string(payload))
+	if p.StateField != "" {
+		var doc any
+		if err := json.Unmarshal(payload, &doc); err != nil {
+			return false
+		}
+		switch v := lookupPath(doc, p.StateField).(type) {
+		case string:
+			state = v
+		case bool:
+			return v
+		case float64:
+			state = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return false
+		}
+	}
+	return strings.EqualFold(state, p.On)
+}
+
+func (s *purifierSink) setRunning(p *purifier, running bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p.running != running {
+		slog.Info("Purifier state changed", "purifier", p.config.Name, "running", running)
+	}
+	p.running = running
+	s.export(p)
+}
+
+func (s *purifierSink) export(p *purifier) {
+	running := 0.0
+	if p.running {
+		running = 1
+	}
+	purifierRunning.WithLabelValues(p.config.Name).Set(running)
+	filterLoad.WithLabelValues(p.config.Name).Set(p.load)
+	filterConsumed.WithLabelValues(p.config.Name).Set(100 * p.load / p.config.capacity())
+}
+
+func (s *purifierSink) status(p *purifier) PurifierStatus {
+	return PurifierStatus{
+		Name:     p.config.Name,
+		Device:   p.config.Device,
+		Running:  p.running,
+		Load:     p.load,
+		Consumed: 100 * p.load / p.config.capacity(),
+		Since:    p.since,
+	}
+}
+
+// handleList serves GET /api/purifiers
+func (s *purifierSink) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	purifiers := make([]PurifierStatus, 0, len(s.purifiers))
+	for _, p := range s.purifiers {
+		purifiers = append(purifiers, s.status(p))
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"purifiers": purifiers})
+}
+
+// handleReset serves POST /api/purifiers/{name}/reset after a filter change.
+func (s *purifierSink) handleReset(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.purifiers {
+		if p.config.Name != r.PathValue("name") {
+			continue
+		}
+		now := time.Now()
+		if err := s.store.SetFilterLoad(p.config.Name, 0, now); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		p.load, p.since = 0, now
+		s.export(p)
+		slog.Info("Filter reset", "purifier", p.config.Name)
+		writeJSON(w, http.StatusOK, s.status(p))
+		return
+	}
+	writeError(w, http.StatusNotFound, "unknown purifier")
+}
@@ -0,0 +1,246 @@
+package collector
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// queryMaxBuckets bounds the buckets of one series, so a tiny step over a
+// long range can't exhaust memory
+const queryMaxBuckets = 10000
+
+// aggregations are what /api/v1/query can compute per bucket, from its
+// values in time order
+var aggregations = map[string]func(values, sorted []float64) float64{
+	"avg": func(values, _ []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values))
+	},
+	"min": func(_, sorted []float64) float64 { return sorted[0] },
+	"max": func(_, sorted []float64) float64 { return sorted[len(sorted)-1] },
+	"sum": func(values, _ []float64) float64 {
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"count": func(values, _ []float64) float64 { return float64(len(values)) },
+	"first": func(values, _ []float64) float64 { return values[0] },
+	"last":  func(values, _ []float64) float64 { return values[len(values)-1] },
+	"p50":   func(_, sorted []float64) float64 { return percentile(sorted, 50) },
+	"p90":   func(_, sorted []float64) float64 { return percentile(sorted, 90) },
+	"p95":   func(_, sorted []float64) float64 { return percentile(sorted, 95) },
+	"p99":   func(_, sorted []float64) float64 { return percentile(sorted, 99) },
+}
+
+// QueryPoint is one bucket of a series: its start and an entry per
+// aggregation
+type QueryPoint struct {
+	Time   time.Time          `json:"time"`
+	Values map[string]float64 `json:"values"`
+}
+
+// QuerySeries is a sensor of one device, or of all of them with group=none
+// where device is "*"
+type QuerySeries struct {
+	Device string       `json:"device"`
+	Sensor string       `json:"sensor"`
+	Points []QueryPoint `json:"points"`
+}
+
+// QueryResponse is returned by /api/v1/query
+type QueryResponse struct {
+	From   time.Time     `json:"from"`
+	To     time.Time     `json:"to"`
+	Step   string        `json:"step,omitempty"`
+	Series []QuerySeries `json:"series"`
+}
+
+// querySeriesKey identifies a series while aggregating; device is "*"
+// with group=none
+type querySeriesKey struct {
+	device, sensor string
+}
+
+// handleQuery serves
+// GET /api/v1/query?sensors=co2,pm25&devices=a,b&from=...&to=...&step=1h&agg=avg,max&group=device&format=json
+// with the stored history aggregated per device (or across devices with
+// group=none), sensor and time bucket. Without step the whole range is one
+// bucket. Buckets are aligned like time.Truncate, so those of steps that
+// divide a day start at midnight UTC.
+func (c *collector) handleQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	to, err := parseTime(r, "to", time.Now())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	from, err := parseTime(r, "from", to.Add(-24*time.Hour))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	var step time.Duration
+	if value := query.Get("step"); value != "" {
+		step, err = time.ParseDuration(value)
+		if err != nil || step < time.Second {
+			writeError(w, http.StatusBadRequest, "invalid step")
+			return
+		}
+		if to.Sub(from)/step > queryMaxBuckets {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("step too small, at most %d buckets", queryMaxBuckets))
+			return
+		}
+	}
+
+	aggs := splitList(query.Get("agg"))
+	if len(aggs) == 0 {
+		aggs = []string{"avg"}
+	}
+	for _, agg := range aggs {
+		if _, ok := aggregations[agg]; !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unknown aggregation %q", agg))
+			return
+		}
+	}
+
+	pooled := false
+	switch query.Get("group") {
+	case "", "device":
+	case "none":
+		pooled = true
+	default:
+		writeError(w, http.StatusBadRequest, "group must be device or none")
+		return
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		writeError(w, http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+
+	var devices []*Device
+	if names := splitList(query.Get("devices")); len(names) > 0 {
+		for _, name := range names {
+			device := c.deviceByName(name)
+			if device == nil {
+				writeError(w, http.StatusNotFound, fmt.Sprintf("unknown device %q", name))
+				return
+			}
+			devices = append(devices, device)
+		}
+	} else {
+		devices = c.devices()
+	}
+	sensors := splitList(query.Get("sensors"))
+
+	buckets := make(map[querySeriesKey]map[time.Time][]timedValue)
+	for _, device := range devices {
+		samples, err := c.history.Samples(device.Name, from, to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		name := device.Name
+		if pooled {
+			name = "*"
+		}
+		for _, sample := range samples {
+			start := from
+			if step > 0 {
+				start = sample.Time.Truncate(step)
+			}
+			for key, value := range sample.Values {
+				if len(sensors) > 0 && !slices.Contains(sensors, key) {
+					continue
+				}
+				series := buckets[querySeriesKey{name, key}]
+				if series == nil {
+					series = make(map[time.Time][]timedValue)
+					buckets[querySeriesKey{name, key}] = series
+				}
+				series[start] = append(series[start], timedValue{sample.Time, value})
+			}
+		}
+	}
+
+	response := QueryResponse{From: from, To: to, Series: make([]QuerySeries, 0, len(buckets))}
+	if step > 0 {
+		response.Step = step.String()
+	}
+	for key, series := range buckets {
+		out := QuerySeries{Device: key.device, Sensor: key.sensor}
+		for start, bucket := range series {
+			// Pooled devices come one after another, first and last need
+			// them interleaved
+			sort.SliceStable(bucket, func(i, j int) bool { return bucket[i].Time.Before(bucket[j].Time) })
+			values := make([]float64, len(bucket))
+			for i, v := range bucket {
+				values[i] = v.Value
+			}
+			sorted := slices.Sorted(slices.Values(values))
+			point := QueryPoint{Time: start, Values: make(map[string]float64, len(aggs))}
+			for _, agg := range aggs {
+				point.Values[agg] = round2(aggregations[agg](values, sorted))
+			}
+			out.Points = append(out.Points, point)
+		}
+		sort.Slice(out.Points, func(i, j int) bool { return out.Points[i].Time.Before(out.Points[j].Time) })
+		response.Series = append(response.Series, out)
+	}
+	sort.Slice(response.Series, func(i, j int) bool {
+		a, b := response.Series[i], response.Series[j]
+		return a.Device < b.Device || a.Device == b.Device && a.Sensor < b.Sensor
+	})
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		if err := writeQueryCSV(w, response, aggs); err != nil {
+			slog.Debug("Failed to write query CSV", "error", err)
+		}
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// writeQueryCSV writes one row per series and bucket, with a column per
+// aggregation.
+func writeQueryCSV(w io.Writer, response QueryResponse, aggs []string) error {
+	out := csv.NewWriter(w)
+	if err := out.Write(append([]string{"time", "device", "sensor"}, aggs...)); err != nil {
+		return err
+	}
+	row := make([]string, len(aggs)+3)
+	for _, series := range response.Series {
+		for _, point := range series.Points {
+			row[0] = point.Time.UTC().Format(time.RFC3339)
+			row[1] = series.Device
+			row[2] = series.Sensor
+			for i, agg := range aggs {
+				row[i+3] = strconv.FormatFloat(point.Values[agg], 'f', -1, 64)
+			}
+			if err := out.Write(row); err != nil {
+				return err
+			}
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
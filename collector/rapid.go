@@ -0,0 +1,148 @@
+package collector
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// rapidMaxInterval is where rapid mode ends; UPDATE_INTERVAL covers
+	// anything slower
+	rapidMaxInterval = 15 * time.Second
+	// rapidWindow is the duration of each Type 12 request in rapid mode,
+	// so a device left behind by the collector soon returns to its own
+	// schedule instead of reporting every few seconds for DURATION
+	rapidWindow = 10 * time.Minute
+)
+
+var rapidMode = registered(prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "qingping_rapid_mode",
+	Help: "1 while a device configured for rapid mode reports at its rapid interval, 0 while it fell back on battery",
+}, []string{"device"}))
+
+// rapidInterval is the interval the device reports at in rapid mode, or 0
+// if it isn't in rapid mode, because it isn't configured for it or runs
+// on battery.
+func (c *collector) rapidInterval(device *Device) time.Duration {
+	if device.Rapid == 0 || !device.commandable() {
+		return 0
+	}
+	c.powerMutex.Lock()
+	defer c.powerMutex.Unlock()
+	if c.onBattery[device.Name] {
+		return 0
+	}
+	return time.Duration(device.Rapid)
+}
+
+// trackPower notices a rapid device being unplugged or plugged in from
+// its battery level and switches it between rapid and normal reporting.
+// The CGDN1 doesn't report its power source, so a falling level means it
+// runs on battery and a rising or full one that it is plugged in.
+func (c *collector) trackPower(device *Device, raw map[string]float64) {
+	level, ok := raw["battery"]
+	if device.Rapid == 0 || !ok {
+		return
+	}
+	c.powerMutex.Lock()
+	previous, known := c.batteryLevels[device.Name]
+	c.batteryLevels[device.Name] = level
+	was := c.onBattery[device.Name]
+	now := was
+	switch {
+	case !known:
+	case level < previous:
+		now = true
+	case level > previous || level >= 100:
+		now = false
+	}
+	c.onBattery[device.Name] = now
+	c.powerMutex.Unlock()
+
+	if !known {
+		rapidMode.WithLabelValues(device.Name).Set(1)
+	}
+	if now == was {
+		return
+	}
+	if now {
+		slog.Info("Device runs on battery, leaving rapid mode", "device", device.Name, "battery", level)
+		rapidMode.WithLabelValues(device.Name).Set(0)
+	} else {
+		slog.Info("Device is plugged in, resuming rapid mode", "device", device.Name, "battery", level)
+		rapidMode.WithLabelValues(device.Name).Set(1)
+	}
+	// Not from within the MQTT handler, which the publish would wait on
+	go c.sendConfigMessage(device)
+}
+
+// downsampler averages the readings of devices in rapid mode over a
+// window before they reach Prometheus, which would otherwise only see
+// whichever reading happened to be the last before a scrape.
+type downsampler struct {
+	window time.Duration
+	// active reports whether the device's readings are downsampled
+	active func(device *Device) bool
+
+	mu      sync.Mutex
+	windows map[string]*downsampleWindow // by device name
+}
+
+// downsampleWindow accumulates a device's readings since start
+type downsampleWindow struct {
+	start  time.Time
+	sums   map[string]float64
+	counts map[string]int
+	last   CGDN1Data
+}
+
+func newDownsampler(window time.Duration) *downsampler {
+	return &downsampler{window: window, windows: make(map[string]*downsampleWindow)}
+}
+
+// add takes a reading and returns the average of the window it closes,
+// if any. Readings of devices not in rapid mode pass straight through.
+func (d *downsampler) add(device *Device, data CGDN1Data) (CGDN1Data, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.active != nil && !d.active(device) {
+		delete(d.windows, device.Name)
+		return data, true
+	}
+
+	w := d.windows[device.Name]
+	var average CGDN1Data
+	closed := false
+	if w != nil && data.Timestamp.Sub(w.start) >= d.window {
+		average, closed = w.average(), true
+		w = nil
+	}
+	if w == nil {
+		w = &downsampleWindow{start: data.Timestamp, sums: make(map[string]float64), counts: make(map[string]int)}
+		d.windows[device.Name] = w
+	}
+	for key, value := range data.Values {
+		w.sums[key] += value
+		w.counts[key]++
+	}
+	w.last = data
+	return average, closed
+}
+
+// average is the window's last reading with every value averaged.
+func (w *downsampleWindow) average() CGDN1Data {
+	data := w.last.clone()
+	for key, sum := range w.sums {
+		data.Values[key] = sum / float64(w.counts[key])
+	}
+	return data
+}
+
+func (d *downsampler) forget(device *Device) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.windows, device.Name)
+}
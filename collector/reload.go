@@ -0,0 +1,288 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// deviceKey identifies a device across config reloads, independent of
+// its name.
+func deviceKey(device *Device) string {
+	if device.foreign() {
+		return "topic:" + device.Topic
+	}
+	return "mac:" + strings.ToUpper(device.MAC)
+}
+
+// deviceBroker is the health key of the broker the device is on.
+func deviceBroker(device *Device) string {
+	if device.home != nil && device.home.Broker != "" {
+		return device.home.Name
+	}
+	return ""
+}
+
+// devices returns the current devices; the list changes on reload.
+//
+// A device is never changed once the collector uses it: reloads, renames
+// and remote configs swap in an updated copy, so handlers can read a
+// device without holding a lock while they work on it. Handlers started
+// by MQTT messages and timers look up the current device first.
+func (c *collector) devices() []*Device {
+	c.lastUpdateMutex.RLock()
+	defer c.lastUpdateMutex.RUnlock()
+	return c.config.Devices
+}
+
+// currentDevice returns the device configured now in place of device, or
+// nil if it was removed.
+func (c *collector) currentDevice(device *Device) *Device {
+	key := deviceKey(device)
+	for _, current := range c.devices() {
+		if deviceKey(current) == key {
+			return current
+		}
+	}
+	return nil
+}
+
+// later returns a timer func running fn on the device configured by then,
+// unless it was removed.
+func (c *collector) later(device *Device, fn func(*Device)) func() {
+	return func() {
+		if current := c.currentDevice(device); current != nil {
+			fn(current)
+		}
+	}
+}
+
+// swapDevice puts next in the place of device. The list is copied, as
+// readers range over it without the lock. It is called with reloadMutex
+// held.
+func (c *collector) swapDevice(device, next *Device) {
+	c.lastUpdateMutex.Lock()
+	defer c.lastUpdateMutex.Unlock()
+	devices := slices.Clone(c.config.Devices)
+	if i := slices.Index(devices, device); i >= 0 {
+		devices[i] = next
+	}
+	c.config.Devices = devices
+}
+
+// devicesOn returns the current devices on a broker.
+func (c *collector) devicesOn(broker string) []*Device {
+	var devices []*Device
+	for _, device := range c.devices() {
+		if deviceBroker(device) == broker {
+			devices = append(devices, device)
+		}
+	}
+	return devices
+}
+
+// restartOnly lists the config file sections that are wired into sinks at
+// startup and only take effect after a restart.
+func restartOnly(current, next Config) []string {
+	var changed []string
+	sections := []struct {
+		name      string
+		were, are any
+	}{
+		{"notifications", current.Notifications, next.Notifications},
+		{"colocated", current.Colocated, next.Colocated},
+		{"thresholds", current.Thresholds, next.Thresholds},
+		{"indicators", current.Indicators, next.Indicators},
+		{"ventilation", current.Ventilation, next.Ventilation},
+		{"purifiers", current.Purifiers, next.Purifiers},
+		{"reports", current.Reports, next.Reports},
+		{"fields", current.Fields, next.Fields},
+	}
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.were, section.are) {
+			changed = append(changed, section.name)
+		}
+	}
+	return changed
+}
+
+// homeBrokers describes the broker connection of every home, to detect
+// changes that need a restart.
+func homeBrokers(homes []*HomeConfig) map[string]HomeConfig {
+	brokers := make(map[string]HomeConfig, len(homes))
+	for _, home := range homes {
+		brokers[home.Name] = HomeConfig{Broker: home.Broker, Port: home.Port, Username: home.Username, Password: home.Password}
+	}
+	return brokers
+}
+
+// reload applies a newly loaded config while the collector keeps running:
+// devices are added, removed and updated, routes and settings change.
+// Devices that stay keep their metrics and state. It returns the added
+// devices.
+func (c *collector) reload(next Config) ([]*Device, error) {
+	if !reflect.DeepEqual(homeBrokers(c.config.Homes), homeBrokers(next.Homes)) {
+		return nil, fmt.Errorf("homes or their brokers changed, restart to apply")
+	}
+	if err := validateAlertRoutes(next.Routes, c.notifier.channelNames()); err != nil {
+		return nil, err
+	}
+	if err := resolvePolicies(next.Devices, next.Routes, c.sinks); err != nil {
+		return nil, err
+	}
+	if err := assignSeriesIDs(next.Devices, c.seriesIDs); err != nil {
+		return nil, err
+	}
+	if changed := restartOnly(c.config, next); len(changed) > 0 {
+		slog.Warn("Config sections changed that only apply after a restart", "sections", changed)
+	}
+
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	current := make(map[string]*Device, len(c.config.Devices))
+	for _, device := range c.config.Devices {
+		current[deviceKey(device)] = device
+	}
+
+	var devices, added, replaced []*Device
+	for _, device := range next.Devices {
+		key := deviceKey(device)
+		old, ok := current[key]
+		replacement := false
+		if !ok {
+			// New hardware takes over the device it replaces
+			for _, mac := range device.Replaces {
+				if old, ok = current["mac:"+mac]; ok {
+					key = "mac:" + mac
+					c.unsubscribeDevice(old)
+					replacement = true
+					break
+				}
+			}
+		}
+		devices = append(devices, device)
+		if !ok {
+			added = append(added, device)
+			continue
+		}
+		delete(current, key)
+		c.updateDevice(old, device)
+		if replacement {
+			replaced = append(replaced, device)
+		}
+	}
+	for _, device := range current {
+		c.removeDevice(device)
+	}
+
+	c.lastUpdateMutex.Lock()
+	c.config.Devices = devices
+	c.config.Homes = next.Homes
+	c.config.Routes = next.Routes
+	c.config.Settings = next.Settings
+	c.config.Schedules = next.Schedules
+	c.lastUpdateMutex.Unlock()
+	setDeviceLabels(devices)
+	c.health.setDevices(len(devices))
+	if c.remote != nil {
+		c.reapplyRemoteConfigs()
+	}
+
+	for _, device := range slices.Concat(added, replaced) {
+		if slices.Contains(replaced, device) {
+			slog.Info("Device replaced, carrying over its state", "device", device.Name, "mac", device.MAC)
+		} else {
+			slog.Info("Adding device", "device", device.Name)
+		}
+		client := c.clientFor(device)
+		if client.IsConnected() && c.subscribeToCGDN1(client, device) {
+			c.health.setSubscribed(deviceBroker(device), device.upTopic())
+		}
+		c.sendSettings(device)
+		c.sendConfigMessage(device)
+	}
+	slog.Info("Reloaded configuration", "devices", len(devices), "added", len(added), "replaced", len(replaced), "removed", len(current))
+	return slices.Concat(added, replaced), nil
+}
+
+// updateDevice swaps in the new config of a device that stays, renaming
+// it if needed.
+func (c *collector) updateDevice(device, next *Device) {
+	if device.Name != next.Name {
+		device = c.renameDevice(device, next.Name, next.Labels)
+	}
+	settingsChanged := !reflect.DeepEqual(device.Settings, next.Settings)
+
+	// Sinks the device is no longer routed to drop what they hold of it
+	for _, sink := range device.policy.Sinks {
+		if forgetter, ok := sink.(Forgetter); ok && !slices.Contains(next.policy.Sinks, sink) {
+			forgetter.Forget(device)
+		}
+	}
+	c.swapDevice(device, next)
+	if c.remote != nil && c.remote.thresholds != nil && deviceKey(device) != deviceKey(next) {
+		c.remote.thresholds.moveDeviceRules(device, next)
+	}
+
+	if settingsChanged {
+		c.sendSettings(next)
+	}
+}
+
+// unsubscribeDevice stops listening to a device's topic.
+func (c *collector) unsubscribeDevice(device *Device) {
+	client := c.clientFor(device)
+	if token := client.Unsubscribe(device.upTopic()); token.Wait() && token.Error() != nil {
+		slog.Warn("Failed to unsubscribe", "device", device.Name, "error", token.Error())
+	}
+	c.health.setUnsubscribed(deviceBroker(device), device.upTopic())
+}
+
+// removeDevice stops listening to a device and drops everything kept
+// about it.
+func (c *collector) removeDevice(device *Device) {
+	slog.Info("Removing device", "device", device.Name)
+	c.unsubscribeDevice(device)
+
+	for _, sink := range device.policy.Sinks {
+		if forgetter, ok := sink.(Forgetter); ok {
+			forgetter.Forget(device)
+		}
+	}
+	lastUpdate.DeleteLabelValues(device.Name)
+	deviceUp.DeleteLabelValues(device.Name)
+	deviceMaintenance.DeleteLabelValues(device.Name)
+	forgetDeviceInfo(device.Name)
+	c.maintenance.end(device)
+	if c.remote != nil && c.remote.thresholds != nil {
+		c.remote.thresholds.setDeviceRules(device, nil)
+	}
+
+	c.lastUpdateMutex.Lock()
+	delete(c.lastUpdateTimes, device.Name)
+	delete(c.latest, device.Name)
+	delete(c.offline, device.Name)
+	delete(c.availability, device.Name)
+	c.lastUpdateMutex.Unlock()
+
+	c.burstMutex.Lock()
+	if b, ok := c.bursts[device.Name]; ok {
+		b.timer.Stop()
+		delete(c.bursts, device.Name)
+	}
+	c.burstMutex.Unlock()
+	c.renewalMutex.Lock()
+	if r, ok := c.renewals[device.Name]; ok {
+		r.timer.Stop()
+		delete(c.renewals, device.Name)
+	}
+	c.renewalMutex.Unlock()
+	c.powerMutex.Lock()
+	delete(c.batteryLevels, device.Name)
+	delete(c.onBattery, device.Name)
+	c.powerMutex.Unlock()
+	rapidMode.DeleteLabelValues(device.Name)
+}
@@ -0,0 +1,235 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// RemoteDeviceConfig is the retained JSON on DEVICE_CONFIG_TOPIC that
+// overrides a configured device's metadata. Fields left out keep their
+// value from the config file; an empty retained message reverts all of
+// them.
+type RemoteDeviceConfig struct {
+	Name   string            `json:"name,omitempty"`
+	Tags   []string          `json:"tags,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Calibration replaces the device's offsets as a whole
+	Calibration map[string]float64 `json:"calibration,omitempty"`
+	// Thresholds apply to this device only, in addition to the config
+	// file's; their tags are ignored
+	Thresholds []ThresholdRule `json:"thresholds,omitempty"`
+}
+
+// remoteConfigs tracks the device configs received over MQTT.
+type remoteConfigs struct {
+	topic      string // with {mac} in place of the device's MAC
+	pattern    *regexp.Regexp
+	thresholds *thresholdSink
+
+	mu      sync.Mutex
+	configs map[string]RemoteDeviceConfig // by MAC
+	// base holds what the config file says about overridden devices
+	base map[string]Device
+}
+
+func newRemoteConfigs(topic string, thresholds *thresholdSink) (*remoteConfigs, error) {
+	if strings.Count(topic, "{mac}") != 1 {
+		return nil, fmt.Errorf("device config topic %q must contain {mac} once", topic)
+	}
+	before, after, _ := strings.Cut(topic, "{mac}")
+	return &remoteConfigs{
+		topic:      topic,
+		pattern:    regexp.MustCompile("^" + regexp.QuoteMeta(before) + "([0-9A-Fa-f]{12})" + regexp.QuoteMeta(after) + "$"),
+		thresholds: thresholds,
+		configs:    make(map[string]RemoteDeviceConfig),
+		base:       make(map[string]Device),
+	}, nil
+}
+
+// subscribeRemoteConfig subscribes to the config topics of all devices on
+// connect; retained configs arrive right away.
+func (c *collector) subscribeRemoteConfig(client mqtt.Client) {
+	filter := strings.Replace(c.remote.topic, "{mac}", "+", 1)
+	token := client.Subscribe(filter, 1, func(client mqtt.Client, msg mqtt.Message) {
+		c.handleRemoteConfig(msg.Topic(), msg.Payload())
+	})
+	if err := waitSubscribed(token, filter, ""); err != nil {
+		slog.Error("Failed to subscribe", "topic", filter, "error", err)
+		return
+	}
+	slog.Info("Subscribed to device configs", "topic", filter)
+}
+
+func (c *collector) handleRemoteConfig(topic string, payload []byte) {
+	match := c.remote.pattern.FindStringSubmatch(topic)
+	if match == nil {
+		return
+	}
+	mac := strings.ToUpper(match[1])
+
+	var config RemoteDeviceConfig
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &config); err != nil {
+			slog.Warn("Ignoring invalid device config", "topic", topic, "error", err)
+			return
+		}
+	}
+
+	c.reloadMutex.Lock()
+	defer c.reloadMutex.Unlock()
+
+	var device *Device
+	for _, d := range c.devices() {
+		if d.knownAs(mac) {
+			device = d
+		}
+	}
+	if device == nil {
+		slog.Debug("Ignoring config of unknown device", "topic", topic, "mac", mac)
+		return
+	}
+	if err := c.validateRemoteConfig(device, &config); err != nil {
+		slog.Warn("Ignoring invalid device config", "device", device.Name, "topic", topic, "error", err)
+		return
+	}
+
+	c.remote.mu.Lock()
+	if len(payload) == 0 {
+		delete(c.remote.configs, mac)
+	} else {
+		c.remote.configs[mac] = config
+	}
+	config, _ = c.remote.configFor(device)
+	c.remote.mu.Unlock()
+	c.applyRemoteConfig(device, config)
+	setDeviceLabels(c.devices())
+}
+
+func (c *collector) validateRemoteConfig(device *Device, config *RemoteDeviceConfig) error {
+	if config.Name != "" && config.Name != device.Name {
+		for _, other := range c.devices() {
+			if other != device && other.Name == config.Name {
+				return fmt.Errorf("device name %q is taken", config.Name)
+			}
+		}
+	}
+	for name := range config.Labels {
+		if !validLabelName(name) || name == "device" {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	if err := validateCalibration(device, config.Calibration); err != nil {
+		return err
+	}
+	if len(config.Thresholds) > 0 && c.remote.thresholds == nil {
+		return fmt.Errorf("thresholds are not available")
+	}
+	for i := range config.Thresholds {
+		config.Thresholds[i].Tags = nil
+	}
+	if err := normalizeThresholds(config.Thresholds); err != nil {
+		return err
+	}
+	if err := checkChannels(config.Thresholds, c.remote.thresholds.notifier); err != nil {
+		return err
+	}
+	for _, rule := range config.Thresholds {
+		if c.remote.thresholds.hasRule(rule.Name) {
+			return fmt.Errorf("threshold %q already exists in the config file", rule.Name)
+		}
+	}
+	return nil
+}
+
+// applyRemoteConfig puts the device in the state its config file values
+// and remote config describe together.
+func (c *collector) applyRemoteConfig(device *Device, config RemoteDeviceConfig) {
+	mac := strings.ToUpper(device.MAC)
+	c.remote.mu.Lock()
+	base, ok := c.remote.base[mac]
+	if !ok {
+		base = Device{Name: device.Name, Tags: device.Tags, Labels: device.Labels, Calibration: device.Calibration}
+		c.remote.base[mac] = base
+	}
+	c.remote.mu.Unlock()
+
+	name, tags, labels, calibration := base.Name, base.Tags, base.Labels, base.Calibration
+	if config.Name != "" {
+		name = config.Name
+	}
+	if config.Tags != nil {
+		tags = config.Tags
+	}
+	if config.Labels != nil {
+		labels = homeLabels(device, config.Labels)
+	}
+	if config.Calibration != nil {
+		calibration = config.Calibration
+	}
+
+	if name != device.Name {
+		device = c.renameDevice(device, name, labels)
+	}
+	if !slices.Equal(tags, device.Tags) || !maps.Equal(labels, device.Labels) {
+		slog.Info("Updating device from its remote config", "device", device.Name, "tags", tags, "labels", labels)
+		next := *device
+		next.Tags, next.Labels = tags, labels
+		// Routes are matched by tags, so the policy may change as well
+		if err := resolvePolicies([]*Device{&next}, c.config.Routes, c.sinks); err == nil {
+			c.swapDevice(device, &next)
+			device = &next
+		}
+	}
+	if !maps.Equal(calibration, device.Calibration) {
+		slog.Info("Calibrating device from its remote config", "device", device.Name, "calibration", calibration)
+		next := *device
+		next.Calibration = calibration
+		c.swapDevice(device, &next)
+		device = &next
+	}
+	if c.remote.thresholds != nil {
+		c.remote.thresholds.setDeviceRules(device, config.Thresholds)
+	}
+}
+
+// configFor returns the config of the device's MAC, or else that of the
+// newest MAC it replaced, so a config published for the old hardware
+// keeps applying. It is called with the lock held.
+func (r *remoteConfigs) configFor(device *Device) (RemoteDeviceConfig, bool) {
+	if config, ok := r.configs[normalizeMAC(device.MAC)]; ok {
+		return config, true
+	}
+	for i := len(device.Replaces) - 1; i >= 0; i-- {
+		if config, ok := r.configs[device.Replaces[i]]; ok {
+			return config, true
+		}
+	}
+	return RemoteDeviceConfig{}, false
+}
+
+// reapplyRemoteConfigs applies the received configs again after the
+// config file was reloaded, on top of its new values.
+func (c *collector) reapplyRemoteConfigs() {
+	c.remote.mu.Lock()
+	c.remote.base = make(map[string]Device)
+	configs := make(map[*Device]RemoteDeviceConfig)
+	for _, device := range c.devices() {
+		if config, ok := c.remote.configFor(device); ok && !device.foreign() {
+			configs[device] = config
+		}
+	}
+	c.remote.mu.Unlock()
+
+	for device, config := range configs {
+		c.applyRemoteConfig(device, config)
+	}
+	setDeviceLabels(c.devices())
+}
@@ -0,0 +1,294 @@
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteConfig configures pushing samples via the Prometheus
+// remote_write protocol.
+type RemoteWriteConfig struct {
+	URL           string
+	Username      string
+	Password      string
+	BearerToken   string
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// remoteSample is a single sample waiting to be pushed
+type remoteSample struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp time.Time
+}
+
+// remoteWriteSink batches readings and pushes them to a remote_write
+// endpoint, either when BatchSize samples are queued or every FlushInterval.
+type remoteWriteSink struct {
+	config RemoteWriteConfig
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []remoteSample
+	// backfill holds past readings. They are pushed first and in batches
+	// of their own, so a receiver rejecting them as out of order drops
+	// no current samples.
+	backfill []remoteSample
+
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newRemoteWriteSink(config RemoteWriteConfig) *remoteWriteSink {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 500
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 15 * time.Second
+	}
+	s := &remoteWriteSink{
+		config: config,
+		client: &http.Client{Timeout: 30 * time.Second},
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s
+}
+
+func (s *remoteWriteSink) Name() string { return "remote_write" }
+
+func (s *remoteWriteSink) Write(device *Device, data CGDN1Data) {
+	s.enqueue(&s.pending, remoteSamples(device, data))
+}
+
+// Backfill queues a past reading apart from the current ones; its samples
+// carry their own timestamps.
+func (s *remoteWriteSink) Backfill(device *Device, data CGDN1Data) {
+	s.enqueue(&s.backfill, remoteSamples(device, data))
+}
+
+// remoteSamples converts a reading to one sample per exported metric.
+func remoteSamples(device *Device, data CGDN1Data) []remoteSample {
+	samples := make([]remoteSample, 0, len(data.Values)+1)
+	for key, value := range data.Values {
+		metric, ok := sensorMetrics[key]
+		if !ok || !exported(key) {
+			continue
+		}
+		samples = append(samples, remoteSample{
+			Labels:    map[string]string{"__name__": exportedName(metric.Name), "device": device.Name},
+			Value:     value,
+			Timestamp: data.Timestamp,
+		})
+	}
+	samples = append(samples, remoteSample{
+		Labels:    map[string]string{"__name__": exportedName(lastUpdateMetric), "device": device.Name},
+		Value:     float64(data.Timestamp.Unix()),
+		Timestamp: data.Timestamp,
+	})
+	for _, sample := range samples {
+		exportedLabels(sample.Labels)
+	}
+	return samples
+}
+
+func (s *remoteWriteSink) enqueue(queue *[]remoteSample, samples []remoteSample) {
+	s.mu.Lock()
+	*queue = append(*queue, samples...)
+	s.trim(queue)
+	full := len(*queue) >= s.config.BatchSize
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// trim keeps at most ten batches in a queue while the endpoint is
+// unreachable, dropping the oldest samples. s.mu must be held.
+func (s *remoteWriteSink) trim(queue *[]remoteSample) {
+	if limit := 10 * s.config.BatchSize; len(*queue) > limit {
+		dropped := len(*queue) - limit
+		*queue = (*queue)[dropped:]
+		slog.Warn("remote_write queue full, dropped oldest samples", "dropped", dropped, "backfill", queue == &s.backfill)
+	}
+}
+
+// remoteSampleSize approximates a queued sample: the struct, its label
+// map and the label strings.
+func remoteSampleSize(sample remoteSample) int64 {
+	size := int64(48 + 48 + 32*len(sample.Labels))
+	for name, value := range sample.Labels {
+		size += int64(len(name) + len(value))
+	}
+	return size
+}
+
+func (s *remoteWriteSink) Buffered() (int, int64, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var memory int64
+	for _, sample := range s.pending {
+		memory += remoteSampleSize(sample)
+	}
+	for _, sample := range s.backfill {
+		memory += remoteSampleSize(sample)
+	}
+	return len(s.pending) + len(s.backfill), memory, 0
+}
+
+func (s *remoteWriteSink) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.flush:
+		case <-s.done:
+			s.send()
+			return
+		}
+		s.send()
+	}
+}
+
+// send pushes the backfill and then the current samples, as they are
+// older.
+func (s *remoteWriteSink) send() {
+	if s.sendQueue(&s.backfill) {
+		s.sendQueue(&s.pending)
+	}
+}
+
+// sendQueue pushes a queue batch by batch, putting a failed batch back at
+// its front so it is retried on the next flush. It reports whether the
+// queue was emptied. Each batch is sorted by time, so a series' samples
+// reach the receiver in order.
+func (s *remoteWriteSink) sendQueue(queue *[]remoteSample) bool {
+	for {
+		s.mu.Lock()
+		n := min(len(*queue), s.config.BatchSize)
+		batch := (*queue)[:n:n]
+		*queue = (*queue)[n:]
+		s.mu.Unlock()
+
+		if n == 0 {
+			return true
+		}
+
+		slices.SortStableFunc(batch, func(a, b remoteSample) int { return a.Timestamp.Compare(b.Timestamp) })
+		if err := s.push(batch); err != nil {
+			slog.Warn("Failed to push samples via remote_write", "samples", n, "error", err)
+			recordError(codeSinkRejected, ErrorExample{Source: s.Name(), Message: err.Error()})
+			s.mu.Lock()
+			*queue = append(batch, *queue...)
+			// Samples kept coming while the push failed
+			s.trim(queue)
+			s.mu.Unlock()
+			return false
+		}
+	}
+}
+
+func (s *remoteWriteSink) push(samples []remoteSample) error {
+	body := snappy.Encode(nil, encodeWriteRequest(samples))
+
+	req, err := http.NewRequest(http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "qingping-collector")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if s.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.BearerToken)
+	} else if s.config.Username != "" {
+		req.SetBasicAuth(s.config.Username, s.config.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		// 4xx means the samples will never be accepted, so don't retry them
+		if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+			slog.Error("remote_write rejected samples", "samples", len(samples), "status", resp.Status, "response", string(bytes.TrimSpace(msg)))
+			recordError(codeSinkRejected, ErrorExample{Source: s.Name(),
+				Message: fmt.Sprintf("dropped %d samples: %s: %s", len(samples), resp.Status, bytes.TrimSpace(msg))})
+			return nil
+		}
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Close flushes any queued samples and stops the background sender.
+func (s *remoteWriteSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	return nil
+}
+
+// encodeWriteRequest serializes samples as a prometheus.WriteRequest
+// protobuf, one TimeSeries per sample.
+func encodeWriteRequest(samples []remoteSample) []byte {
+	var buf []byte
+	for _, sample := range samples {
+		var series []byte
+
+		names := make([]string, 0, len(sample.Labels))
+		for name := range sample.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, sample.Labels[name])
+
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		var point []byte
+		point = protowire.AppendTag(point, 1, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, math.Float64bits(sample.Value))
+		point = protowire.AppendTag(point, 2, protowire.VarintType)
+		point = protowire.AppendVarint(point, uint64(sample.Timestamp.UnixMilli()))
+
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, point)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, series)
+	}
+	return buf
+}
@@ -0,0 +1,73 @@
+package collector
+
+import (
+	"log/slog"
+	"time"
+)
+
+// continuousWindow is the reporting duration asked for by each renewal in
+// continuous mode (DURATION=0). A literal 0 is never sent: some firmware
+// takes it as unlimited, other firmware stops reporting at once.
+const continuousWindow = time.Hour
+
+// renewal is the state of a device's chain of Type 12 requests
+type renewal struct {
+	timer     *time.Timer
+	sent      time.Time
+	expires   time.Time
+	confirmed bool
+}
+
+// renew asks the device to report for the next window and schedules the
+// following request three intervals before that window ends, so the device
+// never reaches the end of its reporting duration. On firmware that would
+// report without end anyway the extra requests are harmless.
+func (c *collector) renew(device *Device) {
+	interval := time.Duration(c.config.UpdateInterval) * time.Second
+	window := max(continuousWindow, 6*interval)
+	if rapid := c.rapidInterval(device); rapid > 0 {
+		interval, window = rapid, rapidWindow
+	}
+
+	c.renewalMutex.Lock()
+	defer c.renewalMutex.Unlock()
+
+	now := time.Now()
+	r := c.renewals[device.Name]
+	if r == nil {
+		r = &renewal{}
+		c.renewals[device.Name] = r
+	} else {
+		r.timer.Stop()
+		// Only judge a renewal once the device had time to report after it
+		if !r.sent.IsZero() && !r.confirmed && now.Sub(r.sent) >= 2*interval {
+			renewalsTotal.WithLabelValues(device.Name, "unconfirmed").Inc()
+			slog.Warn("Device did not report since the last renewal", "device", device.Name, "sent", r.sent, "expires", r.expires)
+		}
+	}
+
+	if err := c.publishReportingConfig(device, int(interval/time.Second), int(window/time.Second)); err != nil {
+		renewalsTotal.WithLabelValues(device.Name, "failed").Inc()
+		r.sent, r.confirmed = time.Time{}, false
+		r.timer = time.AfterFunc(interval, c.later(device, c.sendConfigMessage))
+		return
+	}
+
+	r.sent, r.expires, r.confirmed = now, now.Add(window), false
+	reportingExpiry.WithLabelValues(device.Name).Set(float64(r.expires.Unix()))
+	r.timer = time.AfterFunc(window-3*interval, c.later(device, c.sendConfigMessage))
+	slog.Debug("Scheduled renewal", "device", device.Name, "at", now.Add(window-3*interval))
+}
+
+// confirmRenewal records that the device reported after its last renewal.
+func (c *collector) confirmRenewal(device *Device, now time.Time) {
+	c.renewalMutex.Lock()
+	defer c.renewalMutex.Unlock()
+
+	r := c.renewals[device.Name]
+	if r == nil || r.confirmed || r.sent.IsZero() || now.Before(r.sent) {
+		return
+	}
+	r.confirmed = true
+	renewalsTotal.WithLabelValues(device.Name, "confirmed").Inc()
+}
@@ -0,0 +1,535 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Report periods and formats
+const (
+	reportWeek  = "week"
+	reportMonth = "month"
+	reportHTML  = "html"
+	reportPDF   = "pdf"
+)
+
+// reportNamePattern keeps report names usable in file names and URLs
+var reportNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ReportConfig renders an air quality report of every week or month and
+// stores it once the period is over.
+type ReportConfig struct {
+	Name   string   `json:"name"`
+	Period string   `json:"period"`           // week (Monday to Monday) or month
+	Format string   `json:"format,omitempty"` // html (default) or pdf
+	Tags   []string `json:"tags,omitempty"`   // empty means every device
+	// Sensors are the sensors summarized, the status page's if unset
+	Sensors []string `json:"sensors,omitempty"`
+	// Destination is a local directory, s3://bucket/prefix or the http(s)
+	// URL of a WebDAV collection
+	Destination string `json:"destination"`
+}
+
+// ReportingConfig holds the settings shared by every report
+type ReportingConfig struct {
+	Timezone       string // whose midnight starts a week or month
+	S3Endpoint     string // https://s3.{region}.amazonaws.com if empty
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+	WebDAVUsername string
+	WebDAVPassword string
+}
+
+// normalizeReports validates reports and fills in their defaults.
+func normalizeReports(reports []ReportConfig) error {
+	seen := make(map[string]bool)
+	for i := range reports {
+		report := &reports[i]
+		if !reportNamePattern.MatchString(report.Name) {
+			return fmt.Errorf("report %d: name %q must be letters, digits, - or _", i, report.Name)
+		}
+		if seen[report.Name] {
+			return fmt.Errorf("duplicate report %q", report.Name)
+		}
+		seen[report.Name] = true
+		if report.Period != reportWeek && report.Period != reportMonth {
+			return fmt.Errorf("report %q: period must be week or month, got %q", report.Name, report.Period)
+		}
+		if report.Format == "" {
+			report.Format = reportHTML
+		}
+		if report.Format != reportHTML && report.Format != reportPDF {
+			return fmt.Errorf("report %q: format must be html or pdf, got %q", report.Name, report.Format)
+		}
+		if len(report.Sensors) == 0 {
+			report.Sensors = statusSensors
+		}
+		for _, sensor := range report.Sensors {
+			if _, ok := sensorMetrics[sensor]; !ok {
+				return fmt.Errorf("report %q: unknown sensor %q", report.Name, sensor)
+			}
+		}
+		if report.Destination == "" {
+			return fmt.Errorf("report %q: destination is required", report.Name)
+		}
+	}
+	return nil
+}
+
+// periodOf returns the week or month containing t, in t's location.
+func (r ReportConfig) periodOf(t time.Time) (from, to time.Time) {
+	if r.Period == reportWeek {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		from = day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		return from, from.AddDate(0, 0, 7)
+	}
+	from = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	return from, from.AddDate(0, 1, 0)
+}
+
+// fileName names the report of the period starting at from, e.g.
+// office-2026-W41.pdf or office-2026-09.html.
+func (r ReportConfig) fileName(from time.Time) string {
+	if r.Period == reportWeek {
+		year, week := from.ISOWeek()
+		return fmt.Sprintf("%s-%d-W%02d.%s", r.Name, year, week, r.Format)
+	}
+	return fmt.Sprintf("%s-%s.%s", r.Name, from.Format("2006-01"), r.Format)
+}
+
+// reportData is what a report shows
+type reportData struct {
+	Name      string
+	Period    string
+	From, To  time.Time
+	Generated time.Time
+	Devices   []deviceReport
+}
+
+// deviceReport is the part of a report about one device
+type deviceReport struct {
+	Device      string
+	Sensors     []sensorReport
+	Exceedances []exceedance
+}
+
+// sensorReport summarizes one sensor of a device over the period
+type sensorReport struct {
+	Key, Label         string
+	Count              int
+	Min, Avg, P95, Max float64
+	Hourly             []reportPoint
+	// Limits are the thresholds on the sensor, drawn into the chart
+	Limits []float64
+}
+
+type reportPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// exceedance is how long and how often a threshold rule was exceeded
+type exceedance struct {
+	Rule, Sensor, Limit string
+	Episodes            int
+	Duration            time.Duration
+	Worst               float64
+}
+
+// reporter renders the reports and stores each one once its period is
+// over, catching up on periods missed while the collector was down.
+type reporter struct {
+	c        *collector
+	reports  []ReportConfig
+	rules    []ThresholdRule
+	location *time.Location
+	stores   map[string]reportStore // by report name
+
+	mu sync.Mutex
+	// stored are the file names known to be at their destination
+	stored map[string]bool
+}
+
+func newReporter(c *collector, reports []ReportConfig, rules []ThresholdRule, config ReportingConfig) (*reporter, error) {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("REPORT_TIMEZONE: %w", err)
+	}
+	r := &reporter{
+		c:        c,
+		reports:  reports,
+		rules:    rules,
+		location: location,
+		stores:   make(map[string]reportStore),
+		stored:   make(map[string]bool),
+	}
+	for _, report := range reports {
+		store, err := newReportStore(report.Destination, config)
+		if err != nil {
+			return nil, fmt.Errorf("report %q: %w", report.Name, err)
+		}
+		r.stores[report.Name] = store
+	}
+	return r, nil
+}
+
+// run stores the reports of the last completed periods now and then every
+// 15 minutes, until ctx is done.
+func (r *reporter) run(ctx context.Context) {
+	r.catchUp(ctx)
+	every(ctx, 15*time.Minute, func() { r.catchUp(ctx) })
+}
+
+func (r *reporter) catchUp(ctx context.Context) {
+	now := time.Now().In(r.location)
+	for _, report := range r.reports {
+		current, _ := report.periodOf(now)
+		from, to := report.periodOf(current.Add(-time.Nanosecond))
+		name := report.fileName(from)
+
+		r.mu.Lock()
+		stored := r.stored[name]
+		r.mu.Unlock()
+		if stored {
+			continue
+		}
+		if err := r.store(ctx, report, name, from, to); err != nil {
+			slog.Warn("Failed to store report", "report", report.Name, "file", name, "error", err)
+			continue
+		}
+		r.mu.Lock()
+		r.stored[name] = true
+		r.mu.Unlock()
+	}
+}
+
+func (r *reporter) store(ctx context.Context, report ReportConfig, name string, from, to time.Time) error {
+	store := r.stores[report.Name]
+	exists, err := store.exists(ctx, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	data, err := r.build(report, from, to)
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(data.Devices, func(device deviceReport) bool { return len(device.Sensors) > 0 }) {
+		slog.Debug("Skipping report without readings", "report", report.Name, "from", from)
+		return nil
+	}
+	body, contentType, err := renderReport(report, data)
+	if err != nil {
+		return err
+	}
+	if err := store.put(ctx, name, contentType, body); err != nil {
+		return err
+	}
+	slog.Info("Stored report", "report", report.Name, "file", name, "destination", report.Destination)
+	return nil
+}
+
+// build collects the period's history of every device the report covers.
+func (r *reporter) build(report ReportConfig, from, to time.Time) (reportData, error) {
+	data := reportData{Name: report.Name, Period: report.Period, From: from, To: to, Generated: time.Now().In(r.location)}
+	maxGap := r.c.config.staleAfter()
+	for _, device := range r.c.devices() {
+		if !device.hasAnyTag(report.Tags) {
+			continue
+		}
+		samples, err := r.c.history.Samples(device.Name, from, to)
+		if err != nil {
+			return data, fmt.Errorf("history of %s: %w", device.Name, err)
+		}
+		// The period ends before to
+		samples = slices.DeleteFunc(samples, func(sample Sample) bool { return !sample.Time.Before(to) })
+
+		entry := deviceReport{Device: device.Name}
+		var rules []ThresholdRule
+		for _, rule := range r.rules {
+			if device.hasAnyTag(rule.Tags) {
+				rules = append(rules, rule)
+			}
+		}
+		for _, key := range report.Sensors {
+			values := sensorSeries(samples, key)
+			if len(values) == 0 {
+				continue
+			}
+			sensor := summarizeSensor(key, values)
+			sensor.Hourly = hourlyAverages(samples, key, r.location)
+			for _, rule := range rules {
+				if rule.Sensor != key {
+					continue
+				}
+				for _, limit := range []*float64{rule.Above, rule.Below} {
+					if limit != nil {
+						sensor.Limits = append(sensor.Limits, *limit)
+					}
+				}
+			}
+			entry.Sensors = append(entry.Sensors, sensor)
+		}
+		for _, rule := range rules {
+			entry.Exceedances = append(entry.Exceedances, exceedanceOf(samples, rule, to, maxGap))
+		}
+		data.Devices = append(data.Devices, entry)
+	}
+	return data, nil
+}
+
+func summarizeSensor(key string, values []float64) sensorReport {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	sum := 0.0
+	for _, value := range sorted {
+		sum += value
+	}
+	return sensorReport{
+		Key:   key,
+		Label: sensorMetrics[key].Help,
+		Count: len(sorted),
+		Min:   sorted[0],
+		Avg:   sum / float64(len(sorted)),
+		P95:   percentile(sorted, 95),
+		Max:   sorted[len(sorted)-1],
+	}
+}
+
+// hourlyAverages averages the sensor over every local hour with readings.
+func hourlyAverages(samples []Sample, key string, location *time.Location) []reportPoint {
+	var points []reportPoint
+	var sum float64
+	var count int
+	for _, sample := range samples {
+		value, ok := sample.Values[key]
+		if !ok {
+			continue
+		}
+		t := sample.Time.In(location)
+		hour := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, location)
+		if len(points) > 0 && points[len(points)-1].Time.Equal(hour) {
+			sum += value
+			count++
+			points[len(points)-1].Value = sum / float64(count)
+			continue
+		}
+		points = append(points, reportPoint{Time: hour, Value: value})
+		sum, count = value, 1
+	}
+	return points
+}
+
+// exceedanceOf adds up the time the rule's limit was exceeded: from each
+// reading over it to the next reading, or at most maxGap.
+func exceedanceOf(samples []Sample, rule ThresholdRule, to time.Time, maxGap time.Duration) exceedance {
+	var limits []string
+	if rule.Below != nil {
+		limits = append(limits, fmt.Sprintf("< %g", *rule.Below))
+	}
+	if rule.Above != nil {
+		limits = append(limits, fmt.Sprintf("> %g", *rule.Above))
+	}
+	result := exceedance{Rule: rule.Name, Sensor: rule.Sensor, Limit: strings.Join(limits, " or ")}
+
+	exceeding, found := false, false
+	worst := 0.0
+	for i, sample := range samples {
+		value, ok := sample.Values[rule.Sensor]
+		if !ok {
+			continue
+		}
+		exceeded, limit := rule.exceeded(value)
+		if !exceeded {
+			exceeding = false
+			continue
+		}
+		if !exceeding {
+			result.Episodes++
+			exceeding = true
+		}
+		if by := math.Abs(value - limit); !found || by > worst {
+			worst, found = by, true
+			result.Worst = value
+		}
+		next := to
+		if i+1 < len(samples) {
+			next = samples[i+1].Time
+		}
+		result.Duration += min(next.Sub(sample.Time), maxGap)
+	}
+	return result
+}
+
+// renderReport renders the report in its format.
+func renderReport(report ReportConfig, data reportData) ([]byte, string, error) {
+	if report.Format == reportPDF {
+		return renderReportPDF(data), "application/pdf", nil
+	}
+	var buf bytes.Buffer
+	if err := reportTemplate.Execute(&buf, data); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "text/html; charset=utf-8", nil
+}
+
+// chartSegments scales points into a width×height box, y growing upwards,
+// breaking the line where hours are missing. lo and hi are the values at
+// the bottom and top.
+func chartSegments(sensor sensorReport, from, to time.Time, width, height float64) (segments [][][2]float64, lo, hi float64) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, point := range sensor.Hourly {
+		lo, hi = min(lo, point.Value), max(hi, point.Value)
+	}
+	for _, limit := range sensor.Limits {
+		lo, hi = min(lo, limit), max(hi, limit)
+	}
+	if hi-lo < 1 {
+		lo, hi = lo-0.5, hi+0.5
+	}
+	span := to.Sub(from).Seconds()
+	var segment [][2]float64
+	for i, point := range sensor.Hourly {
+		if i > 0 && point.Time.Sub(sensor.Hourly[i-1].Time) > time.Hour && len(segment) > 0 {
+			segments = append(segments, segment)
+			segment = nil
+		}
+		x := point.Time.Sub(from).Seconds() / span * width
+		y := (point.Value - lo) / (hi - lo) * height
+		segment = append(segment, [2]float64{x, y})
+	}
+	if len(segment) > 0 {
+		segments = append(segments, segment)
+	}
+	return segments, lo, hi
+}
+
+const (
+	svgChartWidth  = 640
+	svgChartHeight = 120
+)
+
+// svgChart draws the hourly averages of a sensor with its limits dashed.
+func svgChart(sensor sensorReport, from, to time.Time) template.HTML {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg width="%d" height="%d" viewBox="-40 -5 %d %d">`, svgChartWidth+50, svgChartHeight+25, svgChartWidth+50, svgChartHeight+25)
+	fmt.Fprintf(&b, `<rect x="0" y="0" width="%d" height="%d" fill="none" stroke="#ccc"/>`, svgChartWidth, svgChartHeight)
+	segments, lo, hi := chartSegments(sensor, from, to, svgChartWidth, svgChartHeight)
+	for _, limit := range sensor.Limits {
+		y := svgChartHeight - (limit-lo)/(hi-lo)*svgChartHeight
+		fmt.Fprintf(&b, `<line x1="0" y1="%.1f" x2="%d" y2="%.1f" stroke="#c00" stroke-dasharray="4 3"/>`, y, svgChartWidth, y)
+	}
+	for _, segment := range segments {
+		b.WriteString(`<polyline fill="none" stroke="#36c" points="`)
+		for _, point := range segment {
+			fmt.Fprintf(&b, "%.1f,%.1f ", point[0], svgChartHeight-point[1])
+		}
+		b.WriteString(`"/>`)
+	}
+	fmt.Fprintf(&b, `<text x="-4" y="10" font-size="10" text-anchor="end">%.0f</text>`, hi)
+	fmt.Fprintf(&b, `<text x="-4" y="%d" font-size="10" text-anchor="end">%.0f</text>`, svgChartHeight, lo)
+	fmt.Fprintf(&b, `<text x="0" y="%d" font-size="10">%s</text>`, svgChartHeight+15, from.Format("Jan 2"))
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-size="10" text-anchor="end">%s</text>`, svgChartWidth, svgChartHeight+15, to.Add(-time.Nanosecond).Format("Jan 2"))
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// reportHours formats a duration as hours with one decimal
+func reportHours(d time.Duration) string {
+	return fmt.Sprintf("%.1f h", d.Hours())
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"chart": svgChart,
+	"hours": reportHours,
+	"last":  func(t time.Time) time.Time { return t.Add(-time.Nanosecond) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Air Quality Report {{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { padding: 0.3em 0.8em; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+h2 { page-break-before: always; }
+</style>
+</head>
+<body>
+<h1>Air Quality Report {{.Name}}</h1>
+<p>{{.From.Format "Monday, January 2, 2006"}} to {{(last .To).Format "Monday, January 2, 2006"}} ({{.From.Location}}), generated {{.Generated.Format "2006-01-02 15:04"}}.</p>
+{{range .Devices}}{{$device := .}}
+<h2>{{.Device}}</h2>
+{{if .Sensors}}
+<table>
+<tr><th>Sensor</th><th>Readings</th><th>Min</th><th>Average</th><th>95th percentile</th><th>Max</th></tr>
+{{range .Sensors}}<tr><td>{{.Label}}</td><td>{{.Count}}</td><td>{{printf "%.1f" .Min}}</td><td>{{printf "%.1f" .Avg}}</td><td>{{printf "%.1f" .P95}}</td><td>{{printf "%.1f" .Max}}</td></tr>
+{{end}}</table>
+{{if .Exceedances}}
+<h3>Threshold exceedances</h3>
+<table>
+<tr><th>Rule</th><th>Sensor</th><th>Limit</th><th>Episodes</th><th>Time exceeded</th><th>Worst</th></tr>
+{{range .Exceedances}}<tr><td>{{.Rule}}</td><td>{{.Sensor}}</td><td>{{.Limit}}</td><td>{{.Episodes}}</td><td>{{hours .Duration}}</td><td>{{if .Episodes}}{{printf "%.1f" .Worst}}{{else}}-{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+{{range .Sensors}}
+<h3>{{.Label}}</h3>
+{{chart . $.From $.To}}
+{{end}}
+{{else}}
+<p>No readings in this period.</p>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+// handleReport serves GET /api/v1/reports/{name} with the report of the
+// last completed period, or of the current one so far with
+// ?period=current.
+func (r *reporter) handleReport(w http.ResponseWriter, req *http.Request) {
+	index := slices.IndexFunc(r.reports, func(report ReportConfig) bool { return report.Name == req.PathValue("name") })
+	if index < 0 {
+		writeError(w, http.StatusNotFound, "unknown report")
+		return
+	}
+	report := r.reports[index]
+	now := time.Now().In(r.location)
+	from, to := report.periodOf(now)
+	switch req.URL.Query().Get("period") {
+	case "current":
+		to = now
+	case "", "last":
+		from, to = report.periodOf(from.Add(-time.Nanosecond))
+	default:
+		writeError(w, http.StatusBadRequest, "period must be last or current")
+		return
+	}
+	data, err := r.build(report, from, to)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	body, contentType, err := renderReport(report, data)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", report.fileName(from)))
+	w.Write(body)
+}
@@ -0,0 +1,235 @@
+package collector
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reportStore is where finished reports are kept
+type reportStore interface {
+	exists(ctx context.Context, name string) (bool, error)
+	put(ctx context.Context, name, contentType string, body []byte) error
+}
+
+// newReportStore picks the store of a report's destination: s3://bucket/prefix,
+// a WebDAV collection's http(s) URL or a local directory.
+func newReportStore(destination string, config ReportingConfig) (reportStore, error) {
+	client := &http.Client{Timeout: time.Minute}
+	switch {
+	case strings.HasPrefix(destination, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(destination, "s3://"), "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("destination %q has no bucket", destination)
+		}
+		if config.S3AccessKey == "" || config.S3SecretKey == "" {
+			return nil, fmt.Errorf("REPORT_S3_ACCESS_KEY and REPORT_S3_SECRET_KEY are required for S3")
+		}
+		endpoint := config.S3Endpoint
+		if endpoint == "" {
+			endpoint = "https://s3." + config.S3Region + ".amazonaws.com"
+		}
+		if _, err := url.Parse(endpoint); err != nil {
+			return nil, fmt.Errorf("REPORT_S3_ENDPOINT: %w", err)
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &s3Store{
+			endpoint:  strings.TrimSuffix(endpoint, "/"),
+			region:    config.S3Region,
+			bucket:    bucket,
+			prefix:    prefix,
+			accessKey: config.S3AccessKey,
+			secretKey: config.S3SecretKey,
+			client:    client,
+		}, nil
+	case strings.HasPrefix(destination, "http://"), strings.HasPrefix(destination, "https://"):
+		if _, err := url.Parse(destination); err != nil {
+			return nil, fmt.Errorf("destination: %w", err)
+		}
+		return &webDAVStore{
+			base:     strings.TrimSuffix(destination, "/") + "/",
+			username: config.WebDAVUsername,
+			password: config.WebDAVPassword,
+			client:   client,
+		}, nil
+	default:
+		return dirStore(strings.TrimPrefix(destination, "file://")), nil
+	}
+}
+
+// dirStore keeps reports in a local directory
+type dirStore string
+
+func (d dirStore) exists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(filepath.Join(string(d), name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (d dirStore) put(ctx context.Context, name, contentType string, body []byte) error {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return err
+	}
+	// Written next to the report and renamed, so it never shows up half written
+	tmp := filepath.Join(string(d), "."+name+".tmp")
+	if err := os.WriteFile(tmp, body, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(string(d), name))
+}
+
+// webDAVStore puts reports into a WebDAV collection, which has to exist
+type webDAVStore struct {
+	base               string
+	username, password string
+	client             *http.Client
+}
+
+func (s *webDAVStore) do(ctx context.Context, method, name, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.base+url.PathEscape(name), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return s.client.Do(req)
+}
+
+func (s *webDAVStore) exists(ctx context.Context, name string) (bool, error) {
+	return storedObject(s.do(ctx, http.MethodHead, name, "", nil))
+}
+
+func (s *webDAVStore) put(ctx context.Context, name, contentType string, body []byte) error {
+	return storeObject(s.do(ctx, http.MethodPut, name, contentType, body))
+}
+
+// s3Store puts reports into an S3 bucket, or one of any S3 compatible
+// storage, addressed by path and signed with AWS Signature Version 4.
+type s3Store struct {
+	endpoint             string
+	region               string
+	bucket, prefix       string
+	accessKey, secretKey string
+	client               *http.Client
+}
+
+func (s *s3Store) do(ctx context.Context, method, name, contentType string, body []byte) (*http.Response, error) {
+	path := "/" + s3Escape(s.bucket+"/"+s.prefix+name)
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.sign(req, path, body, time.Now())
+	return s.client.Do(req)
+}
+
+// sign adds the Signature Version 4 headers, signing the host, the
+// payload's hash and the date.
+func (s *s3Store) sign(req *http.Request, path string, body []byte, now time.Time) {
+	stamp := now.UTC().Format("20060102T150405Z")
+	date := stamp[:8]
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		path,
+		"", // no query
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + stamp,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes an object key like S3 expects: everything but
+// unreserved characters and slashes.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *s3Store) exists(ctx context.Context, name string) (bool, error) {
+	return storedObject(s.do(ctx, http.MethodHead, name, "", nil))
+}
+
+func (s *s3Store) put(ctx context.Context, name, contentType string, body []byte) error {
+	return storeObject(s.do(ctx, http.MethodPut, name, contentType, body))
+}
+
+// storedObject interprets the response to a HEAD request for a report.
+func storedObject(resp *http.Response, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	default:
+		return false, fmt.Errorf("checking for the report: %s", resp.Status)
+	}
+}
+
+// storeObject interprets the response to a PUT request of a report.
+func storeObject(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("uploading the report: %s", resp.Status)
+	}
+	return nil
+}
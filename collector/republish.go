@@ -0,0 +1,298 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// RepublishConfig configures the normalized state published for other
+// MQTT consumers
+type RepublishConfig struct {
+	Topic  string // e.g. airquality/{device}/state, empty disables
+	QoS    int
+	Retain bool
+
+	// Delta publishes only values that moved by more than their deadband
+	// since they were last sent, with a full reading every FullSync
+	Delta     bool
+	Deadbands []string // sensor=deadband pairs, e.g. temperature=0.2
+	FullSync  time.Duration
+
+	// AckTopic is where consumers confirm the messages they handled,
+	// empty disables the handshake
+	AckTopic     string
+	AckConsumers []string // consumers expected to confirm, any one if empty
+	AckTimeout   time.Duration
+}
+
+// republishPublishTimeout bounds the wait for the broker to take a message
+const republishPublishTimeout = 30 * time.Second
+
+// republishAck is what a consumer publishes on the ack topic once it
+// handled a republished message.
+type republishAck struct {
+	ID       string `json:"id"`
+	Consumer string `json:"consumer,omitempty"`
+}
+
+// pendingAck is a republished message waiting for its confirmations.
+type pendingAck struct {
+	device  string
+	sent    time.Time
+	waiting map[string]bool // consumers yet to confirm, "*" for anyone
+}
+
+// republishSink publishes every reading as a flat JSON document of all
+// its values, so consumers don't need to know Qingping's message types.
+type republishSink struct {
+	config    RepublishConfig
+	client    mqtt.Client
+	deadbands map[string]float64
+
+	mu   sync.Mutex
+	sent map[string]*deltaState
+
+	ackMutex sync.Mutex
+	lastID   uint64
+	pending  map[string]*pendingAck
+}
+
+// deltaState is what a delta consumer last received from a device.
+type deltaState struct {
+	values   map[string]float64
+	lastFull time.Time
+}
+
+func newRepublishSink(config RepublishConfig) (*republishSink, error) {
+	if config.QoS < 0 || config.QoS > 2 {
+		return nil, fmt.Errorf("REPUBLISH_QOS must be 0, 1 or 2")
+	}
+	if strings.ContainsAny(config.Topic, "+#") {
+		return nil, fmt.Errorf("REPUBLISH_TOPIC must not contain wildcards")
+	}
+	deadbands, err := parseDeadbands(config.Deadbands)
+	if err != nil {
+		return nil, fmt.Errorf("REPUBLISH_DEADBANDS: %w", err)
+	}
+	if config.Delta && config.FullSync <= 0 {
+		return nil, fmt.Errorf("REPUBLISH_FULL_SYNC must be positive")
+	}
+	if config.AckTopic != "" {
+		if strings.ContainsAny(config.AckTopic, "+#") {
+			return nil, fmt.Errorf("REPUBLISH_ACK_TOPIC must not contain wildcards")
+		}
+		if config.AckTimeout <= 0 {
+			return nil, fmt.Errorf("REPUBLISH_ACK_TIMEOUT must be positive")
+		}
+	}
+	return &republishSink{
+		config:    config,
+		deadbands: deadbands,
+		sent:      make(map[string]*deltaState),
+		// IDs stay unique across restarts
+		lastID:  uint64(time.Now().UnixNano()),
+		pending: make(map[string]*pendingAck),
+	}, nil
+}
+
+func (s *republishSink) Name() string { return "republish" }
+
+// topic expands {device} and {mac} in the configured topic.
+func (s *republishSink) topic(device *Device) string {
+	return strings.NewReplacer("{device}", device.Name, "{mac}", device.MAC).Replace(s.config.Topic)
+}
+
+func (s *republishSink) Write(device *Device, data CGDN1Data) {
+	if s.client == nil {
+		return
+	}
+	if s.config.Delta {
+		s.writeDelta(device, data)
+		return
+	}
+
+	state := make(map[string]any, len(data.Values)+3)
+	for key, value := range data.Values {
+		state[key] = value
+	}
+	if data.AQI != nil {
+		state["aqi"] = data.AQI.Index
+	}
+	state["device"] = device.Name
+	state["timestamp"] = data.Timestamp.UTC()
+	s.publish(device, state)
+}
+
+// publish sends a document and counts whether the broker took it; with QoS
+// 1 or 2 that is the broker's acknowledgement. With an ack topic the
+// document carries an id and the topic to confirm it on.
+func (s *republishSink) publish(device *Device, doc map[string]any) {
+	var id string
+	if s.config.AckTopic != "" {
+		id = s.expectAck(device)
+		doc["id"] = id
+		doc["ack_topic"] = s.config.AckTopic
+	}
+	payload, err := json.Marshal(doc)
+	if err != nil {
+		slog.Error("Failed to marshal state", "sink", s.Name(), "device", device.Name, "error", err)
+		return
+	}
+
+	topic := s.topic(device)
+	token := s.client.Publish(topic, byte(s.config.QoS), s.config.Retain, payload)
+	switch {
+	case !token.WaitTimeout(republishPublishTimeout):
+		republishMessages.WithLabelValues(device.Name, "timeout").Inc()
+		slog.Error("Timed out republishing reading", "device", device.Name, "topic", topic)
+		recordError(codeSinkRejected, ErrorExample{Device: device.Name, Source: s.Name(), Message: "timed out publishing to " + topic})
+	case token.Error() != nil:
+		republishMessages.WithLabelValues(device.Name, "failed").Inc()
+		slog.Error("Failed to republish reading", "device", device.Name, "topic", topic, "error", token.Error())
+		recordError(codeSinkRejected, ErrorExample{Device: device.Name, Source: s.Name(), Message: token.Error().Error()})
+	default:
+		republishMessages.WithLabelValues(device.Name, "delivered").Inc()
+		return
+	}
+	// Nobody can confirm what never reached the broker
+	if id != "" {
+		s.ackMutex.Lock()
+		delete(s.pending, id)
+		s.ackMutex.Unlock()
+	}
+}
+
+// expectAck registers a new message id and counts the consumers that
+// haven't confirmed it within AckTimeout.
+func (s *republishSink) expectAck(device *Device) string {
+	waiting := map[string]bool{"*": true}
+	if len(s.config.AckConsumers) > 0 {
+		waiting = make(map[string]bool, len(s.config.AckConsumers))
+		for _, consumer := range s.config.AckConsumers {
+			waiting[consumer] = true
+		}
+	}
+
+	s.ackMutex.Lock()
+	defer s.ackMutex.Unlock()
+	s.lastID++
+	id := strconv.FormatUint(s.lastID, 10)
+	s.pending[id] = &pendingAck{device: device.Name, sent: time.Now(), waiting: waiting}
+
+	time.AfterFunc(s.config.AckTimeout, func() {
+		s.ackMutex.Lock()
+		defer s.ackMutex.Unlock()
+		pending, ok := s.pending[id]
+		if !ok {
+			return
+		}
+		delete(s.pending, id)
+		for consumer := range pending.waiting {
+			republishAcksMissing.WithLabelValues(pending.device, consumer).Inc()
+			slog.Warn("Republished reading was not confirmed", "device", pending.device, "consumer", consumer, "id", id)
+		}
+	})
+	return id
+}
+
+// subscribe follows the ack topic; call on connect.
+func (s *republishSink) subscribe(client mqtt.Client) {
+	if s.config.AckTopic == "" {
+		return
+	}
+	token := client.Subscribe(s.config.AckTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		var ack republishAck
+		if err := json.Unmarshal(msg.Payload(), &ack); err != nil || ack.ID == "" {
+			slog.Warn("Ignoring invalid republish ack", "topic", msg.Topic(), "payload", limitString(string(msg.Payload()), 200))
+			return
+		}
+		s.confirm(ack, time.Now())
+	})
+	if err := waitSubscribed(token, s.config.AckTopic, ""); err != nil {
+		slog.Error("Failed to subscribe", "sink", s.Name(), "topic", s.config.AckTopic, "error", err)
+	}
+}
+
+// confirm records a consumer's ack. Acks from consumers that aren't
+// expected, or for messages that already timed out, are only logged.
+func (s *republishSink) confirm(ack republishAck, now time.Time) {
+	if ack.Consumer == "" {
+		ack.Consumer = "default"
+	}
+
+	s.ackMutex.Lock()
+	defer s.ackMutex.Unlock()
+	pending, ok := s.pending[ack.ID]
+	if !ok {
+		slog.Debug("Ack for an unknown or expired message", "id", ack.ID, "consumer", ack.Consumer)
+		return
+	}
+	switch {
+	case pending.waiting[ack.Consumer]:
+		delete(pending.waiting, ack.Consumer)
+	case pending.waiting["*"]:
+		delete(pending.waiting, "*")
+	default:
+		slog.Debug("Ack from an unexpected consumer", "id", ack.ID, "consumer", ack.Consumer)
+		return
+	}
+	if len(pending.waiting) == 0 {
+		delete(s.pending, ack.ID)
+	}
+
+	republishAcks.WithLabelValues(pending.device, ack.Consumer).Inc()
+	republishAckLatency.WithLabelValues(ack.Consumer).Observe(now.Sub(pending.sent).Seconds())
+	republishLastAck.WithLabelValues(pending.device, ack.Consumer).Set(float64(now.Unix()))
+}
+
+// writeDelta publishes a compact document of the values that changed by
+// more than their deadband, {"t": unix seconds, "co2": 655}, or nothing
+// at all. Every FullSync, and after the device went silent, all values
+// are sent with "full": true so consumers can resynchronize. Values are
+// rounded to two decimals.
+func (s *republishSink) writeDelta(device *Device, data CGDN1Data) {
+	s.mu.Lock()
+	state := s.sent[device.Name]
+	full := state == nil || data.Timestamp.Sub(state.lastFull) >= s.config.FullSync
+	if state == nil {
+		state = &deltaState{values: make(map[string]float64)}
+		s.sent[device.Name] = state
+	}
+
+	doc := map[string]any{"t": data.Timestamp.Unix()}
+	for key, value := range data.Values {
+		value = math.Round(value*100) / 100
+		last, ok := state.values[key]
+		if full || !ok || math.Abs(value-last) > s.deadbands[key] {
+			doc[key] = value
+			state.values[key] = value
+		}
+	}
+	if full {
+		doc["full"] = true
+		state.lastFull = data.Timestamp
+	}
+	s.mu.Unlock()
+
+	// Only the timestamp: nothing moved enough to be worth sending
+	if len(doc) == 1 {
+		republishSuppressed.WithLabelValues(device.Name).Inc()
+		return
+	}
+	s.publish(device, doc)
+}
+
+// Forget makes the next reading of a device that went silent a full one.
+func (s *republishSink) Forget(device *Device) {
+	s.mu.Lock()
+	delete(s.sent, device.Name)
+	s.mu.Unlock()
+}
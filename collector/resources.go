@@ -0,0 +1,69 @@
+package collector
+
+import (
+	"os"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	mqttStoreDesc = prometheus.NewDesc(
+		"qingping_collector_mqtt_store_messages",
+		"Messages held in the MQTT client's in-flight store",
+		nil, nil)
+	sinkItemsDesc = prometheus.NewDesc(
+		"qingping_collector_sink_buffered_items",
+		"Items a sink currently holds (queued samples, stored readings)",
+		[]string{"sink"}, nil)
+	sinkMemoryDesc = prometheus.NewDesc(
+		"qingping_collector_sink_memory_bytes",
+		"Estimated memory used by the items a sink holds",
+		[]string{"sink"}, nil)
+	sinkDiskDesc = prometheus.NewDesc(
+		"qingping_collector_sink_disk_bytes",
+		"Disk space used by a sink's on-disk store",
+		[]string{"sink"}, nil)
+	openFDsDesc = prometheus.NewDesc(
+		"qingping_collector_open_fds",
+		"Open file descriptors of the collector process",
+		nil, nil)
+)
+
+// resourceCollector reports where the collector keeps data, computed on
+// every scrape, so capacity problems on small machines show up early.
+type resourceCollector struct {
+	store *mqtt.MemoryStore
+	sinks []Sink
+}
+
+func (r resourceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mqttStoreDesc
+	ch <- sinkItemsDesc
+	ch <- sinkMemoryDesc
+	ch <- sinkDiskDesc
+	ch <- openFDsDesc
+}
+
+func (r resourceCollector) Collect(ch chan<- prometheus.Metric) {
+	if r.store != nil {
+		ch <- prometheus.MustNewConstMetric(mqttStoreDesc, prometheus.GaugeValue, float64(len(r.store.All())))
+	}
+
+	for _, sink := range r.sinks {
+		buffer, ok := sink.(Buffer)
+		if !ok {
+			continue
+		}
+		items, memory, disk := buffer.Buffered()
+		ch <- prometheus.MustNewConstMetric(sinkItemsDesc, prometheus.GaugeValue, float64(items), sink.Name())
+		ch <- prometheus.MustNewConstMetric(sinkMemoryDesc, prometheus.GaugeValue, float64(memory), sink.Name())
+		ch <- prometheus.MustNewConstMetric(sinkDiskDesc, prometheus.GaugeValue, float64(disk), sink.Name())
+	}
+
+	// Only available where /proc exists; the Go process collector reports
+	// the same on Linux but can be turned off.
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		ch <- prometheus.MustNewConstMetric(openFDsDesc, prometheus.GaugeValue, float64(len(fds)))
+	}
+}
@@ -0,0 +1,167 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultRollingWindows are those WHO and EPA guidance refers to, plus a
+// short one for dashboards
+var defaultRollingWindows = []string{"15m", "1h", "24h"}
+
+// timedValue is one sensor value of a reading
+type timedValue struct {
+	Time  time.Time
+	Value float64
+}
+
+// rollingSink keeps the recent values of some sensors in memory and
+// exports their average over each window, e.g. qingping_pm25_ugm3_avg_24h.
+type rollingSink struct {
+	windows []time.Duration // ascending
+	history historyStore
+	// gauges by sensor key, one per window
+	gauges map[string][]*prometheus.GaugeVec
+
+	mu     sync.Mutex
+	values map[string]map[string][]timedValue // by device, then sensor
+}
+
+// windowName is the shortest form of a window, e.g. 15m, 1h or 1h30m.
+func windowName(window time.Duration) string {
+	name := window.String()
+	if strings.HasSuffix(name, "m0s") {
+		name = strings.TrimSuffix(name, "0s")
+	}
+	if strings.HasSuffix(name, "h0m") {
+		name = strings.TrimSuffix(name, "0m")
+	}
+	return name
+}
+
+// newRollingSink registers an average gauge per sensor and window. It runs
+// once at startup, after fields and units are set up. A device's first
+// reading fills its windows from history, so averages survive restarts
+// when the history does.
+func newRollingSink(sensors, windows []string, history historyStore, registerer prometheus.Registerer) (*rollingSink, error) {
+	s := &rollingSink{
+		history: history,
+		gauges:  make(map[string][]*prometheus.GaugeVec),
+		values:  make(map[string]map[string][]timedValue),
+	}
+	if len(windows) == 0 {
+		windows = defaultRollingWindows
+	}
+	for _, text := range windows {
+		window, err := time.ParseDuration(text)
+		if err != nil || window < time.Minute {
+			return nil, fmt.Errorf("ROLLING_WINDOWS: invalid window %q, want a duration of at least 1m", text)
+		}
+		if !slices.Contains(s.windows, window) {
+			s.windows = append(s.windows, window)
+		}
+	}
+	slices.Sort(s.windows)
+
+	for _, key := range sensors {
+		metric, ok := sensorMetrics[key]
+		if !ok {
+			return nil, fmt.Errorf("ROLLING_SENSORS: no metric for sensor %q", key)
+		}
+		if _, ok := s.gauges[key]; ok {
+			continue
+		}
+		for _, window := range s.windows {
+			gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+				Name: metric.Name + "_avg_" + windowName(window),
+				Help: fmt.Sprintf("%s, averaged over the last %s", metric.Help, windowName(window)),
+			}, []string{"device"})
+			if err := registerer.Register(gauge); err != nil {
+				return nil, fmt.Errorf("ROLLING_SENSORS: %w", err)
+			}
+			s.gauges[key] = append(s.gauges[key], gauge)
+		}
+	}
+	return s, nil
+}
+
+func (s *rollingSink) Name() string { return "rolling" }
+
+func (s *rollingSink) Write(device *Device, data CGDN1Data) {
+	longest := s.windows[len(s.windows)-1]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values, ok := s.values[device.Name]
+	if !ok {
+		values = s.load(device, data.Timestamp.Add(-longest), data.Timestamp)
+		s.values[device.Name] = values
+	}
+
+	for key, gauges := range s.gauges {
+		value, ok := data.Values[key]
+		if !ok {
+			continue
+		}
+		series := append(values[key], timedValue{data.Timestamp, value})
+		cutoff := data.Timestamp.Add(-longest)
+		if expired := sort.Search(len(series), func(i int) bool { return series[i].Time.After(cutoff) }); expired > 0 {
+			series = append([]timedValue(nil), series[expired:]...)
+		}
+		values[key] = series
+
+		for i, window := range s.windows {
+			since := data.Timestamp.Add(-window)
+			start := sort.Search(len(series), func(i int) bool { return series[i].Time.After(since) })
+			var sum float64
+			for _, v := range series[start:] {
+				sum += v.Value
+			}
+			gauges[i].WithLabelValues(device.Name).Set(sum / float64(len(series)-start))
+		}
+	}
+}
+
+// load reads the values of the averaged sensors in (from, to) back from
+// the history.
+func (s *rollingSink) load(device *Device, from, to time.Time) map[string][]timedValue {
+	values := make(map[string][]timedValue, len(s.gauges))
+	samples, err := s.history.Samples(device.Name, from, to)
+	if err != nil {
+		slog.Error("Failed to read history", "sink", s.Name(), "device", device.Name, "error", err)
+		return values
+	}
+	for _, sample := range samples {
+		// Samples are inclusive, the windows are not
+		if !sample.Time.After(from) || !sample.Time.Before(to) {
+			continue
+		}
+		for key := range s.gauges {
+			if value, ok := sample.Values[key]; ok {
+				values[key] = append(values[key], timedValue{sample.Time, value})
+			}
+		}
+	}
+	return values
+}
+
+// Forget drops a silent device's values and averages; they are read back
+// from the history once it reports again.
+func (s *rollingSink) Forget(device *Device) {
+	s.mu.Lock()
+	delete(s.values, device.Name)
+	s.mu.Unlock()
+	for _, gauges := range s.gauges {
+		for _, gauge := range gauges {
+			gauge.DeleteLabelValues(device.Name)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package collector
+
+import (
+	"fmt"
+	"time"
+)
+
+// RouteConfig maps device tags to the sinks, alert channels and retention
+// that apply to them. Routes are matched in order and the first route
+// sharing a tag with the device wins; a route without tags matches every
+// device and is typically placed last as the default.
+//
+// Omitting sinks or alerts means "all of them"; an empty list means none.
+type RouteConfig struct {
+	Tags      []string `json:"tags,omitempty"`
+	Sinks     []string `json:"sinks,omitempty"`
+	Alerts    []string `json:"alerts,omitempty"`
+	Retention Duration `json:"retention,omitempty"`
+}
+
+// Policy is the resolved routing decision for a single device
+type Policy struct {
+	Sinks     []Sink
+	Alerts    []string      // nil means every alert channel
+	Retention time.Duration // how long the history keeps readings, 0 for the default
+}
+
+// retentionOr is how long the history keeps the device's readings: its
+// route's retention, or fallback if the route sets none.
+func (p Policy) retentionOr(fallback time.Duration) time.Duration {
+	if p.Retention > 0 {
+		return p.Retention
+	}
+	return fallback
+}
+
+// AlertsTo reports whether alerts for the device should go to channel.
+func (p Policy) AlertsTo(channel string) bool {
+	if p.Alerts == nil {
+		return true
+	}
+	for _, name := range p.Alerts {
+		if name == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func (r RouteConfig) matches(device *Device) bool {
+	return device.hasAnyTag(r.Tags)
+}
+
+// resolvePolicies assigns each device the policy of its first matching route.
+func resolvePolicies(devices []*Device, routes []RouteConfig, sinks []Sink) error {
+	byName := make(map[string]Sink, len(sinks))
+	for _, sink := range sinks {
+		byName[sink.Name()] = sink
+	}
+
+	for i, route := range routes {
+		for _, name := range route.Sinks {
+			if _, ok := byName[name]; !ok {
+				return fmt.Errorf("route %d references unknown sink %q", i, name)
+			}
+		}
+	}
+
+	for _, device := range devices {
+		policy := Policy{Sinks: sinks}
+		for _, route := range routes {
+			if !route.matches(device) {
+				continue
+			}
+			if route.Sinks != nil {
+				policy.Sinks = make([]Sink, 0, len(route.Sinks))
+				for _, name := range route.Sinks {
+					policy.Sinks = append(policy.Sinks, byName[name])
+				}
+			}
+			policy.Alerts = route.Alerts
+			policy.Retention = time.Duration(route.Retention)
+			break
+		}
+		device.policy = policy
+	}
+	return nil
+}
+
+// routesTo reports whether the device's readings are delivered to sink.
+func routesTo(device *Device, sink Sink) bool {
+	for _, s := range device.policy.Sinks {
+		if s == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAlertRoutes checks that routes only name existing alert channels.
+func validateAlertRoutes(routes []RouteConfig, channels map[string]bool) error {
+	for i, route := range routes {
+		for _, name := range route.Alerts {
+			if !channels[name] {
+				return fmt.Errorf("route %d references unknown alert channel %q", i, name)
+			}
+		}
+	}
+	return nil
+}
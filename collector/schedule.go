@@ -0,0 +1,273 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commands a schedule can send
+const (
+	scheduleRenew    = "renew"    // the Type 12 reporting request
+	scheduleSettings = "settings" // the device's Type 17 settings
+	scheduleBurst    = "burst"    // a burst of fast reports
+)
+
+// ScheduleConfig sends a command to devices on a cron schedule. Schedules
+// at the top of the config file apply to the devices sharing a tag with
+// them, or to all without tags; a device's own schedules apply to it.
+type ScheduleConfig struct {
+	// Cron is "minute hour day-of-month month day-of-week" in local time,
+	// or @hourly, @daily, @weekly, @monthly or @every with a duration
+	Cron    string   `json:"cron"`
+	Command string   `json:"command"`
+	Tags    []string `json:"tags,omitempty"`
+	// Interval and Duration of a burst, TRIGGER_INTERVAL and
+	// TRIGGER_DURATION if unset
+	Interval Duration `json:"interval,omitempty"`
+	Duration Duration `json:"duration,omitempty"`
+
+	schedule *cronSchedule
+}
+
+// validate parses the schedule's cron expression and checks its command.
+func (s *ScheduleConfig) validate() error {
+	switch s.Command {
+	case scheduleRenew, scheduleSettings, scheduleBurst:
+	default:
+		return fmt.Errorf("unknown command %q (want renew, settings or burst)", s.Command)
+	}
+	if s.Command != scheduleBurst && (s.Interval != 0 || s.Duration != 0) {
+		return fmt.Errorf("interval and duration only apply to bursts")
+	}
+	schedule, err := parseCron(s.Cron)
+	if err != nil {
+		return fmt.Errorf("cron %q: %w", s.Cron, err)
+	}
+	s.schedule = schedule
+	return nil
+}
+
+// cronSchedule is a parsed cron expression. Fields hold a bit per
+// allowed value; every is set instead for @every.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for a * day field; with both restricted a
+	// day matching either runs, as in cron
+	domAny, dowAny bool
+	every          time.Duration
+}
+
+// cronFields are the bounds of the five fields
+var cronFields = [5]struct{ min, max int }{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+var cronDescriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if rest, ok := strings.CutPrefix(expr, "@every "); ok {
+		every, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, err
+		}
+		if every < time.Second {
+			return nil, fmt.Errorf("@every needs at least 1s")
+		}
+		return &cronSchedule{every: every}, nil
+	}
+	if descriptor, ok := cronDescriptors[expr]; ok {
+		expr = descriptor
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("want 5 fields, got %d", len(fields))
+	}
+	var bits [5]uint64
+	for i, field := range fields {
+		var err error
+		if bits[i], err = parseCronField(field, cronFields[i].min, cronFields[i].max); err != nil {
+			return nil, fmt.Errorf("field %d: %w", i+1, err)
+		}
+	}
+	// Sunday is 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	return &cronSchedule{
+		minute: bits[0], hour: bits[1], dom: bits[2], month: bits[3], dow: bits[4],
+		domAny: fields[2] == "*", dowAny: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of *, N or N-M, each
+// optionally with a /step.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, item := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(first); err != nil {
+				return 0, fmt.Errorf("invalid value %q", first)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(last); err != nil {
+					return 0, fmt.Errorf("invalid value %q", last)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", item, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t the schedule runs, or the zero time
+// if it never does, like on February 30.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Add(s.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// schedulesOf returns the schedules that apply to a device: its own, the
+// matching global ones and, unless one of those renews its request or it
+// is in continuous mode, a renewal every two update intervals.
+func (c *collector) schedulesOf(device *Device, global []ScheduleConfig) []ScheduleConfig {
+	schedules := append([]ScheduleConfig(nil), device.Schedules...)
+	for _, schedule := range global {
+		if len(schedule.Tags) == 0 || device.hasAnyTag(schedule.Tags) {
+			schedules = append(schedules, schedule)
+		}
+	}
+	renews := false
+	for _, schedule := range schedules {
+		renews = renews || schedule.Command == scheduleRenew
+	}
+	if !renews && c.config.Duration > 0 {
+		every := time.Duration(2*c.config.UpdateInterval) * time.Second
+		schedules = append(schedules, ScheduleConfig{
+			Cron:     "@every " + every.String(),
+			Command:  scheduleRenew,
+			schedule: &cronSchedule{every: every},
+		})
+	}
+	return schedules
+}
+
+// runSchedules sends the commands of every device's schedules when they
+// are due, until ctx is done. Schedules and devices are looked up anew
+// every second, so reloads apply right away.
+func (c *collector) runSchedules(ctx context.Context) {
+	next := make(map[string]time.Time)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.lastUpdateMutex.RLock()
+			global := c.config.Schedules
+			c.lastUpdateMutex.RUnlock()
+
+			seen := make(map[string]bool, len(next))
+			for _, device := range c.devices() {
+				if !device.commandable() {
+					continue
+				}
+				for i, schedule := range c.schedulesOf(device, global) {
+					key := fmt.Sprintf("%s\x00%d\x00%s\x00%s", device.Name, i, schedule.Cron, schedule.Command)
+					seen[key] = true
+					due, ok := next[key]
+					if !ok {
+						next[key] = schedule.schedule.next(now)
+						continue
+					}
+					if due.IsZero() || now.Before(due) {
+						continue
+					}
+					next[key] = schedule.schedule.next(now)
+					c.runScheduled(device, schedule)
+				}
+			}
+			for key := range next {
+				if !seen[key] {
+					delete(next, key)
+				}
+			}
+		}
+	}
+}
+
+func (c *collector) runScheduled(device *Device, schedule ScheduleConfig) {
+	slog.Debug("Running scheduled command", "device", device.Name, "command", schedule.Command, "cron", schedule.Cron)
+	switch schedule.Command {
+	case scheduleRenew:
+		c.sendConfigMessage(device)
+	case scheduleSettings:
+		c.sendSettings(device)
+	case scheduleBurst:
+		interval, duration := c.config.TriggerInterval, c.config.TriggerDuration
+		if schedule.Interval > 0 {
+			interval = time.Duration(schedule.Interval)
+		}
+		if schedule.Duration > 0 {
+			duration = time.Duration(schedule.Duration)
+		}
+		if err := c.startBurst(device, interval, duration); err != nil {
+			slog.Warn("Failed to start scheduled burst", "device", device.Name, "error", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package collector
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// seriesIDStore keeps the series ID of every device across restarts, under
+// every MAC and topic the device was known by, in memory or next to the
+// history in SQLite.
+type seriesIDStore interface {
+	// SeriesID returns the ID registered under a key, or "" if none is.
+	SeriesID(key string) (string, error)
+	SetSeriesID(key, id string) error
+}
+
+type memorySeriesIDs struct {
+	mu  sync.Mutex
+	ids map[string]string
+}
+
+func newMemorySeriesIDs() *memorySeriesIDs {
+	return &memorySeriesIDs{ids: make(map[string]string)}
+}
+
+func (m *memorySeriesIDs) SeriesID(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ids[key], nil
+}
+
+func (m *memorySeriesIDs) SetSeriesID(key, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.ids[key] = id
+	return nil
+}
+
+// seriesIDKeys returns the keys a device's series ID is registered under,
+// its original hardware first: every MAC it had, or its topic.
+func seriesIDKeys(device *Device) []string {
+	if device.foreign() {
+		return []string{"topic:" + device.Topic}
+	}
+	keys := []string{"mac:" + normalizeMAC(device.originalMAC())}
+	for _, mac := range append(slices.Clone(device.Replaces), device.MAC) {
+		if key := "mac:" + normalizeMAC(mac); !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// newSeriesID derives the ID of a device seen for the first time from its
+// first key, so it comes out the same even without HISTORY_DB.
+func newSeriesID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "dev_" + hex.EncodeToString(sum[:6])
+}
+
+// assignSeriesIDs gives every device its series ID: the one set in the
+// config file, the one registered under any MAC or topic it was known by,
+// or a new one. The ID is then registered under all of them, so it
+// survives renames and hardware swaps.
+func assignSeriesIDs(devices []*Device, store seriesIDStore) error {
+	owners := make(map[string]string, len(devices)) // ID to device name
+	for _, device := range devices {
+		keys := seriesIDKeys(device)
+		id := device.SeriesID
+		for _, key := range keys {
+			if id != "" {
+				break
+			}
+			var err error
+			if id, err = store.SeriesID(key); err != nil {
+				return fmt.Errorf("series ID of %q: %w", device.Name, err)
+			}
+		}
+		if id == "" {
+			id = newSeriesID(keys[0])
+		}
+		if owner, ok := owners[id]; ok {
+			return fmt.Errorf("devices %q and %q have the same series ID %q", owner, device.Name, id)
+		}
+		owners[id] = device.Name
+
+		for _, key := range keys {
+			if err := store.SetSeriesID(key, id); err != nil {
+				return fmt.Errorf("series ID of %q: %w", device.Name, err)
+			}
+		}
+		device.SeriesID = id
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+)
+
+// DeviceSettings are the device preferences pushed with a Type 17 message.
+// Unset fields are left as they are on the device.
+type DeviceSettings struct {
+	ReportInterval  *int   `json:"report_interval,omitempty"`  // seconds between uploads when not requested via Type 12
+	CollectInterval *int   `json:"collect_interval,omitempty"` // seconds between measurements
+	TemperatureUnit string `json:"temperature_unit,omitempty"` // C or F, as shown on the display
+	TVOCUnit        string `json:"tvoc_unit,omitempty"`        // ppb, mg/m3 or index
+}
+
+func (s DeviceSettings) empty() bool {
+	return s == DeviceSettings{}
+}
+
+// merge returns s with every field set in override replaced.
+func (s DeviceSettings) merge(override DeviceSettings) DeviceSettings {
+	if override.ReportInterval != nil {
+		s.ReportInterval = override.ReportInterval
+	}
+	if override.CollectInterval != nil {
+		s.CollectInterval = override.CollectInterval
+	}
+	if override.TemperatureUnit != "" {
+		s.TemperatureUnit = override.TemperatureUnit
+	}
+	if override.TVOCUnit != "" {
+		s.TVOCUnit = override.TVOCUnit
+	}
+	return s
+}
+
+func (s DeviceSettings) validate() error {
+	if s.ReportInterval != nil && *s.ReportInterval < 1 {
+		return fmt.Errorf("report_interval must be positive")
+	}
+	if s.CollectInterval != nil && *s.CollectInterval < 1 {
+		return fmt.Errorf("collect_interval must be positive")
+	}
+	switch s.TemperatureUnit {
+	case "", "C", "F":
+	default:
+		return fmt.Errorf("temperature_unit must be C or F, got %q", s.TemperatureUnit)
+	}
+	switch s.TVOCUnit {
+	case "", "ppb", "mg/m3", "index":
+	default:
+		return fmt.Errorf("tvoc_unit must be ppb, mg/m3 or index, got %q", s.TVOCUnit)
+	}
+	return nil
+}
+
+// message builds the Type 17 message setting the fields that are set.
+func (s DeviceSettings) message() (QingpingSettingMessage, error) {
+	// Round-trip through JSON to get the wire names of the set fields only
+	var setting map[string]interface{}
+	raw, err := json.Marshal(s)
+	if err == nil {
+		err = json.Unmarshal(raw, &setting)
+	}
+	return QingpingSettingMessage{Type: "17", Setting: setting}, err
+}
+
+// sendSettings publishes the device's desired settings as a Type 17
+// message, so it is in a known state after every (re)connect.
+func (c *collector) sendSettings(device *Device) {
+	if device.Settings.empty() || !device.commandable() {
+		return
+	}
+
+	msg, err := device.Settings.message()
+	if err != nil {
+		slog.Error("Failed to encode settings", "device", device.Name, "error", err)
+		return
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("Failed to marshal settings message", "device", device.Name, "error", err)
+		return
+	}
+
+	downTopic := device.downTopic()
+	token := c.clientFor(device).Publish(downTopic, 0, false, payload)
+	if err := waitCommand(token, device, downTopic); err != nil {
+		slog.Error("Failed to publish settings", "device", device.Name, "topic", downTopic, "type", "17", "error", err)
+		return
+	}
+	slog.Info("Sent settings", "device", device.Name, "topic", downTopic, "type", "17", "settings", msg.Setting)
+}
@@ -0,0 +1,44 @@
+package collector
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// signatureSuffix separates a signed payload from its signature
+const signatureSuffix = "\nsig="
+
+// minSigningKeyLen keeps shared secrets from being guessable
+const minSigningKeyLen = 16
+
+// verifySignature checks the HMAC-SHA256 a gateway appended to a device
+// message as "\nsig=<hex>", computed with the shared key over the topic, a
+// newline and the payload. It returns the payload without the signature.
+// Binding the topic keeps one device's signed messages from being replayed
+// as another's.
+func verifySignature(key, topic string, payload []byte) ([]byte, error) {
+	i := bytes.LastIndex(payload, []byte(signatureSuffix))
+	if i < 0 {
+		return nil, errors.New("message is not signed")
+	}
+	body := payload[:i]
+	signature, err := hex.DecodeString(string(bytes.TrimSpace(payload[i+len(signatureSuffix):])))
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if !hmac.Equal(signature, signPayload(key, topic, body)) {
+		return nil, errors.New("signature does not match")
+	}
+	return body, nil
+}
+
+func signPayload(key, topic string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(topic))
+	mac.Write([]byte{'\n'})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
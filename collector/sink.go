@@ -0,0 +1,85 @@
+package collector
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// Sink receives every parsed reading for the devices routed to it
+type Sink interface {
+	Name() string
+	Write(device *Device, data CGDN1Data)
+}
+
+// Forgetter is implemented by sinks that keep per-device state which
+// should be dropped once a device stops reporting.
+type Forgetter interface {
+	Forget(device *Device)
+}
+
+// Backfiller is implemented by sinks that keep every reading with its own
+// time, so readings older than a device's latest one, like those it
+// buffered while offline, can still be sent to them. Other sinks only get
+// the readings that are newer than everything before.
+type Backfiller interface {
+	Backfill(device *Device, data CGDN1Data)
+}
+
+// Buffer is implemented by sinks that hold readings in memory or on disk,
+// so their footprint can be exported. Sizes are estimates.
+type Buffer interface {
+	// Buffered returns the number of held items and their approximate
+	// memory and disk usage in bytes.
+	Buffered() (items int, memory, disk int64)
+}
+
+// prometheusSink sets the gauges served on /metrics
+type prometheusSink struct {
+	// downsample averages readings in rapid mode, if RAPID_DOWNSAMPLE is set
+	downsample *downsampler
+}
+
+func (prometheusSink) Name() string { return "prometheus" }
+
+func (s prometheusSink) Write(device *Device, data CGDN1Data) {
+	if s.downsample != nil {
+		var ok bool
+		if data, ok = s.downsample.add(device, data); !ok {
+			return
+		}
+	}
+	for key, value := range data.Values {
+		if !exported(key) {
+			continue
+		}
+		if gauge, ok := sensorGauges[key]; ok {
+			gauge.WithLabelValues(device.Name).Set(value)
+		} else {
+			unmappedValue.WithLabelValues(device.Name, key).Set(value)
+		}
+	}
+	lastUpdate.WithLabelValues(device.Name).Set(float64(data.Timestamp.Unix()))
+	deviceUp.WithLabelValues(device.Name).Set(1)
+
+	if data.AQI != nil {
+		// Only the current category may be present for the device
+		aqiCategoryInfo.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+		aqiCategoryInfo.WithLabelValues(device.Name, data.AQI.Standard, data.AQI.Category, data.AQI.Label, data.AQI.Color).Set(1)
+		aqiCategoryLevel.WithLabelValues(device.Name, data.AQI.Standard).Set(float64(data.AQI.Level))
+		aqiIndex.WithLabelValues(device.Name, data.AQI.Standard).Set(data.AQI.Index)
+		for pollutant, sub := range data.AQI.SubIndices {
+			aqiSubIndex.WithLabelValues(device.Name, data.AQI.Standard, pollutant).Set(sub)
+		}
+	}
+}
+
+func (s prometheusSink) Forget(device *Device) {
+	if s.downsample != nil {
+		s.downsample.forget(device)
+	}
+	for _, gauge := range sensorGauges {
+		gauge.DeleteLabelValues(device.Name)
+	}
+	unmappedValue.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+	aqiCategoryInfo.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+	aqiCategoryLevel.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+	aqiIndex.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+	aqiSubIndex.DeletePartialMatch(prometheus.Labels{"device": device.Name})
+}
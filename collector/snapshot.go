@@ -0,0 +1,97 @@
+package collector
+
+import (
+	"maps"
+	"net/http"
+	"time"
+)
+
+// Snapshot is the latest reading of a device with how it was received.
+// Stored snapshots are never changed, only replaced, so they can be read
+// without holding a lock.
+type Snapshot struct {
+	Device  string    `json:"device"`
+	Reading CGDN1Data `json:"reading"`
+	// Received is when the collector got the reading; Reading.Timestamp is
+	// when the device took it
+	Received time.Time `json:"received"`
+	Source   string    `json:"source"` // mqtt, ble or cloud
+	Topic    string    `json:"topic,omitempty"`
+	Type     string    `json:"type,omitempty"` // message type of MQTT readings
+}
+
+// origin describes where the values of a reading came from
+type origin struct {
+	Source string
+	Topic  string
+	Type   string
+}
+
+// logAttrs describes the origin in the log.
+func (o origin) logAttrs() []any {
+	if o.Topic != "" {
+		return []any{"topic", o.Topic, "type", o.Type}
+	}
+	return []any{"source", o.Source}
+}
+
+// clone returns a copy of the reading that shares no maps with it.
+func (d CGDN1Data) clone() CGDN1Data {
+	d.Values = maps.Clone(d.Values)
+	if d.AQI != nil {
+		aqi := *d.AQI
+		aqi.SubIndices = maps.Clone(aqi.SubIndices)
+		d.AQI = &aqi
+	}
+	return d
+}
+
+// Latest returns a copy of the latest snapshot of the device with the
+// given name or series ID, which the caller may keep and change.
+func (a *App) Latest(name string) (Snapshot, bool) {
+	device := a.c.deviceByName(name)
+	if device == nil {
+		return Snapshot{}, false
+	}
+	return a.c.snapshot(device)
+}
+
+// LatestAll returns a copy of the latest snapshot of every device that
+// has reported.
+func (a *App) LatestAll() []Snapshot {
+	var snapshots []Snapshot
+	for _, device := range a.c.devices() {
+		if snapshot, ok := a.c.snapshot(device); ok {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots
+}
+
+func (c *collector) snapshot(device *Device) (Snapshot, bool) {
+	c.lastUpdateMutex.RLock()
+	latest, ok := c.latest[device.Name]
+	c.lastUpdateMutex.RUnlock()
+	if !ok {
+		return Snapshot{}, false
+	}
+	snapshot := *latest
+	snapshot.Reading = latest.Reading.clone()
+	return snapshot, true
+}
+
+// handleLatest serves GET /api/v1/devices/{name}/latest with the device's
+// latest reading and how it was received.
+func (c *collector) handleLatest(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.PathValue("name"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	snapshot, ok := c.snapshot(device)
+	if !ok {
+		writeError(w, http.StatusNotFound, "no reading yet")
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
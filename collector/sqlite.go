@@ -0,0 +1,359 @@
+package collector
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqlitePruneInterval is how often a device's expired readings are deleted
+const sqlitePruneInterval = 10 * time.Minute
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS readings (
+	device TEXT    NOT NULL,
+	time   INTEGER NOT NULL, -- unix milliseconds
+	vals   TEXT    NOT NULL  -- JSON object of every raw and derived value
+);
+CREATE INDEX IF NOT EXISTS readings_device_time ON readings (device, time);
+CREATE TABLE IF NOT EXISTS annotations (
+	id       INTEGER PRIMARY KEY,
+	time     INTEGER NOT NULL, -- unix milliseconds
+	time_end INTEGER,
+	text     TEXT    NOT NULL,
+	tags     TEXT    NOT NULL, -- JSON array
+	device   TEXT    NOT NULL
+);
+CREATE INDEX IF NOT EXISTS annotations_time ON annotations (time);
+CREATE TABLE IF NOT EXISTS filters (
+	name  TEXT PRIMARY KEY,
+	load  REAL    NOT NULL, -- µg·h/m³
+	since INTEGER NOT NULL  -- unix milliseconds of the last reset, 0 if never
+);
+CREATE TABLE IF NOT EXISTS series_ids (
+	key TEXT PRIMARY KEY, -- mac:<MAC> or topic:<topic>
+	id  TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS derived_state (
+	component TEXT NOT NULL, -- battery, exposure, deadband or filter
+	device    TEXT NOT NULL,
+	state     TEXT NOT NULL, -- JSON
+	PRIMARY KEY (component, device)
+);
+`
+
+// sqliteHistory is a historyStore persisting every reading in a SQLite
+// file, so history survives restarts and can be queried with sqlite3.
+type sqliteHistory struct {
+	path      string
+	db        *sql.DB
+	retention time.Duration
+
+	mu         sync.Mutex
+	lastPruned map[string]time.Time
+	// readings is the number of stored readings, counted once on open and
+	// kept up to date, so Buffered doesn't scan the table on every scrape
+	readings atomic.Int64
+}
+
+func newSQLiteHistory(path string, retention time.Duration) (*sqliteHistory, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer; a single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("create schema in %s: %w", path, err)
+	}
+	h := &sqliteHistory{
+		path:       path,
+		db:         db,
+		retention:  retention,
+		lastPruned: make(map[string]time.Time),
+	}
+	var readings int64
+	if err := db.QueryRow(`SELECT COUNT(*) FROM readings`).Scan(&readings); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("count readings in %s: %w", path, err)
+	}
+	h.readings.Store(readings)
+	return h, nil
+}
+
+func (h *sqliteHistory) Name() string { return "history" }
+
+func (h *sqliteHistory) Write(device *Device, data CGDN1Data) {
+	values, err := json.Marshal(data.Values)
+	if err != nil {
+		slog.Error("Failed to encode reading", "sink", h.Name(), "device", device.Name, "error", err)
+		return
+	}
+	if _, err := h.db.Exec(`INSERT INTO readings (device, time, vals) VALUES (?, ?, ?)`,
+		device.Name, data.Timestamp.UnixMilli(), string(values)); err != nil {
+		slog.Error("Failed to store reading", "sink", h.Name(), "device", device.Name, "error", err)
+		recordError(codeSinkRejected, ErrorExample{Device: device.Name, Source: h.Name(), Message: err.Error()})
+		return
+	}
+	h.readings.Add(1)
+
+	h.mu.Lock()
+	due := data.Timestamp.Sub(h.lastPruned[device.Name]) >= sqlitePruneInterval
+	if due {
+		h.lastPruned[device.Name] = data.Timestamp
+	}
+	h.mu.Unlock()
+	if due {
+		h.prune(device, data.Timestamp)
+	}
+}
+
+// Backfill stores a reading older than the device's latest, unless one
+// is already stored for its time, as when a device sends its buffer again.
+// Expired readings go with the next prune.
+func (h *sqliteHistory) Backfill(device *Device, data CGDN1Data) {
+	values, err := json.Marshal(data.Values)
+	if err != nil {
+		slog.Error("Failed to encode reading", "sink", h.Name(), "device", device.Name, "error", err)
+		return
+	}
+	millis := data.Timestamp.UnixMilli()
+	result, err := h.db.Exec(`INSERT INTO readings (device, time, vals) SELECT ?, ?, ?
+		WHERE NOT EXISTS (SELECT 1 FROM readings WHERE device = ? AND time = ?)`,
+		device.Name, millis, string(values), device.Name, millis)
+	if err != nil {
+		slog.Error("Failed to store reading", "sink", h.Name(), "device", device.Name, "error", err)
+		recordError(codeSinkRejected, ErrorExample{Device: device.Name, Source: h.Name(), Message: err.Error()})
+		return
+	}
+	n, _ := result.RowsAffected()
+	h.readings.Add(n)
+}
+
+// prune deletes the device's readings older than its retention.
+func (h *sqliteHistory) prune(device *Device, now time.Time) {
+	retention := device.policy.retentionOr(h.retention)
+	result, err := h.db.Exec(`DELETE FROM readings WHERE device = ? AND time < ?`,
+		device.Name, now.Add(-retention).UnixMilli())
+	if err != nil {
+		slog.Error("Failed to prune readings", "sink", h.Name(), "device", device.Name, "error", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		h.readings.Add(-n)
+		slog.Debug("Pruned readings", "sink", h.Name(), "device", device.Name, "deleted", n)
+	}
+}
+
+// Import stores readings in one transaction, skipping those already
+// stored for the same device and time so an import can be repeated. It
+// returns the number of readings added.
+func (h *sqliteHistory) Import(device *Device, readings []CGDN1Data) (int, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	added := 0
+	for _, data := range readings {
+		values, err := json.Marshal(data.Values)
+		if err != nil {
+			return 0, err
+		}
+		millis := data.Timestamp.UnixMilli()
+		result, err := tx.Exec(`INSERT INTO readings (device, time, vals) SELECT ?, ?, ?
+			WHERE NOT EXISTS (SELECT 1 FROM readings WHERE device = ? AND time = ?)`,
+			device.Name, millis, string(values), device.Name, millis)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := result.RowsAffected()
+		added += int(n)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	h.readings.Add(int64(added))
+	return added, nil
+}
+
+func (h *sqliteHistory) Samples(device string, from, to time.Time) ([]Sample, error) {
+	rows, err := h.db.Query(`SELECT time, vals FROM readings WHERE device = ? AND time BETWEEN ? AND ? ORDER BY time`,
+		device, from.UnixMilli(), to.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var samples []Sample
+	for rows.Next() {
+		var millis int64
+		var values string
+		if err := rows.Scan(&millis, &values); err != nil {
+			return nil, err
+		}
+		sample := Sample{Time: time.UnixMilli(millis)}
+		if err := json.Unmarshal([]byte(values), &sample.Values); err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	return samples, rows.Err()
+}
+
+func (h *sqliteHistory) AddAnnotation(a Annotation) (Annotation, error) {
+	tags, err := json.Marshal(a.Tags)
+	if err != nil {
+		return a, err
+	}
+	var end *int64
+	if a.TimeEnd != nil {
+		millis := a.TimeEnd.UnixMilli()
+		end = &millis
+	}
+	result, err := h.db.Exec(`INSERT INTO annotations (time, time_end, text, tags, device) VALUES (?, ?, ?, ?, ?)`,
+		a.Time.UnixMilli(), end, a.Text, string(tags), a.Device)
+	if err != nil {
+		return a, err
+	}
+	a.ID, err = result.LastInsertId()
+	return a, err
+}
+
+func (h *sqliteHistory) Annotations(from, to time.Time) ([]Annotation, error) {
+	rows, err := h.db.Query(`SELECT id, time, time_end, text, tags, device FROM annotations
+		WHERE time <= ? AND COALESCE(time_end, time) >= ? ORDER BY time`, to.UnixMilli(), from.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var annotations []Annotation
+	for rows.Next() {
+		var a Annotation
+		var start int64
+		var end sql.NullInt64
+		var tags string
+		if err := rows.Scan(&a.ID, &start, &end, &a.Text, &tags, &a.Device); err != nil {
+			return nil, err
+		}
+		a.Time = time.UnixMilli(start)
+		if end.Valid {
+			t := time.UnixMilli(end.Int64)
+			a.TimeEnd = &t
+		}
+		if err := json.Unmarshal([]byte(tags), &a.Tags); err != nil {
+			return nil, err
+		}
+		annotations = append(annotations, a)
+	}
+	return annotations, rows.Err()
+}
+
+func (h *sqliteHistory) DeleteAnnotation(id int64) (bool, error) {
+	result, err := h.db.Exec(`DELETE FROM annotations WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (h *sqliteHistory) FilterLoad(name string) (float64, time.Time, error) {
+	var load float64
+	var since int64
+	err := h.db.QueryRow(`SELECT load, since FROM filters WHERE name = ?`, name).Scan(&load, &since)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, time.Time{}, nil
+	}
+	if err != nil || since == 0 {
+		return load, time.Time{}, err
+	}
+	return load, time.UnixMilli(since), nil
+}
+
+func (h *sqliteHistory) SetFilterLoad(name string, load float64, since time.Time) error {
+	var millis int64
+	if !since.IsZero() {
+		millis = since.UnixMilli()
+	}
+	_, err := h.db.Exec(`INSERT INTO filters (name, load, since) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET load = excluded.load, since = excluded.since`, name, load, millis)
+	return err
+}
+
+func (h *sqliteHistory) SeriesID(key string) (string, error) {
+	var id string
+	err := h.db.QueryRow(`SELECT id FROM series_ids WHERE key = ?`, key).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+func (h *sqliteHistory) SetSeriesID(key, id string) error {
+	_, err := h.db.Exec(`INSERT INTO series_ids (key, id) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET id = excluded.id`, key, id)
+	return err
+}
+
+// SaveState replaces the component's saved state.
+func (h *sqliteHistory) SaveState(component string, states map[string][]byte) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM derived_state WHERE component = ?`, component); err != nil {
+		return err
+	}
+	for device, state := range states {
+		if _, err := tx.Exec(`INSERT INTO derived_state (component, device, state) VALUES (?, ?, ?)`,
+			component, device, string(state)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *sqliteHistory) LoadState(component string) (map[string][]byte, error) {
+	rows, err := h.db.Query(`SELECT device, state FROM derived_state WHERE component = ?`, component)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make(map[string][]byte)
+	for rows.Next() {
+		var device, state string
+		if err := rows.Scan(&device, &state); err != nil {
+			return nil, err
+		}
+		states[device] = []byte(state)
+	}
+	return states, rows.Err()
+}
+
+func (h *sqliteHistory) Buffered() (int, int64, int64) {
+	var disk int64
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if info, err := os.Stat(h.path + suffix); err == nil {
+			disk += info.Size()
+		}
+	}
+	return int(h.readings.Load()), 0, disk
+}
+
+func (h *sqliteHistory) Close() error {
+	return h.db.Close()
+}
@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// stateSaveInterval is how often derived state is written to the history
+// database, besides on shutdown
+const stateSaveInterval = 5 * time.Minute
+
+// derivedState is state a sink or filter builds up from readings and
+// can't recompute from the history: battery discharge rates, exposure
+// totals, deadband and filter state. It is kept in the history database,
+// so it survives a restart and moves to another host with a backup.
+type derivedState interface {
+	// saveState returns the state of every device, JSON encoded
+	saveState() (map[string][]byte, error)
+	// loadState restores saved states, before any reading is handled
+	loadState(states map[string][]byte) error
+}
+
+// stateStore keeps the derived state of each component by device
+type stateStore interface {
+	SaveState(component string, states map[string][]byte) error
+	LoadState(component string) (map[string][]byte, error)
+}
+
+// derivedStates keeps the state of its components in a store
+type derivedStates struct {
+	store      stateStore
+	components map[string]derivedState
+}
+
+// load restores every component's state; one that fails starts over.
+func (d *derivedStates) load() {
+	for name, component := range d.components {
+		states, err := d.store.LoadState(name)
+		if err == nil {
+			err = component.loadState(states)
+		}
+		if err != nil {
+			slog.Warn("Failed to restore derived state, starting over", "component", name, "error", err)
+			continue
+		}
+		if len(states) > 0 {
+			slog.Debug("Restored derived state", "component", name, "devices", len(states))
+		}
+	}
+}
+
+func (d *derivedStates) save() {
+	for name, component := range d.components {
+		states, err := component.saveState()
+		if err == nil {
+			err = d.store.SaveState(name, states)
+		}
+		if err != nil {
+			slog.Error("Failed to save derived state", "component", name, "error", err)
+		}
+	}
+}
+
+// run saves the state every stateSaveInterval until ctx is done.
+func (d *derivedStates) run(ctx context.Context) {
+	every(ctx, stateSaveInterval, d.save)
+}
+
+// encodeStates JSON encodes a state per device.
+func encodeStates[T any](states map[string]T) (map[string][]byte, error) {
+	encoded := make(map[string][]byte, len(states))
+	for device, state := range states {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return nil, err
+		}
+		encoded[device] = data
+	}
+	return encoded, nil
+}
+
+// decodeStates decodes what encodeStates encoded.
+func decodeStates[T any](encoded map[string][]byte) (map[string]T, error) {
+	states := make(map[string]T, len(encoded))
+	for device, data := range encoded {
+		var state T
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		states[device] = state
+	}
+	return states, nil
+}
@@ -0,0 +1,154 @@
+package collector
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsCacheTTL bounds how long computed stats are served. Entries are
+// also dropped as soon as the device reports again.
+const statsCacheTTL = time.Minute
+
+// SensorStats summarizes one sensor over a window.
+type SensorStats struct {
+	Samples int     `json:"samples"`
+	Avg     float64 `json:"avg"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	P50     float64 `json:"p50"`
+	P90     float64 `json:"p90"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+}
+
+// StatsResponse is returned by /api/devices/{name}/stats
+type StatsResponse struct {
+	Device string                 `json:"device"`
+	From   time.Time              `json:"from"`
+	To     time.Time              `json:"to"`
+	Stats  map[string]SensorStats `json:"stats"`
+}
+
+// summarize computes the stats of every value found in samples.
+func summarize(samples []Sample) map[string]SensorStats {
+	keys := make(map[string]bool)
+	for _, sample := range samples {
+		for key := range sample.Values {
+			keys[key] = true
+		}
+	}
+
+	stats := make(map[string]SensorStats, len(keys))
+	for key := range keys {
+		values := sensorSeries(samples, key)
+		sort.Float64s(values)
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		stats[key] = SensorStats{
+			Samples: len(values),
+			Avg:     round2(sum / float64(len(values))),
+			Min:     values[0],
+			Max:     values[len(values)-1],
+			P50:     round2(percentile(values, 50)),
+			P90:     round2(percentile(values, 90)),
+			P95:     round2(percentile(values, 95)),
+			P99:     round2(percentile(values, 99)),
+		}
+	}
+	return stats
+}
+
+func round2(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// statsCache keeps computed stats per device and window, so widgets
+// polling every few seconds don't scan the history each time.
+type statsCache struct {
+	mu      sync.Mutex
+	entries map[statsKey]statsEntry
+}
+
+type statsKey struct {
+	device string
+	window time.Duration
+}
+
+type statsEntry struct {
+	response StatsResponse
+	// latest is the device's newest reading the stats include
+	latest  time.Time
+	expires time.Time
+}
+
+func newStatsCache() *statsCache {
+	return &statsCache{entries: make(map[statsKey]statsEntry)}
+}
+
+// get returns cached stats if they are fresh and no reading came since.
+func (s *statsCache) get(key statsKey, latest, now time.Time) (StatsResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || !entry.latest.Equal(latest) || now.After(entry.expires) {
+		return StatsResponse{}, false
+	}
+	return entry.response, true
+}
+
+func (s *statsCache) put(key statsKey, response StatsResponse, latest, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, k)
+		}
+	}
+	s.entries[key] = statsEntry{response: response, latest: latest, expires: now.Add(statsCacheTTL)}
+}
+
+// handleStats serves GET /api/devices/{name}/stats?window=24h: average,
+// minimum, maximum and percentiles of every sensor from the local history.
+func (c *collector) handleStats(w http.ResponseWriter, r *http.Request) {
+	device := c.deviceByName(r.PathValue("name"))
+	if device == nil {
+		writeError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	window, ok := parseWindow(r, 24*time.Hour)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid window")
+		return
+	}
+
+	now := time.Now()
+	c.lastUpdateMutex.RLock()
+	var latest time.Time
+	if snapshot, ok := c.latest[device.Name]; ok {
+		latest = snapshot.Reading.Timestamp
+	}
+	c.lastUpdateMutex.RUnlock()
+
+	key := statsKey{device: device.Name, window: window}
+	if response, ok := c.stats.get(key, latest, now); ok {
+		w.Header().Set("X-Cache", "hit")
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	from := now.Add(-window)
+	samples, err := c.history.Samples(device.Name, from, now)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	response := StatsResponse{Device: device.Name, From: from, To: now, Stats: summarize(samples)}
+	c.stats.put(key, response, latest, now)
+	w.Header().Set("X-Cache", "miss")
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,121 @@
+package collector
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// statsdMaxPacket keeps datagrams below common path MTUs
+const statsdMaxPacket = 1432
+
+// StatsDConfig configures emitting readings as StatsD gauges.
+type StatsDConfig struct {
+	Address string // host:port, e.g. localhost:8125
+	Prefix  string // prepended to every metric name
+	Tags    string // dogstatsd to tag metrics with the device, none to put it in the name
+}
+
+// statsdSink sends every value of a reading as a StatsD gauge over UDP.
+// StatsD is fire and forget, so nothing is queued.
+type statsdSink struct {
+	config StatsDConfig
+	conn   net.Conn
+}
+
+func newStatsDSink(config StatsDConfig) (*statsdSink, error) {
+	switch config.Tags {
+	case "", "dogstatsd":
+		config.Tags = "dogstatsd"
+	case "none":
+	default:
+		return nil, fmt.Errorf("unknown StatsD tag format %q (want dogstatsd or none)", config.Tags)
+	}
+	if config.Prefix != "" && !strings.HasSuffix(config.Prefix, ".") {
+		config.Prefix += "."
+	}
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{config: config, conn: conn}, nil
+}
+
+func (s *statsdSink) Name() string { return "statsd" }
+
+// statsdName makes a string safe in a metric name or tag.
+var statsdName = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_")
+
+func (s *statsdSink) Write(device *Device, data CGDN1Data) {
+	values := make(map[string]float64, len(data.Values)+1)
+	for key, value := range data.Values {
+		if exported(key) {
+			values[key] = value
+		}
+	}
+	if data.AQI != nil {
+		values["aqi"] = data.AQI.Index
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var lines []string
+	for _, key := range keys {
+		name, suffix := s.config.Prefix+statsdName.Replace(key), ""
+		if s.config.Tags == "dogstatsd" {
+			suffix = "|#device:" + statsdName.Replace(device.Name)
+			for _, tag := range device.Tags {
+				suffix += "," + statsdName.Replace(tag)
+			}
+			for _, label := range labelPairs(device.Labels) {
+				suffix += "," + statsdName.Replace(label.GetName()) + ":" + statsdName.Replace(label.GetValue())
+			}
+		} else {
+			name = s.config.Prefix + statsdName.Replace(device.Name) + "." + statsdName.Replace(key)
+		}
+
+		value := values[key]
+		// A signed gauge is a delta, so a negative value needs a reset first
+		if value < 0 {
+			lines = append(lines, name+":0|g"+suffix)
+		}
+		lines = append(lines, name+":"+strconv.FormatFloat(value, 'f', -1, 64)+"|g"+suffix)
+	}
+	s.send(lines)
+}
+
+// send packs lines into as few datagrams as possible.
+func (s *statsdSink) send(lines []string) {
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			slog.Warn("Failed to send StatsD packet", "address", s.config.Address, "error", err)
+			recordError(codeSinkRejected, ErrorExample{Source: s.Name(), Message: err.Error()})
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+}
+
+func (s *statsdSink) Close() error {
+	return s.conn.Close()
+}
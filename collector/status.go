@@ -0,0 +1,185 @@
+package collector
+
+import (
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statusSensors are the sensors shown on the public status page; battery
+// and anything device-specific is deliberately left out.
+var statusSensors = []string{"temperature", "humidity", "co2", "pm25", "pm10", "tvoc"}
+
+// hourlyAverage accumulates one device's readings for a single hour
+type hourlyAverage struct {
+	Hour   time.Time
+	sums   map[string]float64
+	counts map[string]int
+}
+
+func (h *hourlyAverage) add(values map[string]float64) {
+	for _, key := range statusSensors {
+		if value, ok := values[key]; ok {
+			h.sums[key] += value
+			h.counts[key]++
+		}
+	}
+}
+
+func (h *hourlyAverage) averages() map[string]float64 {
+	avg := make(map[string]float64, len(h.sums))
+	for key, sum := range h.sums {
+		// One decimal is plenty for a public page
+		avg[key] = math.Round(sum/float64(h.counts[key])*10) / 10
+	}
+	return avg
+}
+
+// statusDevice is the public view of a device
+type statusDevice struct {
+	Device   string             `json:"device"`
+	Hour     time.Time          `json:"hour"`
+	Averages map[string]float64 `json:"averages"`
+	AQI      *AQIResult         `json:"aqi,omitempty"`
+}
+
+// statusSink keeps hourly averages per device and serves only the last
+// completed hour, so the public page is coarse and at least a bit delayed.
+type statusSink struct {
+	aqi    *aqiStandard
+	locale string
+
+	mu        sync.Mutex
+	current   map[string]*hourlyAverage
+	completed map[string]statusDevice
+	updated   time.Time
+}
+
+func newStatusSink(aqi *aqiStandard, locale string) *statusSink {
+	return &statusSink{
+		aqi:       aqi,
+		locale:    locale,
+		current:   make(map[string]*hourlyAverage),
+		completed: make(map[string]statusDevice),
+	}
+}
+
+func (s *statusSink) Name() string { return "status" }
+
+func (s *statusSink) Write(device *Device, data CGDN1Data) {
+	hour := data.Timestamp.Truncate(time.Hour)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.current[device.Name]
+	if ok && current.Hour.Before(hour) {
+		s.complete(device.Name, current)
+		ok = false
+	}
+	if !ok {
+		current = &hourlyAverage{
+			Hour:   hour,
+			sums:   make(map[string]float64),
+			counts: make(map[string]int),
+		}
+		s.current[device.Name] = current
+	}
+	current.add(data.Values)
+}
+
+func (s *statusSink) complete(name string, hour *hourlyAverage) {
+	avg := hour.averages()
+	entry := statusDevice{Device: name, Hour: hour.Hour, Averages: avg}
+	if result, ok := s.aqi.Classify(avg, s.locale); ok {
+		entry.AQI = &result
+	}
+	s.completed[name] = entry
+	s.updated = time.Now()
+}
+
+func (s *statusSink) snapshot() ([]statusDevice, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Close hours that ended while the device was quiet
+	for name, current := range s.current {
+		if time.Since(current.Hour) >= time.Hour {
+			s.complete(name, current)
+			delete(s.current, name)
+		}
+	}
+
+	devices := make([]statusDevice, 0, len(s.completed))
+	for _, entry := range s.completed {
+		devices = append(devices, entry)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Device < devices[j].Device })
+	return devices, s.updated
+}
+
+// setCacheHeaders lets browsers and CDNs cache the page; the data only
+// changes once an hour anyway.
+func setCacheHeaders(w http.ResponseWriter, updated time.Time) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if !updated.IsZero() {
+		w.Header().Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+}
+
+func (s *statusSink) serveJSON(w http.ResponseWriter, r *http.Request) {
+	devices, updated := s.snapshot()
+	setCacheHeaders(w, updated)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"devices": devices}); err != nil {
+		slog.Debug("Failed to write status JSON", "error", err)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Air Quality</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; text-align: right; border-bottom: 1px solid #ddd; }
+th:first-child, td:first-child { text-align: left; }
+</style>
+</head>
+<body>
+<h1>Air Quality</h1>
+{{if .}}
+<table>
+<tr><th>Device</th><th>Hour</th><th>Temp °C</th><th>Humidity %</th><th>CO2 ppm</th><th>PM2.5 µg/m³</th><th>PM10 µg/m³</th><th>TVOC ppb</th><th>Air Quality</th></tr>
+{{range .}}<tr>
+<td>{{.Device}}</td><td>{{.Hour.Format "2006-01-02 15:04"}}</td>
+<td>{{index .Averages "temperature"}}</td><td>{{index .Averages "humidity"}}</td><td>{{index .Averages "co2"}}</td>
+<td>{{index .Averages "pm25"}}</td><td>{{index .Averages "pm10"}}</td><td>{{index .Averages "tvoc"}}</td>
+<td>{{with .AQI}}<span style="background: {{.Color}}; padding: 0 0.4em;">&nbsp;</span> {{.Label}}{{end}}</td>
+</tr>
+{{end}}</table>
+<p>Hourly averages of the last completed hour.</p>
+{{else}}
+<p>No complete hour of data yet.</p>
+{{end}}
+</body>
+</html>
+`))
+
+func (s *statusSink) serveHTML(w http.ResponseWriter, r *http.Request) {
+	devices, updated := s.snapshot()
+	setCacheHeaders(w, updated)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, devices); err != nil {
+		slog.Debug("Failed to render status page", "error", err)
+	}
+}
@@ -0,0 +1,136 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamKeepalive is how often an idle stream sends a comment so proxies
+// don't close the connection.
+const streamKeepalive = 30 * time.Second
+
+// StreamEvent is the data of every "reading" event on /api/v1/stream
+type StreamEvent struct {
+	Device  string    `json:"device"`
+	Reading CGDN1Data `json:"reading"`
+}
+
+// streamSink fans readings out to the clients of /api/v1/stream. Slow
+// clients miss events rather than holding up the other sinks.
+type streamSink struct {
+	mu      sync.Mutex
+	clients map[chan StreamEvent]struct{}
+}
+
+func newStreamSink() *streamSink {
+	return &streamSink{clients: make(map[chan StreamEvent]struct{})}
+}
+
+func (s *streamSink) Name() string { return "stream" }
+
+func (s *streamSink) Write(device *Device, data CGDN1Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for client := range s.clients {
+		select {
+		case client <- StreamEvent{Device: device.Name, Reading: data}:
+		default:
+		}
+	}
+}
+
+func (s *streamSink) subscribe() chan StreamEvent {
+	client := make(chan StreamEvent, 16)
+	s.mu.Lock()
+	s.clients[client] = struct{}{}
+	s.mu.Unlock()
+	return client
+}
+
+func (s *streamSink) unsubscribe(client chan StreamEvent) {
+	s.mu.Lock()
+	delete(s.clients, client)
+	s.mu.Unlock()
+}
+
+// handleStream serves GET /api/v1/stream?device=NAME as Server-Sent Events:
+// the latest reading of every device first, then each new reading as it
+// arrives. Without device, all devices are streamed.
+func (c *collector) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	only := r.URL.Query().Get("device")
+	if only != "" {
+		device := c.deviceByName(only)
+		if device == nil {
+			writeError(w, http.StatusNotFound, "unknown device")
+			return
+		}
+		only = device.Name
+	}
+
+	client := c.stream.subscribe()
+	defer c.stream.unsubscribe(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event StreamEvent) bool {
+		if only != "" && event.Device != only {
+			return true
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			slog.Error("Failed to marshal stream event", "device", event.Device, "error", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: reading\ndata: %s\n\n", data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	c.lastUpdateMutex.RLock()
+	var initial []StreamEvent
+	for _, device := range c.config.Devices {
+		if snapshot, ok := c.latest[device.Name]; ok {
+			initial = append(initial, StreamEvent{Device: device.Name, Reading: snapshot.Reading})
+		}
+	}
+	c.lastUpdateMutex.RUnlock()
+	for _, event := range initial {
+		if !send(event) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-client:
+			if !send(event) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// minSuggestionSamples is the least amount of history a suggestion is
+// based on; fewer samples say more about the last hour than about the unit.
+const minSuggestionSamples = 60
+
+// suggestionSensors lists which side of the distribution is "bad" for
+// each sensor. Pollutants only get upper thresholds.
+var suggestionSensors = map[string]struct{ low, high bool }{
+	"temperature": {true, true},
+	"humidity":    {true, true},
+	"co2":         {false, true},
+	"pm25":        {false, true},
+	"pm10":        {false, true},
+	"tvoc":        {false, true},
+	"tvoc_index":  {false, true},
+	"noise":       {false, true},
+}
+
+// ThresholdSuggestion summarizes a sensor's distribution and proposes
+// alert thresholds from it.
+type ThresholdSuggestion struct {
+	Samples int     `json:"samples"`
+	P5      float64 `json:"p5"`
+	P50     float64 `json:"p50"`
+	P95     float64 `json:"p95"`
+	P99     float64 `json:"p99"`
+	// Suggested thresholds: warn on the 95th and alert on the 99th
+	// percentile, or the 5th/1st for sensors where low values matter.
+	WarnAbove     *float64 `json:"warn_above,omitempty"`
+	CriticalAbove *float64 `json:"critical_above,omitempty"`
+	WarnBelow     *float64 `json:"warn_below,omitempty"`
+	CriticalBelow *float64 `json:"critical_below,omitempty"`
+}
+
+// SuggestionsResponse is returned by /api/devices/{name}/suggestions
+type SuggestionsResponse struct {
+	Device      string                         `json:"device"`
+	From        time.Time                      `json:"from"`
+	To          time.Time                      `json:"to"`
+	Suggestions map[string]ThresholdSuggestion `json:"suggestions"`
+	// Insufficient lists sensors with less than minSuggestionSamples
+	Insufficient []string `json:"insufficient,omitempty"`
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// suggestThresholds derives per-sensor thresholds from the device's own
+// history, so "bad" is relative to what the unit normally reads.
+func suggestThresholds(samples []Sample) (map[string]ThresholdSuggestion, []string) {
+	suggestions := make(map[string]ThresholdSuggestion)
+	var insufficient []string
+
+	for sensor, sides := range suggestionSensors {
+		values := sensorSeries(samples, sensor)
+		if len(values) < minSuggestionSamples {
+			insufficient = append(insufficient, sensor)
+			continue
+		}
+		sort.Float64s(values)
+
+		s := ThresholdSuggestion{
+			Samples: len(values),
+			P5:      round1(percentile(values, 5)),
+			P50:     round1(percentile(values, 50)),
+			P95:     round1(percentile(values, 95)),
+			P99:     round1(percentile(values, 99)),
+		}
+		if sides.high {
+			warn, critical := s.P95, s.P99
+			s.WarnAbove, s.CriticalAbove = &warn, &critical
+		}
+		if sides.low {
+			warn, critical := s.P5, round1(percentile(values, 1))
+			s.WarnBelow, s.CriticalBelow = &warn, &critical
+		}
+		suggestions[sensor] = s
+	}
+
+	sort.Strings(insufficient)
+	return suggestions, insufficient
+}
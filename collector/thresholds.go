@@ -0,0 +1,348 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// ThresholdRule raises an alert while a sensor is above or below a limit
+// on the devices carrying one of its tags.
+type ThresholdRule struct {
+	Name   string   `json:"name,omitempty"`
+	Tags   []string `json:"tags,omitempty"` // empty means every device
+	Sensor string   `json:"sensor"`
+	Above  *float64 `json:"above,omitempty"`
+	Below  *float64 `json:"below,omitempty"`
+	// For is how long the limit must stay crossed before the rule fires
+	For Duration `json:"for,omitempty"`
+	// Channels limits the rule's notifications to these channels, on top
+	// of the device's routes; empty means all of them
+	Channels []string `json:"channels,omitempty"`
+}
+
+// exceeded reports whether value violates the rule and which limit it crossed.
+func (r ThresholdRule) exceeded(value float64) (bool, float64) {
+	if r.Above != nil && value > *r.Above {
+		return true, *r.Above
+	}
+	if r.Below != nil && value < *r.Below {
+		return true, *r.Below
+	}
+	return false, 0
+}
+
+// alertState is the retained message published on the alert topic of a
+// device and rule whenever the rule starts or stops firing.
+type alertState struct {
+	State     string    `json:"state"` // firing or ok
+	Device    string    `json:"device"`
+	Rule      string    `json:"rule"`
+	Sensor    string    `json:"sensor"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// thresholdSink evaluates the threshold rules against every reading and
+// notifies when a rule starts and stops being exceeded.
+type thresholdSink struct {
+	rules    []ThresholdRule
+	notifier *notifier
+	// topic receives the alert state, {device} and {rule} are replaced
+	topic  string
+	client mqtt.Client
+	// onAlert is called in the background when a rule starts firing
+	onAlert func(device *Device, rule ThresholdRule)
+	// onChange is called, with the sink unlocked, after any rule started
+	// or stopped firing
+	onChange func()
+	// maintenance holds the devices whose readings aren't evaluated
+	maintenance *maintenance
+
+	mu     sync.Mutex
+	firing map[string]bool // "device|rule"
+	// exceeded is when the limit of a rule was crossed, kept until the
+	// value is back in range
+	exceeded map[string]time.Time
+	// deviceRules apply to a single device in addition to rules, by
+	// deviceKey, as the device is swapped on renames and reloads
+	deviceRules map[string][]ThresholdRule
+}
+
+// normalizeThresholds validates rules and names the unnamed ones.
+func normalizeThresholds(rules []ThresholdRule) error {
+	seen := make(map[string]bool)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Sensor == "" {
+			return fmt.Errorf("threshold %d has no sensor", i)
+		}
+		if rule.Above == nil && rule.Below == nil {
+			return fmt.Errorf("threshold %d needs above or below", i)
+		}
+		if rule.For < 0 {
+			return fmt.Errorf("threshold %d has a negative for", i)
+		}
+		if rule.Name == "" {
+			rule.Name = rule.Sensor
+			if rule.Above != nil {
+				rule.Name += fmt.Sprintf("_above_%g", *rule.Above)
+			}
+			if rule.Below != nil {
+				rule.Name += fmt.Sprintf("_below_%g", *rule.Below)
+			}
+		}
+		if seen[rule.Name] {
+			return fmt.Errorf("duplicate threshold name %q", rule.Name)
+		}
+		seen[rule.Name] = true
+	}
+	return nil
+}
+
+// checkChannels verifies that the channels of rules exist.
+func checkChannels(rules []ThresholdRule, notifier *notifier) error {
+	names := notifier.channelNames()
+	for _, rule := range rules {
+		for _, name := range rule.Channels {
+			if !names[name] {
+				return fmt.Errorf("threshold %q references unknown alert channel %q", rule.Name, name)
+			}
+		}
+	}
+	return nil
+}
+
+func newThresholdSink(rules []ThresholdRule, notifier *notifier, topic string) (*thresholdSink, error) {
+	if err := normalizeThresholds(rules); err != nil {
+		return nil, err
+	}
+	if err := checkChannels(rules, notifier); err != nil {
+		return nil, err
+	}
+	if topic != "" {
+		if strings.ContainsAny(topic, "+#") {
+			return nil, fmt.Errorf("ALERT_TOPIC must not contain wildcards")
+		}
+		if !strings.Contains(topic, "{device}") || !strings.Contains(topic, "{rule}") {
+			return nil, fmt.Errorf("ALERT_TOPIC must contain {device} and {rule}")
+		}
+	}
+	return &thresholdSink{
+		rules:       rules,
+		notifier:    notifier,
+		topic:       topic,
+		firing:      make(map[string]bool),
+		exceeded:    make(map[string]time.Time),
+		deviceRules: make(map[string][]ThresholdRule),
+	}, nil
+}
+
+// publish sets the retained alert state of a device and rule, or clears it
+// when state is nil. It doesn't wait, so messages keep their order.
+func (s *thresholdSink) publish(device *Device, rule string, state *alertState) {
+	if s.topic == "" || s.client == nil {
+		return
+	}
+	var payload []byte
+	if state != nil {
+		var err error
+		if payload, err = json.Marshal(state); err != nil {
+			slog.Error("Failed to marshal alert state", "device", device.Name, "rule", rule, "error", err)
+			return
+		}
+	}
+	topic := strings.NewReplacer("{device}", device.Name, "{mac}", device.MAC, "{rule}", rule).Replace(s.topic)
+	token := s.client.Publish(topic, 1, true, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			slog.Error("Failed to publish alert state", "device", device.Name, "topic", topic, "error", token.Error())
+		}
+	}()
+}
+
+// setDeviceRules replaces the rules that only apply to device. Alerts of
+// rules that are gone are dropped without a resolved notification.
+func (s *thresholdSink) setDeviceRules(device *Device, rules []ThresholdRule) {
+	changed := false
+	defer func() {
+		if changed && s.onChange != nil {
+			s.onChange()
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, old := range s.deviceRules[deviceKey(device)] {
+		kept := slices.ContainsFunc(rules, func(rule ThresholdRule) bool { return rule.Name == old.Name })
+		if kept || s.hasRule(old.Name) {
+			continue
+		}
+		key := device.Name + "|" + old.Name
+		if s.firing[key] {
+			changed = true
+			s.publish(device, old.Name, nil)
+		}
+		delete(s.firing, key)
+		delete(s.exceeded, key)
+		thresholdFiring.DeleteLabelValues(device.Name, old.Name)
+	}
+	if len(rules) == 0 {
+		delete(s.deviceRules, deviceKey(device))
+	} else {
+		s.deviceRules[deviceKey(device)] = rules
+	}
+}
+
+// moveDeviceRules hands the rules of a device over to the hardware that
+// replaces it.
+func (s *thresholdSink) moveDeviceRules(device, replacement *Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rules, ok := s.deviceRules[deviceKey(device)]; ok {
+		delete(s.deviceRules, deviceKey(device))
+		s.deviceRules[deviceKey(replacement)] = rules
+	}
+}
+
+func (s *thresholdSink) Name() string { return "thresholds" }
+
+func (s *thresholdSink) Write(device *Device, data CGDN1Data) {
+	// Rules keep their state through maintenance, and fire or resolve
+	// with the first reading after it
+	if s.maintenance.active(device, data.Timestamp) {
+		return
+	}
+	changed := false
+	defer func() {
+		if changed && s.onChange != nil {
+			s.onChange()
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rule := range slices.Concat(s.rules, s.deviceRules[deviceKey(device)]) {
+		if !device.hasAnyTag(rule.Tags) {
+			continue
+		}
+		value, ok := data.Values[rule.Sensor]
+		if !ok {
+			continue
+		}
+
+		key := device.Name + "|" + rule.Name
+		exceeded, limit := rule.exceeded(value)
+		since, pending := s.exceeded[key]
+		if exceeded && !pending {
+			since = data.Timestamp
+			s.exceeded[key] = since
+		}
+		if !exceeded {
+			delete(s.exceeded, key)
+		}
+
+		// A rule with a for duration fires once the limit stayed crossed
+		// that long; it resolves as soon as the value is back in range
+		firing := exceeded && data.Timestamp.Sub(since) >= time.Duration(rule.For)
+		if firing {
+			thresholdFiring.WithLabelValues(device.Name, rule.Name).Set(1)
+		} else {
+			thresholdFiring.WithLabelValues(device.Name, rule.Name).Set(0)
+		}
+		if firing == s.firing[key] {
+			continue
+		}
+		s.firing[key] = firing
+		changed = true
+
+		notification := Notification{
+			Event:     EventResolved,
+			Rule:      rule.Name,
+			Sensor:    rule.Sensor,
+			Value:     value,
+			Threshold: limit,
+			Reading:   data,
+			channels:  rule.Channels,
+		}
+		state := &alertState{
+			State:  "ok",
+			Device: device.Name,
+			Rule:   rule.Name,
+			Sensor: rule.Sensor,
+			Value:  value,
+			Since:  data.Timestamp.UTC(),
+		}
+		if firing {
+			notification.Event = EventAlert
+			state.State = "firing"
+			state.Threshold = limit
+			state.Since = since.UTC()
+			if s.onAlert != nil {
+				go s.onAlert(device, rule)
+			}
+		} else {
+			notification.Duration = data.Timestamp.Sub(since).Round(time.Second).String()
+		}
+		s.notifier.Notify(device, notification)
+		s.publish(device, rule.Name, state)
+	}
+}
+
+// Forget drops the state of a device that went silent, so it is evaluated
+// from scratch once it reports again.
+func (s *thresholdSink) Forget(device *Device) {
+	changed := false
+	defer func() {
+		if changed && s.onChange != nil {
+			s.onChange()
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rule := range slices.Concat(s.rules, s.deviceRules[deviceKey(device)]) {
+		key := device.Name + "|" + rule.Name
+		if s.firing[key] {
+			changed = true
+			s.publish(device, rule.Name, nil)
+		}
+		delete(s.firing, key)
+		delete(s.exceeded, key)
+	}
+	thresholdFiring.DeletePartialMatch(map[string]string{"device": device.Name})
+}
+
+// anyFiring reports whether match accepts a device and rule that fire.
+func (s *thresholdSink) anyFiring(match func(device, rule string) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, firing := range s.firing {
+		device, rule, _ := strings.Cut(key, "|")
+		if firing && match(device, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasRule reports whether a rule with the given name exists.
+func (s *thresholdSink) hasRule(name string) bool {
+	for _, rule := range s.rules {
+		if rule.Name == name {
+			return true
+		}
+	}
+	return false
+}
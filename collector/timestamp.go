@@ -0,0 +1,43 @@
+package collector
+
+import (
+	"log/slog"
+	"time"
+)
+
+// maxClockSkew is how far ahead of the collector a device's clock may run
+// before its timestamps are ignored
+const maxClockSkew = 5 * time.Minute
+
+// minDeviceTime is the earliest timestamp taken from a device; earlier
+// ones come from a clock that hasn't been set since power-up
+var minDeviceTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// readingTime removes the device's timestamp from a reading's raw values,
+// unix seconds (or milliseconds) under "timestamp", and returns when the
+// reading was taken. Without a usable timestamp it is now.
+func readingTime(device *Device, raw map[string]float64, now time.Time, trust bool) time.Time {
+	value, ok := raw["timestamp"]
+	delete(raw, "timestamp")
+	if !ok || !trust || value <= 0 {
+		return now
+	}
+
+	var taken time.Time
+	if value >= 1e12 {
+		taken = time.UnixMilli(int64(value))
+	} else {
+		taken = time.Unix(int64(value), 0)
+	}
+	switch {
+	case taken.Before(minDeviceTime):
+		slog.Debug("Ignoring timestamp of a device clock that isn't set", "device", device.Name, "timestamp", taken)
+		return now
+	case taken.Sub(now) > maxClockSkew:
+		slog.Debug("Ignoring timestamp from the future", "device", device.Name, "timestamp", taken)
+		return now
+	case taken.After(now):
+		return now
+	}
+	return taken
+}
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tvocMgm3PerPpb converts TVOC from ppb to mg/m³. It assumes the reference
+// mixture of Mølhave (about 110 g/mol) at 25°C, as most sensor vendors do.
+const tvocMgm3PerPpb = 0.0045
+
+// unitConversion adds a value in another unit next to an existing one
+type unitConversion struct {
+	From    string
+	Metric  sensorMetric
+	Convert func(float64) float64
+}
+
+func fahrenheit(c float64) float64 { return c*9/5 + 32 }
+
+var temperatureConversions = map[string]unitConversion{
+	"temperature_f": {"temperature", sensorMetric{"qingping_temperature_fahrenheit", "Temperature in Fahrenheit"}, fahrenheit},
+	"dew_point_f":   {"dew_point", sensorMetric{"qingping_dew_point_fahrenheit", "Dew point in Fahrenheit"}, fahrenheit},
+	"heat_index_f":  {"heat_index", sensorMetric{"qingping_heat_index_fahrenheit", "Heat index (NWS) in Fahrenheit"}, fahrenheit},
+}
+
+var tvocConversions = map[string]unitConversion{
+	"tvoc_mgm3": {"tvoc", sensorMetric{"qingping_tvoc_mgm3", "TVOC in milligrams per cubic meter"},
+		func(ppb float64) float64 { return ppb * tvocMgm3PerPpb }},
+}
+
+var (
+	// conversions are the enabled unit conversions by the key they add
+	conversions = make(map[string]unitConversion)
+
+	// hiddenValues are keys kept in readings but not exported as metrics,
+	// because only their converted unit was asked for
+	hiddenValues = make(map[string]bool)
+)
+
+// setupUnits enables the exported units: temperature is celsius,
+// fahrenheit or both and TVOC ppb, mgm3 or both. It runs once at startup,
+// before any reading is handled.
+func setupUnits(temperature, tvoc string, registerer prometheus.Registerer) error {
+	if err := enableUnit("temperature", temperature, "celsius", "fahrenheit", temperatureConversions, registerer); err != nil {
+		return err
+	}
+	return enableUnit("TVOC", tvoc, "ppb", "mgm3", tvocConversions, registerer)
+}
+
+func enableUnit(quantity, unit, base, converted string, available map[string]unitConversion, registerer prometheus.Registerer) error {
+	switch unit {
+	case base:
+		return nil
+	case converted, "both":
+	default:
+		return fmt.Errorf("unknown %s unit %q (want %s, %s or both)", quantity, unit, base, converted)
+	}
+
+	for key, conversion := range available {
+		gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: conversion.Metric.Name,
+			Help: conversion.Metric.Help,
+		}, []string{"device"})
+		if err := registerer.Register(gauge); err != nil {
+			return fmt.Errorf("%s unit: %w", quantity, err)
+		}
+		sensorMetrics[key] = conversion.Metric
+		sensorGauges[key] = gauge
+		conversions[key] = conversion
+		if unit == converted {
+			hiddenValues[conversion.From] = true
+		}
+	}
+	return nil
+}
+
+// convertUnits adds the converted values of a reading. The originals stay
+// so thresholds, the AQI and the API keep working in the base units.
+func convertUnits(values map[string]float64) {
+	for key, conversion := range conversions {
+		if value, ok := values[conversion.From]; ok {
+			values[key] = conversion.Convert(value)
+		}
+	}
+}
+
+// exported reports whether a reading's value is exported as a metric
+func exported(key string) bool {
+	return !hiddenValues[key]
+}
@@ -0,0 +1,209 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"text/template"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// VentilationConfig drives an ERV/HRV unit over MQTT from the CO2 of the
+// rooms it serves (demand-controlled ventilation). The level is a percent
+// of the unit's capacity, interpolated between MinLevel at CO2Low and
+// MaxLevel at CO2High from the worst room.
+type VentilationConfig struct {
+	Name    string   `json:"name"`
+	Tags    []string `json:"tags,omitempty"`    // devices whose CO2 drives the unit, empty means all
+	Topic   string   `json:"topic"`             // command topic of the unit
+	Payload string   `json:"payload,omitempty"` // template of the command, default {{.Level}}
+	Retain  bool     `json:"retain,omitempty"`
+
+	CO2Low   float64  `json:"co2_low,omitempty"`   // ppm at which MinLevel applies, default 600
+	CO2High  float64  `json:"co2_high,omitempty"`  // ppm at which MaxLevel applies, default 1200
+	MinLevel *float64 `json:"min_level,omitempty"` // percent, default 20
+	MaxLevel *float64 `json:"max_level,omitempty"` // percent, default 100
+	Step     float64  `json:"step,omitempty"`      // levels are rounded to this, default 5
+
+	// While the Outdoor device reads below FrostBelow °C the level is
+	// capped at FrostLevel so the heat exchanger doesn't ice up
+	Outdoor    string   `json:"outdoor,omitempty"`
+	FrostBelow *float64 `json:"frost_below,omitempty"` // default -5
+	FrostLevel *float64 `json:"frost_level,omitempty"` // default MinLevel
+}
+
+// VentilationCommand is the data the payload template is executed with
+type VentilationCommand struct {
+	Level int     // percent
+	CO2   float64 // ppm of the worst room, 0 if none reports
+	Frost bool    // frost protection caps the level
+}
+
+// ventilationUnit is a configured unit with its latest inputs
+type ventilationUnit struct {
+	config  VentilationConfig
+	payload *template.Template
+
+	co2     map[string]float64 // per device
+	outdoor *float64
+	level   float64
+	sent    bool
+}
+
+// ventilationSink feeds readings to the ventilation units and publishes a
+// command whenever a unit's level changes.
+type ventilationSink struct {
+	units  []*ventilationUnit
+	client mqtt.Client
+
+	mu sync.Mutex
+}
+
+func newVentilationSink(configs []VentilationConfig, devices []*Device) (*ventilationSink, error) {
+	known := make(map[string]bool, len(devices))
+	for _, device := range devices {
+		known[device.Name] = true
+	}
+	percent := func(p **float64, fallback float64) {
+		if *p == nil {
+			*p = &fallback
+		}
+	}
+
+	s := &ventilationSink{}
+	seen := make(map[string]bool)
+	for i, config := range configs {
+		if config.Name == "" || config.Topic == "" {
+			return nil, fmt.Errorf("ventilation %d needs a name and topic", i)
+		}
+		if seen[config.Name] {
+			return nil, fmt.Errorf("duplicate ventilation name %q", config.Name)
+		}
+		seen[config.Name] = true
+
+		if config.Payload == "" {
+			config.Payload = "{{.Level}}"
+		}
+		if config.CO2Low == 0 {
+			config.CO2Low = 600
+		}
+		if config.CO2High == 0 {
+			config.CO2High = 1200
+		}
+		if config.Step <= 0 {
+			config.Step = 5
+		}
+		percent(&config.MinLevel, 20)
+		percent(&config.MaxLevel, 100)
+		percent(&config.FrostBelow, -5)
+		percent(&config.FrostLevel, *config.MinLevel)
+
+		switch {
+		case config.CO2High <= config.CO2Low:
+			return nil, fmt.Errorf("ventilation %q: co2_high must be above co2_low", config.Name)
+		case *config.MinLevel < 0 || *config.MaxLevel > 100 || *config.MinLevel > *config.MaxLevel:
+			return nil, fmt.Errorf("ventilation %q: need 0 <= min_level <= max_level <= 100", config.Name)
+		case config.Outdoor != "" && !known[config.Outdoor]:
+			return nil, fmt.Errorf("ventilation %q references unknown outdoor device %q", config.Name, config.Outdoor)
+		}
+
+		payload, err := template.New(config.Name).Parse(config.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("ventilation %q payload: %w", config.Name, err)
+		}
+		s.units = append(s.units, &ventilationUnit{
+			config:  config,
+			payload: payload,
+			co2:     make(map[string]float64),
+		})
+	}
+	return s, nil
+}
+
+func (s *ventilationSink) Name() string { return "ventilation" }
+
+func (s *ventilationSink) Write(device *Device, data CGDN1Data) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, unit := range s.units {
+		if device.Name == unit.config.Outdoor {
+			if temperature, ok := data.Values["temperature"]; ok {
+				unit.outdoor = &temperature
+			}
+		} else if co2, ok := data.Values["co2"]; ok && device.hasAnyTag(unit.config.Tags) {
+			unit.co2[device.Name] = co2
+		} else {
+			continue
+		}
+		s.update(unit)
+	}
+}
+
+// Forget stops a silent device from driving the units.
+func (s *ventilationSink) Forget(device *Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, unit := range s.units {
+		if device.Name == unit.config.Outdoor {
+			unit.outdoor = nil
+		} else if _, ok := unit.co2[device.Name]; ok {
+			delete(unit.co2, device.Name)
+		} else {
+			continue
+		}
+		s.update(unit)
+	}
+}
+
+// command works out the level the unit should run at.
+func (u *ventilationUnit) command() VentilationCommand {
+	config := u.config
+	level := *config.MinLevel
+	var co2 float64
+	for _, value := range u.co2 {
+		co2 = max(co2, value)
+	}
+	if co2 > config.CO2Low {
+		fraction := min((co2-config.CO2Low)/(config.CO2High-config.CO2Low), 1)
+		level += fraction * (*config.MaxLevel - *config.MinLevel)
+	}
+	level = min(math.Round(level/config.Step)*config.Step, *config.MaxLevel)
+
+	frost := u.outdoor != nil && *u.outdoor < *config.FrostBelow && level > *config.FrostLevel
+	if frost {
+		level = *config.FrostLevel
+	}
+	return VentilationCommand{Level: int(level), CO2: co2, Frost: frost}
+}
+
+// update publishes the unit's command if its level changed.
+func (s *ventilationSink) update(unit *ventilationUnit) {
+	command := unit.command()
+	ventilationLevel.WithLabelValues(unit.config.Name).Set(float64(command.Level))
+	if command.Frost {
+		ventilationFrost.WithLabelValues(unit.config.Name).Set(1)
+	} else {
+		ventilationFrost.WithLabelValues(unit.config.Name).Set(0)
+	}
+
+	if s.client == nil || (unit.sent && float64(command.Level) == unit.level) {
+		return
+	}
+	var payload strings.Builder
+	if err := unit.payload.Execute(&payload, command); err != nil {
+		slog.Error("Failed to render ventilation command", "unit", unit.config.Name, "error", err)
+		return
+	}
+	token := s.client.Publish(unit.config.Topic, 0, unit.config.Retain, payload.String())
+	if token.Wait() && token.Error() != nil {
+		slog.Error("Failed to publish ventilation command", "unit", unit.config.Name, "topic", unit.config.Topic, "error", token.Error())
+		return
+	}
+	unit.level, unit.sent = float64(command.Level), true
+	slog.Info("Set ventilation level", "unit", unit.config.Name, "level", command.Level, "co2", command.CO2, "frost", command.Frost)
+}
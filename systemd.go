@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mike1808/qingping-air-monitor-lite-collector/collector"
+)
+
+// sdNotify sends state to systemd when it started the collector with
+// Type=notify, and does nothing otherwise.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ is an abstract socket, which net handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval is how often systemd expects a watchdog ping, half its
+// WatchdogSec, or 0 if the watchdog is off or meant for another process.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runSystemd tells systemd the collector is ready once it is connected
+// and subscribed to every device, keeps its status line up to date, and
+// pings the watchdog only while the MQTT client is alive, so a wedged
+// collector gets restarted. It returns at once when not run by systemd.
+func runSystemd(ctx context.Context, a *collector.App) {
+	if os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	watchdog := watchdogInterval()
+	tick := time.Second
+	if watchdog > 0 {
+		tick = min(tick, watchdog)
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	ready, status, withheld := false, "", false
+	var pinged time.Time
+	for {
+		next := "Ready"
+		if err := a.Ready(); err != nil {
+			next = err.Error()
+		} else if !ready {
+			ready = true
+			if err := sdNotify("READY=1"); err != nil {
+				slog.Warn("Failed to notify systemd", "error", err)
+			}
+			slog.Debug("Notified systemd of readiness")
+		}
+		if next != status {
+			status = next
+			sdNotify("STATUS=" + status)
+		}
+
+		if watchdog > 0 && time.Since(pinged) >= watchdog {
+			if err := a.Alive(); err != nil {
+				if !withheld {
+					slog.Warn("Withholding systemd watchdog pings", "error", err)
+				}
+				withheld = true
+			} else {
+				withheld = false
+				pinged = time.Now()
+				if err := sdNotify("WATCHDOG=1"); err != nil {
+					slog.Warn("Failed to ping systemd watchdog", "error", err)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}